@@ -0,0 +1,309 @@
+package readercache
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/iden3/go-iden3-core/components/idenpuboffchain"
+	"github.com/iden3/go-iden3-core/core"
+	"github.com/iden3/go-iden3-core/db"
+	"github.com/iden3/go-iden3-core/merkletree"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	ErrIdenStateDoesntMatch = fmt.Errorf("the public data IdenState doesn't match the queried one")
+)
+
+var (
+	dbPrefixPublicData = []byte("pubdatacache:")
+)
+
+// Config allows configuring the IdenPubOffChainReadCache.
+type Config struct {
+	// Size is the maximum number of public datas kept in the cache.  When
+	// full, the least recently used one is evicted.
+	Size int
+	// TTL is the time a public data is kept in the cache.  A zero TTL
+	// keeps it until evicted.
+	TTL time.Duration
+}
+
+// ConfigDefault is a default configuration for the IdenPubOffChainReadCache.
+var ConfigDefault = Config{
+	Size: 64,
+	TTL:  time.Hour,
+}
+
+// cacheKey identifies the public data of an identity state.
+type cacheKey struct {
+	id        core.ID
+	idenState merkletree.Hash
+}
+
+// cacheEntry is a public data in the memory cache.
+type cacheEntry struct {
+	key        cacheKey
+	publicData *idenpuboffchain.PublicData
+	time       time.Time
+}
+
+// storedPublicData is the public data persisted in the storage.
+type storedPublicData struct {
+	Time  int64
+	Blobs idenpuboffchain.PublicDataBlobs
+}
+
+// IdenPubOffChainReadCache satisfies the IdenPubOffChainReader interface,
+// and caches the public data read from another IdenPubOffChainReader by
+// identity ID and identity state, so that the trees of an identity state are
+// only downloaded and rebuilt once.  The public data is verified against the
+// queried identity state when it's fetched.  Queries of the last identity
+// state (nil idenState) are always forwarded, but their result is cached.
+type IdenPubOffChainReadCache struct {
+	reader  idenpuboffchain.IdenPubOffChainReader
+	cfg     Config
+	storage db.Storage
+	timeNow func() time.Time
+	m       sync.Mutex
+	entries map[cacheKey]*list.Element
+	lru     *list.List
+}
+
+// New creates a new IdenPubOffChainReadCache over reader.  If storage is not
+// nil, the cached public datas are also persisted in it, so that they survive
+// restarts.  The expired and evicted public datas are deleted from the
+// storage, and on creation only the Size most recent ones are kept.
+func New(reader idenpuboffchain.IdenPubOffChainReader, cfg Config,
+	storage db.Storage) *IdenPubOffChainReadCache {
+	return NewWithTimeNow(reader, cfg, storage, time.Now)
+}
+
+// NewWithTimeNow creates a new IdenPubOffChainReadCache that uses the time
+// returned by `timeNow` to expire the cached public datas.  Mainly used for
+// testing.
+func NewWithTimeNow(reader idenpuboffchain.IdenPubOffChainReader, cfg Config,
+	storage db.Storage, timeNow func() time.Time) *IdenPubOffChainReadCache {
+	c := &IdenPubOffChainReadCache{
+		reader:  reader,
+		cfg:     cfg,
+		storage: storage,
+		timeNow: timeNow,
+		entries: make(map[cacheKey]*list.Element),
+		lru:     list.New(),
+	}
+	if err := c.prune(); err != nil {
+		log.WithError(err).Warn("IdenPubOffChainReadCache failed pruning stored public datas")
+	}
+	return c
+}
+
+func dbKeyPublicData(key *cacheKey) []byte {
+	return append(append(append([]byte{}, dbPrefixPublicData...), key.id[:]...), key.idenState[:]...)
+}
+
+// expired returns true if a public data cached at t has expired.
+func (c *IdenPubOffChainReadCache) expired(t time.Time) bool {
+	return c.cfg.TTL != 0 && c.timeNow().Sub(t) > c.cfg.TTL
+}
+
+// GetPublicData returns the public data of the identity id at idenState,
+// from the cache if available.
+func (c *IdenPubOffChainReadCache) GetPublicData(idenPubUrl string, id *core.ID,
+	idenState *merkletree.Hash) (*idenpuboffchain.PublicData, error) {
+	if idenState != nil {
+		key := cacheKey{id: *id, idenState: *idenState}
+		if publicData := c.get(&key); publicData != nil {
+			return publicData, nil
+		}
+		if publicData, t := c.load(&key); publicData != nil {
+			c.add(&key, publicData, t)
+			return publicData, nil
+		}
+	}
+
+	publicData, err := c.reader.GetPublicData(idenPubUrl, id, idenState)
+	if err != nil {
+		return nil, err
+	}
+	if idenState != nil && !publicData.IdenState.Equals(idenState) {
+		return nil, ErrIdenStateDoesntMatch
+	}
+	calcIdenState := core.IdenState(publicData.ClaimsTreeRoot, publicData.RevocationsTree.RootKey(),
+		publicData.RootsTree.RootKey())
+	if !calcIdenState.Equals(publicData.IdenState) {
+		return nil, idenpuboffchain.ErrCalculatedIdenStateDoesntMatch
+	}
+	key := cacheKey{id: *id, idenState: *publicData.IdenState}
+	now := c.timeNow()
+	if err := c.store(&key, publicData, now); err != nil {
+		log.WithError(err).Warn("IdenPubOffChainReadCache failed storing public data")
+	}
+	c.add(&key, publicData, now)
+	return publicData, nil
+}
+
+// get returns the public data of key from the memory cache, or nil if it's
+// not found or expired.  An expired public data is removed from the cache.
+func (c *IdenPubOffChainReadCache) get(key *cacheKey) *idenpuboffchain.PublicData {
+	c.m.Lock()
+	elem, ok := c.entries[*key]
+	if !ok {
+		c.m.Unlock()
+		return nil
+	}
+	entry := elem.Value.(*cacheEntry)
+	if c.expired(entry.time) {
+		c.lru.Remove(elem)
+		delete(c.entries, *key)
+		c.m.Unlock()
+		c.remove([]cacheKey{*key})
+		return nil
+	}
+	c.lru.MoveToFront(elem)
+	c.m.Unlock()
+	return entry.publicData
+}
+
+// add adds the public data of key cached at t to the memory cache, evicting
+// the least recently used ones when full.  The evicted public datas are
+// removed from the storage.
+func (c *IdenPubOffChainReadCache) add(key *cacheKey, publicData *idenpuboffchain.PublicData, t time.Time) {
+	c.m.Lock()
+	if elem, ok := c.entries[*key]; ok {
+		c.lru.Remove(elem)
+	}
+	c.entries[*key] = c.lru.PushFront(&cacheEntry{key: *key, publicData: publicData, time: t})
+	evicted := []cacheKey{}
+	for c.lru.Len() > c.cfg.Size {
+		elem := c.lru.Back()
+		c.lru.Remove(elem)
+		evictedKey := elem.Value.(*cacheEntry).key
+		delete(c.entries, evictedKey)
+		evicted = append(evicted, evictedKey)
+	}
+	c.m.Unlock()
+	c.remove(evicted)
+}
+
+// remove deletes the public datas of keys from the storage.
+func (c *IdenPubOffChainReadCache) remove(keys []cacheKey) {
+	if c.storage == nil || len(keys) == 0 {
+		return
+	}
+	tx, err := c.storage.NewTx()
+	if err != nil {
+		log.WithError(err).Warn("IdenPubOffChainReadCache failed removing stored public datas")
+		return
+	}
+	defer tx.Close()
+	for i := range keys {
+		tx.Delete(dbKeyPublicData(&keys[i]))
+	}
+	if err := tx.Commit(); err != nil {
+		log.WithError(err).Warn("IdenPubOffChainReadCache failed removing stored public datas")
+	}
+}
+
+// prune deletes from the storage the expired public datas and all but the
+// Size most recent ones.
+func (c *IdenPubOffChainReadCache) prune() error {
+	if c.storage == nil {
+		return nil
+	}
+	type storedKey struct {
+		key  []byte
+		time time.Time
+	}
+	storedKeys := []storedKey{}
+	if err := c.storage.WithPrefix(dbPrefixPublicData).Iterate(func(k, v []byte) (bool, error) {
+		var stored struct{ Time int64 }
+		if err := json.Unmarshal(v, &stored); err != nil {
+			return false, err
+		}
+		key := append(append([]byte{}, dbPrefixPublicData...), k...)
+		storedKeys = append(storedKeys, storedKey{key: key, time: time.Unix(stored.Time, 0)})
+		return true, nil
+	}); err != nil {
+		return err
+	}
+	sort.SliceStable(storedKeys, func(i, j int) bool { return storedKeys[i].time.After(storedKeys[j].time) })
+
+	tx, err := c.storage.NewTx()
+	if err != nil {
+		return err
+	}
+	defer tx.Close()
+	for i, storedKey := range storedKeys {
+		if i >= c.cfg.Size || c.expired(storedKey.time) {
+			tx.Delete(storedKey.key)
+		}
+	}
+	return tx.Commit()
+}
+
+// load returns the public data of key from the storage with the time it was
+// cached, or nil if it's not found or expired.  The trees are verified while
+// they are rebuilt.
+func (c *IdenPubOffChainReadCache) load(key *cacheKey) (*idenpuboffchain.PublicData, time.Time) {
+	if c.storage == nil {
+		return nil, time.Time{}
+	}
+	var stored storedPublicData
+	if err := db.LoadJSON(c.storage, dbKeyPublicData(key), &stored); err != nil {
+		if err != db.ErrNotFound {
+			log.WithError(err).Warn("IdenPubOffChainReadCache failed loading public data")
+		}
+		return nil, time.Time{}
+	}
+	t := time.Unix(stored.Time, 0)
+	if c.expired(t) || !stored.Blobs.IdenState.Equals(&key.idenState) {
+		c.remove([]cacheKey{*key})
+		return nil, time.Time{}
+	}
+	publicData, err := idenpuboffchain.NewPublicDataFromBlobs(&stored.Blobs)
+	if err != nil {
+		log.WithError(err).Warn("IdenPubOffChainReadCache failed rebuilding stored public data")
+		c.remove([]cacheKey{*key})
+		return nil, time.Time{}
+	}
+	return publicData, t
+}
+
+// store persists the public data of key cached at t in the storage.
+func (c *IdenPubOffChainReadCache) store(key *cacheKey, publicData *idenpuboffchain.PublicData, t time.Time) error {
+	if c.storage == nil {
+		return nil
+	}
+	var revocationsTree, rootsTree bytes.Buffer
+	if err := publicData.RevocationsTree.DumpTree(&revocationsTree, publicData.RevocationsTree.RootKey()); err != nil {
+		return err
+	}
+	if err := publicData.RootsTree.DumpTree(&rootsTree, publicData.RootsTree.RootKey()); err != nil {
+		return err
+	}
+	stored := storedPublicData{
+		Time: t.Unix(),
+		Blobs: idenpuboffchain.PublicDataBlobs{
+			IdenState:           *publicData.IdenState,
+			ClaimsTreeRoot:      *publicData.ClaimsTreeRoot,
+			RevocationsTreeRoot: *publicData.RevocationsTree.RootKey(),
+			RevocationsTree:     revocationsTree.Bytes(),
+			RootsTreeRoot:       *publicData.RootsTree.RootKey(),
+			RootsTree:           rootsTree.Bytes(),
+		},
+	}
+	tx, err := c.storage.NewTx()
+	if err != nil {
+		return err
+	}
+	if err := db.StoreJSON(tx, dbKeyPublicData(key), &stored); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,178 @@
+package readercache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/iden3/go-iden3-core/components/idenpuboffchain"
+	idenpuboffchanlocal "github.com/iden3/go-iden3-core/components/idenpuboffchain/local"
+	"github.com/iden3/go-iden3-core/core"
+	"github.com/iden3/go-iden3-core/core/claims"
+	"github.com/iden3/go-iden3-core/db"
+	"github.com/iden3/go-iden3-core/merkletree"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const url = "http://foo.bar"
+
+// readerCounter counts the public data requests.
+type readerCounter struct {
+	*idenpuboffchanlocal.IdenPubOffChain
+	requests int
+}
+
+func (r *readerCounter) GetPublicData(idenPubUrl string, id *core.ID,
+	idenState *merkletree.Hash) (*idenpuboffchain.PublicData, error) {
+	r.requests++
+	return r.IdenPubOffChain.GetPublicData(idenPubUrl, id, idenState)
+}
+
+// readerFunc is an IdenPubOffChainReader that returns the public datas of f.
+type readerFunc func(idenState *merkletree.Hash) *idenpuboffchain.PublicData
+
+func (f readerFunc) GetPublicData(idenPubUrl string, id *core.ID,
+	idenState *merkletree.Hash) (*idenpuboffchain.PublicData, error) {
+	return f(idenState), nil
+}
+
+// newPublicData returns the public data of an identity state with the
+// revoked nonces.
+func newPublicData(t *testing.T, revokedNonces []uint32) *idenpuboffchain.PublicData {
+	claimsTreeRoot := &merkletree.HashZero
+	revocationsTree, err := merkletree.NewMerkleTree(db.NewMemoryStorage(), 140)
+	require.Nil(t, err)
+	for _, nonce := range revokedNonces {
+		require.Nil(t, claims.AddLeafRevocationsTree(revocationsTree, nonce, 0xffffffff))
+	}
+	rootsTree, err := merkletree.NewMerkleTree(db.NewMemoryStorage(), 140)
+	require.Nil(t, err)
+	return &idenpuboffchain.PublicData{
+		IdenState:           core.IdenState(claimsTreeRoot, revocationsTree.RootKey(), rootsTree.RootKey()),
+		ClaimsTreeRoot:      claimsTreeRoot,
+		RevocationsTreeRoot: revocationsTree.RootKey(),
+		RevocationsTree:     revocationsTree,
+		RootsTreeRoot:       rootsTree.RootKey(),
+		RootsTree:           rootsTree,
+	}
+}
+
+// Assert that IdenPubOffChainReadCache follows the IdenPubOffChainReader interface
+func TestIdenPubOffChainReadCacheInterface(t *testing.T) {
+	var idenPubOffChainRead idenpuboffchain.IdenPubOffChainReader //nolint:gosimple
+	idenPubOffChainRead = New(nil, ConfigDefault, nil)
+	require.NotNil(t, idenPubOffChainRead)
+}
+
+func TestIdenPubOffChainReadCache(t *testing.T) {
+	id := core.NewID([2]byte{0, 0x42}, [27]byte{0x01})
+	reader := &readerCounter{IdenPubOffChain: idenpuboffchanlocal.NewIdenPubOffChain(url)}
+	publicDatas := []*idenpuboffchain.PublicData{}
+	for i := 0; i < 3; i++ {
+		publicData := newPublicData(t, []uint32{uint32(i)})
+		require.Nil(t, reader.Publish(&id, publicData))
+		publicDatas = append(publicDatas, publicData)
+	}
+
+	now := time.Unix(1000, 0)
+	storage := db.NewMemoryStorage()
+	cfg := Config{Size: 2, TTL: 100 * time.Second}
+	cache := NewWithTimeNow(reader, cfg, storage, func() time.Time { return now })
+	storedLen := func() int {
+		stored, err := storage.WithPrefix(dbPrefixPublicData).List(100)
+		require.Nil(t, err)
+		return len(stored)
+	}
+	get := func(cache *IdenPubOffChainReadCache, i int) {
+		publicData, err := cache.GetPublicData(url, &id, publicDatas[i].IdenState)
+		require.Nil(t, err)
+		assert.Equal(t, publicDatas[i].IdenState, publicData.IdenState)
+		assert.Equal(t, publicDatas[i].RevocationsTree.RootKey(), publicData.RevocationsTree.RootKey())
+	}
+
+	get(cache, 0)
+	get(cache, 0)
+	get(cache, 1)
+	assert.Equal(t, 2, reader.requests)
+
+	// The last identity state is always requested, and then cached
+	publicData, err := cache.GetPublicData(url, &id, nil)
+	require.Nil(t, err)
+	assert.Equal(t, publicDatas[2].IdenState, publicData.IdenState)
+	assert.Equal(t, 3, reader.requests)
+	get(cache, 2)
+	assert.Equal(t, 3, reader.requests)
+
+	// The least recently used public data was evicted, also from the
+	// storage
+	assert.Equal(t, 2, storedLen())
+	get(cache, 0)
+	assert.Equal(t, 4, reader.requests)
+	assert.Equal(t, 2, storedLen())
+
+	// A cache without storage only keeps Size public datas
+	cacheMem := NewWithTimeNow(reader, cfg, nil, func() time.Time { return now })
+	for _, i := range []int{0, 1, 2, 0} {
+		get(cacheMem, i)
+	}
+	assert.Equal(t, 8, reader.requests)
+
+	// A new cache with the same storage doesn't request the public datas
+	cache = NewWithTimeNow(reader, cfg, storage, func() time.Time { return now })
+	get(cache, 2)
+	get(cache, 0)
+	assert.Equal(t, 8, reader.requests)
+
+	// Expired public datas are requested again, and the expired and
+	// evicted ones are deleted from the storage
+	now = now.Add(101 * time.Second)
+	get(cache, 2)
+	assert.Equal(t, 9, reader.requests)
+	now = now.Add(10 * time.Second)
+	get(cache, 1)
+	assert.Equal(t, 10, reader.requests)
+	get(cache, 1)
+	assert.Equal(t, 10, reader.requests)
+	assert.Equal(t, 2, storedLen())
+
+	// A new cache only keeps the Size most recent stored public datas
+	NewWithTimeNow(reader, Config{Size: 1, TTL: cfg.TTL}, storage, func() time.Time { return now })
+	assert.Equal(t, 1, storedLen())
+	cache = NewWithTimeNow(reader, cfg, storage, func() time.Time { return now })
+	get(cache, 1)
+	assert.Equal(t, 10, reader.requests)
+
+	// A new cache deletes the expired stored public datas
+	now = now.Add(101 * time.Second)
+	NewWithTimeNow(reader, cfg, storage, func() time.Time { return now })
+	assert.Equal(t, 0, storedLen())
+}
+
+func TestIdenPubOffChainReadCacheVerify(t *testing.T) {
+	id := core.NewID([2]byte{0, 0x42}, [27]byte{0x01})
+	var publicDataReturned *idenpuboffchain.PublicData
+	reader := readerFunc(func(idenState *merkletree.Hash) *idenpuboffchain.PublicData {
+		return publicDataReturned
+	})
+	cache := New(reader, ConfigDefault, db.NewMemoryStorage())
+
+	// The public data of another identity state
+	publicData0 := newPublicData(t, []uint32{0})
+	publicData1 := newPublicData(t, []uint32{1})
+	publicDataReturned = publicData0
+	_, err := cache.GetPublicData(url, &id, publicData1.IdenState)
+	assert.Equal(t, ErrIdenStateDoesntMatch, err)
+
+	// Public data with trees that don't match the identity state
+	publicDataBad := *publicData1
+	publicDataBad.RevocationsTree = publicData0.RevocationsTree
+	publicDataReturned = &publicDataBad
+	_, err = cache.GetPublicData(url, &id, publicData1.IdenState)
+	assert.Equal(t, idenpuboffchain.ErrCalculatedIdenStateDoesntMatch, err)
+	assert.Equal(t, 0, cache.lru.Len())
+
+	publicDataReturned = publicData1
+	_, err = cache.GetPublicData(url, &id, publicData1.IdenState)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, cache.lru.Len())
+}
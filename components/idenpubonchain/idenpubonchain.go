@@ -1,6 +1,7 @@
 package idenpubonchain
 
 import (
+	"context"
 	"fmt"
 	"math/big"
 
@@ -34,6 +35,10 @@ type IdenPubOnChainer interface {
 	InitState(id *core.ID, genesisState *merkletree.Hash,
 		newState *merkletree.Hash, proof *zktypes.Proof) (*types.Transaction, error)
 	TxConfirmBlocks(tx *types.Transaction) (*big.Int, error)
+	ReplaceTx(tx *types.Transaction, minGasPrice *big.Int) (*types.Transaction, error)
+	TxNonceMined(tx *types.Transaction) (bool, error)
+	CurrentBlock() (uint64, error)
+	BlockHash(blockN uint64) (common.Hash, error)
 	// VerifyProofClaim(pc *proof.ProofClaim) (bool, error)
 }
 
@@ -221,3 +226,46 @@ func (ip *IdenPubOnChain) TxConfirmBlocks(tx *types.Transaction) (*big.Int, erro
 	}
 	return currentBlock.Sub(currentBlock, receipt.BlockNumber), nil
 }
+
+// ReplaceTx resends the transaction tx (with the same nonce) with a gas price
+// of at least minGasPrice to replace it while it's pending.
+func (ip *IdenPubOnChain) ReplaceTx(tx *types.Transaction, minGasPrice *big.Int) (*types.Transaction, error) {
+	newTx, err := ip.client.ReplaceAuth(tx, minGasPrice)
+	if err != nil {
+		return nil, fmt.Errorf("Failed replacing transaction %v: %w", tx.Hash().Hex(), err)
+	}
+	return newTx, nil
+}
+
+// TxNonceMined returns true if a transaction with the nonce of tx (tx or
+// any transaction replacing it) has been mined.
+func (ip *IdenPubOnChain) TxNonceMined(tx *types.Transaction) (bool, error) {
+	nonce, err := ip.client.NonceAt()
+	if err != nil {
+		return false, err
+	}
+	return tx.Nonce() < nonce, nil
+}
+
+// CurrentBlock returns the current block number in the blockchain.
+func (ip *IdenPubOnChain) CurrentBlock() (uint64, error) {
+	currentBlock, err := ip.client.CurrentBlock()
+	if err != nil {
+		return 0, err
+	}
+	return currentBlock.Uint64(), nil
+}
+
+// BlockHash returns the hash of the block with number blockN in the
+// canonical chain.
+func (ip *IdenPubOnChain) BlockHash(blockN uint64) (common.Hash, error) {
+	var header *types.Header
+	if err := ip.client.Call(func(c *ethclient.Client) error {
+		var err error
+		header, err = c.HeaderByNumber(context.Background(), new(big.Int).SetUint64(blockN))
+		return err
+	}); err != nil {
+		return common.Hash{}, err
+	}
+	return header.Hash(), nil
+}
@@ -1,6 +1,7 @@
 package local
 
 import (
+	"encoding/binary"
 	"fmt"
 	"math/big"
 	"sync"
@@ -8,11 +9,13 @@ import (
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
 	zktypes "github.com/iden3/go-circom-prover-verifier/types"
 	"github.com/iden3/go-circom-prover-verifier/verifier"
 	"github.com/iden3/go-iden3-core/components/idenpubonchain"
 	"github.com/iden3/go-iden3-core/core"
 	"github.com/iden3/go-iden3-core/core/proof"
+	"github.com/iden3/go-iden3-core/eth"
 	"github.com/iden3/go-iden3-core/merkletree"
 )
 
@@ -53,6 +56,16 @@ type IdenPubOnChain struct {
 	timeNow        func() time.Time
 	blockNow       func() uint64
 	verifyingKey   *zktypes.Vk
+	// forkBlocks are the first block numbers replaced by each simulated
+	// chain reorganization.
+	forkBlocks []uint64
+	// revertedBlocks are the block numbers at which the transactions
+	// reverted by RevertPending were sent.
+	revertedBlocks map[uint64]bool
+	// nonce is the nonce of the next transaction, and nonceMined the nonce
+	// of the next transaction to be mined.
+	nonce      uint64
+	nonceMined uint64
 }
 
 // New creates a new IdenPubOnChain
@@ -64,6 +77,7 @@ func New(timeNow func() time.Time, blockNow func() uint64, verifyingKey *zktypes
 		timeNow:        timeNow,
 		blockNow:       blockNow,
 		verifyingKey:   verifyingKey,
+		revertedBlocks: make(map[uint64]bool),
 	}
 }
 
@@ -81,6 +95,57 @@ func (ip *IdenPubOnChain) Sync() {
 	}
 	ip.pendingInit = make([]*IdIdenStateData, 0)
 	ip.pendingSet = make([]*IdIdenStateData, 0)
+	ip.nonceMined = ip.nonce
+}
+
+// CancelPending discards all the pending writes, simulating that the
+// transactions have been replaced by other transactions with the same nonces
+// that have been mined.
+func (ip *IdenPubOnChain) CancelPending() {
+	ip.rw.Lock()
+	defer ip.rw.Unlock()
+	ip.pendingInit = make([]*IdIdenStateData, 0)
+	ip.pendingSet = make([]*IdIdenStateData, 0)
+	ip.nonceMined = ip.nonce
+}
+
+// RevertPending discards all the pending writes, simulating that the
+// transactions have been mined but reverted.
+func (ip *IdenPubOnChain) RevertPending() {
+	ip.rw.Lock()
+	defer ip.rw.Unlock()
+	for _, idIdenStateData := range append(ip.pendingInit, ip.pendingSet...) {
+		ip.revertedBlocks[idIdenStateData.IdenStateData.BlockN] = true
+	}
+	ip.pendingInit = make([]*IdIdenStateData, 0)
+	ip.pendingSet = make([]*IdIdenStateData, 0)
+	ip.nonceMined = ip.nonce
+}
+
+// Reorg simulates a chain reorganization in which the last n identity states
+// of the given ID are removed from the chain.  The hashes of the blocks since
+// the first removed state change.
+func (ip *IdenPubOnChain) Reorg(id *core.ID, n int) {
+	ip.rw.Lock()
+	defer ip.rw.Unlock()
+	idenStatesData, ok := ip.idenStatesData[*id]
+	if !ok || n == 0 {
+		return
+	}
+	if n > len(idenStatesData.IdenStates) {
+		n = len(idenStatesData.IdenStates)
+	}
+	removed := idenStatesData.IdenStates[len(idenStatesData.IdenStates)-n:]
+	ip.forkBlocks = append(ip.forkBlocks, removed[0].BlockN)
+	if n == len(idenStatesData.IdenStates) {
+		delete(ip.idenStatesData, *id)
+		return
+	}
+	newIdenStatesData := NewIdenStateHistory()
+	for _, idenStateData := range idenStatesData.IdenStates[:len(idenStatesData.IdenStates)-n] {
+		newIdenStatesData.Add(idenStateData)
+	}
+	ip.idenStatesData[*id] = newIdenStatesData
 }
 
 // GetState returns the Identity State Data of the given ID from the IdenStates Smart Contract.
@@ -145,7 +210,7 @@ func (ip *IdenPubOnChain) SetState(id *core.ID, newState *merkletree.Hash,
 		IdenState: newState,
 	}
 	ip.pendingSet = append(ip.pendingSet, &IdIdenStateData{Id: id, IdenStateData: &idenState})
-	return &types.Transaction{}, nil
+	return ip.newTx(idenState.BlockN), nil
 }
 
 // InitState initializes the first Identity State of the given ID in the IdenStates Smart Contract.
@@ -167,17 +232,68 @@ func (ip *IdenPubOnChain) InitState(id *core.ID, genesisState,
 		IdenState: newState,
 	}
 	ip.pendingInit = append(ip.pendingInit, &IdIdenStateData{Id: id, IdenStateData: &idenState})
-	return types.NewTransaction(0, common.Address{}, nil, 0, nil,
-		new(big.Int).SetUint64(ip.blockNow()).Bytes()), nil
+	return ip.newTx(idenState.BlockN), nil
+}
+
+// newTx returns a transaction with the next nonce and the block number blockN
+// at which it was sent as data.
+func (ip *IdenPubOnChain) newTx(blockN uint64) *types.Transaction {
+	tx := types.NewTransaction(ip.nonce, common.Address{}, nil, 0, nil,
+		new(big.Int).SetUint64(blockN).Bytes())
+	ip.nonce++
+	return tx
 }
 
 // TxConfirmBlocks returns the number of confirmed blocks of transaction tx.
 func (ip *IdenPubOnChain) TxConfirmBlocks(tx *types.Transaction) (*big.Int, error) {
 	blockNumber := new(big.Int).SetBytes(tx.Data())
+	ip.rw.RLock()
+	reverted := ip.revertedBlocks[blockNumber.Uint64()]
+	ip.rw.RUnlock()
+	if reverted {
+		return nil, eth.ErrReceiptStatusFailed
+	}
 	currentBlock := new(big.Int).SetUint64(ip.blockNow())
 	return currentBlock.Sub(currentBlock, blockNumber), nil
 }
 
+// ReplaceTx returns a copy of tx with the gas price minGasPrice.  The pending
+// writes are not modified.
+func (ip *IdenPubOnChain) ReplaceTx(tx *types.Transaction, minGasPrice *big.Int) (*types.Transaction, error) {
+	return types.NewTransaction(tx.Nonce(), common.Address{}, tx.Value(), tx.Gas(), minGasPrice,
+		tx.Data()), nil
+}
+
+// TxNonceMined returns true if a transaction with the nonce of tx has been
+// synced, reverted or cancelled.
+func (ip *IdenPubOnChain) TxNonceMined(tx *types.Transaction) (bool, error) {
+	ip.rw.RLock()
+	defer ip.rw.RUnlock()
+	return tx.Nonce() < ip.nonceMined, nil
+}
+
+// CurrentBlock returns the current block number.
+func (ip *IdenPubOnChain) CurrentBlock() (uint64, error) {
+	return ip.blockNow(), nil
+}
+
+// BlockHash returns a hash of the block number blockN that changes every time
+// the block is replaced by a simulated chain reorganization.
+func (ip *IdenPubOnChain) BlockHash(blockN uint64) (common.Hash, error) {
+	ip.rw.RLock()
+	defer ip.rw.RUnlock()
+	var fork uint64
+	for _, forkBlock := range ip.forkBlocks {
+		if forkBlock <= blockN {
+			fork++
+		}
+	}
+	var b [16]byte
+	binary.BigEndian.PutUint64(b[:8], blockN)
+	binary.BigEndian.PutUint64(b[8:], fork)
+	return crypto.Keccak256Hash(b[:]), nil
+}
+
 func (ip *IdenPubOnChain) verifyZKP(zkProof *zktypes.Proof,
 	id *core.ID, oldState, newState *merkletree.Hash) bool {
 	var idElem merkletree.ElemBytes
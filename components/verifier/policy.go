@@ -0,0 +1,290 @@
+package verifier
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"time"
+
+	zktypes "github.com/iden3/go-circom-prover-verifier/types"
+	"github.com/iden3/go-iden3-core/core"
+	"github.com/iden3/go-iden3-core/core/claims"
+	"github.com/iden3/go-iden3-core/core/proof"
+	"github.com/iden3/go-iden3-core/merkletree"
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	ErrPolicyCredentialType     = fmt.Errorf("the credential type can't be verified with a policy")
+	ErrPolicyIssuer             = fmt.Errorf("the issuer is not trusted by the policy")
+	ErrPolicyClaimType          = fmt.Errorf("the claim type is not allowed by the policy")
+	ErrPolicySchema             = fmt.Errorf("the claim schema is not allowed by the policy")
+	ErrPolicySchemaNotExposed   = fmt.Errorf("the zk proof doesn't expose the claim schema")
+	ErrPolicySubject            = fmt.Errorf("the claim subject is not the required one")
+	ErrPolicySubjectNotExposed  = fmt.Errorf("the zk proof doesn't expose the claim subject")
+	ErrPolicyExpirationRequired = fmt.Errorf("the policy requires claims with expiration")
+	ErrPolicyExpiresSoon        = fmt.Errorf("the claim expires before the policy minimum time")
+	ErrPolicyFormat             = fmt.Errorf("unknown policy file format")
+)
+
+// PolicyMaxFreshnessDefault is the freshness used when the policy
+// MaxFreshness is omitted (zero).
+const PolicyMaxFreshnessDefault = 10 * time.Minute
+
+// Duration is a time.Duration that is encoded as text like "1h30m".
+type Duration time.Duration
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+func (d *Duration) UnmarshalText(b []byte) error {
+	duration, err := time.ParseDuration(string(b))
+	if err != nil {
+		return err
+	}
+	*d = Duration(duration)
+	return nil
+}
+
+// TrustList is a named list of trusted issuers.
+type TrustList struct {
+	Name    string    `json:"name" yaml:"name"`
+	Issuers []core.ID `json:"issuers" yaml:"issuers"`
+}
+
+// Policy is a declarative verification policy, evaluated by
+// Verifier.VerifyWithPolicy.
+type Policy struct {
+	// Issuers and TrustLists are the trusted issuers.  If both are empty,
+	// any issuer is trusted.
+	Issuers    []core.ID   `json:"issuers" yaml:"issuers"`
+	TrustLists []TrustList `json:"trustLists" yaml:"trustLists"`
+	// ClaimTypes are the allowed claim types.  If empty, any claim type
+	// is allowed.
+	ClaimTypes []claims.ClaimType `json:"claimTypes" yaml:"claimTypes"`
+	// Schemas are the names of the allowed schemas, for the claim types
+	// with a schema (ClaimPayloadRoot and ClaimSaltedAttributes), whose
+	// claims hold the hash of the name obtained with claims.HashString.
+	// If not empty, claims without a schema are rejected.
+	Schemas []string `json:"schemas" yaml:"schemas"`
+	// RequireSubject requires the claim subject to be the identity
+	// passed to VerifyWithPolicy.
+	RequireSubject bool `json:"requireSubject" yaml:"requireSubject"`
+	// MaxFreshness is the freshness passed to the credential verification.
+	// If omitted, PolicyMaxFreshnessDefault is used.
+	MaxFreshness Duration `json:"maxFreshness" yaml:"maxFreshness"`
+	// RequireExpiration requires claims with expiration.  For zk proofs,
+	// the circuit must check the claim expiration.
+	RequireExpiration bool `json:"requireExpiration" yaml:"requireExpiration"`
+	// MinTimeToExpiration is the minimum time until the claim expiration.
+	// It only applies to credentials, as zk proofs don't disclose the
+	// expiration.
+	MinTimeToExpiration Duration `json:"minTimeToExpiration" yaml:"minTimeToExpiration"`
+}
+
+// ParsePolicyJSON parses a Policy encoded in JSON.  Unknown fields are
+// rejected.
+func ParsePolicyJSON(data []byte) (*Policy, error) {
+	var policy Policy
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&policy); err != nil {
+		return nil, err
+	}
+	return &policy, nil
+}
+
+// ParsePolicyYAML parses a Policy encoded in YAML.
+func ParsePolicyYAML(data []byte) (*Policy, error) {
+	var policy Policy
+	if err := yaml.UnmarshalStrict(data, &policy); err != nil {
+		return nil, err
+	}
+	return &policy, nil
+}
+
+// LoadPolicy loads a Policy from a JSON (.json) or YAML (.yaml, .yml) file.
+func LoadPolicy(path string) (*Policy, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	switch filepath.Ext(path) {
+	case ".json":
+		return ParsePolicyJSON(data)
+	case ".yaml", ".yml":
+		return ParsePolicyYAML(data)
+	default:
+		return nil, ErrPolicyFormat
+	}
+}
+
+// issuerTrusted returns true if the policy trusts the issuerID.
+func (p *Policy) issuerTrusted(issuerID *core.ID) bool {
+	if len(p.Issuers) == 0 && len(p.TrustLists) == 0 {
+		return true
+	}
+	for i := range p.Issuers {
+		if p.Issuers[i].Equal(issuerID) {
+			return true
+		}
+	}
+	for _, trustList := range p.TrustLists {
+		for i := range trustList.Issuers {
+			if trustList.Issuers[i].Equal(issuerID) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// claimTypeAllowed returns true if the policy allows the claimType.
+func (p *Policy) claimTypeAllowed(claimType claims.ClaimType) bool {
+	if len(p.ClaimTypes) == 0 {
+		return true
+	}
+	for _, allowed := range p.ClaimTypes {
+		if allowed == claimType {
+			return true
+		}
+	}
+	return false
+}
+
+// schemaAllowed returns true if the policy allows the claim schema, as stored
+// in the claims with a schema.
+func (p *Policy) schemaAllowed(schema *merkletree.ElemBytes) bool {
+	for _, name := range p.Schemas {
+		if schemaElem(name) == *schema {
+			return true
+		}
+	}
+	return false
+}
+
+// schemaElem returns the claim schema with the name, as stored in the claims
+// with a schema.
+func schemaElem(name string) (schema merkletree.ElemBytes) {
+	hash := claims.HashString(name)
+	copy(schema[:], hash[:])
+	return schema
+}
+
+// claimSchema returns the schema of the claim in entry, or false if its type
+// doesn't have a schema.
+func claimSchema(entry *merkletree.Entry, claimType claims.ClaimType) (*merkletree.ElemBytes, bool) {
+	var schema merkletree.ElemBytes
+	switch claimType {
+	case claims.ClaimTypePayloadRoot:
+		hash := claims.NewClaimPayloadRootFromEntry(entry).Schema
+		copy(schema[:], hash[:])
+	case claims.ClaimTypeSaltedAttributes:
+		hash := claims.NewClaimSaltedAttributesFromEntry(entry).Schema
+		copy(schema[:], hash[:])
+	default:
+		return nil, false
+	}
+	return &schema, true
+}
+
+// checkIssuerClaimType checks that the policy trusts the issuerID and allows
+// the claimType.
+func (p *Policy) checkIssuerClaimType(issuerID *core.ID, claimType claims.ClaimType) error {
+	if !p.issuerTrusted(issuerID) {
+		return ErrPolicyIssuer
+	}
+	if !p.claimTypeAllowed(claimType) {
+		return ErrPolicyClaimType
+	}
+	return nil
+}
+
+// ZkProofCredential is a zkp of a credential, to be verified with
+// VerifyWithPolicy.
+type ZkProofCredential struct {
+	ZkProof         *zktypes.Proof
+	PubSignals      []*big.Int
+	IssuerID        *core.ID
+	IdenStateBlockN uint64
+	// VerificationKeyHash is the sha256 hash in hex of the verification
+	// key of the circuit, which must be registered in the Verifier with
+	// RegisterZkCircuit.  The claim type, subject and expiration checks
+	// are the ones of the registered circuit.
+	VerificationKeyHash string
+}
+
+// VerifyWithPolicy verifies a credential against the policy.  The credential
+// can be a *proof.CredentialValidity or a *ZkProofCredential.  The subject is
+// the identity that must be the claim subject if the policy requires it.
+func (v *Verifier) VerifyWithPolicy(policy *Policy, subject *core.ID, credential interface{}) error {
+	if policy.RequireSubject && subject == nil {
+		return ErrPolicySubject
+	}
+	freshness := time.Duration(policy.MaxFreshness)
+	if freshness == 0 {
+		freshness = PolicyMaxFreshnessDefault
+	}
+	switch cred := credential.(type) {
+	case *proof.CredentialValidity:
+		var metadata claims.Metadata
+		metadata.Unmarshal(cred.CredentialExistence.Claim)
+		if err := policy.checkIssuerClaimType(cred.CredentialExistence.Id, metadata.Type()); err != nil {
+			return err
+		}
+		if policy.RequireSubject && (metadata.Subject == nil || !metadata.Subject.Equal(subject)) {
+			return ErrPolicySubject
+		}
+		if len(policy.Schemas) != 0 {
+			schema, ok := claimSchema(cred.CredentialExistence.Claim, metadata.Type())
+			if !ok || !policy.schemaAllowed(schema) {
+				return ErrPolicySchema
+			}
+		}
+		if metadata.Header().Expiration {
+			minExpiration := v.timeNow().Add(time.Duration(policy.MinTimeToExpiration)).Unix()
+			if metadata.Expiration < minExpiration {
+				return ErrPolicyExpiresSoon
+			}
+		} else if policy.RequireExpiration {
+			return ErrPolicyExpirationRequired
+		}
+		return v.VerifyCredentialValidity(cred, freshness)
+	case *ZkProofCredential:
+		circuit, err := v.ZkCircuit(cred.VerificationKeyHash)
+		if err != nil {
+			return err
+		}
+		if err := policy.checkIssuerClaimType(cred.IssuerID, circuit.ClaimType); err != nil {
+			return err
+		}
+		if policy.RequireSubject {
+			if circuit.SubjectSignalIdx <= 0 || circuit.SubjectSignalIdx >= len(cred.PubSignals) {
+				return ErrPolicySubjectNotExposed
+			}
+			if cred.PubSignals[circuit.SubjectSignalIdx].Cmp(subject.BigInt()) != 0 {
+				return ErrPolicySubject
+			}
+		}
+		if len(policy.Schemas) != 0 {
+			if circuit.SchemaSignalIdx <= 0 || circuit.SchemaSignalIdx >= len(cred.PubSignals) {
+				return ErrPolicySchemaNotExposed
+			}
+			schema := merkletree.NewElemBytesFromBigInt(cred.PubSignals[circuit.SchemaSignalIdx])
+			if !policy.schemaAllowed(&schema) {
+				return ErrPolicySchema
+			}
+		}
+		if policy.RequireExpiration && circuit.Expiration == nil {
+			return ErrPolicyExpirationRequired
+		}
+		return v.VerifyZkProofCredentialCircuit(cred.ZkProof, cred.PubSignals, cred.IssuerID,
+			cred.IdenStateBlockN, circuit, freshness)
+	default:
+		return ErrPolicyCredentialType
+	}
+}
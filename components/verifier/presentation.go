@@ -0,0 +1,111 @@
+package verifier
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/iden3/go-iden3-core/core"
+	"github.com/iden3/go-iden3-core/core/claims"
+	"github.com/iden3/go-iden3-core/core/proof"
+	noncedb "github.com/iden3/go-iden3-core/utils/noncedb"
+)
+
+var (
+	ErrPresentationNonce       = fmt.Errorf("the presentation nonce is unknown, expired or already used")
+	ErrPresentationIssuer      = fmt.Errorf("the presentation issuer is not the one requested")
+	ErrPresentationClaimType   = fmt.Errorf("the presentation claim type is not the one requested")
+	ErrPresentationSubject     = fmt.Errorf("the presentation claim subject is not the signer")
+	ErrPresentationNonceSignal = fmt.Errorf("the presentation zk proof is not bound to the request nonce")
+)
+
+// NewPresentationRequest creates a request for the presentation of a claim
+// of claimType issued by issuerID, signed in the domain.  The request nonce
+// is stored in nonceDb and expires after delta seconds.
+func (v *Verifier) NewPresentationRequest(nonceDb *noncedb.NonceDb, domain string,
+	issuerID *core.ID, claimType claims.ClaimType, delta int64) *proof.PresentationRequest {
+	req := &proof.PresentationRequest{
+		Domain:    domain,
+		Issuer:    issuerID,
+		ClaimType: claimType,
+	}
+	nObj := nonceDb.New(delta, req)
+	req.Nonce = nObj.Nonce
+	req.Expiration = nObj.Expiration
+	return req
+}
+
+// consumePresentationRequest returns the presentation request of the nonce,
+// deleting it from nonceDb so that it can't be used again.
+func consumePresentationRequest(nonceDb *noncedb.NonceDb, nonce string) (*proof.PresentationRequest, error) {
+	nObj, ok := nonceDb.SearchAndDelete(nonce)
+	if !ok {
+		return nil, ErrPresentationNonce
+	}
+	req, ok := nObj.Aux.(*proof.PresentationRequest)
+	if !ok {
+		return nil, ErrPresentationNonce
+	}
+	return req, nil
+}
+
+// VerifyPresentationCredential verifies a presentation of a credential of
+// validity in answer to a request created with NewPresentationRequest: the
+// credential is valid passed the freshness time, it matches the request
+// issuer and claim type, and it has been signed in the request domain by the
+// claim subject, bound to the request nonce, with a key that has not been
+// revoked passed the freshness time.  The nonce is consumed even if the
+// verification fails.
+func (v *Verifier) VerifyPresentationCredential(nonceDb *noncedb.NonceDb,
+	pres *proof.PresentationCredential, freshness time.Duration) error {
+	req, err := consumePresentationRequest(nonceDb, pres.Nonce)
+	if err != nil {
+		return err
+	}
+	if err := v.VerifyCredentialValidity(pres.CredentialValidity, freshness); err != nil {
+		return err
+	}
+	credExist := &pres.CredentialValidity.CredentialExistence
+	if !credExist.Id.Equal(req.Issuer) {
+		return ErrPresentationIssuer
+	}
+	var metadata claims.Metadata
+	metadata.Unmarshal(credExist.Claim)
+	if metadata.Type() != req.ClaimType {
+		return ErrPresentationClaimType
+	}
+	if metadata.Subject == nil || !metadata.Subject.Equal(pres.KeyCredential.CredentialExistence.Id) {
+		return ErrPresentationSubject
+	}
+	return v.VerifySignedMsgCredentialValidity(pres.SignedMsg(req.Domain), req.Domain,
+		pres.KeyCredential, freshness)
+}
+
+// VerifyPresentationZkProof verifies a presentation of a zkp of a credential
+// generated with the circuit in answer to a request created with
+// NewPresentationRequest: the zkp is bound to the request nonce by the nonce
+// input of the circuit, it's valid passed the freshness time and its claim is
+// not expired (see VerifyZkProofCredentialCircuit), and it matches the request
+// issuer and claim type.  The nonce is consumed even if the verification
+// fails.
+func (v *Verifier) VerifyPresentationZkProof(nonceDb *noncedb.NonceDb,
+	pres *proof.PresentationZkProof, circuit *ZkCircuit, freshness time.Duration) error {
+	req, err := consumePresentationRequest(nonceDb, pres.Nonce)
+	if err != nil {
+		return err
+	}
+	if !pres.IssuerID.Equal(req.Issuer) {
+		return ErrPresentationIssuer
+	}
+	if circuit.ClaimType != req.ClaimType {
+		return ErrPresentationClaimType
+	}
+	if circuit.Nonce == nil || circuit.Nonce.NonceSignalIdx <= 0 ||
+		circuit.Nonce.NonceSignalIdx >= len(pres.PubSignals) {
+		return ErrZkProofNonceSignal
+	}
+	if pres.PubSignals[circuit.Nonce.NonceSignalIdx].Cmp(proof.NonceElem(req.Nonce)) != 0 {
+		return ErrPresentationNonceSignal
+	}
+	return v.VerifyZkProofCredentialCircuit(pres.ZkProof, pres.PubSignals, pres.IssuerID,
+		pres.IdenStateBlockN, circuit, freshness)
+}
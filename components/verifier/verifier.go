@@ -1,9 +1,11 @@
 package verifier
 
 import (
+	"errors"
 	"fmt"
 	"math/big"
 	"reflect"
+	"sync"
 	"time"
 
 	zktypes "github.com/iden3/go-circom-prover-verifier/types"
@@ -12,8 +14,10 @@ import (
 	"github.com/iden3/go-iden3-core/core"
 	"github.com/iden3/go-iden3-core/core/claims"
 	"github.com/iden3/go-iden3-core/core/proof"
+	"github.com/iden3/go-iden3-core/keystore"
 	"github.com/iden3/go-iden3-core/merkletree"
 	zkutils "github.com/iden3/go-iden3-core/utils/zk"
+	"github.com/iden3/go-iden3-crypto/babyjub"
 )
 
 var (
@@ -23,6 +27,14 @@ var (
 	ErrCalculatedIdenStateDoesntMatch = fmt.Errorf("Calculated IdenState doesn't match the one in the credential")
 	ErrClaimExpired                   = fmt.Errorf("Expired claim")
 	ErrFailedVerifyZkProofCredential  = fmt.Errorf("failed verifing generated zk proof of credential")
+	ErrSignedMsgDomain                = fmt.Errorf("the signed message domain doesn't match the expected one")
+	ErrClaimNotKeyAuthorizeKSign      = fmt.Errorf("the claim doesn't authorize a BabyJub signing key")
+	ErrInvalidSignature               = fmt.Errorf("invalid signature")
+	ErrZkProofTimeNowSignal           = fmt.Errorf("the zk proof doesn't have the current time public signal")
+	ErrZkProofNonceSignal             = fmt.Errorf("the zk proof doesn't have the nonce public signal")
+	ErrZkCircuitExpirationUnchecked   = fmt.Errorf("the zk circuit doesn't check the expiration of claims that can expire")
+	ErrZkCircuitVkHash                = fmt.Errorf("the zk circuit files don't have a verification key hash")
+	ErrZkCircuitUnknown               = fmt.Errorf("the zk circuit is not registered in the verifier")
 )
 
 // Verifier allows verifying claims in three forms: credential of existence,
@@ -31,6 +43,10 @@ var (
 type Verifier struct {
 	idenPubOnChain idenpubonchain.IdenPubOnChainer
 	timeNow        func() time.Time
+	// zkCircuits are the registered credential circuits by the hash of
+	// their verification key.
+	zkCircuits  map[string]*ZkCircuit
+	zkCircuitsM sync.RWMutex
 }
 
 // NewWithTimeNow creates a verifier that uses the real time to validate freshness of claims.
@@ -40,6 +56,7 @@ func New(idenPubOnChain idenpubonchain.IdenPubOnChainer) *Verifier {
 		timeNow: func() time.Time {
 			return time.Now()
 		},
+		zkCircuits: make(map[string]*ZkCircuit),
 	}
 }
 
@@ -50,11 +67,15 @@ func NewWithTimeNow(idenPubOnChain idenpubonchain.IdenPubOnChainer, timeNow func
 	return &Verifier{
 		idenPubOnChain: idenPubOnChain,
 		timeNow:        timeNow,
+		zkCircuits:     make(map[string]*ZkCircuit),
 	}
 }
 
 // VerifyCredentialExistence verifies a credential of existence.  That is, that
-// the claim was issued by a particular identity.
+// the claim was issued by a particular identity.  Credentials of claims
+// included in the genesis identity state are verified against the identity
+// ID, which is derived from the genesis identity state, so they don't
+// require any identity state on chain.
 func (v *Verifier) VerifyCredentialExistence(credExist *proof.CredentialExistence) error {
 	if !credExist.MtpClaim.Existence {
 		return ErrMtpNonExistence
@@ -74,6 +95,11 @@ func (v *Verifier) VerifyCredentialExistence(credExist *proof.CredentialExistenc
 		return ErrCalculatedIdenStateDoesntMatch
 	}
 
+	// If the idenState is the genesis one, the ID is derived from it.
+	if core.IdGenesisFromIdenState(idenState).Equal(credExist.Id) {
+		return nil
+	}
+
 	// Verify that the IdenStateData from the existence credential is in the smart contract.
 	idenStateDataOnChain, err := v.idenPubOnChain.GetStateByBlock(credExist.Id, credExist.IdenStateData.BlockN)
 	if err != nil {
@@ -85,6 +111,28 @@ func (v *Verifier) VerifyCredentialExistence(credExist *proof.CredentialExistenc
 	return nil
 }
 
+// VerifyPayloadAttribute verifies a credential of existence of a
+// ClaimPayloadRoot, and that the attribute with its proof of existence
+// belongs to the payload tree committed in the claim.
+func (v *Verifier) VerifyPayloadAttribute(credExist *proof.CredentialExistence,
+	attribute *claims.LeafPayloadTree, mtp *merkletree.Proof) error {
+	if err := v.VerifyCredentialExistence(credExist); err != nil {
+		return err
+	}
+	return claims.VerifyPayloadAttribute(credExist.Claim, attribute, mtp)
+}
+
+// VerifyCredentialExistenceDisclosure verifies a credential of existence of a
+// ClaimSaltedAttributes, and that the disclosed attributes match the
+// commitments in the claim.
+func (v *Verifier) VerifyCredentialExistenceDisclosure(credExist *proof.CredentialExistence,
+	disclosed []claims.DisclosedAttribute) error {
+	if err := v.VerifyCredentialExistence(credExist); err != nil {
+		return err
+	}
+	return claims.VerifyDisclosedAttributes(credExist.Claim, disclosed)
+}
+
 // validateFreshness is a helper function that validates that the passed
 // `idenState` is not older than `freshness`, or that it's the most recent one.
 // The link between `idenState` and `blockTs` is not checked here.
@@ -113,7 +161,9 @@ func (v *Verifier) validateFreshness(id *core.ID, idenState *merkletree.Hash, bl
 
 // VerifyCredentialValidity verifies a credential of validity.  That is, that
 // the claim was issued by a particular identity, and that it has not been
-// revoked passed the freshness time.
+// revoked passed the freshness time.  A credential of validity in the
+// genesis identity state of an identity without identity states on chain is
+// valid, as no claim can have been revoked yet.
 func (v *Verifier) VerifyCredentialValidity(credValid *proof.CredentialValidity, freshness time.Duration) error {
 	// If the claim has an expiration date, check that it hasn't expired.
 	var metadata claims.Metadata
@@ -130,12 +180,6 @@ func (v *Verifier) VerifyCredentialValidity(credValid *proof.CredentialValidity,
 	if credValid.MtpNotNonce.Existence {
 		return ErrMtpExistence
 	}
-	if err := v.validateFreshness(credValid.CredentialExistence.Id,
-		credValid.IdenStateData.IdenState,
-		credValid.IdenStateData.BlockTs,
-		freshness); err != nil {
-		return err
-	}
 	// Verify that the idenState is built from revocations merkle tree
 	// where the claim is not revoked (the revocation nonce is not a leaf).
 	// NOTE: Once we add versions, this will require some changes that need to be thought properly!
@@ -154,8 +198,24 @@ func (v *Verifier) VerifyCredentialValidity(credValid *proof.CredentialValidity,
 		return ErrCalculatedIdenStateDoesntMatch
 	}
 
+	id := credValid.CredentialExistence.Id
+	if core.IdGenesisFromIdenState(idenState).Equal(id) {
+		if _, err := v.idenPubOnChain.GetState(id); errors.Is(err, idenpubonchain.ErrIdenNotOnChain) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+
+	if err := v.validateFreshness(id,
+		credValid.IdenStateData.IdenState,
+		credValid.IdenStateData.BlockTs,
+		freshness); err != nil {
+		return err
+	}
+
 	// Verify that the IdenStateData from the validity credential is in the smart contract.
-	idenStateDataOnChain, err := v.idenPubOnChain.GetStateByBlock(credValid.CredentialExistence.Id, credValid.IdenStateData.BlockN)
+	idenStateDataOnChain, err := v.idenPubOnChain.GetStateByBlock(id, credValid.IdenStateData.BlockN)
 	if err != nil {
 		return err
 	}
@@ -165,8 +225,145 @@ func (v *Verifier) VerifyCredentialValidity(credValid *proof.CredentialValidity,
 	return nil
 }
 
-// VerifyZkProofCredential verifies a zkp of a credential. For now expiration
-// is not checked.
+// VerifyCredentialValidityDisclosure verifies a credential of validity of a
+// ClaimSaltedAttributes, and that the disclosed attributes match the
+// commitments in the claim.
+func (v *Verifier) VerifyCredentialValidityDisclosure(credValid *proof.CredentialValidity,
+	disclosed []claims.DisclosedAttribute, freshness time.Duration) error {
+	if err := v.VerifyCredentialValidity(credValid, freshness); err != nil {
+		return err
+	}
+	return claims.VerifyDisclosedAttributes(credValid.CredentialExistence.Claim, disclosed)
+}
+
+// verifySignedMsg verifies that the message was signed in the domain with the
+// key authorized by the ClaimKeyBabyJub claim.
+func verifySignedMsg(signedMsg *proof.SignedMsg, domain string, claim *merkletree.Entry) error {
+	if signedMsg.Domain != domain {
+		return ErrSignedMsgDomain
+	}
+	var metadata claims.Metadata
+	metadata.Unmarshal(claim)
+	if metadata.Type() != claims.ClaimTypeKeyBabyJub {
+		return ErrClaimNotKeyAuthorizeKSign
+	}
+	claimKey := claims.NewClaimKeyBabyJubFromEntry(claim)
+	if claimKey.KeyType != claims.BabyJubKeyTypeAuthorizeKSign {
+		return ErrClaimNotKeyAuthorizeKSign
+	}
+	if signedMsg.Signature == nil {
+		return ErrInvalidSignature
+	}
+	pkComp := (&babyjub.PublicKey{X: claimKey.Ax, Y: claimKey.Ay}).Compress()
+	ok, err := keystore.VerifySignatureElem(&pkComp, signedMsg.Hash(), signedMsg.Signature)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// VerifySignedMsgCredentialExistence verifies that the message was signed in
+// the domain by the identity of the credential of existence, with the key
+// authorized by its ClaimKeyBabyJub.  The key is not checked to be
+// unrevoked, use VerifySignedMsgCredentialValidity for that.
+func (v *Verifier) VerifySignedMsgCredentialExistence(signedMsg *proof.SignedMsg, domain string,
+	credExist *proof.CredentialExistence) error {
+	if err := v.VerifyCredentialExistence(credExist); err != nil {
+		return err
+	}
+	return verifySignedMsg(signedMsg, domain, credExist.Claim)
+}
+
+// VerifySignedMsgCredentialValidity verifies that the message was signed in
+// the domain by the identity of the credential of validity, with the key
+// authorized by its ClaimKeyBabyJub, which has not been revoked passed the
+// freshness time.
+func (v *Verifier) VerifySignedMsgCredentialValidity(signedMsg *proof.SignedMsg, domain string,
+	credValid *proof.CredentialValidity, freshness time.Duration) error {
+	if err := v.VerifyCredentialValidity(credValid, freshness); err != nil {
+		return err
+	}
+	return verifySignedMsg(signedMsg, domain, credValid.CredentialExistence.Claim)
+}
+
+// verifyZkProofNotExpired verifies that the current time public signal of a
+// credential zkp described by expiration is not older than its MaxDelay, so
+// that the claim, which the circuit proves that expires after that time, was
+// not expired passed MaxDelay.
+func (v *Verifier) verifyZkProofNotExpired(pubSignals []*big.Int,
+	expiration *zkutils.CredentialExpiration) error {
+	if expiration.TimeNowSignalIdx < 0 || expiration.TimeNowSignalIdx >= len(pubSignals) {
+		return ErrZkProofTimeNowSignal
+	}
+	timeNow := pubSignals[expiration.TimeNowSignalIdx]
+	minTimeNow := v.timeNow().Add(-expiration.MaxDelay).Unix()
+	if timeNow.Cmp(big.NewInt(minTimeNow)) < 0 {
+		return ErrClaimExpired
+	}
+	return nil
+}
+
+// ZkCircuit describes a credential circuit to the Verifier: its zk files, the
+// type of the claims it proves and the meaning of its public signals.
+type ZkCircuit struct {
+	ZkFiles *zkutils.ZkFiles
+	// ClaimType is the type of the claims proved by the circuit.
+	ClaimType claims.ClaimType
+	// SubjectSignalIdx is the index of the public signal with the claim
+	// subject ID, or 0 if the circuit doesn't expose it (the first public
+	// signal is the issuer identity state).
+	SubjectSignalIdx int
+	// SchemaSignalIdx is the index of the public signal with the claim
+	// schema, or 0 if the circuit doesn't expose it.
+	SchemaSignalIdx int
+	// Expiration describes how the circuit checks the claim expiration,
+	// or is nil if it doesn't, which is only accepted for claim types
+	// that can't expire.
+	Expiration *zkutils.CredentialExpiration
+	// Nonce describes how the circuit binds the proof to the nonce of a
+	// presentation request, or is nil if it doesn't.
+	Nonce *zkutils.CredentialNonce
+}
+
+// RegisterZkCircuit registers a credential circuit in the Verifier by the
+// sha256 hash of its verification key, which is checked when the key is
+// loaded, so that zkps of credentials can refer to it (see
+// ZkProofCredential).  Circuits that don't check the claim expiration are
+// rejected unless their claim type can't expire.
+func (v *Verifier) RegisterZkCircuit(circuit *ZkCircuit) error {
+	if circuit.Expiration == nil && claims.ClaimTypeExpirable(circuit.ClaimType) {
+		return ErrZkCircuitExpirationUnchecked
+	}
+	vkHash := circuit.ZkFiles.VerificationKeyHash()
+	if vkHash == "" {
+		return ErrZkCircuitVkHash
+	}
+	v.zkCircuitsM.Lock()
+	defer v.zkCircuitsM.Unlock()
+	v.zkCircuits[vkHash] = circuit
+	return nil
+}
+
+// ZkCircuit returns the credential circuit registered with the verification
+// key hash vkHash.
+func (v *Verifier) ZkCircuit(vkHash string) (*ZkCircuit, error) {
+	v.zkCircuitsM.RLock()
+	defer v.zkCircuitsM.RUnlock()
+	circuit, ok := v.zkCircuits[vkHash]
+	if !ok {
+		return nil, ErrZkCircuitUnknown
+	}
+	return circuit, nil
+}
+
+// VerifyZkProofCredential verifies a zkp of a credential.  The claim
+// expiration is not checked.
+//
+// Deprecated: use VerifyZkProofCredentialCircuit, which rejects zkps of
+// claims that can expire unless the circuit checks their expiration.
 func (v *Verifier) VerifyZkProofCredential(
 	zkProof *zktypes.Proof,
 	pubSignals []*big.Int,
@@ -174,6 +371,42 @@ func (v *Verifier) VerifyZkProofCredential(
 	idenStateBlockN uint64,
 	zkFiles *zkutils.ZkFiles,
 	freshness time.Duration) error {
+	return v.verifyZkProofCredential(zkProof, pubSignals, issuerID, idenStateBlockN, zkFiles, freshness)
+}
+
+// VerifyZkProofCredentialCircuit verifies a zkp of a credential generated
+// with the circuit.  If the circuit checks the claim expiration against a
+// current time input, proofs with a current time older than its
+// Expiration.MaxDelay are rejected.  Circuits that don't check the claim
+// expiration are rejected unless their claim type can't expire.
+func (v *Verifier) VerifyZkProofCredentialCircuit(
+	zkProof *zktypes.Proof,
+	pubSignals []*big.Int,
+	issuerID *core.ID,
+	idenStateBlockN uint64,
+	circuit *ZkCircuit,
+	freshness time.Duration) error {
+
+	if circuit.Expiration == nil {
+		if claims.ClaimTypeExpirable(circuit.ClaimType) {
+			return ErrZkCircuitExpirationUnchecked
+		}
+	} else if err := v.verifyZkProofNotExpired(pubSignals, circuit.Expiration); err != nil {
+		return err
+	}
+	return v.verifyZkProofCredential(zkProof, pubSignals, issuerID, idenStateBlockN, circuit.ZkFiles, freshness)
+}
+
+// verifyZkProofCredential verifies a zkp of a credential generated with the
+// circuit of zkFiles, and that the issuer identity state it uses is on chain
+// and fresh.
+func (v *Verifier) verifyZkProofCredential(
+	zkProof *zktypes.Proof,
+	pubSignals []*big.Int,
+	issuerID *core.ID,
+	idenStateBlockN uint64,
+	zkFiles *zkutils.ZkFiles,
+	freshness time.Duration) error {
 
 	vk, err := zkFiles.VerificationKey()
 	if err != nil {
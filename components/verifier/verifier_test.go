@@ -2,8 +2,11 @@ package verifier
 
 import (
 	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"math/big"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -160,6 +163,409 @@ func TestVerifyCredentialExistence(t *testing.T) {
 	assert.NotNil(t, err)
 }
 
+func TestVerifyCredentialExistenceGenesis(t *testing.T) {
+	cfg := issuer.ConfigDefault
+	cfg.GenesisOnly = true
+	storage := db.NewMemoryStorage()
+	ksStorage := keystore.MemStorage([]byte{})
+	keyStore, err := keystore.NewKeyStore(&ksStorage, keystore.LightKeyStoreParams)
+	require.Nil(t, err)
+	kOp, err := keyStore.NewKey(pass)
+	require.Nil(t, err)
+	indexBytes, valueBytes := [claims.IndexSlotLen]byte{}, [claims.ValueSlotLen]byte{}
+	indexBytes[0] = 0x42
+	claim := claims.NewClaimBasic(indexBytes, valueBytes)
+	_, err = issuer.Create(cfg, kOp, []claims.Claimer{claim}, storage, keyStore)
+	require.Nil(t, err)
+	is, err := issuer.Load(storage, keyStore, nil, nil, nil)
+	require.Nil(t, err)
+
+	credExist, err := is.GenCredentialExistenceGenesis(claim)
+	require.Nil(t, err)
+
+	verifier := New(idenPubOnChain)
+
+	// Good Cred Exist without any state on chain
+	err = verifier.VerifyCredentialExistence(credExist)
+	assert.Nil(t, err)
+
+	// Cred Exist has bad Id
+	credExistBad := &proof.CredentialExistence{}
+	Copy(credExistBad, credExist)
+	credExistBad.Id[4] ^= 0xff
+	err = verifier.VerifyCredentialExistence(credExistBad)
+	assert.NotNil(t, err)
+
+	// Cred Exist has bad Claim
+	credExistBad = &proof.CredentialExistence{}
+	Copy(credExistBad, credExist)
+	indexBytes[0] = 0x88
+	credExistBad.Claim = claims.NewClaimBasic(indexBytes, valueBytes).Entry()
+	err = verifier.VerifyCredentialExistence(credExistBad)
+	assert.NotNil(t, err)
+}
+
+func TestVerifySignedMsg(t *testing.T) {
+	cfg := issuer.ConfigDefault
+	cfg.GenesisOnly = true
+	storage := db.NewMemoryStorage()
+	ksStorage := keystore.MemStorage([]byte{})
+	keyStore, err := keystore.NewKeyStore(&ksStorage, keystore.LightKeyStoreParams)
+	require.Nil(t, err)
+	kOp, err := keyStore.NewKey(pass)
+	require.Nil(t, err)
+	require.Nil(t, keyStore.UnlockKey(kOp, pass))
+	indexBytes, valueBytes := [claims.IndexSlotLen]byte{}, [claims.ValueSlotLen]byte{}
+	claim := claims.NewClaimBasic(indexBytes, valueBytes)
+	_, err = issuer.Create(cfg, kOp, []claims.Claimer{claim}, storage, keyStore)
+	require.Nil(t, err)
+	is, err := issuer.Load(storage, keyStore, nil, nil, nil)
+	require.Nil(t, err)
+
+	claimKOp, err := is.ClaimKeyOperational()
+	require.Nil(t, err)
+	credExist, err := is.GenCredentialExistenceGenesis(claimKOp)
+	require.Nil(t, err)
+	domain := "login:example.com"
+	signedMsg, err := is.Sign(domain, []byte("challenge"))
+	require.Nil(t, err)
+
+	verifier := New(idenPubOnChain)
+	assert.Nil(t, verifier.VerifySignedMsgCredentialExistence(signedMsg, domain, credExist))
+
+	// Signature for another domain
+	assert.Equal(t, ErrSignedMsgDomain,
+		verifier.VerifySignedMsgCredentialExistence(signedMsg, "login:example.org", credExist))
+	signedMsgBad := *signedMsg
+	signedMsgBad.Domain = "login:example.org"
+	assert.Equal(t, ErrInvalidSignature,
+		verifier.VerifySignedMsgCredentialExistence(&signedMsgBad, signedMsgBad.Domain, credExist))
+
+	// Tampered message
+	signedMsgBad = *signedMsg
+	signedMsgBad.Msg = []byte("challenge2")
+	assert.Equal(t, ErrInvalidSignature,
+		verifier.VerifySignedMsgCredentialExistence(&signedMsgBad, domain, credExist))
+
+	// Credential of a claim that doesn't authorize a key
+	credExistClaim, err := is.GenCredentialExistenceGenesis(claim)
+	require.Nil(t, err)
+	assert.Equal(t, ErrClaimNotKeyAuthorizeKSign,
+		verifier.VerifySignedMsgCredentialExistence(signedMsg, domain, credExistClaim))
+}
+
+func TestVerifyZkProofCredentialExpiration(t *testing.T) {
+	verifier := NewWithTimeNow(idenPubOnChain, func() time.Time {
+		return time.Unix(2000, 0)
+	})
+	expiration := &zkutils.CredentialExpiration{
+		TimeNowInput:     "timeNow",
+		TimeNowSignalIdx: 1,
+		MaxDelay:         100 * time.Second,
+	}
+	pubSignals := func(timeNow int64) []*big.Int {
+		return []*big.Int{big.NewInt(0), big.NewInt(timeNow)}
+	}
+	assert.Nil(t, verifier.verifyZkProofNotExpired(pubSignals(2000), expiration))
+	assert.Nil(t, verifier.verifyZkProofNotExpired(pubSignals(1900), expiration))
+	assert.Nil(t, verifier.verifyZkProofNotExpired(pubSignals(3000), expiration))
+	assert.Equal(t, ErrClaimExpired, verifier.verifyZkProofNotExpired(pubSignals(1899), expiration))
+	assert.Equal(t, ErrZkProofTimeNowSignal, verifier.verifyZkProofNotExpired(pubSignals(2000)[:1], expiration))
+
+	// The expiration is checked before the zkp, whose vk is missing here
+	dir, err := ioutil.TempDir("", "zkfiles")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	zkFiles := zkutils.NewZkFiles("", dir, zkutils.ProvingKeyFormatJSON, zkutils.ZkFilesHashes{}, false)
+	issuerID := core.NewID([2]byte{0, 0x42}, [27]byte{0x01})
+	verify := func(circuit *ZkCircuit, pubSignals []*big.Int) error {
+		return verifier.VerifyZkProofCredentialCircuit(&zktypes.Proof{}, pubSignals, &issuerID, 0, circuit, time.Minute)
+	}
+
+	// A circuit that doesn't check the expiration only proves claims that
+	// can't expire
+	circuit := &ZkCircuit{ZkFiles: zkFiles, ClaimType: claims.NewClaimTypeNum(9999)}
+	assert.Equal(t, ErrZkCircuitExpirationUnchecked, verify(circuit, pubSignals(2000)))
+	circuit.ClaimType = claims.ClaimTypeOtherIden
+	err = verify(circuit, pubSignals(2000))
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "error loading zk vk")
+
+	circuit = &ZkCircuit{ZkFiles: zkFiles, ClaimType: claims.NewClaimTypeNum(9999), Expiration: expiration}
+	assert.Equal(t, ErrClaimExpired, verify(circuit, pubSignals(1899)))
+	assert.Equal(t, ErrZkProofTimeNowSignal, verify(circuit, pubSignals(2000)[:1]))
+	err = verify(circuit, pubSignals(2000))
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "error loading zk vk")
+
+	// The deprecated VerifyZkProofCredential doesn't check the expiration
+	err = verifier.VerifyZkProofCredential(&zktypes.Proof{}, pubSignals(1899), &issuerID, 0, zkFiles, time.Minute)
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "error loading zk vk")
+}
+
+func TestParsePolicy(t *testing.T) {
+	issuer0 := core.NewID([2]byte{0, 0x42}, [27]byte{0x01})
+	issuer1 := core.NewID([2]byte{0, 0x42}, [27]byte{0x02})
+	claimType, err := claims.NewClaimTypeNum(9999).MarshalText()
+	require.Nil(t, err)
+	policyJSON := fmt.Sprintf(`{
+		"issuers": ["%v"],
+		"trustLists": [{"name": "gov", "issuers": ["%v"]}],
+		"claimTypes": ["str:OtherIden", "%s"],
+		"schemas": ["degree"],
+		"requireSubject": true,
+		"maxFreshness": "10m",
+		"requireExpiration": true,
+		"minTimeToExpiration": "24h"
+	}`, issuer0.String(), issuer1.String(), claimType)
+	policyYAML := fmt.Sprintf(`
+issuers: ["%v"]
+trustLists:
+  - name: gov
+    issuers: ["%v"]
+claimTypes: ["str:OtherIden", "%s"]
+schemas: [degree]
+requireSubject: true
+maxFreshness: 10m
+requireExpiration: true
+minTimeToExpiration: 24h
+`, issuer0.String(), issuer1.String(), claimType)
+
+	expected := &Policy{
+		Issuers:             []core.ID{issuer0},
+		TrustLists:          []TrustList{{Name: "gov", Issuers: []core.ID{issuer1}}},
+		ClaimTypes:          []claims.ClaimType{claims.ClaimTypeOtherIden, claims.NewClaimTypeNum(9999)},
+		Schemas:             []string{"degree"},
+		RequireSubject:      true,
+		MaxFreshness:        Duration(10 * time.Minute),
+		RequireExpiration:   true,
+		MinTimeToExpiration: Duration(24 * time.Hour),
+	}
+	policy, err := ParsePolicyJSON([]byte(policyJSON))
+	require.Nil(t, err)
+	assert.Equal(t, expected, policy)
+	policy, err = ParsePolicyYAML([]byte(policyYAML))
+	require.Nil(t, err)
+	assert.Equal(t, expected, policy)
+
+	dir, err := ioutil.TempDir("", "policy")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "policy.yml"), []byte(policyYAML), 0600))
+	policy, err = LoadPolicy(filepath.Join(dir, "policy.yml"))
+	require.Nil(t, err)
+	assert.Equal(t, expected, policy)
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "policy.txt"), []byte(policyYAML), 0600))
+	_, err = LoadPolicy(filepath.Join(dir, "policy.txt"))
+	assert.Equal(t, ErrPolicyFormat, err)
+
+	_, err = ParsePolicyYAML([]byte("maxFreshness: 10 minutes"))
+	assert.NotNil(t, err)
+	_, err = ParsePolicyYAML([]byte("maxFreshnes: 10m"))
+	assert.NotNil(t, err)
+	_, err = ParsePolicyJSON([]byte(`{"maxFreshnes": "10m"}`))
+	assert.NotNil(t, err)
+}
+
+func TestVerifyWithPolicyReject(t *testing.T) {
+	verifier := NewWithTimeNow(idenPubOnChain, func() time.Time {
+		return time.Unix(3000, 0)
+	})
+	subject := core.NewID([2]byte{0, 0x42}, [27]byte{0x01})
+	other := core.NewID([2]byte{0, 0x42}, [27]byte{0x02})
+
+	claim := newClaimDemo(&subject, []byte("foo"), []byte("bar"))
+	// claimExp is a claim with expiration at T=3500
+	header := claims.ClaimHeader{
+		Type:       claims.NewClaimTypeNum(9999),
+		Subject:    claims.ClaimSubjectSelf,
+		Expiration: true,
+		Version:    false,
+	}
+	metadata := claims.NewMetadata(header)
+	metadata.Expiration = 3500
+	var entry merkletree.Entry
+	metadata.Marshal(&entry)
+	claimExp := claims.NewClaimGeneric(&entry)
+	claimSchema := claims.NewClaimPayloadRoot(&subject, claims.HashString("degree"),
+		[claims.EntryFullBytesLen]byte{}, &merkletree.HashZero)
+
+	cfg := issuer.ConfigDefault
+	cfg.GenesisOnly = true
+	storage := db.NewMemoryStorage()
+	ksStorage := keystore.MemStorage([]byte{})
+	keyStore, err := keystore.NewKeyStore(&ksStorage, keystore.LightKeyStoreParams)
+	require.Nil(t, err)
+	kOp, err := keyStore.NewKey(pass)
+	require.Nil(t, err)
+	require.Nil(t, keyStore.UnlockKey(kOp, pass))
+	_, err = issuer.Create(cfg, kOp, []claims.Claimer{claim, claimExp, claimSchema}, storage, keyStore)
+	require.Nil(t, err)
+	is, err := issuer.Load(storage, keyStore, nil, nil, nil)
+	require.Nil(t, err)
+
+	credValid := func(claim claims.Claimer) *proof.CredentialValidity {
+		credExist, err := is.GenCredentialExistenceGenesis(claim)
+		require.Nil(t, err)
+		return &proof.CredentialValidity{CredentialExistence: *credExist}
+	}
+	cred, credExp := credValid(claim), credValid(claimExp)
+
+	// Issuer
+	policy := &Policy{Issuers: []core.ID{other}}
+	assert.Equal(t, ErrPolicyIssuer, verifier.VerifyWithPolicy(policy, nil, cred))
+	policy.TrustLists = []TrustList{{Name: "gov", Issuers: []core.ID{*is.ID()}}}
+
+	// Claim type
+	policy.ClaimTypes = []claims.ClaimType{claims.ClaimTypeBasic}
+	assert.Equal(t, ErrPolicyClaimType, verifier.VerifyWithPolicy(policy, nil, cred))
+	policy.ClaimTypes = append(policy.ClaimTypes, claims.ClaimTypeOtherIden, claims.NewClaimTypeNum(9999))
+
+	// Subject
+	policy.RequireSubject = true
+	assert.Equal(t, ErrPolicySubject, verifier.VerifyWithPolicy(policy, nil, cred))
+	assert.Equal(t, ErrPolicySubject, verifier.VerifyWithPolicy(policy, &other, cred))
+	assert.Equal(t, ErrPolicySubject, verifier.VerifyWithPolicy(policy, &subject, credExp))
+	policy.RequireSubject = false
+
+	// Expiration
+	policy.RequireExpiration = true
+	assert.Equal(t, ErrPolicyExpirationRequired, verifier.VerifyWithPolicy(policy, nil, cred))
+	policy.MinTimeToExpiration = Duration(1000 * time.Second)
+	assert.Equal(t, ErrPolicyExpiresSoon, verifier.VerifyWithPolicy(policy, nil, credExp))
+
+	// Schema
+	credSchema := credValid(claimSchema)
+	credSchema.MtpNotNonce = &merkletree.Proof{Existence: true}
+	policy = &Policy{Schemas: []string{"passport"}}
+	assert.Equal(t, ErrPolicySchema, verifier.VerifyWithPolicy(policy, nil, cred))
+	assert.Equal(t, ErrPolicySchema, verifier.VerifyWithPolicy(policy, nil, credSchema))
+	policy.Schemas = append(policy.Schemas, "degree")
+	assert.Equal(t, ErrMtpExistence, verifier.VerifyWithPolicy(policy, nil, credSchema))
+
+	// Zk proofs
+	vkHash := "12a730890e85e33d8bf0f2e54db41dcff875c2dc49011d7e2a283185f47ac0de"
+	zkFiles := zkutils.NewZkFiles("", "", zkutils.ProvingKeyFormatJSON,
+		zkutils.ZkFilesHashes{VerificationKey: vkHash}, false)
+	circuit := &ZkCircuit{ZkFiles: zkFiles, ClaimType: claims.NewClaimTypeNum(9999), SubjectSignalIdx: 1}
+	assert.Equal(t, ErrZkCircuitExpirationUnchecked, verifier.RegisterZkCircuit(circuit))
+	circuit.ClaimType = claims.ClaimTypeOtherIden
+	assert.Equal(t, ErrZkCircuitVkHash, verifier.RegisterZkCircuit(&ZkCircuit{
+		ZkFiles:   zkutils.NewZkFiles("", "", zkutils.ProvingKeyFormatJSON, zkutils.ZkFilesHashes{}, false),
+		ClaimType: claims.ClaimTypeOtherIden,
+	}))
+	zkCred := &ZkProofCredential{
+		PubSignals:          []*big.Int{big.NewInt(0), subject.BigInt()},
+		IssuerID:            is.ID(),
+		VerificationKeyHash: vkHash,
+	}
+	assert.Equal(t, ErrZkCircuitUnknown, verifier.VerifyWithPolicy(&Policy{}, nil, zkCred))
+	require.Nil(t, verifier.RegisterZkCircuit(circuit))
+	policy = &Policy{Issuers: []core.ID{other}}
+	assert.Equal(t, ErrPolicyIssuer, verifier.VerifyWithPolicy(policy, nil, zkCred))
+	policy = &Policy{ClaimTypes: []claims.ClaimType{claims.ClaimTypeBasic}}
+	assert.Equal(t, ErrPolicyClaimType, verifier.VerifyWithPolicy(policy, nil, zkCred))
+	policy = &Policy{RequireSubject: true}
+	assert.Equal(t, ErrPolicySubject, verifier.VerifyWithPolicy(policy, &other, zkCred))
+	circuit.SubjectSignalIdx = 0
+	assert.Equal(t, ErrPolicySubjectNotExposed, verifier.VerifyWithPolicy(policy, &subject, zkCred))
+	policy = &Policy{Schemas: []string{"passport"}}
+	assert.Equal(t, ErrPolicySchemaNotExposed, verifier.VerifyWithPolicy(policy, nil, zkCred))
+	circuit.SchemaSignalIdx = 1
+	var schema merkletree.ElemBytes
+	schemaHash := claims.HashString("degree")
+	copy(schema[:], schemaHash[:])
+	zkCred.PubSignals[1] = schema.BigInt()
+	assert.Equal(t, ErrPolicySchema, verifier.VerifyWithPolicy(policy, nil, zkCred))
+	policy = &Policy{RequireExpiration: true, Schemas: []string{"degree"}}
+	assert.Equal(t, ErrPolicyExpirationRequired, verifier.VerifyWithPolicy(policy, nil, zkCred))
+
+	assert.Equal(t, ErrPolicyCredentialType, verifier.VerifyWithPolicy(policy, nil, &cred.CredentialExistence))
+}
+
+func TestVerifyPayloadAttribute(t *testing.T) {
+	attributes := []*claims.LeafPayloadTree{
+		claims.NewLeafPayloadTree("name", []byte("Alice")),
+		claims.NewLeafPayloadTree("degree", []byte("Computer Science")),
+	}
+	payloadTree, err := claims.NewPayloadTree(attributes)
+	require.Nil(t, err)
+
+	is, _, _ := newIssuer(t, idenPubOnChain, idenPubOffChain)
+	claim := claims.NewClaimPayloadRoot(is.ID(), claims.HashString("diploma"),
+		[claims.EntryFullBytesLen]byte{}, payloadTree.RootKey())
+	err = is.IssueClaim(claim)
+	require.Nil(t, err)
+
+	blockTs, blockN = 106000, 22
+	err = is.PublishState()
+	require.Nil(t, err)
+	idenPubOnChain.Sync()
+
+	blockTs += 20
+	blockN += 10
+	err = is.SyncIdenStatePublic()
+	require.Nil(t, err)
+
+	credExist, err := is.GenCredentialExistence(claim)
+	require.Nil(t, err)
+
+	verifier := NewWithTimeNow(idenPubOnChain, func() time.Time {
+		return time.Unix(blockTs, 0)
+	})
+
+	mtp, err := claims.GenPayloadAttributeProof(payloadTree, attributes[1])
+	require.Nil(t, err)
+	err = verifier.VerifyPayloadAttribute(credExist, attributes[1], mtp)
+	assert.Nil(t, err)
+
+	err = verifier.VerifyPayloadAttribute(credExist,
+		claims.NewLeafPayloadTree("degree", []byte("Physics")), mtp)
+	assert.Equal(t, claims.ErrPayloadRootDoesntMatch, err)
+}
+
+func TestVerifyCredentialExistenceDisclosure(t *testing.T) {
+	var attributes [claims.SaltedAttributesLen]*claims.SaltedAttribute
+	for i := range attributes {
+		var err error
+		attributes[i], err = claims.NewSaltedAttribute(big.NewInt(int64(2000 + i)))
+		require.Nil(t, err)
+	}
+
+	is, _, _ := newIssuer(t, idenPubOnChain, idenPubOffChain)
+	claim, err := claims.NewClaimSaltedAttributes(is.ID(), claims.HashString("kyc"), attributes)
+	require.Nil(t, err)
+	err = is.IssueClaim(claim)
+	require.Nil(t, err)
+
+	blockTs, blockN = 107000, 32
+	err = is.PublishState()
+	require.Nil(t, err)
+	idenPubOnChain.Sync()
+
+	blockTs += 20
+	blockN += 10
+	err = is.SyncIdenStatePublic()
+	require.Nil(t, err)
+
+	credExist, err := is.GenCredentialExistence(claim)
+	require.Nil(t, err)
+
+	verifier := NewWithTimeNow(idenPubOnChain, func() time.Time {
+		return time.Unix(blockTs, 0)
+	})
+
+	disclosed, err := claims.DiscloseSaltedAttributes(attributes, 0, 2)
+	require.Nil(t, err)
+	err = verifier.VerifyCredentialExistenceDisclosure(credExist, disclosed)
+	assert.Nil(t, err)
+
+	disclosed[1].Value = big.NewInt(42)
+	err = verifier.VerifyCredentialExistenceDisclosure(credExist, disclosed)
+	assert.Equal(t, claims.ErrDisclosedAttributeDoesntMatch, err)
+}
+
 func newHolder(t *testing.T, idenPubOnChain idenpubonchain.IdenPubOnChainer,
 	idenPubOffChainWrite idenpuboffchain.IdenPubOffChainWriter,
 	idenPubOffChainRead idenpuboffchain.IdenPubOffChainReader) (*holder.Holder, db.Storage, *keystore.KeyStore) {
@@ -234,6 +640,7 @@ func TestVerifyCredentialValidity(t *testing.T) {
 
 	// HOLDER + VERIFIER - Zero Knowledge Proof
 
+	circuitCredential := &ZkCircuit{ZkFiles: zkFilesCredential, ClaimType: claims.ClaimTypeOtherIden}
 	addInputs := func(inputs map[string]interface{}) error {
 		var metadata claims.Metadata
 		metadata.Unmarshal(credExistClaim1.Claim)
@@ -245,21 +652,40 @@ func TestVerifyCredentialValidity(t *testing.T) {
 
 		return nil
 	}
-	zkProofCredOut, err := ho.HolderGenZkProofCredential(credExistClaim1, addInputs,
-		idOwnershipLevels, issuerLevels, zkFilesCredential)
+	zkProofCredOut, err := ho.HolderGenZkProofCredentialExpiration(credExistClaim1, addInputs,
+		idOwnershipLevels, issuerLevels, zkFilesCredential, nil)
 	require.Nil(t, err)
 	require.NotNil(t, zkProofCredOut)
 
-	err = verifier.VerifyZkProofCredential(
+	err = verifier.VerifyZkProofCredentialCircuit(
 		&zkProofCredOut.ZkProofOut.Proof,
 		zkProofCredOut.ZkProofOut.PubSignals,
 		zkProofCredOut.IssuerID,
 		zkProofCredOut.IdenStateBlockN,
-		zkFilesCredential,
+		circuitCredential,
 		500*time.Second,
 	)
 	assert.Nil(t, err)
 
+	// HOLDER + VERIFIER - Policy
+
+	policy := &Policy{
+		Issuers:        []core.ID{*is.ID()},
+		ClaimTypes:     []claims.ClaimType{claims.ClaimTypeOtherIden},
+		RequireSubject: true,
+		MaxFreshness:   Duration(500 * time.Second),
+	}
+	assert.Nil(t, verifier.VerifyWithPolicy(policy, ho.ID(), credValidClaim1t1))
+	policy.RequireSubject = false
+	require.Nil(t, verifier.RegisterZkCircuit(circuitCredential))
+	assert.Nil(t, verifier.VerifyWithPolicy(policy, nil, &ZkProofCredential{
+		ZkProof:             &zkProofCredOut.ZkProofOut.Proof,
+		PubSignals:          zkProofCredOut.ZkProofOut.PubSignals,
+		IssuerID:            zkProofCredOut.IssuerID,
+		IdenStateBlockN:     zkProofCredOut.IdenStateBlockN,
+		VerificationKeyHash: zkFilesCredential.VerificationKeyHash(),
+	}))
+
 	//
 	// {Ts: 2000, BlockN: 130} -> claim2 is added
 	//
@@ -327,17 +753,17 @@ func TestVerifyCredentialValidity(t *testing.T) {
 
 		return nil
 	}
-	zkProofCredOut, err = ho.HolderGenZkProofCredential(credExistClaim2, addInputs,
-		idOwnershipLevels, issuerLevels, zkFilesCredential)
+	zkProofCredOut, err = ho.HolderGenZkProofCredentialExpiration(credExistClaim2, addInputs,
+		idOwnershipLevels, issuerLevels, zkFilesCredential, nil)
 	require.Nil(t, err)
 	require.NotNil(t, zkProofCredOut)
 
-	err = verifier.VerifyZkProofCredential(
+	err = verifier.VerifyZkProofCredentialCircuit(
 		&zkProofCredOut.ZkProofOut.Proof,
 		zkProofCredOut.ZkProofOut.PubSignals,
 		zkProofCredOut.IssuerID,
 		zkProofCredOut.IdenStateBlockN,
-		zkFilesCredential,
+		circuitCredential,
 		500*time.Second,
 	)
 	assert.Nil(t, err)
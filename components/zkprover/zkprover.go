@@ -0,0 +1,379 @@
+package zkprover
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/iden3/go-circom-prover-verifier/prover"
+	zktypes "github.com/iden3/go-circom-prover-verifier/types"
+	"github.com/iden3/go-circom-prover-verifier/verifier"
+	witnesscalc "github.com/iden3/go-circom-witnesscalc"
+	zkutils "github.com/iden3/go-iden3-core/utils/zk"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	ErrProverStopped       = fmt.Errorf("prover is stopped")
+	ErrQueueFull           = fmt.Errorf("prover job queue is full")
+	ErrFailedVerifyZkProof = fmt.Errorf("failed verifying generated zk proof")
+)
+
+// Priority of a job in the Prover queue.  Jobs with higher priority are
+// picked first; jobs with the same priority are picked in submission order.
+type Priority int
+
+const (
+	PriorityLow Priority = iota
+	PriorityNormal
+	PriorityHigh
+)
+
+// Config of the Prover.
+type Config struct {
+	// Workers is the number of proofs that can be generated concurrently.
+	Workers int
+	// QueueSize is the maximum number of jobs waiting for a worker.  0
+	// means unlimited.
+	QueueSize int
+	// MaxCircuits is the maximum number of circuits whose zk files are
+	// kept in memory.  The least recently used circuit is dropped when a
+	// job of a new one is submitted.  0 means MaxCircuitsDefault.
+	MaxCircuits int
+}
+
+// MaxCircuitsDefault is the default maximum number of circuits whose zk files
+// are kept in memory.
+const MaxCircuitsDefault = 4
+
+// ConfigDefault is a Config with a single worker, an unlimited queue and up to
+// MaxCircuitsDefault circuits in memory.
+var ConfigDefault = Config{Workers: 1, QueueSize: 0, MaxCircuits: MaxCircuitsDefault}
+
+// Metrics of a Prover.
+type Metrics struct {
+	// Queued is the number of jobs waiting for a worker.
+	Queued int
+	// Running is the number of jobs being run by a worker.
+	Running int
+	// Completed is the number of jobs that finished successfully.
+	Completed uint64
+	// Failed is the number of jobs that finished with an error.
+	Failed uint64
+	// Cancelled is the number of jobs that were discarded because their
+	// context was cancelled before a worker picked them or because the
+	// Prover was stopped.
+	Cancelled uint64
+	// WaitTime is the accumulated time that the run jobs spent in the queue.
+	WaitTime time.Duration
+	// RunTime is the accumulated time that the workers spent running jobs.
+	RunTime time.Duration
+}
+
+// Future is the result of a job submitted to the Prover.
+type Future struct {
+	done       chan struct{}
+	zkProofOut *zkutils.ZkProofOut
+	err        error
+}
+
+func newFuture() *Future {
+	return &Future{done: make(chan struct{})}
+}
+
+func (f *Future) resolve(zkProofOut *zkutils.ZkProofOut, err error) {
+	f.zkProofOut, f.err = zkProofOut, err
+	close(f.done)
+}
+
+// Done returns a channel that is closed when the job has finished.
+func (f *Future) Done() <-chan struct{} {
+	return f.done
+}
+
+// Wait blocks until the job has finished and returns its result.  If ctx is
+// cancelled before, it returns the ctx error; the job is not affected.
+func (f *Future) Wait(ctx context.Context) (*zkutils.ZkProofOut, error) {
+	select {
+	case <-f.done:
+		return f.zkProofOut, f.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+type job struct {
+	ctx      context.Context
+	priority Priority
+	seq      uint64
+	queuedAt time.Time
+	run      func() (*zkutils.ZkProofOut, error)
+	future   *Future
+}
+
+// jobQueue is a heap of jobs ordered by priority and submission order.
+type jobQueue []*job
+
+func (q jobQueue) Len() int { return len(q) }
+func (q jobQueue) Less(i, j int) bool {
+	if q[i].priority != q[j].priority {
+		return q[i].priority > q[j].priority
+	}
+	return q[i].seq < q[j].seq
+}
+func (q jobQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *jobQueue) Push(x interface{}) { *q = append(*q, x.(*job)) }
+func (q *jobQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	j := old[n-1]
+	old[n-1] = nil
+	*q = old[:n-1]
+	return j
+}
+
+// circuit holds the parsed zk files of a circuit, so that they are loaded
+// only once no matter how many jobs use them.  The proving key is only kept
+// if the zk files cache it (see zkutils.ZkFiles.CacheProvingKey); otherwise
+// it's loaded for every job and dropped afterwards.
+type circuit struct {
+	m    sync.Mutex
+	pk   *zktypes.Pk
+	vk   *zktypes.Vk
+	wasm []byte
+	// used is the Prover sequence number at the last use of the circuit,
+	// protected by the Prover mutex.
+	used uint64
+}
+
+func (c *circuit) load(zkFiles *zkutils.ZkFiles) (*zktypes.Pk, *zktypes.Vk, []byte, error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.vk == nil {
+		vk, err := zkFiles.VerificationKey()
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("error loading zk vk: %w", err)
+		}
+		wasm, err := zkFiles.WitnessCalcWASM()
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("error loading zk witnessCalc WASM: %w", err)
+		}
+		c.vk, c.wasm = vk, wasm
+	}
+	if c.pk != nil {
+		return c.pk, c.vk, c.wasm, nil
+	}
+	pk, err := zkFiles.ProvingKey()
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("error loading zk pk: %w", err)
+	}
+	if zkFiles.CacheProvingKey() {
+		c.pk = pk
+	}
+	return pk, c.vk, c.wasm, nil
+}
+
+// Prover is a zk proof generation service with a bounded pool of workers
+// and a priority queue of jobs.  A process hosting many identities should
+// share a single Prover among them so that the CPU and memory used by the
+// proof generation stays bounded.  The zk files of each circuit are kept in
+// memory once, shared by all the jobs of that circuit, for up to
+// Config.MaxCircuits circuits.
+type Prover struct {
+	cfg      Config
+	m        sync.Mutex
+	cond     *sync.Cond
+	queue    jobQueue
+	seq      uint64
+	stopped  bool
+	metrics  Metrics
+	circuits map[string]*circuit
+	wg       sync.WaitGroup
+}
+
+// New creates a new Prover and starts its workers.
+func New(cfg Config) *Prover {
+	if cfg.Workers < 1 {
+		cfg.Workers = 1
+	}
+	if cfg.MaxCircuits < 1 {
+		cfg.MaxCircuits = MaxCircuitsDefault
+	}
+	p := &Prover{
+		cfg:      cfg,
+		circuits: make(map[string]*circuit),
+	}
+	p.cond = sync.NewCond(&p.m)
+	for i := 0; i < cfg.Workers; i++ {
+		p.wg.Add(1)
+		go p.worker()
+	}
+	return p
+}
+
+// Stop the Prover.  The queued jobs are resolved with ErrProverStopped, and
+// Stop waits for the running jobs to finish.
+func (p *Prover) Stop() {
+	p.m.Lock()
+	if p.stopped {
+		p.m.Unlock()
+		return
+	}
+	p.stopped = true
+	queue := p.queue
+	p.queue = nil
+	p.metrics.Queued = 0
+	p.metrics.Cancelled += uint64(len(queue))
+	p.cond.Broadcast()
+	p.m.Unlock()
+	for _, j := range queue {
+		j.future.resolve(nil, ErrProverStopped)
+	}
+	p.wg.Wait()
+}
+
+// Metrics returns a snapshot of the Prover metrics.
+func (p *Prover) Metrics() Metrics {
+	p.m.Lock()
+	defer p.m.Unlock()
+	return p.metrics
+}
+
+func (p *Prover) worker() {
+	defer p.wg.Done()
+	for {
+		p.m.Lock()
+		for len(p.queue) == 0 && !p.stopped {
+			p.cond.Wait()
+		}
+		if p.stopped {
+			p.m.Unlock()
+			return
+		}
+		j := heap.Pop(&p.queue).(*job)
+		p.metrics.Queued--
+		if err := j.ctx.Err(); err != nil {
+			p.metrics.Cancelled++
+			p.m.Unlock()
+			j.future.resolve(nil, err)
+			continue
+		}
+		p.metrics.Running++
+		p.metrics.WaitTime += time.Since(j.queuedAt)
+		p.m.Unlock()
+
+		start := time.Now()
+		zkProofOut, err := j.run()
+		elapsed := time.Since(start)
+
+		p.m.Lock()
+		p.metrics.Running--
+		p.metrics.RunTime += elapsed
+		if err != nil {
+			p.metrics.Failed++
+		} else {
+			p.metrics.Completed++
+		}
+		p.m.Unlock()
+		j.future.resolve(zkProofOut, err)
+	}
+}
+
+// SubmitFunc queues a job that runs f in a worker.  If ctx is cancelled
+// before a worker picks the job, the job is discarded and its Future
+// resolves with the ctx error.
+func (p *Prover) SubmitFunc(ctx context.Context, priority Priority,
+	f func() (*zkutils.ZkProofOut, error)) (*Future, error) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	if p.stopped {
+		return nil, ErrProverStopped
+	}
+	if p.cfg.QueueSize > 0 && len(p.queue) >= p.cfg.QueueSize {
+		return nil, ErrQueueFull
+	}
+	j := &job{
+		ctx:      ctx,
+		priority: priority,
+		seq:      p.seq,
+		queuedAt: time.Now(),
+		run:      f,
+		future:   newFuture(),
+	}
+	p.seq++
+	heap.Push(&p.queue, j)
+	p.metrics.Queued++
+	p.cond.Signal()
+	return j.future, nil
+}
+
+// circuit returns the circuit of zkFiles, creating it if necessary and
+// dropping the least recently used one if there are already
+// cfg.MaxCircuits.  Circuits are identified by the path of their zk files.
+// The jobs of a dropped circuit keep using it until they finish.
+func (p *Prover) circuit(zkFiles *zkutils.ZkFiles) *circuit {
+	p.m.Lock()
+	defer p.m.Unlock()
+	c, ok := p.circuits[zkFiles.Path]
+	if !ok {
+		if len(p.circuits) >= p.cfg.MaxCircuits {
+			var lruPath string
+			var lru *circuit
+			for path, c := range p.circuits {
+				if lru == nil || c.used < lru.used {
+					lruPath, lru = path, c
+				}
+			}
+			delete(p.circuits, lruPath)
+		}
+		c = &circuit{}
+		p.circuits[zkFiles.Path] = c
+	}
+	c.used = p.seq
+	p.seq++
+	return c
+}
+
+// Submit queues a job that calculates the witness and generates the zk
+// proof of the circuit described by zkFiles with the inputs.  The generated
+// proof is verified before resolving the Future.
+func (p *Prover) Submit(ctx context.Context, priority Priority, zkFiles *zkutils.ZkFiles,
+	inputs map[string]interface{}) (*Future, error) {
+	c := p.circuit(zkFiles)
+	return p.SubmitFunc(ctx, priority, func() (*zkutils.ZkProofOut, error) {
+		pk, vk, wasm, err := c.load(zkFiles)
+		if err != nil {
+			return nil, err
+		}
+		wit, err := witnesscalc.CalculateWitnessBinWASM(wasm, inputs)
+		if err != nil {
+			return nil, err
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		start := time.Now()
+		proof, pubSignals, err := prover.GenerateProof(pk, wit)
+		if err != nil {
+			return nil, err
+		}
+		// Verify zk proof
+		if !verifier.Verify(vk, proof, pubSignals) {
+			return nil, ErrFailedVerifyZkProof
+		}
+		log.WithField("elapsed", time.Since(start)).Debug("Proof generated")
+		return &zkutils.ZkProofOut{Proof: *proof, PubSignals: pubSignals}, nil
+	})
+}
+
+// Prove submits a zk proof job and waits for its result.
+func (p *Prover) Prove(ctx context.Context, priority Priority, zkFiles *zkutils.ZkFiles,
+	inputs map[string]interface{}) (*zkutils.ZkProofOut, error) {
+	future, err := p.Submit(ctx, priority, zkFiles, inputs)
+	if err != nil {
+		return nil, err
+	}
+	return future.Wait(ctx)
+}
@@ -0,0 +1,183 @@
+package zkprover
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	zkutils "github.com/iden3/go-iden3-core/utils/zk"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// keepBusy submits a job that blocks a worker until the returned function is
+// called.
+func keepBusy(t *testing.T, p *Prover) func() {
+	release := make(chan struct{})
+	busy := make(chan struct{})
+	_, err := p.SubmitFunc(context.Background(), PriorityHigh, func() (*zkutils.ZkProofOut, error) {
+		close(busy)
+		<-release
+		return nil, nil
+	})
+	require.Nil(t, err)
+	<-busy
+	return func() { close(release) }
+}
+
+func TestProverWorkers(t *testing.T) {
+	p := New(Config{Workers: 2})
+	defer p.Stop()
+
+	var m sync.Mutex
+	running, maxRunning := 0, 0
+	futures := []*Future{}
+	for i := 0; i < 6; i++ {
+		future, err := p.SubmitFunc(context.Background(), PriorityNormal, func() (*zkutils.ZkProofOut, error) {
+			m.Lock()
+			running++
+			if running > maxRunning {
+				maxRunning = running
+			}
+			m.Unlock()
+			time.Sleep(10 * time.Millisecond)
+			m.Lock()
+			running--
+			m.Unlock()
+			return &zkutils.ZkProofOut{}, nil
+		})
+		require.Nil(t, err)
+		futures = append(futures, future)
+	}
+	for _, future := range futures {
+		zkProofOut, err := future.Wait(context.Background())
+		require.Nil(t, err)
+		assert.NotNil(t, zkProofOut)
+	}
+	assert.Equal(t, 2, maxRunning)
+
+	metrics := p.Metrics()
+	assert.Equal(t, 0, metrics.Queued)
+	assert.Equal(t, 0, metrics.Running)
+	assert.Equal(t, uint64(6), metrics.Completed)
+	assert.True(t, metrics.RunTime >= 60*time.Millisecond)
+}
+
+func TestProverPriority(t *testing.T) {
+	p := New(Config{Workers: 1})
+	defer p.Stop()
+
+	release := keepBusy(t, p)
+	var m sync.Mutex
+	order := []string{}
+	submit := func(name string, priority Priority) *Future {
+		future, err := p.SubmitFunc(context.Background(), priority, func() (*zkutils.ZkProofOut, error) {
+			m.Lock()
+			order = append(order, name)
+			m.Unlock()
+			return nil, nil
+		})
+		require.Nil(t, err)
+		return future
+	}
+	futures := []*Future{
+		submit("low", PriorityLow),
+		submit("normal0", PriorityNormal),
+		submit("high", PriorityHigh),
+		submit("normal1", PriorityNormal),
+	}
+	assert.Equal(t, 4, p.Metrics().Queued)
+	release()
+	for _, future := range futures {
+		<-future.Done()
+	}
+	assert.Equal(t, []string{"high", "normal0", "normal1", "low"}, order)
+}
+
+func TestProverCancel(t *testing.T) {
+	p := New(Config{Workers: 1, QueueSize: 2})
+	defer p.Stop()
+
+	release := keepBusy(t, p)
+	ctx, cancel := context.WithCancel(context.Background())
+	run := false
+	future, err := p.SubmitFunc(ctx, PriorityNormal, func() (*zkutils.ZkProofOut, error) {
+		run = true
+		return nil, nil
+	})
+	require.Nil(t, err)
+	errFailed := fmt.Errorf("failed")
+	futureFailed, err := p.SubmitFunc(context.Background(), PriorityLow, func() (*zkutils.ZkProofOut, error) {
+		return nil, errFailed
+	})
+	require.Nil(t, err)
+	_, err = p.SubmitFunc(context.Background(), PriorityNormal, func() (*zkutils.ZkProofOut, error) {
+		return nil, nil
+	})
+	assert.Equal(t, ErrQueueFull, err)
+
+	// Waiting can be abandoned without affecting the job
+	waitCtx, waitCancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer waitCancel()
+	_, err = futureFailed.Wait(waitCtx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	cancel()
+	release()
+	_, err = future.Wait(context.Background())
+	assert.Equal(t, context.Canceled, err)
+	assert.False(t, run)
+	_, err = futureFailed.Wait(context.Background())
+	assert.Equal(t, errFailed, err)
+
+	metrics := p.Metrics()
+	assert.Equal(t, uint64(1), metrics.Completed)
+	assert.Equal(t, uint64(1), metrics.Failed)
+	assert.Equal(t, uint64(1), metrics.Cancelled)
+}
+
+func TestProverStop(t *testing.T) {
+	p := New(Config{Workers: 1})
+
+	release := keepBusy(t, p)
+	future, err := p.SubmitFunc(context.Background(), PriorityNormal, func() (*zkutils.ZkProofOut, error) {
+		return nil, nil
+	})
+	require.Nil(t, err)
+	stopped := make(chan struct{})
+	go func() {
+		p.Stop()
+		close(stopped)
+	}()
+	_, err = future.Wait(context.Background())
+	assert.Equal(t, ErrProverStopped, err)
+	release()
+	<-stopped
+
+	_, err = p.SubmitFunc(context.Background(), PriorityNormal, func() (*zkutils.ZkProofOut, error) {
+		return nil, nil
+	})
+	assert.Equal(t, ErrProverStopped, err)
+	assert.Equal(t, uint64(1), p.Metrics().Completed)
+	assert.Equal(t, uint64(1), p.Metrics().Cancelled)
+}
+
+func TestProverCircuits(t *testing.T) {
+	p := New(Config{Workers: 1, MaxCircuits: 2})
+	defer p.Stop()
+
+	zkFiles := func(path string) *zkutils.ZkFiles {
+		return zkutils.NewZkFiles("", path, zkutils.ProvingKeyFormatJSON, zkutils.ZkFilesHashes{}, false)
+	}
+	circuitA := p.circuit(zkFiles("a"))
+	circuitB := p.circuit(zkFiles("b"))
+	assert.True(t, circuitA == p.circuit(zkFiles("a")))
+
+	// The least recently used circuit is dropped
+	p.circuit(zkFiles("c"))
+	assert.Equal(t, 2, len(p.circuits))
+	assert.True(t, circuitA == p.circuit(zkFiles("a")))
+	assert.False(t, circuitB == p.circuit(zkFiles("b")))
+}
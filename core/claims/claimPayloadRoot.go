@@ -0,0 +1,181 @@
+package claims
+
+import (
+	"fmt"
+
+	"github.com/iden3/go-iden3-core/core"
+	"github.com/iden3/go-iden3-core/crypto"
+	"github.com/iden3/go-iden3-core/db"
+	"github.com/iden3/go-iden3-core/merkletree"
+)
+
+var (
+	// ErrPayloadAttributeNotFound is used when an attribute is not found in the payload tree.
+	ErrPayloadAttributeNotFound = fmt.Errorf("attribute not found in the payload tree")
+	// ErrPayloadRootDoesntMatch is used when the root calculated from an
+	// attribute proof doesn't match the root in the claim.
+	ErrPayloadRootDoesntMatch = fmt.Errorf("calculated payload tree root doesn't match the one in the claim")
+)
+
+// PayloadTreeMaxLevels is the maximum number of levels used for the payload
+// merkle trees built with NewPayloadTree.
+const PayloadTreeMaxLevels = 140
+
+// ClaimPayloadRoot is a claim about a subject identity whose value commits
+// to the root of a separate merkle tree (the payload tree) that holds an
+// arbitrary number of attributes.  This allows issuing claims about
+// documents that don't fit in the claim entry.
+type ClaimPayloadRoot struct {
+	metadata Metadata
+	// Schema identifies the kind of payload (for example, the hash of the
+	// schema name obtained with HashString).
+	Schema [EntryFullBytesLen]byte
+	// IndexSlot is data that goes into the remaining space used for the
+	// index, and can be used to distinguish multiple payloads of the same
+	// schema for the same subject.
+	IndexSlot [EntryFullBytesLen]byte
+	// Root is the root of the payload tree.
+	Root merkletree.Hash
+}
+
+// NewClaimPayloadRoot returns a ClaimPayloadRoot for the subject with the
+// root of the payload tree.
+func NewClaimPayloadRoot(subject *core.ID, schema, indexSlot [EntryFullBytesLen]byte,
+	root *merkletree.Hash) *ClaimPayloadRoot {
+	metadata := NewMetadata(ClaimHeaderPayloadRoot)
+	metadata.Subject = subject
+	return &ClaimPayloadRoot{
+		metadata:  metadata,
+		Schema:    schema,
+		IndexSlot: indexSlot,
+		Root:      *root,
+	}
+}
+
+// NewClaimPayloadRootFromEntry deserializes a ClaimPayloadRoot from an Entry.
+func NewClaimPayloadRootFromEntry(e *merkletree.Entry) *ClaimPayloadRoot {
+	c := &ClaimPayloadRoot{}
+	c.metadata.Unmarshal(e)
+	copy(c.Schema[:], e.Index()[2][:EntryFullBytesLen])
+	copy(c.IndexSlot[:], e.Index()[3][:EntryFullBytesLen])
+	c.Root = merkletree.Hash(e.Value()[1])
+	return c
+}
+
+// Entry serializes the claim into an Entry.
+func (c *ClaimPayloadRoot) Entry() *merkletree.Entry {
+	e := &merkletree.Entry{}
+	copy(e.Index()[2][:], c.Schema[:])
+	copy(e.Index()[3][:], c.IndexSlot[:])
+	e.Value()[1] = merkletree.ElemBytes(c.Root)
+	c.metadata.Marshal(e)
+	return e
+}
+
+func (c *ClaimPayloadRoot) Metadata() *Metadata {
+	return &c.metadata
+}
+
+// LeafPayloadTree is an attribute of a payload, stored as a leaf in the
+// payload tree.  The index of the leaf is the hash of the attribute name, so
+// each name can only appear once in a payload tree.
+type LeafPayloadTree struct {
+	Name  string
+	Value []byte
+}
+
+// NewLeafPayloadTree returns a LeafPayloadTree with the provided name and value.
+func NewLeafPayloadTree(name string, value []byte) *LeafPayloadTree {
+	return &LeafPayloadTree{
+		Name:  name,
+		Value: value,
+	}
+}
+
+// Entry serializes the leaf into an Entry.  The value is committed by its
+// hash, so it can be of arbitrary length.
+func (l *LeafPayloadTree) Entry() *merkletree.Entry {
+	e := &merkletree.Entry{}
+	nameHash := HashString(l.Name)
+	copy(e.Index()[0][:], nameHash[:])
+	valueHash := crypto.HashBytes(l.Value)
+	copy(e.Value()[0][:], valueHash[len(valueHash)-EntryFullBytesLen:])
+	return e
+}
+
+// AddLeafPayloadTree adds a new leaf to the given MerkleTree, which contains
+// the attribute name and value.
+func AddLeafPayloadTree(mt *merkletree.MerkleTree, name string, value []byte) error {
+	l := NewLeafPayloadTree(name, value)
+	return mt.AddEntry(l.Entry())
+}
+
+// NewPayloadTree builds a payload tree in memory storage containing the given
+// attributes.
+func NewPayloadTree(attributes []*LeafPayloadTree) (*merkletree.MerkleTree, error) {
+	mt, err := merkletree.NewMerkleTree(db.NewMemoryStorage(), PayloadTreeMaxLevels)
+	if err != nil {
+		return nil, err
+	}
+	for _, attribute := range attributes {
+		if err := mt.AddEntry(attribute.Entry()); err != nil {
+			return nil, fmt.Errorf("error adding attribute %v: %w", attribute.Name, err)
+		}
+	}
+	return mt, nil
+}
+
+// GenPayloadAttributeProof generates a proof of existence of a single
+// attribute in the payload tree.  The attribute value must match the one in
+// the tree.
+func GenPayloadAttributeProof(mt *merkletree.MerkleTree,
+	attribute *LeafPayloadTree) (*merkletree.Proof, error) {
+	hi, hv, err := attribute.Entry().HiHv()
+	if err != nil {
+		return nil, err
+	}
+	data, err := mt.GetDataByIndex(hi)
+	if err == merkletree.ErrEntryIndexNotFound {
+		return nil, ErrPayloadAttributeNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	// Entry.Equal only compares the index, so compare the value hash.
+	foundEntry := &merkletree.Entry{Data: *data}
+	foundHv, err := foundEntry.HValue()
+	if err != nil {
+		return nil, err
+	}
+	if !foundHv.Equals(hv) {
+		return nil, merkletree.ErrEntryDataNotMatch
+	}
+	return mt.GenerateProof(hi, nil)
+}
+
+// VerifyPayloadAttribute verifies that the attribute with its proof of
+// existence belongs to the payload tree committed in the claim.  The claim
+// itself is not verified against the issuer identity state.
+func VerifyPayloadAttribute(claim *merkletree.Entry, attribute *LeafPayloadTree,
+	mtp *merkletree.Proof) error {
+	var metadata Metadata
+	metadata.Unmarshal(claim)
+	if metadata.Type() != ClaimTypePayloadRoot {
+		return ErrInvalidClaimType
+	}
+	if !mtp.Existence {
+		return ErrPayloadAttributeNotFound
+	}
+	c := NewClaimPayloadRootFromEntry(claim)
+	hi, hv, err := attribute.Entry().HiHv()
+	if err != nil {
+		return err
+	}
+	root, err := merkletree.RootFromProof(mtp, hi, hv)
+	if err != nil {
+		return err
+	}
+	if !root.Equals(&c.Root) {
+		return ErrPayloadRootDoesntMatch
+	}
+	return nil
+}
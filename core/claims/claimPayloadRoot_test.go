@@ -0,0 +1,56 @@
+package claims
+
+import (
+	"testing"
+
+	"github.com/iden3/go-iden3-core/core"
+	"github.com/iden3/go-iden3-core/merkletree"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClaimPayloadRoot(t *testing.T) {
+	attributes := []*LeafPayloadTree{
+		NewLeafPayloadTree("name", []byte("Alice")),
+		NewLeafPayloadTree("degree", []byte("Computer Science")),
+		NewLeafPayloadTree("thesis", make([]byte, 4096)),
+	}
+	payloadTree, err := NewPayloadTree(attributes)
+	require.Nil(t, err)
+
+	id := core.NewID([2]byte{0, 0x42}, [27]byte{})
+	var indexSlot [EntryFullBytesLen]byte
+	indexSlot[0] = 0x01
+	c0 := NewClaimPayloadRoot(&id, HashString("diploma"), indexSlot, payloadTree.RootKey())
+	c0.Metadata().RevNonce = 5678
+	e := c0.Entry()
+	dataTestOutput(&e.Data)
+	c1 := NewClaimPayloadRootFromEntry(e)
+	c2, err := NewClaimFromEntry(e)
+	assert.Nil(t, err)
+	assert.Equal(t, c0, c1)
+	assert.Equal(t, c0.Metadata(), c1.Metadata())
+	assert.Equal(t, c0, c2)
+	assert.True(t, merkletree.CheckEntryInField(*e))
+
+	// Prove and verify a single attribute
+	mtp, err := GenPayloadAttributeProof(payloadTree, attributes[1])
+	require.Nil(t, err)
+	assert.Nil(t, VerifyPayloadAttribute(e, attributes[1], mtp))
+
+	// Attribute with a different value
+	assert.Equal(t, ErrPayloadRootDoesntMatch,
+		VerifyPayloadAttribute(e, NewLeafPayloadTree("degree", []byte("Physics")), mtp))
+	_, err = GenPayloadAttributeProof(payloadTree, NewLeafPayloadTree("degree", []byte("Physics")))
+	assert.Equal(t, merkletree.ErrEntryDataNotMatch, err)
+
+	// Attribute not in the payload tree
+	_, err = GenPayloadAttributeProof(payloadTree, NewLeafPayloadTree("grade", []byte("A")))
+	assert.Equal(t, ErrPayloadAttributeNotFound, err)
+
+	// Claim of a different type
+	var indexBytes [IndexSlotLen]byte
+	var valueBytes [ValueSlotLen]byte
+	assert.Equal(t, ErrInvalidClaimType,
+		VerifyPayloadAttribute(NewClaimBasic(indexBytes, valueBytes).Entry(), attributes[1], mtp))
+}
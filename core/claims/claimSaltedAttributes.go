@@ -0,0 +1,159 @@
+package claims
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+
+	"github.com/iden3/go-iden3-core/core"
+	"github.com/iden3/go-iden3-core/merkletree"
+	"github.com/iden3/go-iden3-crypto/constants"
+	"github.com/iden3/go-iden3-crypto/poseidon"
+)
+
+var (
+	// ErrDisclosedAttributeDoesntMatch is used when a disclosed attribute
+	// doesn't match the commitment in the claim.
+	ErrDisclosedAttributeDoesntMatch = fmt.Errorf("disclosed attribute doesn't match the commitment in the claim")
+	// ErrDisclosedAttributePos is used when the position of a disclosed
+	// attribute is out of range.
+	ErrDisclosedAttributePos = fmt.Errorf("disclosed attribute position out of range")
+)
+
+// SaltedAttributesLen is the number of attributes stored in a
+// ClaimSaltedAttributes.
+const SaltedAttributesLen = 4
+
+// SaltedAttribute is an attribute value with the salt used to commit to it.
+// The commitment is Poseidon(Value, Salt).
+type SaltedAttribute struct {
+	Value *big.Int
+	Salt  *big.Int
+}
+
+// NewSaltedAttribute returns a SaltedAttribute of value with a random salt.
+func NewSaltedAttribute(value *big.Int) (*SaltedAttribute, error) {
+	salt, err := rand.Int(rand.Reader, constants.Q)
+	if err != nil {
+		return nil, err
+	}
+	return &SaltedAttribute{Value: value, Salt: salt}, nil
+}
+
+// Commitment returns the salted Poseidon commitment of the attribute.
+func (a *SaltedAttribute) Commitment() (*merkletree.Hash, error) {
+	toHash := [poseidon.T]*big.Int{a.Value, a.Salt, big.NewInt(0), big.NewInt(0), big.NewInt(0), big.NewInt(0)}
+	h, err := poseidon.PoseidonHash(toHash)
+	if err != nil {
+		return nil, err
+	}
+	return merkletree.NewHashFromBigInt(h), nil
+}
+
+// DisclosedAttribute is a SaltedAttribute opened by the holder together with
+// its position in the claim.
+type DisclosedAttribute struct {
+	Pos int
+	SaltedAttribute
+}
+
+// ClaimSaltedAttributes is a claim about a subject identity where each
+// attribute is stored as a salted commitment.  This allows the holder to
+// disclose a subset of the attributes to a verifier without revealing the
+// rest.
+type ClaimSaltedAttributes struct {
+	metadata Metadata
+	// Schema identifies the kind of attributes (for example, the hash of
+	// the schema name obtained with HashString).
+	Schema [EntryFullBytesLen]byte
+	// Commitments are the salted commitments of the attributes.  The
+	// first one goes in the index, the rest in the value.
+	Commitments [SaltedAttributesLen]merkletree.Hash
+}
+
+// NewClaimSaltedAttributes returns a ClaimSaltedAttributes for the subject
+// with the commitments of the attributes.
+func NewClaimSaltedAttributes(subject *core.ID, schema [EntryFullBytesLen]byte,
+	attributes [SaltedAttributesLen]*SaltedAttribute) (*ClaimSaltedAttributes, error) {
+	metadata := NewMetadata(ClaimHeaderSaltedAttributes)
+	metadata.Subject = subject
+	c := &ClaimSaltedAttributes{
+		metadata: metadata,
+		Schema:   schema,
+	}
+	for i, attribute := range attributes {
+		commitment, err := attribute.Commitment()
+		if err != nil {
+			return nil, fmt.Errorf("error calculating commitment of attribute %v: %w", i, err)
+		}
+		c.Commitments[i] = *commitment
+	}
+	return c, nil
+}
+
+// NewClaimSaltedAttributesFromEntry deserializes a ClaimSaltedAttributes from an Entry.
+func NewClaimSaltedAttributesFromEntry(e *merkletree.Entry) *ClaimSaltedAttributes {
+	c := &ClaimSaltedAttributes{}
+	c.metadata.Unmarshal(e)
+	copy(c.Schema[:], e.Index()[2][:EntryFullBytesLen])
+	c.Commitments[0] = merkletree.Hash(e.Index()[3])
+	for i := 1; i < SaltedAttributesLen; i++ {
+		c.Commitments[i] = merkletree.Hash(e.Value()[i])
+	}
+	return c
+}
+
+// Entry serializes the claim into an Entry.
+func (c *ClaimSaltedAttributes) Entry() *merkletree.Entry {
+	e := &merkletree.Entry{}
+	copy(e.Index()[2][:], c.Schema[:])
+	e.Index()[3] = merkletree.ElemBytes(c.Commitments[0])
+	for i := 1; i < SaltedAttributesLen; i++ {
+		e.Value()[i] = merkletree.ElemBytes(c.Commitments[i])
+	}
+	c.metadata.Marshal(e)
+	return e
+}
+
+func (c *ClaimSaltedAttributes) Metadata() *Metadata {
+	return &c.metadata
+}
+
+// DiscloseSaltedAttributes returns the attributes at the positions to be
+// revealed to a verifier.
+func DiscloseSaltedAttributes(attributes [SaltedAttributesLen]*SaltedAttribute,
+	positions ...int) ([]DisclosedAttribute, error) {
+	disclosed := make([]DisclosedAttribute, len(positions))
+	for i, pos := range positions {
+		if pos < 0 || pos >= SaltedAttributesLen {
+			return nil, ErrDisclosedAttributePos
+		}
+		disclosed[i] = DisclosedAttribute{Pos: pos, SaltedAttribute: *attributes[pos]}
+	}
+	return disclosed, nil
+}
+
+// VerifyDisclosedAttributes verifies that the disclosed attributes match the
+// commitments in the claim.  The claim itself is not verified against the
+// issuer identity state.
+func VerifyDisclosedAttributes(claim *merkletree.Entry, disclosed []DisclosedAttribute) error {
+	var metadata Metadata
+	metadata.Unmarshal(claim)
+	if metadata.Type() != ClaimTypeSaltedAttributes {
+		return ErrInvalidClaimType
+	}
+	c := NewClaimSaltedAttributesFromEntry(claim)
+	for _, attribute := range disclosed {
+		if attribute.Pos < 0 || attribute.Pos >= SaltedAttributesLen {
+			return ErrDisclosedAttributePos
+		}
+		commitment, err := attribute.Commitment()
+		if err != nil {
+			return err
+		}
+		if !commitment.Equals(&c.Commitments[attribute.Pos]) {
+			return ErrDisclosedAttributeDoesntMatch
+		}
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package claims
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/iden3/go-iden3-core/core"
+	"github.com/iden3/go-iden3-core/merkletree"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClaimSaltedAttributes(t *testing.T) {
+	var attributes [SaltedAttributesLen]*SaltedAttribute
+	for i := range attributes {
+		var err error
+		attributes[i], err = NewSaltedAttribute(big.NewInt(int64(1000 + i)))
+		require.Nil(t, err)
+	}
+
+	id := core.NewID([2]byte{0, 0x42}, [27]byte{})
+	c0, err := NewClaimSaltedAttributes(&id, HashString("kyc"), attributes)
+	require.Nil(t, err)
+	c0.Metadata().RevNonce = 5678
+	e := c0.Entry()
+	dataTestOutput(&e.Data)
+	c1 := NewClaimSaltedAttributesFromEntry(e)
+	c2, err := NewClaimFromEntry(e)
+	assert.Nil(t, err)
+	assert.Equal(t, c0, c1)
+	assert.Equal(t, c0.Metadata(), c1.Metadata())
+	assert.Equal(t, c0, c2)
+	assert.True(t, merkletree.CheckEntryInField(*e))
+
+	// Disclose a subset of the attributes
+	disclosed, err := DiscloseSaltedAttributes(attributes, 1, 3)
+	require.Nil(t, err)
+	assert.Nil(t, VerifyDisclosedAttributes(e, disclosed))
+
+	// Disclosed attribute with a different value
+	disclosed[1].Value = big.NewInt(42)
+	assert.Equal(t, ErrDisclosedAttributeDoesntMatch, VerifyDisclosedAttributes(e, disclosed))
+
+	// Disclosed attribute at a different position
+	disclosed, err = DiscloseSaltedAttributes(attributes, 2)
+	require.Nil(t, err)
+	disclosed[0].Pos = 0
+	assert.Equal(t, ErrDisclosedAttributeDoesntMatch, VerifyDisclosedAttributes(e, disclosed))
+	disclosed[0].Pos = SaltedAttributesLen
+	assert.Equal(t, ErrDisclosedAttributePos, VerifyDisclosedAttributes(e, disclosed))
+
+	_, err = DiscloseSaltedAttributes(attributes, SaltedAttributesLen)
+	assert.Equal(t, ErrDisclosedAttributePos, err)
+}
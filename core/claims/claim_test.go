@@ -153,6 +153,12 @@ func TestMetadata(t *testing.T) {
 	}
 }
 
+func TestClaimTypeExpirable(t *testing.T) {
+	assert.False(t, ClaimTypeExpirable(ClaimTypeBasic))
+	assert.False(t, ClaimTypeExpirable(ClaimTypeOtherIden))
+	assert.True(t, ClaimTypeExpirable(NewClaimTypeNum(42)))
+}
+
 // TODO: Update to new claim spec.
 //func TestForwardingInterop(t *testing.T) {
 //
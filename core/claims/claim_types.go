@@ -24,6 +24,16 @@ var (
 	ClaimTypeOtherIden       = NewClaimTypeNum(2)
 	ClaimTypeStringOtherIden = "OtherIden"
 
+	// ClaimTypePayloadRoot is a claim type that commits to the root of a
+	// payload tree with attributes about a subject identity.
+	ClaimTypePayloadRoot       = NewClaimTypeNum(3)
+	ClaimTypeStringPayloadRoot = "PayloadRoot"
+
+	// ClaimTypeSaltedAttributes is a claim type with salted commitments of
+	// attributes about a subject identity, used for selective disclosure.
+	ClaimTypeSaltedAttributes       = NewClaimTypeNum(4)
+	ClaimTypeStringSaltedAttributes = "SaltedAttributes"
+
 // 	// ClaimTypeSetRootKey is a claim type of the root key of a merkle tree that goes into the relay.
 // 	ClaimTypeSetRootKey = NewClaimTypeNum(2)
 // 	// ClaimTypeAssignName is a claim type to assign a name to an ID
@@ -51,6 +61,10 @@ func (ct ClaimType) MarshalText() ([]byte, error) {
 		str = fmt.Sprintf("str:%v", ClaimTypeStringKeyBabyJub)
 	case ClaimTypeOtherIden:
 		str = fmt.Sprintf("str:%v", ClaimTypeStringOtherIden)
+	case ClaimTypePayloadRoot:
+		str = fmt.Sprintf("str:%v", ClaimTypeStringPayloadRoot)
+	case ClaimTypeSaltedAttributes:
+		str = fmt.Sprintf("str:%v", ClaimTypeStringSaltedAttributes)
 	default:
 		str = fmt.Sprintf("hex:%v", common.Hex(ct[:]))
 	}
@@ -68,6 +82,10 @@ func (ct *ClaimType) UnmarshalText(b []byte) error {
 			*ct = ClaimTypeKeyBabyJub
 		case ClaimTypeStringOtherIden:
 			*ct = ClaimTypeOtherIden
+		case ClaimTypeStringPayloadRoot:
+			*ct = ClaimTypePayloadRoot
+		case ClaimTypeStringSaltedAttributes:
+			*ct = ClaimTypeSaltedAttributes
 		default:
 			return fmt.Errorf("Unknown ClaimType str:%v", str)
 		}
@@ -106,6 +124,12 @@ func NewClaimFromEntry(e *merkletree.Entry) (merkletree.Entrier, error) {
 	case ClaimTypeOtherIden:
 		c := NewClaimOtherIdenFromEntry(e)
 		return c, nil
+	case ClaimTypePayloadRoot:
+		c := NewClaimPayloadRootFromEntry(e)
+		return c, nil
+	case ClaimTypeSaltedAttributes:
+		c := NewClaimSaltedAttributesFromEntry(e)
+		return c, nil
 	// case *ClaimTypeSetRootKey:
 	// 	c := NewClaimSetRootKeyFromEntry(e)
 	// 	return c, nil
@@ -145,8 +169,39 @@ var (
 		SubjectPos: ClaimSubjectPosIndex,
 		Expiration: false,
 		Version:    false}
+	ClaimHeaderPayloadRoot = ClaimHeader{
+		Type:       ClaimTypePayloadRoot,
+		Subject:    ClaimSubjectOtherIden,
+		SubjectPos: ClaimSubjectPosIndex,
+		Expiration: false,
+		Version:    false}
+	ClaimHeaderSaltedAttributes = ClaimHeader{
+		Type:       ClaimTypeSaltedAttributes,
+		Subject:    ClaimSubjectOtherIden,
+		SubjectPos: ClaimSubjectPosIndex,
+		Expiration: false,
+		Version:    false}
 )
 
+// ClaimTypeExpirable returns true if the claims of claimType can have an
+// expiration.  The claim types with a fixed header can't have one.
+func ClaimTypeExpirable(claimType ClaimType) bool {
+	switch claimType {
+	case ClaimTypeBasic:
+		return ClaimHeaderBasic.Expiration
+	case ClaimTypeKeyBabyJub:
+		return ClaimHeaderKeyBabyJub.Expiration
+	case ClaimTypeOtherIden:
+		return ClaimHeaderOtherIden.Expiration
+	case ClaimTypePayloadRoot:
+		return ClaimHeaderPayloadRoot.Expiration
+	case ClaimTypeSaltedAttributes:
+		return ClaimHeaderSaltedAttributes.Expiration
+	default:
+		return true
+	}
+}
+
 func checkHeader(header *ClaimHeader) error {
 	switch header.Type {
 	case ClaimTypeBasic:
@@ -164,6 +219,16 @@ func checkHeader(header *ClaimHeader) error {
 			return fmt.Errorf("claim header for ClaimType %v is different than expected",
 				ClaimTypeStringOtherIden)
 		}
+	case ClaimTypePayloadRoot:
+		if *header != ClaimHeaderPayloadRoot {
+			return fmt.Errorf("claim header for ClaimType %v is different than expected",
+				ClaimTypeStringPayloadRoot)
+		}
+	case ClaimTypeSaltedAttributes:
+		if *header != ClaimHeaderSaltedAttributes {
+			return fmt.Errorf("claim header for ClaimType %v is different than expected",
+				ClaimTypeStringSaltedAttributes)
+		}
 	default:
 	}
 	return nil
@@ -0,0 +1,68 @@
+package proof
+
+import (
+	"math/big"
+
+	zktypes "github.com/iden3/go-circom-prover-verifier/types"
+	"github.com/iden3/go-iden3-core/core"
+	"github.com/iden3/go-iden3-core/core/claims"
+	"github.com/iden3/go-iden3-crypto/babyjub"
+	"github.com/iden3/go-iden3-crypto/poseidon"
+)
+
+// PresentationRequest is a request of a verifier to a holder for the
+// presentation of a claim of ClaimType issued by Issuer.  The presentation
+// must be bound to the Nonce, which can only be used once and expires at
+// Expiration (unix time in seconds).  The holder signs the presentation in
+// the verifier Domain.
+type PresentationRequest struct {
+	Nonce      string
+	Domain     string
+	Issuer     *core.ID
+	ClaimType  claims.ClaimType
+	Expiration int64
+}
+
+// PresentationCredential is the presentation of a credential of validity in
+// answer to a PresentationRequest.  The holder binds the credential to the
+// request nonce by signing it with the key authorized by the claim of
+// KeyCredential, which is a credential of validity of the current
+// operational key claim of the holder.
+type PresentationCredential struct {
+	Nonce              string
+	CredentialValidity *CredentialValidity
+	KeyCredential      *CredentialValidity
+	Signature          *babyjub.SignatureComp
+}
+
+// Msg returns the message signed by the holder: [nonce | issuer | claim].
+func (p *PresentationCredential) Msg() []byte {
+	credExist := p.CredentialValidity.CredentialExistence
+	msg := append([]byte(p.Nonce), credExist.Id[:]...)
+	return append(msg, credExist.Claim.Bytes()...)
+}
+
+// SignedMsg returns the SignedMsg of the presentation in the domain.
+func (p *PresentationCredential) SignedMsg(domain string) *SignedMsg {
+	return &SignedMsg{Domain: domain, Msg: p.Msg(), Signature: p.Signature}
+}
+
+// PresentationZkProof is the presentation of a zero knowledge proof of a
+// credential in answer to a PresentationRequest.  The zk proof is bound to
+// the request nonce by a public input of the circuit with the nonce as a
+// field element (see NonceElem), so that it proves the ownership of the
+// claim subject for this request only, without revealing the holder
+// identity.
+type PresentationZkProof struct {
+	Nonce           string
+	ZkProof         *zktypes.Proof
+	PubSignals      []*big.Int
+	IssuerID        *core.ID
+	IdenStateBlockN uint64
+}
+
+// NonceElem returns the nonce of a PresentationRequest as a field element,
+// to be used as a zk proof input.
+func NonceElem(nonce string) *big.Int {
+	return poseidon.HashBytes([]byte(nonce))
+}
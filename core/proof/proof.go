@@ -3,11 +3,18 @@ package proof
 import (
 
 	// common3 "github.com/iden3/go-iden3-core/common"
+	"encoding/binary"
 	"fmt"
+	"math/big"
 
 	"github.com/iden3/go-iden3-core/core"
 	"github.com/iden3/go-iden3-core/merkletree"
-	// "github.com/iden3/go-iden3-crypto/babyjub"
+	"github.com/iden3/go-iden3-crypto/babyjub"
+	"github.com/iden3/go-iden3-crypto/poseidon"
+)
+
+var (
+	SigPrefixMsg = []byte("msg:")
 )
 
 type IdenStateData struct {
@@ -43,3 +50,28 @@ func (c CredentialValidity) String() string {
 	type alias CredentialValidity
 	return fmt.Sprintf("%+v", alias(c))
 }
+
+// SignedMsg is a message signed by an identity with an operational key in a
+// domain.  The domain (like "login:example.com") separates the signatures of
+// different applications, so that a signature can't be reused in another
+// one.
+type SignedMsg struct {
+	Domain    string
+	Msg       []byte
+	Signature *babyjub.SignatureComp
+}
+
+// Hash returns the poseidon hash of the [prefix | len(domain) | domain |
+// len(msg) | msg] byte slice, which is the signed field element.  The
+// lengths are 4 byte big endian, so that different (domain, msg) pairs never
+// share the hashed bytes.
+func (m *SignedMsg) Hash() *big.Int {
+	var domainLen, msgLen [4]byte
+	binary.BigEndian.PutUint32(domainLen[:], uint32(len(m.Domain)))
+	binary.BigEndian.PutUint32(msgLen[:], uint32(len(m.Msg)))
+	msg := append(append([]byte{}, SigPrefixMsg...), domainLen[:]...)
+	msg = append(msg, m.Domain...)
+	msg = append(msg, msgLen[:]...)
+	msg = append(msg, m.Msg...)
+	return poseidon.HashBytes(msg)
+}
@@ -13,3 +13,7 @@ func (m kvMap) Get(k []byte) ([]byte, bool) {
 func (m kvMap) Put(k, v []byte) {
 	m[sha256.Sum256(k)] = KV{k, v}
 }
+
+func (m kvMap) Delete(k []byte) {
+	delete(m, sha256.Sum256(k))
+}
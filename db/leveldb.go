@@ -18,6 +18,7 @@ type LevelDbStorage struct {
 type LevelDbStorageTx struct {
 	*LevelDbStorage
 	cache kvMap
+	del   kvMap
 }
 
 func NewLevelDbStorage(path string, errorIfMissing bool) (*LevelDbStorage, error) {
@@ -71,7 +72,7 @@ func (l *LevelDbStorage) WithPrefix(prefix []byte) Storage {
 }
 
 func (l *LevelDbStorage) NewTx() (Tx, error) {
-	return &LevelDbStorageTx{l, make(kvMap)}, nil
+	return &LevelDbStorageTx{l, make(kvMap), make(kvMap)}, nil
 }
 
 // Get retreives a value from a key in the mt.Lvl
@@ -109,6 +110,9 @@ func (l *LevelDbStorageTx) Get(key []byte) ([]byte, error) {
 
 	fullkey := concat(l.prefix, key)
 
+	if _, ok := l.del.Get(fullkey); ok {
+		return nil, ErrNotFound
+	}
 	if value, ok := l.cache.Get(fullkey); ok {
 		return value, nil
 	}
@@ -123,14 +127,26 @@ func (l *LevelDbStorageTx) Get(key []byte) ([]byte, error) {
 
 // Insert saves a key:value into the mt.Lvl
 func (tx *LevelDbStorageTx) Put(k, v []byte) {
+	tx.del.Delete(concat(tx.prefix, k[:]))
 	tx.cache.Put(concat(tx.prefix, k[:]), v)
 }
 
+// Delete removes a key from the mt.Lvl when the transaction is committed
+func (tx *LevelDbStorageTx) Delete(k []byte) {
+	tx.cache.Delete(concat(tx.prefix, k[:]))
+	tx.del.Put(concat(tx.prefix, k[:]), nil)
+}
+
 func (tx *LevelDbStorageTx) Add(atx Tx) {
 	ldbtx := atx.(*LevelDbStorageTx)
 	for _, v := range ldbtx.cache {
+		tx.del.Delete(v.K)
 		tx.cache.Put(v.K, v.V)
 	}
+	for _, v := range ldbtx.del {
+		tx.cache.Delete(v.K)
+		tx.del.Put(v.K, nil)
+	}
 }
 
 func (l *LevelDbStorageTx) Commit() error {
@@ -139,13 +155,18 @@ func (l *LevelDbStorageTx) Commit() error {
 	for _, v := range l.cache {
 		batch.Put(v.K, v.V)
 	}
+	for _, v := range l.del {
+		batch.Delete(v.K)
+	}
 
 	l.cache = nil
+	l.del = nil
 	return l.ldb.Write(&batch, nil)
 }
 
 func (l *LevelDbStorageTx) Close() {
 	l.cache = nil
+	l.del = nil
 }
 
 func (l *LevelDbStorage) Close() {
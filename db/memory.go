@@ -11,8 +11,9 @@ type MemoryStorage struct {
 }
 
 type MemoryStorageTx struct {
-	s  *MemoryStorage
-	kv kvMap
+	s   *MemoryStorage
+	kv  kvMap
+	del kvMap
 }
 
 func NewMemoryStorage() *MemoryStorage {
@@ -29,7 +30,7 @@ func (m *MemoryStorage) WithPrefix(prefix []byte) Storage {
 }
 
 func (m *MemoryStorage) NewTx() (Tx, error) {
-	return &MemoryStorageTx{m, make(kvMap)}, nil
+	return &MemoryStorageTx{m, make(kvMap), make(kvMap)}, nil
 }
 
 // Get retreives a value from a key in the mt.Lvl
@@ -65,6 +66,9 @@ func (l *MemoryStorage) Iterate(f func([]byte, []byte) (bool, error)) error {
 
 func (tx *MemoryStorageTx) Get(key []byte) ([]byte, error) {
 
+	if _, ok := tx.del.Get(concat(tx.s.prefix, key)); ok {
+		return nil, ErrNotFound
+	}
 	if v, ok := tx.kv.Get(concat(tx.s.prefix, key)); ok {
 		return v, nil
 	}
@@ -76,26 +80,43 @@ func (tx *MemoryStorageTx) Get(key []byte) ([]byte, error) {
 }
 
 func (tx *MemoryStorageTx) Put(k, v []byte) {
+	tx.del.Delete(concat(tx.s.prefix, k))
 	tx.kv.Put(concat(tx.s.prefix, k), v)
 }
 
+// Delete removes a key when the transaction is committed.
+func (tx *MemoryStorageTx) Delete(k []byte) {
+	tx.kv.Delete(concat(tx.s.prefix, k))
+	tx.del.Put(concat(tx.s.prefix, k), nil)
+}
+
 func (tx *MemoryStorageTx) Commit() error {
 	for _, v := range tx.kv {
 		tx.s.kv.Put(v.K, v.V)
 	}
+	for _, v := range tx.del {
+		tx.s.kv.Delete(v.K)
+	}
 	tx.kv = nil
+	tx.del = nil
 	return nil
 }
 
 func (tx *MemoryStorageTx) Add(atx Tx) {
 	mstx := atx.(*MemoryStorageTx)
 	for _, v := range mstx.kv {
+		tx.del.Delete(v.K)
 		tx.kv.Put(v.K, v.V)
 	}
+	for _, v := range mstx.del {
+		tx.kv.Delete(v.K)
+		tx.del.Put(v.K, nil)
+	}
 }
 
 func (tx *MemoryStorageTx) Close() {
 	tx.kv = nil
+	tx.del = nil
 }
 
 func (m *MemoryStorage) Close() {
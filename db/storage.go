@@ -24,6 +24,10 @@ type Storage interface {
 type Tx interface {
 	Get([]byte) ([]byte, error)
 	Put(k, v []byte)
+	// Delete removes the key when the Tx is committed.  A following Get
+	// in the same Tx returns ErrNotFound, and a following Put sets it
+	// again.
+	Delete(k []byte)
 	Add(Tx)
 	Commit() error
 	Close()
@@ -164,6 +164,46 @@ func testConcatTx(t *testing.T, sto Storage) {
 	assert.Equal(t, v2, []byte{8, 9})
 }
 
+func testDelete(t *testing.T, sto Storage) {
+	sto1 := sto.WithPrefix([]byte{1})
+	sto1tx, _ := sto1.NewTx()
+	sto1tx.Put([]byte{1}, []byte{4})
+	sto1tx.Put([]byte{2}, []byte{5})
+	assert.Nil(t, sto1tx.Commit())
+
+	// a deleted key is not found within the tx, and only removed from the
+	// storage once committed
+	sto1tx, _ = sto1.NewTx()
+	sto1tx.Delete([]byte{1})
+	_, err := sto1tx.Get([]byte{1})
+	assert.Equal(t, ErrNotFound, err)
+	v, err := sto1.Get([]byte{1})
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{4}, v)
+	assert.Nil(t, sto1tx.Commit())
+	_, err = sto1.Get([]byte{1})
+	assert.Equal(t, ErrNotFound, err)
+
+	// a put after a delete in the same tx keeps the key
+	sto1tx, _ = sto1.NewTx()
+	sto1tx.Delete([]byte{2})
+	sto1tx.Put([]byte{2}, []byte{6})
+	assert.Nil(t, sto1tx.Commit())
+	v, err = sto1.Get([]byte{2})
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{6}, v)
+
+	// deletes of an added tx are committed
+	sto1tx, _ = sto1.NewTx()
+	sto1tx2, _ := sto1.NewTx()
+	sto1tx2.Delete([]byte{2})
+	sto1tx.Add(sto1tx2)
+	assert.Nil(t, sto1tx.Commit())
+	r, err := sto1.List(100)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(r))
+}
+
 func testList(t *testing.T, sto Storage) {
 	sto1 := sto.WithPrefix([]byte{1})
 	r1, err := sto1.List(100)
@@ -205,6 +245,7 @@ func TestLevelDb(t *testing.T) {
 	testConcatTx(t, levelDbStorage(t))
 	testList(t, levelDbStorage(t))
 	testIterate(t, levelDbStorage(t))
+	testDelete(t, levelDbStorage(t))
 }
 
 func TestMemory(t *testing.T) {
@@ -214,6 +255,7 @@ func TestMemory(t *testing.T) {
 	testConcatTx(t, NewMemoryStorage())
 	testList(t, NewMemoryStorage())
 	testIterate(t, NewMemoryStorage())
+	testDelete(t, NewMemoryStorage())
 }
 
 func TestLevelDbInterface(t *testing.T) {
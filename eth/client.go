@@ -92,6 +92,47 @@ func (c *Client) CallAuth(gasLimit uint64,
 	return tx, err
 }
 
+// ReplaceAuth resends the transaction tx with the same nonce, destination,
+// value, gas limit and data, but with a gas price of at least minGasPrice, so
+// that it replaces tx if it's still pending.  This call requires a valid
+// account with Ether that can be spend during the call.
+func (c *Client) ReplaceAuth(tx *types.Transaction, minGasPrice *big.Int) (*types.Transaction, error) {
+	if c.account == nil {
+		return nil, ErrAccountNil
+	}
+
+	gasPrice, err := c.client.SuggestGasPrice(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	if gasPrice.Cmp(minGasPrice) == -1 {
+		gasPrice.Set(minGasPrice)
+	}
+	log.WithField("gasPrice", gasPrice).WithField("nonce", tx.Nonce()).Debug("Replacement transaction metadata")
+
+	var newTx *types.Transaction
+	if tx.To() == nil {
+		newTx = types.NewContractCreation(tx.Nonce(), tx.Value(), tx.Gas(), gasPrice, tx.Data())
+	} else {
+		newTx = types.NewTransaction(tx.Nonce(), *tx.To(), tx.Value(), tx.Gas(), gasPrice, tx.Data())
+	}
+	auth, err := bind.NewKeyStoreTransactor(c.ks, *c.account)
+	if err != nil {
+		return nil, err
+	}
+	// Use the same signer as the abigen bindings
+	newTx, err = auth.Signer(types.HomesteadSigner{}, auth.From, newTx)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.client.SendTransaction(context.Background(), newTx); err != nil {
+		return nil, err
+	}
+	log.WithField("tx", newTx.Hash().Hex()).WithField("replacedTx", tx.Hash().Hex()).
+		WithField("nonce", newTx.Nonce()).Debug("Transaction")
+	return newTx, nil
+}
+
 type ContractData struct {
 	Address common.Address
 	Tx      *types.Transaction
@@ -181,6 +222,15 @@ func (c *Client) waitReceipt(tx *types.Transaction, ctx context.Context, timeout
 	return receipt, err
 }
 
+// NonceAt returns the nonce of the account at the latest block, which is the
+// nonce of the next transaction of the account to be mined.
+func (c *Client) NonceAt() (uint64, error) {
+	if c.account == nil {
+		return 0, ErrAccountNil
+	}
+	return c.client.NonceAt(context.TODO(), c.account.Address, nil)
+}
+
 // CurrentBlock returns the current block number in the blockchain
 func (c *Client) CurrentBlock() (*big.Int, error) {
 	ctx, cancel := context.WithTimeout(context.TODO(), 1*time.Second)
@@ -1,6 +1,7 @@
 package holder
 
 import (
+	"context"
 	"fmt"
 	"math/big"
 	"time"
@@ -9,7 +10,9 @@ import (
 	"github.com/iden3/go-circom-prover-verifier/verifier"
 	witnesscalc "github.com/iden3/go-circom-witnesscalc"
 	"github.com/iden3/go-iden3-core/components/idenpuboffchain"
+	"github.com/iden3/go-iden3-core/components/idenpuboffchain/readercache"
 	"github.com/iden3/go-iden3-core/components/idenpubonchain"
+	"github.com/iden3/go-iden3-core/components/zkprover"
 	"github.com/iden3/go-iden3-core/core"
 	"github.com/iden3/go-iden3-core/core/claims"
 	"github.com/iden3/go-iden3-core/core/proof"
@@ -50,6 +53,11 @@ type Holder struct {
 	*issuer.Issuer
 	idenPubOffChainReader idenpuboffchain.IdenPubOffChainReader
 	idenPubOnChain        idenpubonchain.IdenPubOnChainer
+	// prover can be nil if the Holder generates the zk proofs in the
+	// caller's goroutine.
+	prover  *zkprover.Prover
+	storage db.Storage
+	timeNow func() time.Time
 }
 
 // Create a new Holder, calling the internal Issuer.New().
@@ -63,6 +71,9 @@ func Create(cfg Config, kOpComp *babyjub.PublicKeyComp, extraGenesisClaims []cla
 }
 
 // New creates a Holder by loading a previously created Holder (with New, and calling the internal Issuer.Load().
+// The idenPubOffChainReader is wrapped in a readercache.IdenPubOffChainReadCache
+// with the default configuration, unless it already is one, so that the
+// public data of every issuer identity state is only downloaded once.
 func Load(storage db.Storage, keyStore *keystore.KeyStore,
 	idenPubOnChain idenpubonchain.IdenPubOnChainer,
 	idenStateZkProofConf *issuer.IdenStateZkProofConf,
@@ -72,13 +83,26 @@ func Load(storage db.Storage, keyStore *keystore.KeyStore,
 	if err != nil {
 		return nil, err
 	}
+	if _, ok := idenPubOffChainReader.(*readercache.IdenPubOffChainReadCache); !ok && idenPubOffChainReader != nil {
+		idenPubOffChainReader = readercache.New(idenPubOffChainReader, readercache.ConfigDefault, nil)
+	}
 	return &Holder{
 		Issuer:                is,
 		idenPubOffChainReader: idenPubOffChainReader,
 		idenPubOnChain:        idenPubOnChain,
+		storage:               storage,
+		timeNow:               time.Now,
 	}, nil
 }
 
+// SetProver makes the Holder generate its zk proofs, both of credentials and
+// of identity state updates, in zkProver.  Credential proofs are generated
+// with normal priority.
+func (h *Holder) SetProver(zkProver *zkprover.Prover) {
+	h.Issuer.SetProver(zkProver)
+	h.prover = zkProver
+}
+
 // CredentialValidityAux contains the data used in a validity proof.
 type CredentialValidityAux struct {
 	IdenStateData  *proof.IdenStateData
@@ -98,6 +122,13 @@ func (h *Holder) HolderGetCredentialValidityData(
 		return nil, err
 	}
 	log.WithField("state", idenStateData.IdenState).Debug("Holder.idenPubOnChain.GetState()")
+	return h.credentialValidityData(credExist, idenStateData)
+}
+
+// credentialValidityData returns the data used in a validity proof from a
+// credential existence proof in the issuer identity state idenStateData.
+func (h *Holder) credentialValidityData(credExist *proof.CredentialExistence,
+	idenStateData *proof.IdenStateData) (*CredentialValidityAux, error) {
 	publicData, err := h.idenPubOffChainReader.GetPublicData(credExist.IdenPubUrl, credExist.Id, idenStateData.IdenState)
 	if err != nil {
 		return nil, err
@@ -143,13 +174,20 @@ func (h *Holder) HolderGetCredentialValidity(
 	if err != nil {
 		return nil, err
 	}
+	return newCredentialValidity(credExist, credValidData), nil
+}
+
+// newCredentialValidity builds a Credential of Validity from a Credential of
+// Existence and the data of its validity proof.
+func newCredentialValidity(credExist *proof.CredentialExistence,
+	credValidData *CredentialValidityAux) *proof.CredentialValidity {
 	return &proof.CredentialValidity{
 		CredentialExistence: *credExist,
 		IdenStateData:       *credValidData.IdenStateData,
 		MtpNotNonce:         credValidData.MtpNotNonce,
 		ClaimsTreeRoot:      credValidData.ClaimsTreeRoot,
 		RootsTreeRoot:       credValidData.RootsTreeRoot,
-	}, nil
+	}
 }
 
 // CredentialProofInputs are all the iinputs for the credential ownership proof
@@ -275,28 +313,33 @@ type ZkProofCredOut struct {
 	IdenStateBlockN uint64
 }
 
-// HolderGenZkProofCredential generates a zkp of a credential.  This function
-// prepares all the inputs of the `credential.circom` circuit and removes the
-// "claim" input.  The `addInputs` function allows adding circuit inputs as
-// necessary (for example, inputs used to build the claim).
+// HolderGenZkProofCredential generates a zkp of a credential with a circuit
+// that doesn't check the claim expiration.
+//
+// Deprecated: use HolderGenZkProofCredentialExpiration, which sets the
+// current time input of circuits that check the claim expiration.
 func (h *Holder) HolderGenZkProofCredential(
 	credExist *proof.CredentialExistence,
 	addInputs func(inputs map[string]interface{}) error,
 	idOwnershipLevels, issuerLevels int,
 	zkFiles *zkutils.ZkFiles) (*ZkProofCredOut, error) {
+	return h.HolderGenZkProofCredentialExpiration(credExist, addInputs,
+		idOwnershipLevels, issuerLevels, zkFiles, nil)
+}
 
-	pk, err := zkFiles.ProvingKey()
-	if err != nil {
-		return nil, fmt.Errorf("error loading zk pk: %w", err)
-	}
-	vk, err := zkFiles.VerificationKey()
-	if err != nil {
-		return nil, fmt.Errorf("error loading zk vk: %w", err)
-	}
-	witnessCalcWASM, err := zkFiles.WitnessCalcWASM()
-	if err != nil {
-		return nil, fmt.Errorf("error loading zk witnessCalc WASM: %w", err)
-	}
+// HolderGenZkProofCredentialExpiration generates a zkp of a credential.  This
+// function prepares all the inputs of the `credential.circom` circuit and
+// removes the "claim" input.  The `addInputs` function allows adding circuit
+// inputs as necessary (for example, inputs used to build the claim).  If the
+// circuit checks the claim expiration, `expiration` describes its current
+// time input, which is set to the Holder current time; otherwise it's nil.
+// If the Holder has a prover (see SetProver), the proof is generated in it.
+func (h *Holder) HolderGenZkProofCredentialExpiration(
+	credExist *proof.CredentialExistence,
+	addInputs func(inputs map[string]interface{}) error,
+	idOwnershipLevels, issuerLevels int,
+	zkFiles *zkutils.ZkFiles,
+	expiration *zkutils.CredentialExpiration) (*ZkProofCredOut, error) {
 
 	idOwnershipInputs, err := h.GenIdOwnershipGenesisInputs(idOwnershipLevels)
 	if err != nil {
@@ -320,6 +363,46 @@ func (h *Holder) HolderGenZkProofCredential(
 	if err := addInputs(inputs); err != nil {
 		return nil, err
 	}
+	if expiration != nil {
+		inputs[expiration.TimeNowInput] = big.NewInt(h.timeNow().Unix())
+	}
+
+	var zkProofOut *zkutils.ZkProofOut
+	if h.prover != nil {
+		zkProofOut, err = h.prover.Prove(context.Background(), zkprover.PriorityNormal, zkFiles, inputs)
+		if err == zkprover.ErrFailedVerifyZkProof {
+			return nil, ErrFailedVerifyZkProofCredential
+		} else if err != nil {
+			return nil, err
+		}
+	} else {
+		zkProofOut, err = genZkProof(zkFiles, inputs)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &ZkProofCredOut{
+		ZkProofOut:      *zkProofOut,
+		IssuerID:        credExist.Id,
+		IdenStateBlockN: credValidData.IdenStateData.BlockN,
+	}, nil
+}
+
+// genZkProof calculates the witness and generates the zk proof of the
+// circuit described by zkFiles with the inputs in the caller's goroutine.
+func genZkProof(zkFiles *zkutils.ZkFiles, inputs map[string]interface{}) (*zkutils.ZkProofOut, error) {
+	pk, err := zkFiles.ProvingKey()
+	if err != nil {
+		return nil, fmt.Errorf("error loading zk pk: %w", err)
+	}
+	vk, err := zkFiles.VerificationKey()
+	if err != nil {
+		return nil, fmt.Errorf("error loading zk vk: %w", err)
+	}
+	witnessCalcWASM, err := zkFiles.WitnessCalcWASM()
+	if err != nil {
+		return nil, fmt.Errorf("error loading zk witnessCalc WASM: %w", err)
+	}
 
 	wit, err := witnesscalc.CalculateWitnessBinWASM(witnessCalcWASM, inputs)
 	if err != nil {
@@ -337,14 +420,5 @@ func (h *Holder) HolderGenZkProofCredential(
 	}
 
 	log.WithField("elapsed", time.Since(start)).Debug("Proof generated")
-	return &ZkProofCredOut{
-		ZkProofOut:      zkutils.ZkProofOut{Proof: *proof, PubSignals: pubSignals},
-		IssuerID:        credExist.Id,
-		IdenStateBlockN: credValidData.IdenStateData.BlockN,
-	}, nil
+	return &zkutils.ZkProofOut{Proof: *proof, PubSignals: pubSignals}, nil
 }
-
-// HolderImportCredentialExistence imports a received Credential of Existence into the ClaimsDB.
-// func (h *Holder) HolderImportCredentialExistence(credExist *proof.ProofClaim) error {
-// 	return fmt.Errorf("TODO: Implement ClaimDB")
-// }
@@ -0,0 +1,154 @@
+package holder
+
+import (
+	"fmt"
+
+	"github.com/iden3/go-iden3-core/core/claims"
+	"github.com/iden3/go-iden3-core/core/proof"
+	"github.com/iden3/go-iden3-core/db"
+	"github.com/iden3/go-iden3-core/identity/issuer"
+	"github.com/iden3/go-iden3-core/merkletree"
+	zkutils "github.com/iden3/go-iden3-core/utils/zk"
+)
+
+var (
+	ErrPresentationIssuer    = fmt.Errorf("the credential issuer is not the one requested")
+	ErrPresentationClaimType = fmt.Errorf("the credential claim type is not the one requested")
+	ErrPresentationExpired   = fmt.Errorf("the presentation request has expired")
+)
+
+// checkPresentationRequest checks that the credential of existence matches
+// the presentation request and that the request hasn't expired.
+func (h *Holder) checkPresentationRequest(req *proof.PresentationRequest,
+	credExist *proof.CredentialExistence) error {
+	if req.Expiration < h.timeNow().Unix() {
+		return ErrPresentationExpired
+	}
+	if !credExist.Id.Equal(req.Issuer) {
+		return ErrPresentationIssuer
+	}
+	var metadata claims.Metadata
+	metadata.Unmarshal(credExist.Claim)
+	if metadata.Type() != req.ClaimType {
+		return ErrPresentationClaimType
+	}
+	return nil
+}
+
+// keyCredential returns the credential of validity of the current
+// operational key claim, which authorizes the key used in the presentation
+// signatures.  While the Holder has no identity state on chain, the key
+// claim is the genesis one, which can't have been revoked, so its credential
+// of validity is in the genesis identity state.
+func (h *Holder) keyCredential() (*proof.CredentialValidity, error) {
+	claimKOp, err := h.ClaimKeyOperational()
+	if err != nil {
+		return nil, err
+	}
+	if !h.IdenStateOnChain().Equals(&merkletree.HashZero) {
+		credExist, err := h.GenCredentialExistence(claimKOp)
+		if err != nil {
+			return nil, err
+		}
+		return h.HolderGetCredentialValidity(credExist)
+	}
+	credExist, err := h.GenCredentialExistenceGenesis(claimKOp)
+	if err != nil {
+		return nil, err
+	}
+	hi, hv, err := credExist.Claim.HiHv()
+	if err != nil {
+		return nil, err
+	}
+	claimsTreeRoot, err := merkletree.RootFromProof(credExist.MtpClaim, hi, hv)
+	if err != nil {
+		return nil, err
+	}
+	// The genesis revocations tree is empty
+	revocationsTree, err := merkletree.NewMerkleTree(db.NewMemoryStorage(),
+		issuer.ConfigDefault.MaxLevelsRevocationTree)
+	if err != nil {
+		return nil, err
+	}
+	var metadata claims.Metadata
+	metadata.Unmarshal(credExist.Claim)
+	revLeafHi, err := claims.NewLeafRevocationsTree(metadata.RevNonce, 0xffffffff).Entry().HIndex()
+	if err != nil {
+		return nil, err
+	}
+	mtpNotNonce, err := revocationsTree.GenerateProof(revLeafHi, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &proof.CredentialValidity{
+		CredentialExistence: *credExist,
+		IdenStateData:       credExist.IdenStateData,
+		MtpNotNonce:         mtpNotNonce,
+		ClaimsTreeRoot:      claimsTreeRoot,
+		RootsTreeRoot:       credExist.RootsTreeRoot,
+	}, nil
+}
+
+// HolderGenPresentationCredential answers the presentation request req with
+// a credential of validity of the credential of existence credExist, bound
+// to the request nonce by a signature of the Holder in the request domain.
+func (h *Holder) HolderGenPresentationCredential(req *proof.PresentationRequest,
+	credExist *proof.CredentialExistence) (*proof.PresentationCredential, error) {
+	if err := h.checkPresentationRequest(req, credExist); err != nil {
+		return nil, err
+	}
+	credValid, err := h.HolderGetCredentialValidity(credExist)
+	if err != nil {
+		return nil, err
+	}
+	keyCredential, err := h.keyCredential()
+	if err != nil {
+		return nil, err
+	}
+	pres := proof.PresentationCredential{
+		Nonce:              req.Nonce,
+		CredentialValidity: credValid,
+		KeyCredential:      keyCredential,
+	}
+	signedMsg, err := h.Sign(req.Domain, pres.Msg())
+	if err != nil {
+		return nil, err
+	}
+	pres.Signature = signedMsg.Signature
+	return &pres, nil
+}
+
+// HolderGenPresentationZkProof answers the presentation request req with a
+// zkp of the credential of existence credExist (see
+// HolderGenZkProofCredentialExpiration), bound to the request nonce by the
+// nonce input of the circuit described by `nonce`.
+func (h *Holder) HolderGenPresentationZkProof(req *proof.PresentationRequest,
+	credExist *proof.CredentialExistence,
+	addInputs func(inputs map[string]interface{}) error,
+	idOwnershipLevels, issuerLevels int,
+	zkFiles *zkutils.ZkFiles,
+	expiration *zkutils.CredentialExpiration,
+	nonce *zkutils.CredentialNonce) (*proof.PresentationZkProof, error) {
+	if err := h.checkPresentationRequest(req, credExist); err != nil {
+		return nil, err
+	}
+	addInputsNonce := func(inputs map[string]interface{}) error {
+		if err := addInputs(inputs); err != nil {
+			return err
+		}
+		inputs[nonce.NonceInput] = proof.NonceElem(req.Nonce)
+		return nil
+	}
+	zkProofCredOut, err := h.HolderGenZkProofCredentialExpiration(credExist, addInputsNonce,
+		idOwnershipLevels, issuerLevels, zkFiles, expiration)
+	if err != nil {
+		return nil, err
+	}
+	return &proof.PresentationZkProof{
+		Nonce:           req.Nonce,
+		ZkProof:         &zkProofCredOut.ZkProofOut.Proof,
+		PubSignals:      zkProofCredOut.ZkProofOut.PubSignals,
+		IssuerID:        zkProofCredOut.IssuerID,
+		IdenStateBlockN: zkProofCredOut.IdenStateBlockN,
+	}, nil
+}
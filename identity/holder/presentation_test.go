@@ -0,0 +1,159 @@
+package holder
+
+import (
+	"io/ioutil"
+	"math/big"
+	"os"
+	"testing"
+	"time"
+
+	zktypes "github.com/iden3/go-circom-prover-verifier/types"
+	idenpuboffchanlocal "github.com/iden3/go-iden3-core/components/idenpuboffchain/local"
+	"github.com/iden3/go-iden3-core/components/verifier"
+	"github.com/iden3/go-iden3-core/core/claims"
+	"github.com/iden3/go-iden3-core/core/proof"
+	"github.com/iden3/go-iden3-core/db"
+	noncedb "github.com/iden3/go-iden3-core/utils/noncedb"
+	zkutils "github.com/iden3/go-iden3-core/utils/zk"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPresentationCredential(t *testing.T) {
+	idenPubOnChain := newIdenPubOnChainFake()
+	idenPubOffChain := &idenPubOffChainCounter{IdenPubOffChain: idenpuboffchanlocal.NewIdenPubOffChain("")}
+	newHolderOnChain := func() *Holder {
+		storage := db.NewMemoryStorage()
+		keyStore, kOp := newKeyStore(t)
+		_, err := Create(ConfigDefault, kOp, []claims.Claimer{}, storage, keyStore)
+		require.Nil(t, err)
+		ho, err := Load(storage, keyStore, idenPubOnChain, nil, nil, idenPubOffChain)
+		require.Nil(t, err)
+		return ho
+	}
+	ho := newHolderOnChain()
+	other := newHolderOnChain()
+
+	claim := newClaimOtherIden(ho.ID(), 0)
+	is := newIssuerGenesis(t, []claims.Claimer{claim})
+	publishState(t, is, idenPubOnChain, idenPubOffChain, 1, nil)
+	credExist, err := is.GenCredentialExistenceGenesis(claim)
+	require.Nil(t, err)
+
+	v := verifier.New(idenPubOnChain)
+	nonceDb := noncedb.NewNonceDb()
+	domain := "login:example.com"
+	freshness := 60 * time.Second
+	newRequest := func() *proof.PresentationRequest {
+		return v.NewPresentationRequest(nonceDb, domain, is.ID(), claims.ClaimTypeOtherIden, 60)
+	}
+
+	req := newRequest()
+	pres, err := ho.HolderGenPresentationCredential(req, credExist)
+	require.Nil(t, err)
+	assert.Nil(t, v.VerifyPresentationCredential(nonceDb, pres, freshness))
+
+	// The nonce can't be used again
+	assert.Equal(t, verifier.ErrPresentationNonce, v.VerifyPresentationCredential(nonceDb, pres, freshness))
+
+	// The presentation can't be bound to another nonce
+	pres, err = ho.HolderGenPresentationCredential(newRequest(), credExist)
+	require.Nil(t, err)
+	pres.Nonce = newRequest().Nonce
+	assert.Equal(t, verifier.ErrInvalidSignature, v.VerifyPresentationCredential(nonceDb, pres, freshness))
+
+	// Unknown nonce
+	pres.Nonce = "foo"
+	assert.Equal(t, verifier.ErrPresentationNonce, v.VerifyPresentationCredential(nonceDb, pres, freshness))
+
+	// The credential of the holder presented by another identity
+	pres, err = other.HolderGenPresentationCredential(newRequest(), credExist)
+	require.Nil(t, err)
+	assert.Equal(t, verifier.ErrPresentationSubject, v.VerifyPresentationCredential(nonceDb, pres, freshness))
+
+	// The credential doesn't match the request
+	req = v.NewPresentationRequest(nonceDb, domain, ho.ID(), claims.ClaimTypeOtherIden, 60)
+	_, err = ho.HolderGenPresentationCredential(req, credExist)
+	assert.Equal(t, ErrPresentationIssuer, err)
+	req = v.NewPresentationRequest(nonceDb, domain, is.ID(), claims.ClaimTypeBasic, 60)
+	_, err = ho.HolderGenPresentationCredential(req, credExist)
+	assert.Equal(t, ErrPresentationClaimType, err)
+	pres, err = ho.HolderGenPresentationCredential(newRequest(), credExist)
+	require.Nil(t, err)
+	pres.Nonce = req.Nonce
+	assert.Equal(t, verifier.ErrPresentationClaimType, v.VerifyPresentationCredential(nonceDb, pres, freshness))
+
+	// Expired request
+	req = v.NewPresentationRequest(nonceDb, domain, is.ID(), claims.ClaimTypeOtherIden, -1)
+	_, err = ho.HolderGenPresentationCredential(req, credExist)
+	assert.Equal(t, ErrPresentationExpired, err)
+	req.Expiration += 60
+	pres, err = ho.HolderGenPresentationCredential(req, credExist)
+	require.Nil(t, err)
+	assert.Equal(t, verifier.ErrPresentationNonce, v.VerifyPresentationCredential(nonceDb, pres, freshness))
+
+	// The genesis key credential is outdated once the holder publishes an
+	// identity state, which here revokes the genesis key claim
+	pres, err = ho.HolderGenPresentationCredential(newRequest(), credExist)
+	require.Nil(t, err)
+	assert.Equal(t, pres.KeyCredential.CredentialExistence.IdenStateData, pres.KeyCredential.IdenStateData)
+	publishState(t, ho.Issuer, idenPubOnChain, idenPubOffChain, 2, []uint32{0})
+	assert.NotNil(t, v.VerifyPresentationCredential(nonceDb, pres, freshness))
+}
+
+func TestPresentationZkProof(t *testing.T) {
+	idenPubOnChain := newIdenPubOnChainFake()
+	idenPubOffChain := &idenPubOffChainCounter{IdenPubOffChain: idenpuboffchanlocal.NewIdenPubOffChain("")}
+	ho := newHolder(t)
+	claim := newClaimOtherIden(ho.ID(), 0)
+	is := newIssuerGenesis(t, []claims.Claimer{claim})
+	publishState(t, is, idenPubOnChain, idenPubOffChain, 1, nil)
+
+	v := verifier.New(idenPubOnChain)
+	nonceDb := noncedb.NewNonceDb()
+	freshness := 60 * time.Second
+	nonce := &zkutils.CredentialNonce{NonceInput: "nonce", NonceSignalIdx: 1}
+	dir, err := ioutil.TempDir("", "zkfiles")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	zkFiles := zkutils.NewZkFiles("", dir, zkutils.ProvingKeyFormatJSON, zkutils.ZkFilesHashes{}, false)
+	circuit := &verifier.ZkCircuit{ZkFiles: zkFiles, ClaimType: claims.ClaimTypeOtherIden, Nonce: nonce}
+	newPresentation := func(nonceSignal string) *proof.PresentationZkProof {
+		req := v.NewPresentationRequest(nonceDb, "login:example.com", is.ID(), claims.ClaimTypeOtherIden, 60)
+		return &proof.PresentationZkProof{
+			Nonce:      req.Nonce,
+			ZkProof:    &zktypes.Proof{},
+			PubSignals: []*big.Int{big.NewInt(0), proof.NonceElem(nonceSignal)},
+			IssuerID:   is.ID(),
+		}
+	}
+
+	// The zk proof of another request can't be presented
+	pres := newPresentation("foo")
+	assert.Equal(t, verifier.ErrPresentationNonceSignal,
+		v.VerifyPresentationZkProof(nonceDb, pres, circuit, freshness))
+	assert.Equal(t, verifier.ErrPresentationNonce,
+		v.VerifyPresentationZkProof(nonceDb, pres, circuit, freshness))
+	pres = newPresentation("foo")
+	pres.PubSignals = pres.PubSignals[:1]
+	assert.Equal(t, verifier.ErrZkProofNonceSignal,
+		v.VerifyPresentationZkProof(nonceDb, pres, circuit, freshness))
+	pres = newPresentation("foo")
+	assert.Equal(t, verifier.ErrZkProofNonceSignal,
+		v.VerifyPresentationZkProof(nonceDb, pres, &verifier.ZkCircuit{ZkFiles: zkFiles,
+			ClaimType: claims.ClaimTypeOtherIden}, freshness))
+
+	// The circuit must prove claims of the requested type
+	pres = newPresentation("")
+	pres.PubSignals[1] = proof.NonceElem(pres.Nonce)
+	assert.Equal(t, verifier.ErrPresentationClaimType,
+		v.VerifyPresentationZkProof(nonceDb, pres, &verifier.ZkCircuit{ZkFiles: zkFiles,
+			ClaimType: claims.ClaimTypeBasic, Nonce: nonce}, freshness))
+
+	// With the request nonce, the zk proof itself is verified
+	pres = newPresentation("")
+	pres.PubSignals[1] = proof.NonceElem(pres.Nonce)
+	err = v.VerifyPresentationZkProof(nonceDb, pres, circuit, freshness)
+	require.NotNil(t, err)
+	assert.Contains(t, err.Error(), "error loading zk vk")
+}
@@ -0,0 +1,150 @@
+package holder
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/iden3/go-iden3-core/core"
+	"github.com/iden3/go-iden3-core/core/proof"
+	"github.com/iden3/go-iden3-core/identity/issuer"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// RefresherConfig allows configuring the Refresher.
+type RefresherConfig struct {
+	// Interval is the time between refresh cycles.
+	Interval time.Duration
+}
+
+// RefresherConfigDefault is a default configuration for the Refresher.
+var RefresherConfigDefault = RefresherConfig{
+	Interval: 5 * time.Minute,
+}
+
+// RefresherHooks are functions called by the Refresher on events.  Nil hooks
+// are ignored.
+type RefresherHooks struct {
+	// CredentialRevoked is called when a stored credential is found to be
+	// revoked by its issuer.
+	CredentialRevoked func(cred *StoredCredential)
+	// CredentialExpired is called when the claim of a stored credential
+	// expires.
+	CredentialExpired func(cred *StoredCredential)
+	// RefreshFailed is called when the refresh of the credentials of an
+	// issuer fails.  It will be retried in the next cycle.
+	RefreshFailed func(issuerID *core.ID, err error)
+}
+
+// Refresher is a long-running service that keeps the stored credentials of
+// the Holder fresh: every time an issuer publishes a new identity state, the
+// credentials of validity of its claims are refreshed, and the revoked and
+// expired ones are reported.  The public data of every issuer identity state
+// is only downloaded once, as the Holder caches it (see Load).
+type Refresher struct {
+	ho    *Holder
+	cfg   RefresherConfig
+	hooks RefresherHooks
+	clock issuer.Clock
+}
+
+// NewRefresher creates a new Refresher for the Holder.
+func NewRefresher(ho *Holder, cfg RefresherConfig, hooks RefresherHooks, clock issuer.Clock) *Refresher {
+	return &Refresher{
+		ho:    ho,
+		cfg:   cfg,
+		hooks: hooks,
+		clock: clock,
+	}
+}
+
+// Run runs refresh cycles, the first one right away, until the ctx is
+// cancelled, returning the ctx error.
+func (r *Refresher) Run(ctx context.Context) error {
+	for {
+		if err := r.step(); err != nil {
+			log.WithError(err).Warn("Refresher cycle failed")
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-r.clock.After(r.cfg.Interval):
+		}
+	}
+}
+
+// step runs a single refresh cycle.  The credentials already revoked or
+// expired are not refreshed.  A failure refreshing the credentials of an
+// issuer doesn't stop the refresh of the other issuers, and the first one is
+// returned at the end of the cycle.
+func (r *Refresher) step() error {
+	creds, err := r.ho.Credentials(CredentialsQuery{})
+	if err != nil {
+		return err
+	}
+	credsByIssuer := make(map[core.ID][]*StoredCredential)
+	issuerIDs := []core.ID{}
+	for _, cred := range creds {
+		if cred.Status == CredentialStatusRevoked || cred.Status == CredentialStatusExpired {
+			continue
+		}
+		if _, ok := credsByIssuer[*cred.Issuer]; !ok {
+			issuerIDs = append(issuerIDs, *cred.Issuer)
+		}
+		credsByIssuer[*cred.Issuer] = append(credsByIssuer[*cred.Issuer], cred)
+	}
+	var errFirst error
+	for i := range issuerIDs {
+		issuerID := &issuerIDs[i]
+		if err := r.refreshIssuer(issuerID, credsByIssuer[*issuerID]); err != nil {
+			if errFirst == nil {
+				errFirst = fmt.Errorf("error refreshing the credentials of issuer %v: %w", issuerID, err)
+			}
+			if r.hooks.RefreshFailed != nil {
+				r.hooks.RefreshFailed(issuerID, err)
+			}
+		}
+	}
+	return errFirst
+}
+
+// refreshIssuer refreshes the credentials of the issuer issuerID whose
+// status is not up to date with the last identity state of the issuer.
+func (r *Refresher) refreshIssuer(issuerID *core.ID, creds []*StoredCredential) error {
+	idenStateData, err := r.ho.issuerIdenStateData(issuerID)
+	if err != nil {
+		return err
+	}
+	now := r.ho.timeNow().Unix()
+	for _, cred := range creds {
+		if credentialFresh(cred, idenStateData) && !credentialExpired(cred, now) {
+			continue
+		}
+		if err := r.ho.updateCredentialStatus(cred, idenStateData); err != nil {
+			return err
+		}
+		switch cred.Status {
+		case CredentialStatusRevoked:
+			if r.hooks.CredentialRevoked != nil {
+				r.hooks.CredentialRevoked(cred)
+			}
+		case CredentialStatusExpired:
+			if r.hooks.CredentialExpired != nil {
+				r.hooks.CredentialExpired(cred)
+			}
+		}
+	}
+	return nil
+}
+
+// credentialFresh returns true if the credential of validity of cred is in
+// the issuer identity state idenStateData, or if cred is valid and the issuer
+// has no identity state on chain (idenStateData is nil).
+func credentialFresh(cred *StoredCredential, idenStateData *proof.IdenStateData) bool {
+	if idenStateData == nil {
+		return cred.Status == CredentialStatusValid
+	}
+	return cred.CredentialValidity != nil &&
+		cred.CredentialValidity.IdenStateData.IdenState.Equals(idenStateData.IdenState)
+}
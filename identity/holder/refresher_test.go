@@ -0,0 +1,206 @@
+package holder
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/iden3/go-iden3-core/components/idenpuboffchain"
+	idenpuboffchanlocal "github.com/iden3/go-iden3-core/components/idenpuboffchain/local"
+	"github.com/iden3/go-iden3-core/components/idenpubonchain"
+	idenpubonchainlocal "github.com/iden3/go-iden3-core/components/idenpubonchain/local"
+	"github.com/iden3/go-iden3-core/core"
+	"github.com/iden3/go-iden3-core/core/claims"
+	"github.com/iden3/go-iden3-core/core/proof"
+	"github.com/iden3/go-iden3-core/db"
+	"github.com/iden3/go-iden3-core/identity/issuer"
+	"github.com/iden3/go-iden3-core/merkletree"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// idenPubOnChainFake returns the identity states appended to states, or err
+// if it's not nil.
+type idenPubOnChainFake struct {
+	*idenpubonchainlocal.IdenPubOnChain
+	states map[core.ID][]*proof.IdenStateData
+	err    error
+}
+
+func newIdenPubOnChainFake() *idenPubOnChainFake {
+	return &idenPubOnChainFake{
+		IdenPubOnChain: idenpubonchainlocal.New(time.Now, func() uint64 { return 0 }, nil),
+		states:         make(map[core.ID][]*proof.IdenStateData),
+	}
+}
+
+func (ip *idenPubOnChainFake) GetState(id *core.ID) (*proof.IdenStateData, error) {
+	if ip.err != nil {
+		return nil, ip.err
+	}
+	idenStates, ok := ip.states[*id]
+	if !ok {
+		return nil, idenpubonchain.ErrIdenNotOnChain
+	}
+	return idenStates[len(idenStates)-1], nil
+}
+
+func (ip *idenPubOnChainFake) GetStateByBlock(id *core.ID, blockN uint64) (*proof.IdenStateData, error) {
+	idenStates := ip.states[*id]
+	for i := len(idenStates) - 1; i >= 0; i-- {
+		if idenStates[i].BlockN <= blockN {
+			return idenStates[i], nil
+		}
+	}
+	return nil, idenpubonchain.ErrIdenNotOnChain
+}
+
+// idenPubOffChainCounter counts the public data requests.
+type idenPubOffChainCounter struct {
+	*idenpuboffchanlocal.IdenPubOffChain
+	requests int
+}
+
+func (ip *idenPubOffChainCounter) GetPublicData(idenPubUrl string, id *core.ID,
+	idenState *merkletree.Hash) (*idenpuboffchain.PublicData, error) {
+	ip.requests++
+	return ip.IdenPubOffChain.GetPublicData(idenPubUrl, id, idenState)
+}
+
+// publishState publishes an identity state of the genesis only issuer with
+// the revoked nonces.
+func publishState(t *testing.T, is *issuer.Issuer, idenPubOnChain *idenPubOnChainFake,
+	idenPubOffChain *idenPubOffChainCounter, blockN uint64, revokedNonces []uint32) *merkletree.Hash {
+	_, idenStateTreeRoots := is.State()
+	revocationsTree, err := merkletree.NewMerkleTree(db.NewMemoryStorage(), 140)
+	require.Nil(t, err)
+	for _, nonce := range revokedNonces {
+		require.Nil(t, claims.AddLeafRevocationsTree(revocationsTree, nonce, 0xffffffff))
+	}
+	rootsTree, err := merkletree.NewMerkleTree(db.NewMemoryStorage(), 140)
+	require.Nil(t, err)
+	require.Nil(t, claims.AddLeafRootsTree(rootsTree, idenStateTreeRoots.ClaimsTreeRoot))
+	idenState := core.IdenState(idenStateTreeRoots.ClaimsTreeRoot, revocationsTree.RootKey(), rootsTree.RootKey())
+	require.Nil(t, idenPubOffChain.Publish(is.ID(), &idenpuboffchain.PublicData{
+		IdenState:           idenState,
+		ClaimsTreeRoot:      idenStateTreeRoots.ClaimsTreeRoot,
+		RevocationsTreeRoot: revocationsTree.RootKey(),
+		RevocationsTree:     revocationsTree,
+		RootsTreeRoot:       rootsTree.RootKey(),
+		RootsTree:           rootsTree,
+	}))
+	idenPubOnChain.states[*is.ID()] = append(idenPubOnChain.states[*is.ID()],
+		&proof.IdenStateData{IdenState: idenState, BlockN: blockN, BlockTs: time.Now().Unix()})
+	return idenState
+}
+
+func TestRefresher(t *testing.T) {
+	idenPubOnChain := newIdenPubOnChainFake()
+	idenPubOffChain := &idenPubOffChainCounter{IdenPubOffChain: idenpuboffchanlocal.NewIdenPubOffChain("")}
+	storage := db.NewMemoryStorage()
+	keyStore, kOp := newKeyStore(t)
+	_, err := Create(ConfigDefault, kOp, []claims.Claimer{}, storage, keyStore)
+	require.Nil(t, err)
+	ho, err := Load(storage, keyStore, idenPubOnChain, nil, nil, idenPubOffChain)
+	require.Nil(t, err)
+
+	claim0 := newClaimOtherIden(ho.ID(), 0)
+	claim1 := newClaimOtherIden(ho.ID(), 1)
+	is := newIssuerGenesis(t, []claims.Claimer{claim0, claim1})
+	for _, claim := range []claims.Claimer{claim0, claim1} {
+		credExist, err := is.GenCredentialExistenceGenesis(claim)
+		require.Nil(t, err)
+		require.Nil(t, ho.HolderImportCredentialExistence(credExist))
+	}
+	hi1, err := claim1.Entry().HIndex()
+	require.Nil(t, err)
+
+	revoked := []*StoredCredential{}
+	refresher := NewRefresher(ho, RefresherConfigDefault, RefresherHooks{
+		CredentialRevoked: func(cred *StoredCredential) { revoked = append(revoked, cred) },
+		RefreshFailed:     func(issuerID *core.ID, err error) { t.Errorf("refresh failed: %v", err) },
+	}, issuer.ClockSystem)
+	checkStatus := func(status0, status1 CredentialStatus) []*StoredCredential {
+		creds, err := ho.Credentials(CredentialsQuery{Issuer: is.ID()})
+		require.Nil(t, err)
+		require.Equal(t, 2, len(creds))
+		for _, cred := range creds {
+			if cred.HIndex.Equals(hi1) {
+				assert.Equal(t, status1, cred.Status)
+			} else {
+				assert.Equal(t, status0, cred.Status)
+			}
+		}
+		return creds
+	}
+
+	// The issuer has no identity state on chain, so the genesis claims
+	// are valid
+	require.Nil(t, refresher.step())
+	for _, cred := range checkStatus(CredentialStatusValid, CredentialStatusValid) {
+		assert.Nil(t, cred.CredentialValidity)
+	}
+	assert.Equal(t, 0, idenPubOffChain.requests)
+
+	// The public data of the new identity state is downloaded once
+	idenState := publishState(t, is, idenPubOnChain, idenPubOffChain, 1, nil)
+	require.Nil(t, refresher.step())
+	for _, cred := range checkStatus(CredentialStatusValid, CredentialStatusValid) {
+		assert.Equal(t, idenState, cred.CredentialValidity.IdenStateData.IdenState)
+	}
+	assert.Equal(t, 1, idenPubOffChain.requests)
+	require.Nil(t, refresher.step())
+	assert.Equal(t, 1, idenPubOffChain.requests)
+	assert.Equal(t, 0, len(revoked))
+
+	// claim1 is revoked in a new identity state
+	idenState = publishState(t, is, idenPubOnChain, idenPubOffChain, 2, []uint32{claim1.Metadata().RevNonce})
+	require.Nil(t, refresher.step())
+	creds := checkStatus(CredentialStatusValid, CredentialStatusRevoked)
+	for _, cred := range creds {
+		if cred.Status == CredentialStatusValid {
+			assert.Equal(t, idenState, cred.CredentialValidity.IdenStateData.IdenState)
+		}
+	}
+	assert.Equal(t, 2, idenPubOffChain.requests)
+	require.Equal(t, 1, len(revoked))
+	assert.Equal(t, hi1, revoked[0].HIndex)
+
+	// Revoked credentials are not refreshed again
+	require.Nil(t, refresher.step())
+	assert.Equal(t, 1, len(revoked))
+}
+
+func TestRefresherRun(t *testing.T) {
+	idenPubOnChain := newIdenPubOnChainFake()
+	idenPubOnChain.err = errors.New("smart contract unavailable")
+	storage := db.NewMemoryStorage()
+	keyStore, kOp := newKeyStore(t)
+	_, err := Create(ConfigDefault, kOp, []claims.Claimer{}, storage, keyStore)
+	require.Nil(t, err)
+	ho, err := Load(storage, keyStore, idenPubOnChain, nil, nil, nil)
+	require.Nil(t, err)
+	claim := newClaimOtherIden(ho.ID(), 0)
+	is := newIssuerGenesis(t, []claims.Claimer{claim})
+	credExist, err := is.GenCredentialExistenceGenesis(claim)
+	require.Nil(t, err)
+	require.Nil(t, ho.HolderImportCredentialExistence(credExist))
+
+	// The failure refreshing an issuer is returned by the cycle
+	failed := make(chan *core.ID, 1)
+	refresher := NewRefresher(ho, RefresherConfig{Interval: time.Hour}, RefresherHooks{
+		RefreshFailed: func(issuerID *core.ID, err error) { failed <- issuerID },
+	}, issuer.ClockSystem)
+	err = refresher.step()
+	assert.True(t, errors.Is(err, idenPubOnChain.err))
+	assert.Equal(t, is.ID(), <-failed)
+
+	// The first cycle runs right away
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- refresher.Run(ctx) }()
+	assert.Equal(t, is.ID(), <-failed)
+	cancel()
+	assert.Equal(t, context.Canceled, <-done)
+}
@@ -0,0 +1,287 @@
+package holder
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/iden3/go-iden3-core/components/idenpubonchain"
+	"github.com/iden3/go-iden3-core/core"
+	"github.com/iden3/go-iden3-core/core/claims"
+	"github.com/iden3/go-iden3-core/core/proof"
+	"github.com/iden3/go-iden3-core/db"
+	"github.com/iden3/go-iden3-core/identity/issuer"
+	"github.com/iden3/go-iden3-core/merkletree"
+)
+
+var (
+	ErrCredentialSubject              = fmt.Errorf("the claim subject is not the holder ID")
+	ErrCredentialMtpNonExistence      = fmt.Errorf("the credential Merkle Tree Proof is of non-existence")
+	ErrCredentialIdenStateDoesntMatch = fmt.Errorf("the credential IdenState doesn't match the one on chain")
+)
+
+var (
+	dbPrefixCredentials           = []byte("holdercreds:")
+	dbPrefixCredentialsIdxType    = []byte("holdercredsidxtype:")
+	dbPrefixCredentialsIdxSubject = []byte("holdercredsidxsubject:")
+)
+
+// CredentialStatus is the validity status of a stored credential.
+type CredentialStatus string
+
+const (
+	// CredentialStatusUnknown is the status of a credential whose validity
+	// hasn't been checked yet.
+	CredentialStatusUnknown CredentialStatus = "unknown"
+	// CredentialStatusValid is a credential not revoked in the last
+	// identity state of the issuer.
+	CredentialStatusValid CredentialStatus = "valid"
+	// CredentialStatusRevoked is a credential revoked by the issuer.
+	CredentialStatusRevoked CredentialStatus = "revoked"
+	// CredentialStatusExpired is a credential of an expired claim.
+	CredentialStatusExpired CredentialStatus = "expired"
+)
+
+// StoredCredential is a credential of existence received by the Holder,
+// with its validity status.
+type StoredCredential struct {
+	Issuer              *core.ID
+	HIndex              *merkletree.Hash
+	Type                claims.ClaimType
+	Subject             *core.ID
+	CredentialExistence *proof.CredentialExistence
+	Status              CredentialStatus
+	// CredentialValidity is the last credential of validity obtained, or
+	// nil if the status has never been valid.
+	CredentialValidity *proof.CredentialValidity
+	ImportTime         int64
+	// StatusTime is the time of the last validity check.
+	StatusTime int64
+}
+
+// CredentialsQuery are the filters to query the stored credentials.  Nil
+// filters are ignored.
+type CredentialsQuery struct {
+	Issuer  *core.ID
+	Type    *claims.ClaimType
+	Subject *core.ID
+}
+
+func dbKeyCredential(issuerID *core.ID, hi *merkletree.Hash) []byte {
+	return append(append(append([]byte{}, dbPrefixCredentials...), issuerID[:]...), hi[:]...)
+}
+
+// verifyCredentialExistence verifies that the claim of the credential of
+// existence is in the issuer identity state, which is either the genesis one
+// or the one on chain at the credential block.
+func (h *Holder) verifyCredentialExistence(credExist *proof.CredentialExistence) error {
+	if credExist.MtpClaim == nil || !credExist.MtpClaim.Existence {
+		return ErrCredentialMtpNonExistence
+	}
+	hi, hv, err := credExist.Claim.HiHv()
+	if err != nil {
+		return err
+	}
+	claimsRoot, err := merkletree.RootFromProof(credExist.MtpClaim, hi, hv)
+	if err != nil {
+		return err
+	}
+	idenState := core.IdenState(claimsRoot, credExist.RevocationsTreeRoot, credExist.RootsTreeRoot)
+	if !idenState.Equals(credExist.IdenStateData.IdenState) {
+		return ErrCalculatedIdenStateDoesntMatch
+	}
+	if core.IdGenesisFromIdenState(idenState).Equal(credExist.Id) {
+		return nil
+	}
+	if h.idenPubOnChain == nil {
+		return issuer.ErrIdenPubOnChainNil
+	}
+	idenStateDataOnChain, err := h.idenPubOnChain.GetStateByBlock(credExist.Id, credExist.IdenStateData.BlockN)
+	if err != nil {
+		return err
+	}
+	if !reflect.DeepEqual(idenStateDataOnChain, &credExist.IdenStateData) {
+		return ErrCredentialIdenStateDoesntMatch
+	}
+	return nil
+}
+
+// HolderImportCredentialExistence verifies a received Credential of
+// Existence of a claim about the Holder and stores it, indexed by issuer,
+// claim type and subject.  Importing a credential of an already stored
+// claim replaces it.
+func (h *Holder) HolderImportCredentialExistence(credExist *proof.CredentialExistence) error {
+	var metadata claims.Metadata
+	metadata.Unmarshal(credExist.Claim)
+	if metadata.Subject == nil || !metadata.Subject.Equal(h.ID()) {
+		return ErrCredentialSubject
+	}
+	if err := h.verifyCredentialExistence(credExist); err != nil {
+		return err
+	}
+	hi, err := credExist.Claim.HIndex()
+	if err != nil {
+		return err
+	}
+	now := h.timeNow().Unix()
+	cred := StoredCredential{
+		Issuer:              credExist.Id,
+		HIndex:              hi,
+		Type:                metadata.Type(),
+		Subject:             metadata.Subject,
+		CredentialExistence: credExist,
+		Status:              CredentialStatusUnknown,
+		ImportTime:          now,
+	}
+	if claimExpired(&metadata, now) {
+		cred.Status = CredentialStatusExpired
+		cred.StatusTime = now
+	}
+
+	tx, err := h.storage.NewTx()
+	if err != nil {
+		return err
+	}
+	key := dbKeyCredential(cred.Issuer, cred.HIndex)
+	if err := db.StoreJSON(tx, key, &cred); err != nil {
+		return err
+	}
+	idxKey := append(append([]byte{}, cred.Issuer[:]...), cred.HIndex[:]...)
+	tx.Put(append(append(append([]byte{}, dbPrefixCredentialsIdxType...), cred.Type[:]...), idxKey...), key)
+	tx.Put(append(append(append([]byte{}, dbPrefixCredentialsIdxSubject...), cred.Subject[:]...), idxKey...), key)
+	return tx.Commit()
+}
+
+// claimExpired returns true if the claim with metadata has an expiration
+// date before now.
+func claimExpired(metadata *claims.Metadata, now int64) bool {
+	return metadata.Header().Expiration && metadata.Expiration < now
+}
+
+// credentialExpired returns true if the claim of the stored credential cred
+// has an expiration date before now.
+func credentialExpired(cred *StoredCredential, now int64) bool {
+	var metadata claims.Metadata
+	metadata.Unmarshal(cred.CredentialExistence.Claim)
+	return claimExpired(&metadata, now)
+}
+
+// Credential returns the stored credential of the claim with HIndex hi
+// issued by issuerID.
+func (h *Holder) Credential(issuerID *core.ID, hi *merkletree.Hash) (*StoredCredential, error) {
+	var cred StoredCredential
+	if err := db.LoadJSON(h.storage, dbKeyCredential(issuerID, hi), &cred); err != nil {
+		return nil, err
+	}
+	return &cred, nil
+}
+
+// Credentials returns the stored credentials that match the query.
+func (h *Holder) Credentials(query CredentialsQuery) ([]*StoredCredential, error) {
+	// Collect the candidate keys using the most selective index
+	// available.  The remaining filters are applied on each credential.
+	var keys [][]byte
+	var prefix []byte
+	if query.Issuer != nil {
+		prefix = append(append([]byte{}, dbPrefixCredentials...), query.Issuer[:]...)
+	} else if query.Type != nil {
+		prefix = append(append([]byte{}, dbPrefixCredentialsIdxType...), query.Type[:]...)
+	} else if query.Subject != nil {
+		prefix = append(append([]byte{}, dbPrefixCredentialsIdxSubject...), query.Subject[:]...)
+	} else {
+		prefix = dbPrefixCredentials
+	}
+	isIdx := query.Issuer == nil && (query.Type != nil || query.Subject != nil)
+	if err := h.storage.WithPrefix(prefix).Iterate(func(key, value []byte) (bool, error) {
+		if isIdx {
+			keys = append(keys, append([]byte{}, value...))
+		} else {
+			keys = append(keys, append(append([]byte{}, prefix...), key...))
+		}
+		return true, nil
+	}); err != nil {
+		return nil, err
+	}
+
+	results := []*StoredCredential{}
+	for _, key := range keys {
+		var cred StoredCredential
+		if err := db.LoadJSON(h.storage, key, &cred); err != nil {
+			return nil, err
+		}
+		if query.Type != nil && cred.Type != *query.Type {
+			continue
+		}
+		if query.Subject != nil && !cred.Subject.Equal(query.Subject) {
+			continue
+		}
+		results = append(results, &cred)
+	}
+	return results, nil
+}
+
+// HolderUpdateCredentialStatus checks the validity of the stored credential
+// of the claim with HIndex hi issued by issuerID against the last identity
+// state of the issuer, storing its new status and its credential of
+// validity.  This requires a request to the Issuer IdenStatePubOffChain.
+func (h *Holder) HolderUpdateCredentialStatus(issuerID *core.ID, hi *merkletree.Hash) (*StoredCredential, error) {
+	cred, err := h.Credential(issuerID, hi)
+	if err != nil {
+		return nil, err
+	}
+	idenStateData, err := h.issuerIdenStateData(issuerID)
+	if err != nil {
+		return nil, err
+	}
+	if err := h.updateCredentialStatus(cred, idenStateData); err != nil {
+		return nil, err
+	}
+	return cred, nil
+}
+
+// issuerIdenStateData returns the last identity state on chain of the issuer
+// issuerID, or nil if the issuer has no identity state on chain.
+func (h *Holder) issuerIdenStateData(issuerID *core.ID) (*proof.IdenStateData, error) {
+	if h.idenPubOnChain == nil {
+		return nil, issuer.ErrIdenPubOnChainNil
+	}
+	idenStateData, err := h.idenPubOnChain.GetState(issuerID)
+	if errors.Is(err, idenpubonchain.ErrIdenNotOnChain) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return idenStateData, nil
+}
+
+// updateCredentialStatus checks the validity of the stored credential cred
+// against the issuer identity state idenStateData, and stores its new status
+// and its credential of validity.  If idenStateData is nil the issuer only
+// has the genesis identity state, so the claim can't have been revoked, and
+// there is no credential of validity.
+func (h *Holder) updateCredentialStatus(cred *StoredCredential, idenStateData *proof.IdenStateData) error {
+	now := h.timeNow().Unix()
+	if credentialExpired(cred, now) {
+		cred.Status = CredentialStatusExpired
+	} else if idenStateData == nil {
+		cred.Status = CredentialStatusValid
+	} else if credValidData, err := h.credentialValidityData(cred.CredentialExistence,
+		idenStateData); err == ErrRevokedClaim {
+		cred.Status = CredentialStatusRevoked
+	} else if err != nil {
+		return err
+	} else {
+		cred.Status = CredentialStatusValid
+		cred.CredentialValidity = newCredentialValidity(cred.CredentialExistence, credValidData)
+	}
+	cred.StatusTime = now
+
+	tx, err := h.storage.NewTx()
+	if err != nil {
+		return err
+	}
+	if err := db.StoreJSON(tx, dbKeyCredential(cred.Issuer, cred.HIndex), cred); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
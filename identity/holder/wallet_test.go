@@ -0,0 +1,122 @@
+package holder
+
+import (
+	"testing"
+
+	"github.com/iden3/go-iden3-core/core"
+	"github.com/iden3/go-iden3-core/core/claims"
+	"github.com/iden3/go-iden3-core/core/proof"
+	"github.com/iden3/go-iden3-core/db"
+	"github.com/iden3/go-iden3-core/identity/issuer"
+	"github.com/iden3/go-iden3-core/keystore"
+	"github.com/iden3/go-iden3-core/merkletree"
+	"github.com/iden3/go-iden3-crypto/babyjub"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var pass = []byte("my passphrase")
+
+func newKeyStore(t *testing.T) (*keystore.KeyStore, *babyjub.PublicKeyComp) {
+	ksStorage := keystore.MemStorage([]byte{})
+	keyStore, err := keystore.NewKeyStore(&ksStorage, keystore.LightKeyStoreParams)
+	require.Nil(t, err)
+	kOp, err := keyStore.NewKey(pass)
+	require.Nil(t, err)
+	require.Nil(t, keyStore.UnlockKey(kOp, pass))
+	return keyStore, kOp
+}
+
+func newHolder(t *testing.T) *Holder {
+	storage := db.NewMemoryStorage()
+	keyStore, kOp := newKeyStore(t)
+	_, err := Create(ConfigDefault, kOp, []claims.Claimer{}, storage, keyStore)
+	require.Nil(t, err)
+	ho, err := Load(storage, keyStore, nil, nil, nil, nil)
+	require.Nil(t, err)
+	return ho
+}
+
+// newIssuerGenesis creates a genesis only issuer with the extraGenesisClaims.
+func newIssuerGenesis(t *testing.T, extraGenesisClaims []claims.Claimer) *issuer.Issuer {
+	cfg := issuer.ConfigDefault
+	cfg.GenesisOnly = true
+	storage := db.NewMemoryStorage()
+	keyStore, kOp := newKeyStore(t)
+	_, err := issuer.Create(cfg, kOp, extraGenesisClaims, storage, keyStore)
+	require.Nil(t, err)
+	is, err := issuer.Load(storage, keyStore, nil, nil, nil)
+	require.Nil(t, err)
+	return is
+}
+
+func newClaimOtherIden(id *core.ID, index byte) claims.Claimer {
+	indexBytes, valueBytes := [claims.IndexSubjectSlotLen]byte{}, [claims.ValueSlotLen]byte{}
+	indexBytes[0] = index
+	return claims.NewClaimOtherIden(id, indexBytes, valueBytes)
+}
+
+func TestHolderWallet(t *testing.T) {
+	ho := newHolder(t)
+	other := newHolder(t)
+
+	claim0 := newClaimOtherIden(ho.ID(), 0)
+	claim1 := newClaimOtherIden(ho.ID(), 1)
+	claimOther := newClaimOtherIden(other.ID(), 2)
+	claimBasic := claims.NewClaimBasic([claims.IndexSlotLen]byte{}, [claims.ValueSlotLen]byte{})
+	is := newIssuerGenesis(t, []claims.Claimer{claim0, claim1, claimOther, claimBasic})
+	claim2 := newClaimOtherIden(ho.ID(), 3)
+	is2 := newIssuerGenesis(t, []claims.Claimer{claim2})
+
+	credExist := func(is *issuer.Issuer, claim merkletree.Entrier) *proof.CredentialExistence {
+		credExist, err := is.GenCredentialExistenceGenesis(claim)
+		require.Nil(t, err)
+		return credExist
+	}
+	require.Nil(t, ho.HolderImportCredentialExistence(credExist(is, claim0)))
+	require.Nil(t, ho.HolderImportCredentialExistence(credExist(is, claim1)))
+	require.Nil(t, ho.HolderImportCredentialExistence(credExist(is2, claim2)))
+
+	// Credentials of claims about other identities are rejected
+	assert.Equal(t, ErrCredentialSubject, ho.HolderImportCredentialExistence(credExist(is, claimOther)))
+	assert.Equal(t, ErrCredentialSubject, ho.HolderImportCredentialExistence(credExist(is, claimBasic)))
+
+	// Credentials with an invalid proof are rejected
+	credExistBad := credExist(is, claim1)
+	credExistBad.Claim = newClaimOtherIden(ho.ID(), 4).Entry()
+	assert.Equal(t, ErrCalculatedIdenStateDoesntMatch, ho.HolderImportCredentialExistence(credExistBad))
+
+	creds, err := ho.Credentials(CredentialsQuery{})
+	require.Nil(t, err)
+	assert.Equal(t, 3, len(creds))
+	creds, err = ho.Credentials(CredentialsQuery{Issuer: is.ID()})
+	require.Nil(t, err)
+	require.Equal(t, 2, len(creds))
+	for _, cred := range creds {
+		assert.Equal(t, CredentialStatusUnknown, cred.Status)
+		assert.Equal(t, is.ID(), cred.Issuer)
+	}
+	claimType := claims.ClaimTypeOtherIden
+	creds, err = ho.Credentials(CredentialsQuery{Type: &claimType, Subject: ho.ID()})
+	require.Nil(t, err)
+	assert.Equal(t, 3, len(creds))
+	creds, err = ho.Credentials(CredentialsQuery{Subject: other.ID()})
+	require.Nil(t, err)
+	assert.Equal(t, 0, len(creds))
+	claimType = claims.ClaimTypeBasic
+	creds, err = ho.Credentials(CredentialsQuery{Issuer: is.ID(), Type: &claimType})
+	require.Nil(t, err)
+	assert.Equal(t, 0, len(creds))
+
+	hi, err := claim0.Entry().HIndex()
+	require.Nil(t, err)
+	cred, err := ho.Credential(is.ID(), hi)
+	require.Nil(t, err)
+	assert.Equal(t, claim0.Entry(), cred.CredentialExistence.Claim)
+	_, err = ho.Credential(is2.ID(), hi)
+	assert.Equal(t, db.ErrNotFound, err)
+
+	// The status can't be updated without access to the smart contract
+	_, err = ho.HolderUpdateCredentialStatus(is.ID(), hi)
+	assert.Equal(t, issuer.ErrIdenPubOnChainNil, err)
+}
@@ -17,7 +17,7 @@ type Issuer interface {
 	PublishState() error
 	RevokeClaim(claim merkletree.Entrier) error
 	UpdateClaim(hIndex *merkletree.Hash, value []merkletree.ElemBytes) error
-	Sign(string) (string, error)
+	Sign(domain string, msg []byte) (*proof.SignedMsg, error)
 	SignBinary(string) (string, error)
 }
 
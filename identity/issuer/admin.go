@@ -0,0 +1,274 @@
+package issuer
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/iden3/go-iden3-core/core/claims"
+	"github.com/iden3/go-iden3-core/db"
+	"github.com/iden3/go-iden3-core/merkletree"
+)
+
+var (
+	ErrInvalidTreeType  = fmt.Errorf("invalid tree type")
+	ErrTreeRootUnknown  = fmt.Errorf("the tree root doesn't belong to any identity state of the issuer")
+	ErrIdenStateUnknown = fmt.Errorf("the identity state is not in the issuer identity states list")
+)
+
+// TreeType identifies one of the three merkle trees of an Issuer.
+type TreeType string
+
+const (
+	TreeTypeClaims      TreeType = "claims"
+	TreeTypeRevocations TreeType = "revocations"
+	TreeTypeRoots       TreeType = "roots"
+)
+
+// Admin exposes the low level data of an Issuer for support and data
+// migration.  It's based on the old components/idenadminutils.
+type Admin struct {
+	is *Issuer
+}
+
+// NewAdmin creates a new Admin of the Issuer.
+func NewAdmin(is *Issuer) *Admin {
+	return &Admin{is: is}
+}
+
+// Trees returns the claims, revocations and roots merkle trees of the
+// Issuer.  The trees must not be modified.
+func (a *Admin) Trees() (claimsTree, revocationsTree, rootsTree *merkletree.MerkleTree) {
+	a.is.rw.RLock()
+	defer a.is.rw.RUnlock()
+	return a.is.claimsTree, a.is.revocationsTree, a.is.rootsTree
+}
+
+// tree returns the merkle tree of treeType.
+func (a *Admin) tree(treeType TreeType) (*merkletree.MerkleTree, error) {
+	switch treeType {
+	case TreeTypeClaims:
+		return a.is.claimsTree, nil
+	case TreeTypeRevocations:
+		return a.is.revocationsTree, nil
+	case TreeTypeRoots:
+		return a.is.rootsTree, nil
+	default:
+		return nil, ErrInvalidTreeType
+	}
+}
+
+// root returns the root of the tree of treeType.
+func (r *IdenStateTreeRoots) root(treeType TreeType) (*merkletree.Hash, error) {
+	switch treeType {
+	case TreeTypeClaims:
+		return r.ClaimsTreeRoot, nil
+	case TreeTypeRevocations:
+		return r.RevocationsTreeRoot, nil
+	case TreeTypeRoots:
+		return r.RootsTreeRoot, nil
+	default:
+		return nil, ErrInvalidTreeType
+	}
+}
+
+// treeRoot returns the root of the tree of treeType in the identity state
+// idenState, or in the current one if idenState is nil.  Must be called
+// with the lock held.
+func (a *Admin) treeRoot(treeType TreeType, idenState *merkletree.Hash) (*merkletree.Hash, error) {
+	var idenStateTreeRoots *IdenStateTreeRoots
+	if idenState == nil {
+		_, roots := a.is.state()
+		idenStateTreeRoots = &roots
+	} else {
+		tx, err := a.is.storage.NewTx() // Read only Tx
+		if err != nil {
+			return nil, err
+		}
+		defer tx.Close()
+		if idenStateTreeRoots, err = a.is.getIdenStateTreeRoots(tx, idenState); err == db.ErrNotFound {
+			return nil, ErrIdenStateUnknown
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	return idenStateTreeRoots.root(treeType)
+}
+
+// DumpTree writes to w the dump of the tree of treeType in the identity
+// state idenState, or in the current one if idenState is nil.  The output
+// can be imported with ImportTree.
+func (a *Admin) DumpTree(w io.Writer, treeType TreeType, idenState *merkletree.Hash) error {
+	a.is.rw.RLock()
+	defer a.is.rw.RUnlock()
+	mt, err := a.tree(treeType)
+	if err != nil {
+		return err
+	}
+	rootKey, err := a.treeRoot(treeType, idenState)
+	if err != nil {
+		return err
+	}
+	return mt.DumpTree(w, rootKey)
+}
+
+// ImportTree imports a tree of treeType dumped with DumpTree and returns its
+// root, which must be the root of the tree in one of the identity states of
+// the Issuer.  This allows restoring the nodes of a historical identity
+// state.  The current trees of the Issuer are not modified.
+func (a *Admin) ImportTree(r io.Reader, treeType TreeType) (*merkletree.Hash, error) {
+	a.is.rw.Lock()
+	defer a.is.rw.Unlock()
+	mt, err := a.tree(treeType)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := mt.Storage().NewTx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Close()
+	rootKey, err := mt.ImportTreeTx(tx, r)
+	if err != nil {
+		return nil, err
+	}
+	if known, err := a.treeRootKnown(treeType, rootKey); err != nil {
+		return nil, err
+	} else if !known {
+		return nil, ErrTreeRootUnknown
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return rootKey, nil
+}
+
+// treeRootKnown returns true if rootKey is the root of the tree of treeType
+// in the current identity state or in one of the idenStateList.  Must be
+// called with the lock held.
+func (a *Admin) treeRootKnown(treeType TreeType, rootKey *merkletree.Hash) (bool, error) {
+	rootKeyCurrent, err := a.treeRoot(treeType, nil)
+	if err != nil {
+		return false, err
+	}
+	if rootKey.Equals(rootKeyCurrent) {
+		return true, nil
+	}
+	tx, err := a.is.storage.NewTx() // Read only Tx
+	if err != nil {
+		return false, err
+	}
+	defer tx.Close()
+	idenStateListLen, err := a.is.idenStateList.Length(tx)
+	if err != nil {
+		return false, err
+	}
+	for idx := uint32(0); idx < idenStateListLen; idx++ {
+		_, idenStateTreeRoots, err := a.is.getIdenStateByIdx(tx, int64(idx))
+		if err != nil {
+			return false, err
+		}
+		rootKeyIdx, err := idenStateTreeRoots.root(treeType)
+		if err != nil {
+			return false, err
+		}
+		if rootKey.Equals(rootKeyIdx) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// RawDump calls f with every key and value, hex encoded, of the Issuer
+// storage.
+func (a *Admin) RawDump(f func(key, value string)) error {
+	a.is.rw.RLock()
+	defer a.is.rw.RUnlock()
+	return a.is.storage.Iterate(func(key, value []byte) (bool, error) {
+		f(hex.EncodeToString(key), hex.EncodeToString(value))
+		return true, nil
+	})
+}
+
+// RawImport stores every hex encoded key and value of raw in the Issuer
+// storage in a single transaction and returns the number of imported
+// entries.  The output of RawDump can be imported.  After the import, the
+// Issuer trees and state are reloaded from the storage.
+func (a *Admin) RawImport(raw map[string]string) (int, error) {
+	a.is.rw.Lock()
+	defer a.is.rw.Unlock()
+	tx, err := a.is.storage.NewTx()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Close()
+	for k, v := range raw {
+		key, err := hex.DecodeString(strings.TrimPrefix(k, "0x"))
+		if err != nil {
+			return 0, fmt.Errorf("invalid key %v: %w", k, err)
+		}
+		value, err := hex.DecodeString(strings.TrimPrefix(v, "0x"))
+		if err != nil {
+			return 0, fmt.Errorf("invalid value of key %v: %w", k, err)
+		}
+		tx.Put(key, value)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	if err := a.is.reload(); err != nil {
+		return 0, err
+	}
+	return len(raw), nil
+}
+
+// ClaimsDump returns the claims, hex encoded, of the claims tree in the
+// identity state idenState, or in the current one if idenState is nil.  The
+// output can be decoded with DecodeClaimsDump.
+func (a *Admin) ClaimsDump(idenState *merkletree.Hash) ([]string, error) {
+	a.is.rw.RLock()
+	defer a.is.rw.RUnlock()
+	rootKey, err := a.treeRoot(TreeTypeClaims, idenState)
+	if err != nil {
+		return nil, err
+	}
+	return a.is.claimsTree.DumpClaims(rootKey)
+}
+
+// DecodeClaimsDump decodes the hex encoded claims of a claims dump into
+// typed claims.
+func DecodeClaimsDump(dumpedClaims []string) ([]merkletree.Entrier, error) {
+	entries, err := decodeClaimsDumpEntries(dumpedClaims)
+	if err != nil {
+		return nil, err
+	}
+	cs := make([]merkletree.Entrier, len(entries))
+	for i, e := range entries {
+		claim, err := claims.NewClaimFromEntry(e)
+		if err != nil {
+			return nil, fmt.Errorf("invalid claim %v: %w", i, err)
+		}
+		cs[i] = claim
+	}
+	return cs, nil
+}
+
+// decodeClaimsDumpEntries decodes the hex encoded claims of a claims dump
+// into entries.
+func decodeClaimsDumpEntries(dumpedClaims []string) ([]*merkletree.Entry, error) {
+	entries := make([]*merkletree.Entry, len(dumpedClaims))
+	for i, dumpedClaim := range dumpedClaims {
+		var dataBytes [merkletree.ElemBytesLen * merkletree.DataLen]byte
+		b, err := hex.DecodeString(strings.TrimPrefix(dumpedClaim, "0x"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid claim %v: %w", i, err)
+		}
+		if len(b) != len(dataBytes) {
+			return nil, fmt.Errorf("invalid claim %v: length %v != %v", i, len(b), len(dataBytes))
+		}
+		copy(dataBytes[:], b)
+		entries[i] = &merkletree.Entry{Data: *merkletree.NewDataFromBytes(dataBytes)}
+	}
+	return entries, nil
+}
@@ -0,0 +1,113 @@
+package issuer
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/iden3/go-iden3-core/core/claims"
+	"github.com/iden3/go-iden3-core/merkletree"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdmin(t *testing.T) {
+	issuer, storage, _ := newIssuer(t, false, idenPubOnChain, idenPubOffChain)
+	admin := NewAdmin(issuer)
+	tx, err := storage.NewTx()
+	require.Nil(t, err)
+	defer tx.Close()
+	genesisState, genesisTreeRoots, err := issuer.getIdenStateByIdx(tx, 0)
+	require.Nil(t, err)
+
+	indexBytes, valueBytes := [claims.IndexSlotLen]byte{}, [claims.ValueSlotLen]byte{}
+	claim := claims.NewClaimBasic(indexBytes, valueBytes)
+	require.Nil(t, issuer.IssueClaim(claim))
+	require.Nil(t, issuer.RevokeClaim(claim))
+	issuer.rw.Lock()
+	_, idenState, _, err := issuer.preparePublishState()
+	issuer.rw.Unlock()
+	require.Nil(t, err)
+
+	claimsTree, revocationsTree, rootsTree := admin.Trees()
+	_, idenStateTreeRoots := issuer.State()
+	assert.Equal(t, idenStateTreeRoots.ClaimsTreeRoot, claimsTree.RootKey())
+	assert.Equal(t, idenStateTreeRoots.RevocationsTreeRoot, revocationsTree.RootKey())
+	assert.Equal(t, idenStateTreeRoots.RootsTreeRoot, rootsTree.RootKey())
+
+	// Claims dump at the genesis and at the current identity state
+	dumpedClaims, err := admin.ClaimsDump(genesisState)
+	require.Nil(t, err)
+	genesisClaims, err := DecodeClaimsDump(dumpedClaims)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(genesisClaims))
+	assert.IsType(t, &claims.ClaimKeyBabyJub{}, genesisClaims[0])
+	dumpedClaims, err = admin.ClaimsDump(idenState)
+	require.Nil(t, err)
+	cs, err := DecodeClaimsDump(dumpedClaims)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(cs))
+	claimBasicFound := false
+	for _, c := range cs {
+		if c, ok := c.(*claims.ClaimBasic); ok {
+			claimBasicFound = true
+			assert.Equal(t, claim.Entry().Data, c.Entry().Data)
+		}
+	}
+	assert.True(t, claimBasicFound)
+	_, err = DecodeClaimsDump([]string{"0x1234"})
+	assert.NotNil(t, err)
+
+	// Trees dump and import at a historical identity state
+	var dump bytes.Buffer
+	require.Nil(t, admin.DumpTree(&dump, TreeTypeRevocations, genesisState))
+	rootKey, err := admin.ImportTree(&dump, TreeTypeRevocations)
+	require.Nil(t, err)
+	assert.Equal(t, genesisTreeRoots.RevocationsTreeRoot, rootKey)
+	dump.Reset()
+	require.Nil(t, admin.DumpTree(&dump, TreeTypeClaims, nil))
+	rootKey, err = admin.ImportTree(&dump, TreeTypeClaims)
+	require.Nil(t, err)
+	assert.Equal(t, idenStateTreeRoots.ClaimsTreeRoot, rootKey)
+
+	var idenStateUnknown merkletree.Hash
+	idenStateUnknown[0] = 0x42
+	assert.Equal(t, ErrIdenStateUnknown, admin.DumpTree(&dump, TreeTypeRoots, &idenStateUnknown))
+	assert.Equal(t, ErrInvalidTreeType, admin.DumpTree(&dump, TreeType("foo"), nil))
+
+	// The trees of another identity are not imported
+	issuer2, _, _ := newIssuer(t, true, nil, nil)
+	dump.Reset()
+	require.Nil(t, NewAdmin(issuer2).DumpTree(&dump, TreeTypeClaims, nil))
+	_, err = admin.ImportTree(&dump, TreeTypeClaims)
+	assert.Equal(t, ErrTreeRootUnknown, err)
+
+	// Raw dump and import restore a previous identity state
+	raw := make(map[string]string)
+	require.Nil(t, admin.RawDump(func(key, value string) { raw[key] = value }))
+	indexBytes[0] = 0x01
+	require.Nil(t, issuer.IssueClaim(claims.NewClaimBasic(indexBytes, valueBytes)))
+	idenStateNew, _ := issuer.State()
+	assert.NotEqual(t, idenState, idenStateNew)
+	n, err := admin.RawImport(raw)
+	require.Nil(t, err)
+	assert.Equal(t, len(raw), n)
+	idenStateRestored, _ := issuer.State()
+	assert.Equal(t, idenState, idenStateRestored)
+	idenStatePending, _ := issuer.IdenStatePending()
+	assert.Equal(t, idenState, idenStatePending)
+
+	// Raw import of another identity replaces the id and operational key
+	issuer3, _, _ := newIssuer(t, false, idenPubOnChain, idenPubOffChain)
+	raw = make(map[string]string)
+	require.Nil(t, NewAdmin(issuer3).RawDump(func(key, value string) { raw[key] = value }))
+	_, err = admin.RawImport(raw)
+	require.Nil(t, err)
+	assert.Equal(t, issuer3.ID(), issuer.ID())
+	assert.Equal(t, issuer3.KeyOperational(), issuer.KeyOperational())
+	idenStateImported, _ := issuer.State()
+	idenState3, _ := issuer3.State()
+	assert.Equal(t, idenState3, idenStateImported)
+
+	_, err = admin.RawImport(map[string]string{"0xzz": "00"})
+	assert.NotNil(t, err)
+}
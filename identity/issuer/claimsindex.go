@@ -0,0 +1,368 @@
+package issuer
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+
+	"github.com/iden3/go-iden3-core/core"
+	"github.com/iden3/go-iden3-core/core/claims"
+	"github.com/iden3/go-iden3-core/db"
+	"github.com/iden3/go-iden3-core/merkletree"
+)
+
+var (
+	ErrClaimNotFoundRevNonce = fmt.Errorf("no issued claim found with the revocation nonce")
+)
+
+var (
+	dbPrefixClaimsLog             = []byte("claimslog:")
+	dbPrefixClaimsIdxType         = []byte("claimsidxtype:")
+	dbPrefixClaimsIdxSubject      = []byte("claimsidxsubject:")
+	dbPrefixClaimsIdxRevNonce     = []byte("claimsidxrevnonce:")
+	dbPrefixIdenStateClaimsLogLen = []byte("idenstateclaimsloglen:")
+)
+
+// ClaimRecord is the information stored in the issuer claims index for every
+// issued claim.
+type ClaimRecord struct {
+	// Idx is the position of the claim in the list of issued claims.
+	Idx       uint32
+	Type      claims.ClaimType
+	Subject   *core.ID
+	RevNonce  uint32
+	IssueTime int64
+}
+
+// IssuedClaim is an issued claim returned by the claims index queries.
+type IssuedClaim struct {
+	ClaimRecord
+	HIndex *merkletree.Hash
+	Claim  *merkletree.Entry
+	// IdenState is the first identity state published by the issuer that
+	// includes the claim.  It is nil if the claim has been issued but no
+	// identity state including it has been seen on chain yet.
+	IdenState *merkletree.Hash
+}
+
+// ClaimsQuery are the filters and pagination parameters to query the issued
+// claims.  Nil filters are ignored.  The results are returned in issuance
+// order.
+type ClaimsQuery struct {
+	Type    *claims.ClaimType
+	Subject *core.ID
+	Offset  int
+	// Limit is the maximum number of results.  0 means no limit.
+	Limit int
+}
+
+func uint32ToBytesBE(v uint32) []byte {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	return b[:]
+}
+
+func dbKeyClaimsIdxRevNonce(nonce uint32) []byte {
+	return append(append([]byte{}, dbPrefixClaimsIdxRevNonce...), uint32ToBytesBE(nonce)...)
+}
+
+func dbKeyIdenStateClaimsLogLen(idenState *merkletree.Hash) []byte {
+	return append(append([]byte{}, dbPrefixIdenStateClaimsLogLen...), idenState[:]...)
+}
+
+// indexClaim adds the claim to the claims index in an open db transaction.
+func (is *Issuer) indexClaim(tx db.Tx, claim merkletree.Entrier, issueTime int64) error {
+	e := claim.Entry()
+	hi, err := e.HIndex()
+	if err != nil {
+		return err
+	}
+	var metadata claims.Metadata
+	metadata.Unmarshal(e)
+	idx, err := is.claimsLog.Length(tx)
+	if err != nil {
+		return err
+	}
+	record := ClaimRecord{
+		Idx:       idx,
+		Type:      metadata.Type(),
+		Subject:   metadata.Subject,
+		RevNonce:  metadata.RevNonce,
+		IssueTime: issueTime,
+	}
+	if err := is.claimsLog.Append(tx, hi[:], &record); err != nil {
+		return err
+	}
+	idxBytes := uint32ToBytesBE(idx)
+	tx.Put(append(append(append([]byte{}, dbPrefixClaimsIdxType...), record.Type[:]...), idxBytes...), hi[:])
+	if record.Subject != nil {
+		tx.Put(append(append(append([]byte{}, dbPrefixClaimsIdxSubject...), record.Subject[:]...), idxBytes...), hi[:])
+	}
+	tx.Put(dbKeyClaimsIdxRevNonce(record.RevNonce), hi[:])
+	return nil
+}
+
+// indexIdenState stores the number of issued claims included in the
+// identity state in an open db transaction.
+func (is *Issuer) indexIdenState(tx db.Tx, idenState *merkletree.Hash) error {
+	claimsLogLen, err := is.claimsLog.Length(tx)
+	if err != nil {
+		return err
+	}
+	db.NewStorageValue(dbKeyIdenStateClaimsLogLen(idenState)).Set(tx, claimsLogLen)
+	return nil
+}
+
+// migrateClaimsIndex initializes the claims index of an Issuer created by a
+// version without it, indexing every claim of the claims tree.  The claims
+// are indexed in the order of the first identity state that includes them,
+// which keeps the number of indexed claims of every identity state, and
+// their issue time is unknown, so it's left as 0.
+func (is *Issuer) migrateClaimsIndex(tx db.Tx) (bool, error) {
+	if _, err := is.claimsLog.Length(tx); err == nil {
+		return false, nil
+	} else if err != db.ErrNotFound {
+		return false, err
+	}
+	idenStateListLen, err := is.idenStateList.Length(tx)
+	if err != nil {
+		return false, err
+	}
+	idenStates := make([]*merkletree.Hash, idenStateListLen)
+	claimsTreeRoots := make([]*merkletree.Hash, idenStateListLen)
+	for i := range idenStates {
+		idenState, idenStateTreeRoots, err := is.getIdenStateByIdx(tx, int64(i))
+		if err != nil {
+			return false, err
+		}
+		idenStates[i], claimsTreeRoots[i] = idenState, idenStateTreeRoots.ClaimsTreeRoot
+	}
+
+	// Claims are never removed from the claims tree, so the first identity
+	// state that includes a claim can be found with a binary search.
+	type claimFirstIdenState struct {
+		entry        *merkletree.Entry
+		idenStateIdx int
+	}
+	leafs, err := treeLeafs(is.claimsTree, is.claimsTree.RootKey())
+	if err != nil {
+		return false, err
+	}
+	claimsFirst := make([]claimFirstIdenState, len(leafs))
+	for i, leaf := range leafs {
+		hi, err := leaf.HIndex()
+		if err != nil {
+			return false, err
+		}
+		var errSearch error
+		idx := sort.Search(len(claimsTreeRoots), func(j int) bool {
+			mtp, err := is.claimsTree.GenerateProof(hi, claimsTreeRoots[j])
+			if err != nil {
+				errSearch = err
+				return true
+			}
+			return mtp.Existence
+		})
+		if errSearch != nil {
+			return false, errSearch
+		}
+		claimsFirst[i] = claimFirstIdenState{entry: leaf, idenStateIdx: idx}
+	}
+	sort.SliceStable(claimsFirst, func(i, j int) bool {
+		return claimsFirst[i].idenStateIdx < claimsFirst[j].idenStateIdx
+	})
+
+	is.claimsLog.Init(tx)
+	j := 0
+	for i := 0; i <= len(idenStates); i++ {
+		for ; j < len(claimsFirst) && claimsFirst[j].idenStateIdx <= i; j++ {
+			if err := is.indexClaim(tx, (*entrier)(claimsFirst[j].entry), 0); err != nil {
+				return false, err
+			}
+		}
+		if i < len(idenStates) {
+			if err := is.indexIdenState(tx, idenStates[i]); err != nil {
+				return false, err
+			}
+		}
+	}
+	return true, nil
+}
+
+// claimIdenState returns the first published identity state that includes
+// the issued claim at position idx of the claims log, or nil if there's
+// none.  The published identity states are the genesis one and the ones seen
+// on chain.
+func (is *Issuer) claimIdenState(tx db.Tx, idx uint32) (*merkletree.Hash, error) {
+	idenStateListLen, err := is.idenStateList.Length(tx)
+	if err != nil {
+		return nil, err
+	}
+	var errSearch error
+	getClaimsLogLen := func(i int) uint32 {
+		idenState, _, err := is.getIdenStateByIdx(tx, int64(i))
+		if err != nil {
+			errSearch = err
+			return 0
+		}
+		claimsLogLen, err := db.NewStorageValue(dbKeyIdenStateClaimsLogLen(idenState)).Get(tx)
+		if err != nil {
+			errSearch = err
+			return 0
+		}
+		return claimsLogLen
+	}
+	i := sort.Search(int(idenStateListLen), func(i int) bool {
+		return getClaimsLogLen(i) > idx
+	})
+	if errSearch != nil {
+		return nil, errSearch
+	}
+	return is.firstPublishedIdenState(tx, i)
+}
+
+// firstPublishedIdenState returns the first published identity state
+// starting at position idx of the identity state list, or nil if there's
+// none.  The published identity states are the genesis one and the ones seen
+// on chain.
+func (is *Issuer) firstPublishedIdenState(tx db.Tx, idx int) (*merkletree.Hash, error) {
+	idenStateListLen, err := is.idenStateList.Length(tx)
+	if err != nil {
+		return nil, err
+	}
+	for ; idx < int(idenStateListLen); idx++ {
+		idenState, _, err := is.getIdenStateByIdx(tx, int64(idx))
+		if err != nil {
+			return nil, err
+		}
+		if idx == 0 {
+			return idenState, nil
+		}
+		if _, err := tx.Get(dbKeyIdenStateData(idenState)); err == nil {
+			return idenState, nil
+		} else if err != db.ErrNotFound {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+// issuedClaim builds the IssuedClaim of the claim with the HIndex hi.
+func (is *Issuer) issuedClaim(tx db.Tx, hi []byte) (*IssuedClaim, error) {
+	var issuedClaim IssuedClaim
+	issuedClaim.HIndex = &merkletree.Hash{}
+	copy(issuedClaim.HIndex[:], hi)
+	if err := is.claimsLog.Get(tx, hi, &issuedClaim.ClaimRecord); err != nil {
+		return nil, err
+	}
+	data, err := is.claimsTree.GetDataByIndex(issuedClaim.HIndex)
+	if err != nil {
+		return nil, err
+	}
+	issuedClaim.Claim = &merkletree.Entry{Data: *data}
+	idenState, err := is.claimIdenState(tx, issuedClaim.Idx)
+	if err != nil {
+		return nil, err
+	}
+	issuedClaim.IdenState = idenState
+	return &issuedClaim, nil
+}
+
+// Claims returns the issued claims that match the query, in issuance order.
+func (is *Issuer) Claims(query ClaimsQuery) ([]*IssuedClaim, error) {
+	is.rw.RLock()
+	defer is.rw.RUnlock()
+	tx, err := is.storage.NewTx() // Read only Tx
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Close()
+
+	results := []*IssuedClaim{}
+	skipped := 0
+	// add adds the claim with HIndex hi to the results if it matches the
+	// query, and returns false once the page is complete.
+	add := func(hi []byte) (bool, error) {
+		if query.Subject != nil && query.Type != nil {
+			var record ClaimRecord
+			if err := is.claimsLog.Get(tx, hi, &record); err != nil {
+				return false, err
+			}
+			if record.Type != *query.Type {
+				return true, nil
+			}
+		}
+		if skipped < query.Offset {
+			skipped++
+			return true, nil
+		}
+		issuedClaim, err := is.issuedClaim(tx, hi)
+		if err != nil {
+			return false, err
+		}
+		results = append(results, issuedClaim)
+		return query.Limit == 0 || len(results) < query.Limit, nil
+	}
+
+	// Iterate the most selective index available, stopping once the page
+	// is complete.  Without filters, the page is read directly from the
+	// claims log by position.
+	var prefix []byte
+	if query.Subject != nil {
+		prefix = append(append([]byte{}, dbPrefixClaimsIdxSubject...), query.Subject[:]...)
+	} else if query.Type != nil {
+		prefix = append(append([]byte{}, dbPrefixClaimsIdxType...), query.Type[:]...)
+	} else {
+		claimsLogLen, err := is.claimsLog.Length(tx)
+		if err != nil {
+			return nil, err
+		}
+		skipped = query.Offset
+		for idx := uint32(query.Offset); idx < claimsLogLen; idx++ {
+			hi, err := is.claimsLog.GetByIdx(tx, idx, &ClaimRecord{})
+			if err != nil {
+				return nil, err
+			}
+			if cont, err := add(hi); err != nil {
+				return nil, err
+			} else if !cont {
+				break
+			}
+		}
+		return results, nil
+	}
+	if err := is.storage.WithPrefix(prefix).Iterate(func(_, hi []byte) (bool, error) {
+		return add(append([]byte{}, hi...))
+	}); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// ClaimsByType returns a page of the issued claims of type claimType.
+func (is *Issuer) ClaimsByType(claimType claims.ClaimType, offset, limit int) ([]*IssuedClaim, error) {
+	return is.Claims(ClaimsQuery{Type: &claimType, Offset: offset, Limit: limit})
+}
+
+// ClaimsBySubject returns a page of the issued claims about the subject id.
+func (is *Issuer) ClaimsBySubject(id *core.ID, offset, limit int) ([]*IssuedClaim, error) {
+	return is.Claims(ClaimsQuery{Subject: id, Offset: offset, Limit: limit})
+}
+
+// ClaimByRevNonce returns the issued claim with the revocation nonce.
+func (is *Issuer) ClaimByRevNonce(nonce uint32) (*IssuedClaim, error) {
+	is.rw.RLock()
+	defer is.rw.RUnlock()
+	tx, err := is.storage.NewTx() // Read only Tx
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Close()
+	hi, err := tx.Get(dbKeyClaimsIdxRevNonce(nonce))
+	if err == db.ErrNotFound {
+		return nil, ErrClaimNotFoundRevNonce
+	} else if err != nil {
+		return nil, err
+	}
+	return is.issuedClaim(tx, hi)
+}
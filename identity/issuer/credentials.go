@@ -0,0 +1,158 @@
+package issuer
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/iden3/go-iden3-core/core/proof"
+	"github.com/iden3/go-iden3-core/db"
+	"github.com/iden3/go-iden3-core/merkletree"
+)
+
+var (
+	ErrIdenStateNotOnChain = fmt.Errorf("the identity state is not known to be on chain")
+)
+
+var (
+	dbPrefixIdenStateData = []byte("idenstatedata:")
+)
+
+func dbKeyIdenStateData(idenState *merkletree.Hash) []byte {
+	return append(append([]byte{}, dbPrefixIdenStateData...), idenState[:]...)
+}
+
+// CredentialSink receives the credentials generated by
+// GenCredentialsForState.  Returning an error stops the generation.
+type CredentialSink interface {
+	Put(credExist *proof.CredentialExistence) error
+}
+
+// CredentialSinkFunc is an adapter to use a function as a CredentialSink.
+type CredentialSinkFunc func(credExist *proof.CredentialExistence) error
+
+// Put calls f(credExist).
+func (f CredentialSinkFunc) Put(credExist *proof.CredentialExistence) error {
+	return f(credExist)
+}
+
+// GenCredentialsForState generates the existence credentials of all the
+// claims issued after the previous identity state and included in
+// idenState, which must be an identity state confirmed on chain, and sends
+// them to the sink in issuance order.  The Issuer is read locked while the
+// credentials are generated, so the sink should not block for long.
+func (is *Issuer) GenCredentialsForState(idenState *merkletree.Hash, sink CredentialSink) error {
+	if is.cfg.GenesisOnly {
+		return ErrIdenGenesisOnly
+	}
+	is.rw.RLock()
+	defer is.rw.RUnlock()
+	tx, err := is.storage.NewTx() // Read only Tx
+	if err != nil {
+		return err
+	}
+	defer tx.Close()
+
+	var idenStateData proof.IdenStateData
+	if err := db.LoadJSON(is.storage, dbKeyIdenStateData(idenState), &idenStateData); err == db.ErrNotFound {
+		return ErrIdenStateNotOnChain
+	} else if err != nil {
+		return err
+	}
+	// An identity state that is not the last one on chain may have been
+	// removed by a chain reorganization after it was seen.
+	if !idenState.Equals(is.idenStateOnChain()) {
+		idenStateDataOnChain, err := is.idenPubOnChain.GetStateByBlock(is.id, idenStateData.BlockN)
+		if err != nil {
+			return err
+		}
+		if !reflect.DeepEqual(idenStateDataOnChain, &idenStateData) {
+			return ErrIdenStateNotOnChain
+		}
+	}
+	idenStateTreeRoots, err := is.getIdenStateTreeRoots(tx, idenState)
+	if err != nil {
+		return err
+	}
+
+	// The claims included in idenState and not in the previous identity
+	// state are the ones in the claims log between both lengths.
+	claimsLogLen, err := db.NewStorageValue(dbKeyIdenStateClaimsLogLen(idenState)).Get(tx)
+	if err != nil {
+		return err
+	}
+	claimsLogLenPrev := uint32(0)
+	idenStateListLen, err := is.idenStateList.Length(tx)
+	if err != nil {
+		return err
+	}
+	for idx := int64(idenStateListLen) - 1; idx > 0; idx-- {
+		idenStateIdx, _, err := is.getIdenStateByIdx(tx, idx)
+		if err != nil {
+			return err
+		}
+		if !idenStateIdx.Equals(idenState) {
+			continue
+		}
+		idenStatePrev, _, err := is.getIdenStateByIdx(tx, idx-1)
+		if err != nil {
+			return err
+		}
+		claimsLogLenPrev, err = db.NewStorageValue(dbKeyIdenStateClaimsLogLen(idenStatePrev)).Get(tx)
+		if err != nil {
+			return err
+		}
+		break
+	}
+
+	idenPubUrl := is.idenPubOffChainWriter.Url()
+	for idx := claimsLogLenPrev; idx < claimsLogLen; idx++ {
+		hiBytes, err := is.claimsLog.GetByIdx(tx, idx, &ClaimRecord{})
+		if err != nil {
+			return err
+		}
+		var hi merkletree.Hash
+		copy(hi[:], hiBytes)
+		data, err := is.claimsTree.GetDataByIndex(&hi)
+		if err != nil {
+			return err
+		}
+		mtpExist, err := generateExistenceMTProof(is.claimsTree, &hi, idenStateTreeRoots.ClaimsTreeRoot)
+		if err != nil {
+			return err
+		}
+		if err := sink.Put(&proof.CredentialExistence{
+			Id:                  is.id,
+			IdenStateData:       idenStateData,
+			MtpClaim:            mtpExist,
+			Claim:               &merkletree.Entry{Data: *data},
+			RevocationsTreeRoot: idenStateTreeRoots.RevocationsTreeRoot,
+			RootsTreeRoot:       idenStateTreeRoots.RootsTreeRoot,
+			IdenPubUrl:          idenPubUrl,
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateIdenStateData stores the IdenStateData of the identity state on
+// chain, which tells in which published identity state each claim is
+// included.
+func (is *Issuer) migrateIdenStateData(tx db.Tx) (bool, error) {
+	var idenStateData proof.IdenStateData
+	if err := db.LoadJSON(is.storage, dbKeyIdenStateDataOnChain, &idenStateData); err != nil {
+		return false, err
+	}
+	if idenStateData.IdenState.Equals(&merkletree.HashZero) {
+		return false, nil
+	}
+	if _, err := tx.Get(dbKeyIdenStateData(idenStateData.IdenState)); err == nil {
+		return false, nil
+	} else if err != db.ErrNotFound {
+		return false, err
+	}
+	if err := db.StoreJSON(tx, dbKeyIdenStateData(idenStateData.IdenState), &idenStateData); err != nil {
+		return false, err
+	}
+	return true, nil
+}
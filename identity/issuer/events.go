@@ -0,0 +1,186 @@
+package issuer
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/iden3/go-iden3-core/db"
+	"github.com/iden3/go-iden3-core/merkletree"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	dbPrefixAuditLog = []byte("auditlog:")
+)
+
+// EventType is the type of operation of an Issuer Event.
+type EventType string
+
+const (
+	// EventClaimIssued is a claim added to the claims tree.
+	EventClaimIssued EventType = "claimissued"
+	// EventClaimRevoked is a claim revocation nonce added to the
+	// revocations tree.
+	EventClaimRevoked EventType = "claimrevoked"
+	// EventStateComputed is a new identity state calculated to be
+	// published.
+	EventStateComputed EventType = "statecomputed"
+	// EventStatePublished is an identity state sent to the Smart
+	// Contract.
+	EventStatePublished EventType = "statepublished"
+	// EventStateConfirmed is an identity state confirmed in the Smart
+	// Contract.
+	EventStateConfirmed EventType = "stateconfirmed"
+	// EventStateRolledBack is the identity state on chain set back to a
+	// previous one by a chain reorganization.
+	EventStateRolledBack EventType = "staterolledback"
+)
+
+// Event is an operation done by the Issuer.  Events are sent to the
+// subscribers and recorded in the audit log.
+type Event struct {
+	Type EventType
+	// Time is the unix time of the operation.
+	Time int64
+	// HIndex and RevNonce identify the affected claim in claim events.
+	HIndex   *merkletree.Hash `json:",omitempty"`
+	RevNonce *uint32          `json:",omitempty"`
+	// IdenState is the identity state resulting from the operation.
+	IdenState *merkletree.Hash
+}
+
+// subscriptions are the channels of the Issuer event subscribers.
+type subscriptions struct {
+	rw    sync.RWMutex
+	next  int
+	chans map[int]chan Event
+}
+
+// Subscribe returns a channel that receives the events of the Issuer, and a
+// function to cancel the subscription.  Events are sent without blocking: if
+// the channel buffer of bufferSize events is full the event is dropped for
+// this subscriber, so the audit log must be used when no event can be missed.
+func (is *Issuer) Subscribe(bufferSize int) (<-chan Event, func()) {
+	is.subs.rw.Lock()
+	defer is.subs.rw.Unlock()
+	if is.subs.chans == nil {
+		is.subs.chans = make(map[int]chan Event)
+	}
+	n := is.subs.next
+	is.subs.next++
+	ch := make(chan Event, bufferSize)
+	is.subs.chans[n] = ch
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			is.subs.rw.Lock()
+			defer is.subs.rw.Unlock()
+			delete(is.subs.chans, n)
+			close(ch)
+		})
+	}
+}
+
+// emit sends the events to the subscribers.
+func (is *Issuer) emit(events ...*Event) {
+	is.subs.rw.RLock()
+	defer is.subs.rw.RUnlock()
+	for _, event := range events {
+		for _, ch := range is.subs.chans {
+			select {
+			case ch <- *event:
+			default:
+				log.WithField("type", event.Type).Warn("Issuer event dropped: subscriber channel full")
+			}
+		}
+	}
+}
+
+// newEvent creates a new event of type eventType at the current time.
+func newEvent(eventType EventType, idenState *merkletree.Hash) *Event {
+	return &Event{Type: eventType, Time: time.Now().Unix(), IdenState: idenState}
+}
+
+// newClaimEvent creates a new event of type eventType at the current time
+// about the claim with HIndex hi and revocation nonce revNonce.
+func newClaimEvent(eventType EventType, hi *merkletree.Hash, revNonce uint32,
+	idenState *merkletree.Hash) *Event {
+	event := newEvent(eventType, idenState)
+	event.HIndex = hi
+	event.RevNonce = &revNonce
+	return event
+}
+
+// audit appends the events to the audit log in an open db transaction.
+func (is *Issuer) audit(tx db.Tx, events ...*Event) error {
+	for _, event := range events {
+		idx, err := is.auditLog.Length(tx)
+		if err != nil {
+			return err
+		}
+		if err := is.auditLog.Append(tx, uint32ToBytesBE(idx), event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AuditLog returns the events recorded in the audit log with a time in the
+// range [from, to), in the order they happened.
+func (is *Issuer) AuditLog(from, to time.Time) ([]*Event, error) {
+	is.rw.RLock()
+	defer is.rw.RUnlock()
+	tx, err := is.storage.NewTx() // Read only Tx
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Close()
+	auditLogLen, err := is.auditLog.Length(tx)
+	if err != nil {
+		return nil, err
+	}
+	getEvent := func(idx uint32) (*Event, error) {
+		var event Event
+		if _, err := is.auditLog.GetByIdx(tx, idx, &event); err != nil {
+			return nil, err
+		}
+		return &event, nil
+	}
+	var errSearch error
+	start := sort.Search(int(auditLogLen), func(i int) bool {
+		event, err := getEvent(uint32(i))
+		if err != nil {
+			errSearch = err
+			return true
+		}
+		return event.Time >= from.Unix()
+	})
+	if errSearch != nil {
+		return nil, errSearch
+	}
+	events := []*Event{}
+	for idx := uint32(start); idx < auditLogLen; idx++ {
+		event, err := getEvent(idx)
+		if err != nil {
+			return nil, err
+		}
+		if event.Time >= to.Unix() {
+			break
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+// migrateAuditLog initializes an empty audit log.
+func (is *Issuer) migrateAuditLog(tx db.Tx) (bool, error) {
+	if _, err := is.auditLog.Length(tx); err == nil {
+		return false, nil
+	} else if err != db.ErrNotFound {
+		return false, err
+	}
+	is.auditLog.Init(tx)
+	return true, nil
+}
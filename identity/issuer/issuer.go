@@ -1,15 +1,20 @@
 package issuer
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"math/big"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/iden3/go-iden3-core/components/idenpuboffchain"
 	"github.com/iden3/go-iden3-core/components/idenpubonchain"
+	"github.com/iden3/go-iden3-core/components/zkprover"
 	"github.com/iden3/go-iden3-core/core"
 	"github.com/iden3/go-iden3-core/core/claims"
 	"github.com/iden3/go-iden3-core/core/genesis"
@@ -42,7 +47,9 @@ var (
 	ErrClaimNotFoundStateOnChain          = fmt.Errorf("claim not found under the on chain identity state")
 	ErrClaimNotFoundClaimsTree            = fmt.Errorf("claim not found in the claims tree: the claim hasn't been issued")
 	ErrClaimNotYetInOnChainState          = fmt.Errorf("claim has been issued but is not yet under a published on chain identity state")
+	ErrClaimNotFoundGenesis               = fmt.Errorf("claim not found under the genesis identity state")
 	ErrFailedVerifyZkProofIdenStateUpdate = fmt.Errorf("failed verifing generated zk proof of identity state update")
+	ErrIdenStateDiverged                  = fmt.Errorf("the identity state changed while the zk proof of its update was generated")
 )
 
 var (
@@ -63,6 +70,8 @@ var (
 	dbKeyIdenStatePendingTransacted = []byte("idenstatependingtxed")
 	dbKeyEthTxSetState              = []byte("ethtxsetstate")
 	dbKeyEthTxInitState             = []byte("ethtxinitstate")
+	dbKeyIdenStatePendingTxSent     = []byte("idenstatependingtxsent")
+	dbKeyIdenStateOnChainBlockHash  = []byte("idenstateonchainblockhash")
 )
 
 var (
@@ -70,7 +79,8 @@ var (
 )
 
 // ConfigDefault is a default configuration for the Issuer.
-var ConfigDefault = Config{MaxLevelsClaimsTree: 140, MaxLevelsRevocationTree: 140, MaxLevelsRootsTree: 140, GenesisOnly: false, ConfirmBlocks: 3}
+var ConfigDefault = Config{MaxLevelsClaimsTree: 140, MaxLevelsRevocationTree: 140, MaxLevelsRootsTree: 140, GenesisOnly: false, ConfirmBlocks: 3,
+	PendingTxStaleTimeout: 10 * time.Minute, PendingTxStaleBlocks: 40, GasPriceBumpPercent: 10}
 
 // Config allows configuring the creation of an Issuer.
 type Config struct {
@@ -79,6 +89,17 @@ type Config struct {
 	MaxLevelsRootsTree      int
 	GenesisOnly             bool
 	ConfirmBlocks           uint64
+	// PendingTxStaleTimeout is the time after which a transaction
+	// publishing an identity state that hasn't been confirmed is
+	// considered stale.  0 disables the check.
+	PendingTxStaleTimeout time.Duration
+	// PendingTxStaleBlocks is the number of blocks after which a
+	// transaction publishing an identity state that hasn't been confirmed
+	// is considered stale.  0 disables the check.
+	PendingTxStaleBlocks uint64
+	// GasPriceBumpPercent is the gas price increase used to resubmit a
+	// stale transaction.
+	GasPriceBumpPercent uint64
 }
 
 // IdenStateZkProofConf are the paths to the SNARK related files required to
@@ -86,6 +107,11 @@ type Config struct {
 type IdenStateZkProofConf struct {
 	Levels int
 	Files  zkutils.ZkFiles
+	// KeyRotation is true if the circuit supports proving the identity
+	// ownership with the proofs of existence and non revocation of the
+	// key claim (see IdOwnershipInputs), which is required to rotate the
+	// operational key.
+	KeyRotation bool
 }
 
 // IdenStateTreeRoots is the set of the three roots of each Identity Merkle Tree.
@@ -97,7 +123,10 @@ type IdenStateTreeRoots struct {
 
 // Issuer is an identity that issues claims
 type Issuer struct {
-	rw              *sync.RWMutex
+	rw *sync.RWMutex
+	// publishMutex serializes the publication of identity states, which
+	// generate the zk proof without holding rw.
+	publishMutex    *sync.Mutex
 	storage         db.Storage
 	id              *core.ID
 	claimsTree      *merkletree.MerkleTree
@@ -110,12 +139,23 @@ type Issuer struct {
 	idenPubOffChainWriter idenpuboffchain.IdenPubOffChainWriter
 	keyStore              *keystore.KeyStore
 	kOpComp               *babyjub.PublicKeyComp
-	nonceGen              *UniqueNonceGen
-	idenStateList         *db.StorageList
+	// kOpList is the list of operational keys of the identity, starting
+	// with the genesis one.
+	kOpList       *db.StorageList
+	nonceGen      *UniqueNonceGen
+	idenStateList *db.StorageList
+	// claimsLog is the list of issued claims, used by the claims index.
+	claimsLog *db.StorageList
+	// auditLog is the append-only list of events of the Issuer.
+	auditLog *db.StorageList
+	subs     *subscriptions
 	// _idenStateOnChain     *merkletree.Hash
 	// idenStateDataOnChain is the last known identity state checked to be
 	// in the Smart Contract.
 	_idenStateDataOnChain *proof.IdenStateData
+	// _idenStateOnChainBlockHash is the hash of the block in which the
+	// idenStateDataOnChain was set, used to detect chain reorganizations.
+	_idenStateOnChainBlockHash common.Hash
 	// idenStatePending is a newly calculated identity state that is being
 	// published in the Smart Contract but the transaction to publish it is
 	// still pending.
@@ -123,8 +163,14 @@ type Issuer struct {
 	_idenStatePendingTransacted bool
 	_ethTxSetState              *types.Transaction
 	_ethTxInitState             *types.Transaction
-	idenStateZkProofConf        *IdenStateZkProofConf
-	cfg                         Config
+	// idenStatePendingTxSent is when the transaction to publish the
+	// idenStatePending was sent.
+	_idenStatePendingTxSent *TxSent
+	idenStateZkProofConf    *IdenStateZkProofConf
+	// prover can be nil if the Issuer generates the zk proofs in its own
+	// goroutines.
+	prover *zkprover.Prover
+	cfg    Config
 }
 
 //
@@ -135,6 +181,13 @@ func (is *Issuer) idenStateDataOnChain() *proof.IdenStateData { return is._idenS
 
 func (is *Issuer) setIdenStateDataOnChain(tx db.Tx, v *proof.IdenStateData) error {
 	is._idenStateDataOnChain = v
+	if !v.IdenState.Equals(&merkletree.HashZero) {
+		// Keep the IdenStateData of every identity state seen on chain
+		// to generate credentials of past identity states.
+		if err := db.StoreJSON(tx, dbKeyIdenStateData(v.IdenState), v); err != nil {
+			return err
+		}
+	}
 	return db.StoreJSON(tx, dbKeyIdenStateDataOnChain, v)
 }
 
@@ -143,7 +196,26 @@ func (is *Issuer) loadIdenStateDataOnChain() error {
 	return db.LoadJSON(is.storage, dbKeyIdenStateDataOnChain, is._idenStateDataOnChain)
 }
 
+func (is *Issuer) idenStateOnChainBlockHash() common.Hash { return is._idenStateOnChainBlockHash }
+
+func (is *Issuer) setIdenStateOnChainBlockHash(tx db.Tx, v common.Hash) {
+	is._idenStateOnChainBlockHash = v
+	tx.Put(dbKeyIdenStateOnChainBlockHash, v[:])
+}
+
+func (is *Issuer) loadIdenStateOnChainBlockHash() error {
+	b, err := is.storage.Get(dbKeyIdenStateOnChainBlockHash)
+	if err != nil {
+		return err
+	}
+	is._idenStateOnChainBlockHash = common.BytesToHash(b)
+	return nil
+}
+
+// IdenStateOnChain returns the last identity state known to be on chain.
 func (is *Issuer) IdenStateOnChain() *merkletree.Hash {
+	is.rw.RLock()
+	defer is.rw.RUnlock()
 	return is._idenStateDataOnChain.IdenState
 }
 
@@ -151,7 +223,11 @@ func (is *Issuer) idenStateOnChain() *merkletree.Hash {
 	return is._idenStateDataOnChain.IdenState
 }
 
+// IdenStatePending returns the identity state pending to be set on chain and
+// whether the transaction to set it has been sent.
 func (is *Issuer) IdenStatePending() (*merkletree.Hash, bool) {
+	is.rw.RLock()
+	defer is.rw.RUnlock()
 	return is._idenStatePending, is._idenStatePendingTransacted
 }
 
@@ -223,6 +299,78 @@ func (is *Issuer) loadEthTxInitState() error {
 	return db.LoadJSON(is.storage, dbKeyEthTxInitState, &is._ethTxInitState)
 }
 
+func (is *Issuer) idenStatePendingTxSent() *TxSent { return is._idenStatePendingTxSent }
+
+func (is *Issuer) setIdenStatePendingTxSent(tx db.Tx, v *TxSent) error {
+	is._idenStatePendingTxSent = v
+	return db.StoreJSON(tx, dbKeyIdenStatePendingTxSent, v)
+}
+
+func (is *Issuer) loadIdenStatePendingTxSent() error {
+	is._idenStatePendingTxSent = &TxSent{}
+	return db.LoadJSON(is.storage, dbKeyIdenStatePendingTxSent, is._idenStatePendingTxSent)
+}
+
+// loadPersisted loads the persisted fields of the Issuer from the storage.
+func (is *Issuer) loadPersisted() error {
+	if err := is.loadIdenStateDataOnChain(); err != nil {
+		return err
+	}
+	if err := is.loadIdenStateOnChainBlockHash(); err != nil {
+		return err
+	}
+	if err := is.loadIdenStatePending(); err != nil {
+		return err
+	}
+	if err := is.loadEthTxInitState(); err != nil {
+		return err
+	}
+	if err := is.loadEthTxSetState(); err != nil {
+		return err
+	}
+	if err := is.loadIdenStatePendingTxSent(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// reload loads again the id, the operational key, the merkle trees and the
+// persisted fields of the Issuer from the storage.  Must be called with the
+// write lock held.
+func (is *Issuer) reload() error {
+	id, kOpComp, err := loadIdKOp(is.storage)
+	if err != nil {
+		return err
+	}
+	clt, ret, rot, err := loadMTs(&is.cfg, is.storage)
+	if err != nil {
+		return fmt.Errorf("error loading merkle trees from storage: %w", err)
+	}
+	is.id, is.kOpComp = id, kOpComp
+	is.claimsTree, is.revocationsTree, is.rootsTree = clt, ret, rot
+	is.nonceGen = NewUniqueNonceGen(db.NewStorageValue(dbKeyNonceIdx))
+	return is.loadPersisted()
+}
+
+// loadIdKOp loads the id and the current operational key of the Issuer from
+// the storage.
+func loadIdKOp(storage db.Storage) (*core.ID, *babyjub.PublicKeyComp, error) {
+	kOpCompBytes, err := storage.Get(dbKeyKOp)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error getting kop from storage: %w", err)
+	}
+	var kOpComp babyjub.PublicKeyComp
+	copy(kOpComp[:], kOpCompBytes)
+
+	var id core.ID
+	idBytes, err := storage.Get(dbKeyId)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error getting id from storage: %w", err)
+	}
+	copy(id[:], idBytes)
+	return &id, &kOpComp, nil
+}
+
 // loadMTs loads the three identity merkle trees from the storage using the configuration.
 func loadMTs(cfg *Config, storage db.Storage) (*merkletree.MerkleTree, *merkletree.MerkleTree,
 	*merkletree.MerkleTree, error) {
@@ -315,9 +463,13 @@ func Create(cfg Config, kOpComp *babyjub.PublicKeyComp, extraGenesisClaims []cla
 	tx.Put(dbKeyConfig, cfgJSON)
 
 	idenStateList := db.NewStorageList(dbPrefixIdenStateList)
+	claimsLog := db.NewStorageList(dbPrefixClaimsLog)
+	kOpList := db.NewStorageList(dbPrefixKOpList)
+	auditLog := db.NewStorageList(dbPrefixAuditLog)
 
 	is := Issuer{
 		rw:                    &sync.RWMutex{},
+		publishMutex:          &sync.Mutex{},
 		id:                    id,
 		claimsTree:            clt,
 		revocationsTree:       ret,
@@ -330,9 +482,34 @@ func Create(cfg Config, kOpComp *babyjub.PublicKeyComp, extraGenesisClaims []cla
 		storage:       storage,
 		nonceGen:      nonceGen,
 		idenStateList: idenStateList,
+		claimsLog:     claimsLog,
+		kOpList:       kOpList,
+		auditLog:      auditLog,
+		subs:          &subscriptions{},
 		cfg:           cfg,
 	}
 
+	// Initialize the list of operational keys with the genesis one
+	kOpList.Init(tx)
+	if err := kOpList.Append(tx, kOpComp[:], &keyOperational{
+		ClaimHIndex: claimKOpHi,
+		RevNonce:    nonce,
+	}); err != nil {
+		return nil, err
+	}
+
+	// Initialize the claims index with the genesis claims
+	claimsLog.Init(tx)
+	issueTime := time.Now().Unix()
+	if err := is.indexClaim(tx, claimKOp, issueTime); err != nil {
+		return nil, err
+	}
+	for _, claim := range extraGenesisClaims {
+		if err := is.indexClaim(tx, claim, issueTime); err != nil {
+			return nil, err
+		}
+	}
+
 	// Initalize the history of idenStates
 	idenState, idenStateTreeRoots := is.state()
 	idenStateList.Init(tx)
@@ -340,11 +517,27 @@ func Create(cfg Config, kOpComp *babyjub.PublicKeyComp, extraGenesisClaims []cla
 	if err := idenStateList.Append(tx, idenState[:], &idenStateTreeRoots); err != nil {
 		return nil, err
 	}
+	if err := is.indexIdenState(tx, idenState); err != nil {
+		return nil, err
+	}
+
+	// Initialize the audit log with the genesis claims
+	auditLog.Init(tx)
+	for _, claim := range append([]claims.Claimer{claimKOp}, extraGenesisClaims...) {
+		hi, err := claim.Entry().HIndex()
+		if err != nil {
+			return nil, err
+		}
+		if err := is.audit(tx, newClaimEvent(EventClaimIssued, hi, claim.Metadata().RevNonce, idenState)); err != nil {
+			return nil, err
+		}
+	}
 
 	// Initialize IdenStateDataOnChain and IdenStatePending to zero (writes to storage).
 	if err := is.setIdenStateDataOnChain(tx, &proof.IdenStateData{IdenState: &merkletree.HashZero}); err != nil {
 		return nil, err
 	}
+	is.setIdenStateOnChainBlockHash(tx, common.Hash{})
 	is.setIdenStatePending(tx, &merkletree.HashZero, false)
 	if err := is.setEthTxInitState(tx, nil); err != nil {
 		return nil, err
@@ -352,6 +545,9 @@ func Create(cfg Config, kOpComp *babyjub.PublicKeyComp, extraGenesisClaims []cla
 	if err := is.setEthTxSetState(tx, nil); err != nil {
 		return nil, err
 	}
+	if err := is.setIdenStatePendingTxSent(tx, &TxSent{}); err != nil {
+		return nil, err
+	}
 
 	if err := tx.Commit(); err != nil {
 		return nil, err
@@ -388,19 +584,10 @@ func Load(storage db.Storage, keyStore *keystore.KeyStore,
 		}
 	}
 
-	kOpCompBytes, err := storage.Get(dbKeyKOp)
-	if err != nil {
-		return nil, fmt.Errorf("error getting kop from storage: %w", err)
-	}
-	var kOpComp babyjub.PublicKeyComp
-	copy(kOpComp[:], kOpCompBytes)
-
-	var id core.ID
-	idBytes, err := storage.Get(dbKeyId)
+	id, kOpComp, err := loadIdKOp(storage)
 	if err != nil {
-		return nil, fmt.Errorf("error getting id from storage: %w", err)
+		return nil, err
 	}
-	copy(id[:], idBytes)
 
 	clt, ret, rot, err := loadMTs(&cfg, storage)
 	if err != nil {
@@ -409,39 +596,46 @@ func Load(storage db.Storage, keyStore *keystore.KeyStore,
 
 	nonceGen := NewUniqueNonceGen(db.NewStorageValue(dbKeyNonceIdx))
 	idenStateList := db.NewStorageList(dbPrefixIdenStateList)
+	claimsLog := db.NewStorageList(dbPrefixClaimsLog)
+	kOpList := db.NewStorageList(dbPrefixKOpList)
+	auditLog := db.NewStorageList(dbPrefixAuditLog)
 
 	is := Issuer{
 		rw:                    &sync.RWMutex{},
-		id:                    &id,
+		publishMutex:          &sync.Mutex{},
+		id:                    id,
 		claimsTree:            clt,
 		revocationsTree:       ret,
 		rootsTree:             rot,
 		idenPubOnChain:        idenPubOnChain,
 		idenPubOffChainWriter: idenPubOffChainWriter,
 		keyStore:              keyStore,
-		kOpComp:               &kOpComp,
+		kOpComp:               kOpComp,
 		storage:               storage,
 		nonceGen:              nonceGen,
 		idenStateList:         idenStateList,
+		claimsLog:             claimsLog,
+		kOpList:               kOpList,
+		auditLog:              auditLog,
+		subs:                  &subscriptions{},
 		idenStateZkProofConf:  idenStateZkProofConf,
 		cfg:                   cfg,
 	}
 
-	if err := is.loadIdenStateDataOnChain(); err != nil {
-		return nil, err
-	}
-	if err := is.loadIdenStatePending(); err != nil {
-		return nil, err
-	}
-	if err := is.loadEthTxInitState(); err != nil {
-		return nil, err
+	if err := is.migrate(); err != nil {
+		return nil, fmt.Errorf("error migrating storage: %w", err)
 	}
-	if err := is.loadEthTxSetState(); err != nil {
+	if err := is.loadPersisted(); err != nil {
 		return nil, err
 	}
 
 	if !is.cfg.GenesisOnly {
-		if err := is.SyncIdenStatePublic(); err != nil {
+		// A stale pending transaction is kept pending, to be
+		// resubmitted or abandoned by the caller.
+		if err := is.SyncIdenStatePublic(); errors.Is(err, ErrIdenStatePendingStale) {
+			log.WithField("idenStatePending", is._idenStatePending).
+				Warn("Loaded Issuer with a stale identity state update transaction")
+		} else if err != nil {
 			return nil, fmt.Errorf("error syncing idenstate from smart contract: %w", err)
 		}
 	}
@@ -486,6 +680,12 @@ func (is *Issuer) KeyOperational() *babyjub.PublicKeyComp {
 // SyncIdenStatePublic updates the IdenStateOnChain and IdenStatePending from
 // the values in the Smart Contract.
 func (is *Issuer) SyncIdenStatePublic() error {
+	return is.syncIdenStatePublic(ClockSystem)
+}
+
+// syncIdenStatePublic is SyncIdenStatePublic using the clock to check if the
+// pending transaction is stale.
+func (is *Issuer) syncIdenStatePublic(clock Clock) error {
 	if is.cfg.GenesisOnly {
 		return ErrIdenGenesisOnly
 	}
@@ -497,17 +697,12 @@ func (is *Issuer) SyncIdenStatePublic() error {
 	idenStatePending, transacted := is.idenStatePending()
 	// (C)(idenStatePending: X, transacted: true)
 	if !idenStatePending.Equals(&merkletree.HashZero) && transacted {
-		var ethTx *types.Transaction
-		// If idenStateOnChain is zero, the pending state was caused by
-		// InitState.  Otherwise it was a regular SetState.
-		if is.idenStateOnChain().Equals(&merkletree.HashZero) {
-			ethTx = is.ethTxInitState()
-		} else {
-			ethTx = is.ethTxSetState()
-		}
+		ethTx := is.ethTxPending()
 		confirmBlocks, err := is.idenPubOnChain.TxConfirmBlocks(ethTx)
 		if err == eth.ErrReceiptNotReceived {
-			return nil
+			return is.checkIdenStatePendingStale(clock)
+		} else if err == eth.ErrReceiptStatusFailed {
+			return is.idenStatePendingTxFailed()
 		} else if err != nil {
 			return fmt.Errorf("TxConfirmBlocks: %w", err)
 		}
@@ -535,7 +730,17 @@ func (is *Issuer) SyncIdenStatePublic() error {
 		// obtained one must be the idenStateOnChain (Zero for genesis
 		// / empty in the smart contract).
 		if idenStateData.IdenState.Equals(is.idenStateOnChain()) {
-			return nil
+			// After a chain reorganization the transaction may
+			// have been included in a different block.
+			return is.updateIdenStateOnChainBlock(idenStateData)
+		}
+
+		// The idenStateOnChain may have been removed by a chain
+		// reorganization.
+		if reorg, err := is.idenStateOnChainReorged(); err != nil {
+			return err
+		} else if reorg {
+			return is.rollbackIdenStateOnChain(idenStateData)
 		}
 
 		return fmt.Errorf("Fatal error: Identity State in the Smart Contract (%v)"+
@@ -548,6 +753,9 @@ func (is *Issuer) SyncIdenStatePublic() error {
 	// a. the idenStateOnchan (in this case, we still have an
 	// IdenState pending to be set on chain).
 	if idenStateData.IdenState.Equals(is.idenStateOnChain()) {
+		if transacted {
+			return is.checkIdenStatePendingStale(clock)
+		}
 		return nil
 	}
 
@@ -560,23 +768,58 @@ func (is *Issuer) SyncIdenStatePublic() error {
 		if err != nil {
 			return err
 		}
+		blockHash, err := is.idenPubOnChain.BlockHash(idenStateData.BlockN)
+		if err != nil {
+			return err
+		}
 		is.setIdenStatePending(tx, &merkletree.HashZero, false)
 		if err := is.setIdenStateDataOnChain(tx, idenStateData); err != nil {
 			return err
 		}
+		is.setIdenStateOnChainBlockHash(tx, blockHash)
+		eventConfirmed := newEvent(EventStateConfirmed, idenStateData.IdenState)
+		if err := is.audit(tx, eventConfirmed); err != nil {
+			return err
+		}
 		if err := tx.Commit(); err != nil {
 			return err
 		}
+		is.emit(eventConfirmed)
 		return nil
 	}
 
-	// c. Neither the idenStatePending nor the idenStateOnchain
-	// (unexpected result).
+	// c. Neither the idenStatePending nor the idenStateOnchain.  The
+	// idenStateOnChain may have been removed by a chain reorganization.
+	if reorg, err := is.idenStateOnChainReorged(); err != nil {
+		return err
+	} else if reorg {
+		return is.rollbackIdenStateOnChain(idenStateData)
+	}
+
+	// Otherwise it's an unexpected result.
 	return fmt.Errorf("Fatal error: Identity State in the Smart Contract (%v)"+
 		" doesn't match the Pending one (%v) nor the OnChain one (%v).",
 		idenStateData.IdenState, idenStatePending, is.idenStateOnChain())
 }
 
+// IssueClaimsError is returned by IssueClaims when some of the claims in the
+// batch can't be issued.  In that case none of the claims is issued.
+type IssueClaimsError struct {
+	// Errs contains the error of each claim in the batch, in the same
+	// order, or nil for claims that could be issued.
+	Errs []error
+}
+
+func (e *IssueClaimsError) Error() string {
+	var failed []string
+	for i, err := range e.Errs {
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("claim %v: %v", i, err))
+		}
+	}
+	return fmt.Sprintf("error issuing claims: %v", strings.Join(failed, "; "))
+}
+
 // IssueClaim adds a new claim to the Claims Merkle Tree of the Issuer.  The
 // Identity State is not updated.  The claim metadata is updated if the issue
 // is successfull.
@@ -586,25 +829,117 @@ func (is *Issuer) IssueClaim(claim claims.Claimer) error {
 	}
 	is.rw.Lock()
 	defer is.rw.Unlock()
+	err := is.issueClaims([]claims.Claimer{claim})
+	if errClaims, ok := err.(*IssueClaimsError); ok {
+		return errClaims.Errs[0]
+	}
+	return err
+}
+
+// IssueClaims adds a batch of claims to the Claims Merkle Tree of the Issuer
+// atomically: either all the claims are issued or none is.  The Identity
+// State is not updated.  The claims metadata is updated if the issue is
+// successfull.  If any claim can't be added to the Claims Merkle Tree (for
+// example, because its index already exists or its values are not inside
+// the finite field), an *IssueClaimsError is returned with the error of each
+// claim.
+func (is *Issuer) IssueClaims(cs []claims.Claimer) error {
+	if is.cfg.GenesisOnly {
+		return ErrIdenGenesisOnly
+	}
+	is.rw.Lock()
+	defer is.rw.Unlock()
+	return is.issueClaims(cs)
+}
+
+// issueClaims assigns the revocation nonces and adds the claims to the Claims
+// Merkle Tree and the claims index in a single storage transaction.
+func (is *Issuer) issueClaims(cs []claims.Claimer) (err error) {
 	tx, err := is.storage.NewTx()
 	if err != nil {
 		return err
 	}
-	nonce, err := is.nonceGen.Next(tx)
+	defer tx.Close()
+	txClaimsTree, err := is.claimsTree.Storage().NewTx()
+	if err != nil {
+		return err
+	}
+	defer txClaimsTree.Close()
+
+	// Restore the claims metadata if the issue is not successfull.
+	oldNonces := make([]uint32, len(cs))
+	for i, claim := range cs {
+		oldNonces[i] = claim.Metadata().RevNonce
+	}
+	defer func() {
+		if err != nil {
+			for i, claim := range cs {
+				claim.Metadata().RevNonce = oldNonces[i]
+			}
+		}
+	}()
+
+	claimsTreeRoot, events, err := is.issueClaimsTx(tx, txClaimsTree, cs)
 	if err != nil {
 		return err
 	}
+	idenState := core.IdenState(claimsTreeRoot, is.revocationsTree.RootKey(), is.rootsTree.RootKey())
+	for _, event := range events {
+		event.IdenState = idenState
+	}
+	if err := is.audit(tx, events...); err != nil {
+		return err
+	}
+
+	tx.Add(txClaimsTree)
 	if err := tx.Commit(); err != nil {
 		return err
 	}
-	claim.Metadata().RevNonce = nonce
-	err = is.claimsTree.AddClaim(claim)
-	if err != nil {
+	if err := is.claimsTree.SetRootKey(claimsTreeRoot); err != nil {
 		return err
 	}
+	is.emit(events...)
 	return nil
 }
 
+// issueClaimsTx assigns the revocation nonces and adds the claims to the
+// Claims Merkle Tree in the open transaction txClaimsTree and to the claims
+// index in the open transaction tx.  It returns the new Claims Merkle Tree
+// root and the events of the issued claims, without identity state.
+func (is *Issuer) issueClaimsTx(tx, txClaimsTree db.Tx, cs []claims.Claimer) (*merkletree.Hash, []*Event, error) {
+	errs := make([]error, len(cs))
+	failed := false
+	claimsTreeRoot := is.claimsTree.RootKey()
+	issueTime := time.Now().Unix()
+	events := make([]*Event, 0, len(cs))
+	for i, claim := range cs {
+		nonce, err := is.nonceGen.Next(tx)
+		if err != nil {
+			return nil, nil, err
+		}
+		claim.Metadata().RevNonce = nonce
+		newClaimsTreeRoot, err := is.claimsTree.AddEntryTx(txClaimsTree, claimsTreeRoot, claim.Entry())
+		if err != nil {
+			errs[i] = err
+			failed = true
+			continue
+		}
+		claimsTreeRoot = newClaimsTreeRoot
+		if err := is.indexClaim(tx, claim, issueTime); err != nil {
+			return nil, nil, err
+		}
+		hi, err := claim.Entry().HIndex()
+		if err != nil {
+			return nil, nil, err
+		}
+		events = append(events, newClaimEvent(EventClaimIssued, hi, nonce, nil))
+	}
+	if failed {
+		return nil, nil, &IssueClaimsError{Errs: errs}
+	}
+	return claimsTreeRoot, events, nil
+}
+
 // getIdenStateByIdx gets identity state and identity state tree roots of the
 // Issuer from the stored list at index idx.
 func (is *Issuer) getIdenStateByIdx(tx db.Tx, idx int64) (*merkletree.Hash, *IdenStateTreeRoots, error) {
@@ -646,72 +981,79 @@ func (is *Issuer) getIdenStateTreeRoots(tx db.Tx, idenState *merkletree.Hash) (*
 // PublishState calculates the current Issuer identity state, and if it's
 // different than the last one, it publishes in in the blockchain.
 func (is *Issuer) PublishState() error {
+	return is.publishState(context.Background(), ClockSystem, nil)
+}
+
+// PublishStateCtx is PublishState with a context.  The zk proof of the
+// identity state update is generated without holding the Issuer lock, so
+// claims can be issued and queried meanwhile, and the generation is
+// stopped after its running step if ctx is cancelled.  The publication only
+// returns once the generation has stopped, so that cancelled publications
+// don't pile up proofs in the background.  The new identity state is kept pending, so
+// a cancelled publication can be retried later.  If the pending identity
+// state or the identity state on chain change while the proof is generated,
+// nothing is published and ErrIdenStateDiverged is returned.
+func (is *Issuer) PublishStateCtx(ctx context.Context) error {
+	return is.publishState(ctx, ClockSystem, nil)
+}
+
+// publishState is PublishStateCtx using the clock to timestamp the sent
+// transaction, and calling zkProofGenerated (if not nil) with the time spent
+// generating the zk proof of the identity state update.
+func (is *Issuer) publishState(ctx context.Context, clock Clock,
+	zkProofGenerated func(elapsed time.Duration)) error {
 	if is.cfg.GenesisOnly {
 		return ErrIdenGenesisOnly
 	}
+	// Only one identity state can be published at a time.
+	is.publishMutex.Lock()
+	defer is.publishMutex.Unlock()
+
+	is.rw.Lock()
+	idenStateLast, idenState, inputs, err := is.preparePublishState()
+	zkProver := is.prover
+	is.rw.Unlock()
+	if err != nil {
+		return err
+	}
+	if idenState == nil {
+		// IdenState hasn't changed, there's no need to do anything!
+		return nil
+	}
+
+	start := time.Now()
+	zkProofOut, err := is.genZkProof(ctx, zkProver, inputs)
+	if err != nil {
+		return err
+	}
+	if zkProofGenerated != nil {
+		zkProofGenerated(time.Since(start))
+	}
+
 	is.rw.Lock()
 	defer is.rw.Unlock()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	// Check that the identity state transition proved is still the one
+	// to be published.
 	idenStatePending, transacted := is.idenStatePending()
-	// (C)(idenStatePending: X, transacted: true)
-	if !idenStatePending.Equals(&merkletree.HashZero) && transacted {
-		return ErrIdenStatePendingNotNil
+	if !idenStatePending.Equals(idenState) || transacted {
+		return ErrIdenStateDiverged
 	}
-
-	idenState, idenStateTreeRoots := is.state()
-
 	tx0, err := is.storage.NewTx() // Read only Tx
-	defer tx0.Close()
 	if err != nil {
 		return err
 	}
-	idenStateLast, idenStateTreeRootsLast, err := is.getIdenStateByIdx(tx0, -1)
+	defer tx0.Close()
+	idenStateFrom, err := is.idenStatePublishFrom(tx0)
 	if err != nil {
 		return err
 	}
-
-	// (A)(idenStatePending: 0, transacted: false) && idenState != idenStateLast
-	if idenStatePending.Equals(&merkletree.HashZero) && !transacted {
-		if idenState.Equals(idenStateLast) {
-			// IdenState hasn't changed, there's no need to do
-			// anything!
-			return nil
-		}
-
-		// idenState != idenStateLast
-
-		// If the ClaimsTreeRoot has changed (claims have been added), add the
-		// ClaimsTreeRoot to the RootsTree.
-		if !idenStateTreeRoots.ClaimsTreeRoot.Equals(idenStateTreeRootsLast.ClaimsTreeRoot) {
-			if err := claims.AddLeafRootsTree(is.rootsTree, idenStateTreeRoots.ClaimsTreeRoot); err != nil {
-				return err
-			}
-			idenState, idenStateTreeRoots = is.state()
-		}
-
-		tx, err := is.storage.NewTx()
-		if err != nil {
-			return err
-		}
-
-		if err := is.idenStateList.Append(tx, idenState[:], &idenStateTreeRoots); err != nil {
-			return err
-		}
-
-		is.setIdenStatePending(tx, idenState, false)
-
-		if err := tx.Commit(); err != nil {
-			return err
-		}
-	} else {
-		idenStateLast, idenStateTreeRootsLast, err = is.getIdenStateByIdx(tx0, -2)
-		if err != nil {
-			return err
-		}
+	if !idenStateFrom.Equals(idenStateLast) {
+		return ErrIdenStateDiverged
 	}
-
-	// (B)(idenStatePending: X, transacted: false)
-
-	zkProofOut, err := is.GenZkProofIdenStateUpdate(idenStateLast, idenState)
+	idenStateTreeRoots, err := is.getIdenStateTreeRoots(tx0, idenState)
 	if err != nil {
 		return err
 	}
@@ -745,10 +1087,18 @@ func (is *Issuer) PublishState() error {
 		}
 	}
 	is.setIdenStatePending(tx, idenState, true)
+	if err := is.setIdenStatePendingTxSent(tx, is.newTxSent(clock)); err != nil {
+		return err
+	}
+	eventPublished := newEvent(EventStatePublished, idenState)
+	if err := is.audit(tx, eventPublished); err != nil {
+		return err
+	}
 
 	if err := tx.Commit(); err != nil {
 		return err
 	}
+	is.emit(eventPublished)
 
 	publicData := idenpuboffchain.PublicData{
 		IdenState:           idenState,
@@ -766,6 +1116,103 @@ func (is *Issuer) PublishState() error {
 	return nil
 }
 
+// idenStatePublishFrom returns the identity state from which the
+// idenStatePending is published: the identity state on chain, or the genesis
+// one if there's none.
+func (is *Issuer) idenStatePublishFrom(tx db.Tx) (*merkletree.Hash, error) {
+	if is.idenStateOnChain().Equals(&merkletree.HashZero) {
+		idenStateGenesis, _, err := is.getIdenStateByIdx(tx, 0)
+		return idenStateGenesis, err
+	}
+	return is.idenStateOnChain(), nil
+}
+
+// preparePublishState calculates the new identity state to publish and sets
+// it as the idenStatePending, unless there's already one pending not yet
+// transacted.  It returns the identity state transition to publish with the
+// inputs of its zk proof, or a nil idenState if the identity state hasn't
+// changed.  Must be called with the write lock held.
+func (is *Issuer) preparePublishState() (idenStateLast, idenState *merkletree.Hash,
+	inputs map[string]interface{}, err error) {
+	idenStatePending, transacted := is.idenStatePending()
+	// (C)(idenStatePending: X, transacted: true)
+	if !idenStatePending.Equals(&merkletree.HashZero) && transacted {
+		return nil, nil, nil, ErrIdenStatePendingNotNil
+	}
+
+	idenState, idenStateTreeRoots := is.state()
+
+	tx0, err := is.storage.NewTx() // Read only Tx
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer tx0.Close()
+	idenStateLast, idenStateTreeRootsLast, err := is.getIdenStateByIdx(tx0, -1)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	// (A)(idenStatePending: 0, transacted: false) && idenState != idenStateLast
+	if idenStatePending.Equals(&merkletree.HashZero) && !transacted {
+		if idenState.Equals(idenStateLast) {
+			// IdenState hasn't changed, there's no need to do
+			// anything!
+			return nil, nil, nil, nil
+		}
+
+		// idenState != idenStateLast
+
+		// If the ClaimsTreeRoot has changed (claims have been added), add the
+		// ClaimsTreeRoot to the RootsTree.
+		if !idenStateTreeRoots.ClaimsTreeRoot.Equals(idenStateTreeRootsLast.ClaimsTreeRoot) {
+			if err := claims.AddLeafRootsTree(is.rootsTree, idenStateTreeRoots.ClaimsTreeRoot); err != nil {
+				return nil, nil, nil, err
+			}
+			idenState, idenStateTreeRoots = is.state()
+		}
+
+		tx, err := is.storage.NewTx()
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		if err := is.idenStateList.Append(tx, idenState[:], &idenStateTreeRoots); err != nil {
+			return nil, nil, nil, err
+		}
+		if err := is.indexIdenState(tx, idenState); err != nil {
+			return nil, nil, nil, err
+		}
+
+		is.setIdenStatePending(tx, idenState, false)
+		eventComputed := newEvent(EventStateComputed, idenState)
+		if err := is.audit(tx, eventComputed); err != nil {
+			return nil, nil, nil, err
+		}
+
+		if err := tx.Commit(); err != nil {
+			return nil, nil, nil, err
+		}
+		is.emit(eventComputed)
+	} else {
+		// The pending state was calculated in a previous call but not
+		// transacted (or it was requeued).
+		idenState = idenStatePending
+	}
+
+	// (B)(idenStatePending: X, transacted: false)
+
+	// Publish the pending state as a transition from the state on chain
+	// (or the genesis state).
+	if idenStateLast, err = is.idenStatePublishFrom(tx0); err != nil {
+		return nil, nil, nil, err
+	}
+	inputs, err = is.genZkProofIdenStateUpdateInputs(idenStateLast, idenState)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return idenStateLast, idenState, inputs, nil
+}
+
 // RevokeClaim revokes an already issued claim.
 func (is *Issuer) RevokeClaim(claim merkletree.Entrier) error {
 	if is.cfg.GenesisOnly {
@@ -784,10 +1231,7 @@ func (is *Issuer) RevokeClaim(claim merkletree.Entrier) error {
 	}
 	nonce := claims.GetRevocationNonce(&merkletree.Entry{Data: *data})
 
-	if err := claims.AddLeafRevocationsTree(is.revocationsTree, nonce, 0xffffffff); err != nil {
-		return err
-	}
-	return nil
+	return is.revokeNonce(hi, nonce)
 }
 
 // UpdateClaim allows updating the value of an already issued claim.
@@ -798,9 +1242,18 @@ func (is *Issuer) UpdateClaim(hIndex *merkletree.Hash, value []merkletree.ElemBy
 	return fmt.Errorf("TODO")
 }
 
-// Sign signs a message by the kOp of the issuer.
-func (is *Issuer) Sign(string) (string, error) {
-	return "", fmt.Errorf("TODO")
+// Sign signs the message msg in the domain by the kOp of the issuer.  The
+// signature can be verified with a credential of the ClaimKeyOperational.
+func (is *Issuer) Sign(domain string, msg []byte) (*proof.SignedMsg, error) {
+	is.rw.RLock()
+	defer is.rw.RUnlock()
+	signedMsg := proof.SignedMsg{Domain: domain, Msg: msg}
+	sig, err := is.keyStore.SignElem(is.kOpComp, signedMsg.Hash())
+	if err != nil {
+		return nil, err
+	}
+	signedMsg.Signature = sig
+	return &signedMsg, nil
 }
 
 // SignBinary signs a binary message by the kOp of the issuer.
@@ -843,12 +1296,9 @@ func generateExistenceMTProof(mt *merkletree.MerkleTree, hi, root *merkletree.Ha
 // GenCredentialExistence generates an existence credential (claim + proof of
 // existence) of an issued claim.  The result contains all data necessary to
 // validate the credential against the Identity State found in the blockchain.
-// For now, there are no genesis credentials.
+// Credentials of claims included in the genesis state, which don't require
+// any state on chain, are generated with GenCredentialExistenceGenesis.
 func (is *Issuer) GenCredentialExistence(claim merkletree.Entrier) (*proof.CredentialExistence, error) {
-	// TODO: Once a genesis credential is implemented, figure out what to
-	// return here.  Maybe this function will error and there will be a
-	// "GenCredentialExistenceGenesis".  Maybe this function will be able
-	// to return a credential even when there's no state on chain.
 	if is.cfg.GenesisOnly {
 		return nil, ErrIdenGenesisOnly
 	}
@@ -900,6 +1350,55 @@ func (is *Issuer) GenCredentialExistence(claim merkletree.Entrier) (*proof.Crede
 	}, nil
 }
 
+// GenCredentialExistenceGenesis generates an existence credential of a claim
+// included in the genesis identity state (like the extraGenesisClaims).  The
+// credential doesn't require any identity state on chain: it's verified
+// against the identity ID, which is derived from the genesis identity state
+// (see core.IdGenesisFromIdenState).  The IdenStateData only contains the
+// genesis identity state.
+func (is *Issuer) GenCredentialExistenceGenesis(claim merkletree.Entrier) (*proof.CredentialExistence, error) {
+	is.rw.RLock()
+	defer is.rw.RUnlock()
+	tx, err := is.storage.NewTx() // Read only Tx
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Close()
+	idenStateGenesis, idenStateTreeRoots, err := is.getIdenStateByIdx(tx, 0)
+	if err != nil {
+		return nil, err
+	}
+	claimEntry := claim.Entry()
+	hi, err := claimEntry.HIndex()
+	if err != nil {
+		return nil, err
+	}
+	mtpExist, err := is.claimsTree.GenerateProof(hi, idenStateTreeRoots.ClaimsTreeRoot)
+	if err != nil {
+		return nil, err
+	}
+	if !mtpExist.Existence {
+		return nil, ErrClaimNotFoundGenesis
+	}
+	// Check the HValue is also valid
+	if err := is.claimsTree.EntryExists(claimEntry, idenStateTreeRoots.ClaimsTreeRoot); err != nil {
+		return nil, ErrClaimNotFoundGenesis
+	}
+	var idenPubUrl string
+	if is.idenPubOffChainWriter != nil {
+		idenPubUrl = is.idenPubOffChainWriter.Url()
+	}
+	return &proof.CredentialExistence{
+		Id:                  is.id,
+		IdenStateData:       proof.IdenStateData{IdenState: idenStateGenesis},
+		MtpClaim:            mtpExist,
+		Claim:               claimEntry,
+		RevocationsTreeRoot: idenStateTreeRoots.RevocationsTreeRoot,
+		RootsTreeRoot:       idenStateTreeRoots.RootsTreeRoot,
+		IdenPubUrl:          idenPubUrl,
+	}, nil
+}
+
 type IdOwnershipGenesisInputs struct {
 	Id             *big.Int
 	PrivateKey     *big.Int
@@ -910,6 +1409,16 @@ type IdOwnershipGenesisInputs struct {
 }
 
 func (is *Issuer) GenIdOwnershipGenesisInputs(levels int) (*IdOwnershipGenesisInputs, error) {
+	tx, err := is.storage.NewTx() // Read only Tx
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Close()
+	if rotated, err := is.keyOperationalRotated(tx); err != nil {
+		return nil, err
+	} else if rotated {
+		return nil, ErrKeyOperationalRotated
+	}
 	sk, err := is.keyStore.ExportKey(is.kOpComp)
 	if err != nil {
 		return nil, err
@@ -941,30 +1450,118 @@ func (is *Issuer) GenIdOwnershipGenesisInputs(levels int) (*IdOwnershipGenesisIn
 	}, nil
 }
 
+// GenZkProofIdenStateUpdate generates the zk proof of the identity state
+// update from oldIdState to newIdState.
 func (is *Issuer) GenZkProofIdenStateUpdate(oldIdState, newIdState *merkletree.Hash) (*zkutils.ZkProofOut, error) {
-	pk, err := is.idenStateZkProofConf.Files.ProvingKey()
+	return is.GenZkProofIdenStateUpdateCtx(context.Background(), oldIdState, newIdState)
+}
+
+// GenZkProofIdenStateUpdateCtx is GenZkProofIdenStateUpdate with a context.
+// The Issuer is only read locked while the inputs of the proof are
+// generated, and the generation is stopped after its running step if ctx is
+// cancelled.
+func (is *Issuer) GenZkProofIdenStateUpdateCtx(ctx context.Context,
+	oldIdState, newIdState *merkletree.Hash) (*zkutils.ZkProofOut, error) {
+	is.rw.RLock()
+	inputs, err := is.genZkProofIdenStateUpdateInputs(oldIdState, newIdState)
+	zkProver := is.prover
+	is.rw.RUnlock()
 	if err != nil {
-		return nil, fmt.Errorf("error loading zk pk: %w", err)
+		return nil, err
 	}
-	vk, err := is.idenStateZkProofConf.Files.VerificationKey()
+	return is.genZkProof(ctx, zkProver, inputs)
+}
+
+// genZkProofIdenStateUpdateInputs generates the inputs of the zk proof of
+// the identity state update from oldIdState to newIdState.  Must be called
+// with the lock held.
+func (is *Issuer) genZkProofIdenStateUpdateInputs(oldIdState,
+	newIdState *merkletree.Hash) (map[string]interface{}, error) {
+	tx, err := is.storage.NewTx() // Read only Tx
 	if err != nil {
-		return nil, fmt.Errorf("error loading zk vk: %w", err)
+		return nil, err
 	}
-
-	idOwnershipInputs, err := is.GenIdOwnershipGenesisInputs(is.idenStateZkProofConf.Levels)
+	rotated, err := is.keyOperationalRotated(tx)
+	tx.Close()
 	if err != nil {
-		return nil, fmt.Errorf("error generating idOwnership inputs: %w", err)
+		return nil, err
 	}
 
 	inputs := make(map[string]interface{})
 
-	inputs["id"] = idOwnershipInputs.Id
+	if !rotated {
+		// The genesis operational key is proved with its genesis MTP.
+		idOwnershipInputs, err := is.GenIdOwnershipGenesisInputs(is.idenStateZkProofConf.Levels)
+		if err != nil {
+			return nil, fmt.Errorf("error generating idOwnership inputs: %w", err)
+		}
+		inputs["id"] = idOwnershipInputs.Id
+		inputs["userPrivateKey"] = idOwnershipInputs.PrivateKey
+		inputs["siblings"] = idOwnershipInputs.MtpSiblings
+		inputs["claimsTreeRoot"] = idOwnershipInputs.ClaimsTreeRoot
+	} else {
+		if !is.idenStateZkProofConf.KeyRotation {
+			return nil, ErrKeyRotationUnsupported
+		}
+		// Once the operational key has been rotated, the key
+		// authorized in the old identity state is proved with the
+		// proofs of existence and non revocation of its claim.
+		idOwnershipInputs, err := is.GenIdOwnershipInputs(oldIdState, is.idenStateZkProofConf.Levels)
+		if err != nil {
+			return nil, fmt.Errorf("error generating idOwnership inputs: %w", err)
+		}
+		inputs["id"] = idOwnershipInputs.Id
+		inputs["userPrivateKey"] = idOwnershipInputs.PrivateKey
+		inputs["claimsTreeRoot"] = idOwnershipInputs.ClaimsTreeRoot
+		inputs["authClaimMtp"] = idOwnershipInputs.AuthClaimMtp
+		inputs["revTreeRoot"] = idOwnershipInputs.RevTreeRoot
+		inputs["authClaimNonRevMtp"] = idOwnershipInputs.AuthClaimNonRevMtp
+		inputs["authClaimNonRevMtpNoAux"] = idOwnershipInputs.AuthClaimNonRevMtpNoAux
+		inputs["authClaimNonRevMtpAuxHi"] = idOwnershipInputs.AuthClaimNonRevMtpAuxHi
+		inputs["authClaimNonRevMtpAuxHv"] = idOwnershipInputs.AuthClaimNonRevMtpAuxHv
+		inputs["rootsTreeRoot"] = idOwnershipInputs.RootsTreeRoot
+	}
 	inputs["oldIdState"] = oldIdState.BigInt()
-	inputs["userPrivateKey"] = idOwnershipInputs.PrivateKey
-	inputs["siblings"] = idOwnershipInputs.MtpSiblings
-	inputs["claimsTreeRoot"] = idOwnershipInputs.ClaimsTreeRoot
 	inputs["newIdState"] = newIdState.BigInt()
+	return inputs, nil
+}
+
+// genZkProof calculates the witness and generates the zk proof of the
+// identity state update circuit with the inputs, in zkProver if it's not
+// nil.  It doesn't access the Issuer state, so it doesn't require the lock.
+// If ctx is cancelled, the steps not yet started are skipped, and the ctx
+// error is returned once the running step finishes, so that no calculation
+// is left running in the background.
+func (is *Issuer) genZkProof(ctx context.Context, zkProver *zkprover.Prover,
+	inputs map[string]interface{}) (*zkutils.ZkProofOut, error) {
+	if zkProver != nil {
+		future, err := zkProver.Submit(ctx, zkprover.PriorityHigh, &is.idenStateZkProofConf.Files, inputs)
+		if err != nil {
+			return nil, err
+		}
+		// A job is skipped if ctx is cancelled before it starts, but
+		// once started it runs until it finishes.
+		zkProofOut, err := future.Wait(context.Background())
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		if err == zkprover.ErrFailedVerifyZkProof {
+			return nil, ErrFailedVerifyZkProofIdenStateUpdate
+		}
+		return zkProofOut, err
+	}
 
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	pk, err := is.idenStateZkProofConf.Files.ProvingKey()
+	if err != nil {
+		return nil, fmt.Errorf("error loading zk pk: %w", err)
+	}
+	vk, err := is.idenStateZkProofConf.Files.VerificationKey()
+	if err != nil {
+		return nil, fmt.Errorf("error loading zk vk: %w", err)
+	}
 	witnessCalcWASM, err := is.idenStateZkProofConf.Files.WitnessCalcWASM()
 	if err != nil {
 		return nil, fmt.Errorf("error loading zk witnessCalc WASM: %w", err)
@@ -973,25 +1570,31 @@ func (is *Issuer) GenZkProofIdenStateUpdate(oldIdState, newIdState *merkletree.H
 	if err != nil {
 		return nil, err
 	}
-
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	start := time.Now()
 	proof, pubSignals, err := prover.GenerateProof(pk, wit)
 	if err != nil {
 		return nil, err
 	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	// Verify zk proof
 	if !verifier.Verify(vk, proof, pubSignals) {
 		return nil, ErrFailedVerifyZkProofIdenStateUpdate
 	}
-
 	log.WithField("elapsed", time.Since(start)).Debug("Proof generated")
 	return &zkutils.ZkProofOut{Proof: *proof, PubSignals: pubSignals}, nil
 }
 
-// TODO: Create an Admin struct that exposes the following:
-// - The 3 Merle Trees
-// - RawDump(f func(key, value string))
-// - RawImport(raw map[string]string) (int, error)
-// - ClaimsDump() map[string]string
-// The return and input types are open to change.  They are based on the old
-// components/idenadminutils/idenadminutils.go
+// SetProver makes the Issuer generate its zk proofs in zkProver, which
+// can be shared with other identities to bound the resources used by the
+// proof generation.  Identity state update proofs are generated with high
+// priority, as they block the publication of the issued claims.
+func (is *Issuer) SetProver(zkProver *zkprover.Prover) {
+	is.rw.Lock()
+	defer is.rw.Unlock()
+	is.prover = zkProver
+}
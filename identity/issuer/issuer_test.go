@@ -1,6 +1,8 @@
 package issuer
 
 import (
+	"bytes"
+	"context"
 	"os"
 	"testing"
 	"time"
@@ -11,12 +13,15 @@ import (
 	idenpuboffchanlocal "github.com/iden3/go-iden3-core/components/idenpuboffchain/local"
 	"github.com/iden3/go-iden3-core/components/idenpubonchain"
 	idenpubonchainlocal "github.com/iden3/go-iden3-core/components/idenpubonchain/local"
+	"github.com/iden3/go-iden3-core/components/zkprover"
 	"github.com/iden3/go-iden3-core/core"
 	"github.com/iden3/go-iden3-core/core/claims"
+	"github.com/iden3/go-iden3-core/core/proof"
 	"github.com/iden3/go-iden3-core/db"
 	"github.com/iden3/go-iden3-core/keystore"
 	"github.com/iden3/go-iden3-core/merkletree"
 	zkutils "github.com/iden3/go-iden3-core/utils/zk"
+	"github.com/iden3/go-iden3-crypto/babyjub"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
@@ -58,6 +63,88 @@ func TestNewLoadIssuer(t *testing.T) {
 	assert.Equal(t, issuer.id, issuerLoad.id)
 }
 
+func TestLoadIssuerMigrate(t *testing.T) {
+	issuer, storage, keyStore := newIssuer(t, false, idenPubOnChain, idenPubOffChain)
+
+	// Claims included in a published identity state and pending claims
+	subject := core.NewID([2]byte{0, 0x42}, [27]byte{0x01})
+	var root merkletree.Hash
+	issueClaims := func(from, to int) {
+		for i := from; i < to; i++ {
+			var indexSlot [claims.EntryFullBytesLen]byte
+			indexSlot[0] = byte(i)
+			require.Nil(t, issuer.IssueClaim(claims.NewClaimPayloadRoot(&subject, claims.HashString("doc"),
+				indexSlot, &root)))
+		}
+	}
+	issueClaims(0, 3)
+	require.Nil(t, issuer.PublishState())
+	idenPubOnChain.Sync()
+	blockN += 10
+	require.Nil(t, issuer.SyncIdenStatePublic())
+	issueClaims(3, 5)
+	issuedClaims, err := issuer.Claims(ClaimsQuery{})
+	require.Nil(t, err)
+	require.Equal(t, 6, len(issuedClaims))
+
+	// Copy the storage without the keys added after the first version
+	storageOld := db.NewMemoryStorage()
+	tx, err := storageOld.NewTx()
+	require.Nil(t, err)
+	err = storage.Iterate(func(k, v []byte) (bool, error) {
+		for _, prefix := range [][]byte{dbPrefixClaimsLog, dbPrefixClaimsIdxType, dbPrefixClaimsIdxSubject,
+			dbPrefixClaimsIdxRevNonce, dbPrefixIdenStateClaimsLogLen, dbPrefixKOpList, dbPrefixAuditLog,
+			dbKeyIdenStatePendingTxSent, dbKeyIdenStateOnChainBlockHash} {
+			if bytes.HasPrefix(k, prefix) {
+				return true, nil
+			}
+		}
+		tx.Put(k, v)
+		return true, nil
+	})
+	require.Nil(t, err)
+	require.Nil(t, tx.Commit())
+
+	issuerLoad, err := Load(storageOld, keyStore, idenPubOnChain, idenStateZkProofConf, idenPubOffChain)
+	require.Nil(t, err)
+	assert.Equal(t, issuer.id, issuerLoad.id)
+	assert.Equal(t, &TxSent{}, issuerLoad.idenStatePendingTxSent())
+	claimKOp, err := issuerLoad.ClaimKeyOperational()
+	require.Nil(t, err)
+	events, err := issuerLoad.AuditLog(time.Unix(0, 0), time.Now())
+	require.Nil(t, err)
+	assert.Equal(t, 0, len(events))
+
+	// The existing claims are indexed with the published identity state
+	// that includes them
+	issuedClaimsLoad, err := issuerLoad.Claims(ClaimsQuery{})
+	require.Nil(t, err)
+	assert.Equal(t, len(issuedClaims), len(issuedClaimsLoad))
+	for i, issuedClaim := range issuedClaims {
+		assert.Equal(t, uint32(i), issuedClaimsLoad[i].Idx)
+		issuedClaimLoad, err := issuerLoad.ClaimByRevNonce(issuedClaim.RevNonce)
+		require.Nil(t, err)
+		assert.Equal(t, issuedClaim.Claim, issuedClaimLoad.Claim)
+		assert.Equal(t, issuedClaim.IdenState, issuedClaimLoad.IdenState)
+		// The pending claims stay after the published ones
+		assert.Equal(t, issuedClaim.IdenState == nil, issuedClaimLoad.Idx >= 4)
+	}
+	bySubject, err := issuerLoad.ClaimsBySubject(&subject, 0, 0)
+	require.Nil(t, err)
+	assert.Equal(t, 5, len(bySubject))
+
+	tx, err = storageOld.NewTx() // Read only Tx
+	require.Nil(t, err)
+	defer tx.Close()
+	var kOp keyOperational
+	require.Nil(t, issuerLoad.kOpList.Get(tx, issuer.kOpComp[:], &kOp))
+	assert.Equal(t, claimKOp.Metadata().RevNonce, kOp.RevNonce)
+
+	// Loading again doesn't migrate anything
+	_, err = Load(storageOld, keyStore, idenPubOnChain, idenStateZkProofConf, idenPubOffChain)
+	require.Nil(t, err)
+}
+
 func TestIssuerGenesis(t *testing.T) {
 	issuer, _, _ := newIssuer(t, true, nil, nil)
 
@@ -208,6 +295,821 @@ func TestIssuerCredential(t *testing.T) {
 	assert.Equal(t, ErrClaimNotYetInOnChainState, err)
 }
 
+func TestIssuerCredentialGenesis(t *testing.T) {
+	cfg := ConfigDefault
+	cfg.GenesisOnly = true
+	storage := db.NewMemoryStorage()
+	ksStorage := keystore.MemStorage([]byte{})
+	keyStore, err := keystore.NewKeyStore(&ksStorage, keystore.LightKeyStoreParams)
+	require.Nil(t, err)
+	kOp, err := keyStore.NewKey(pass)
+	require.Nil(t, err)
+	indexBytes, valueBytes := [claims.IndexSlotLen]byte{}, [claims.ValueSlotLen]byte{}
+	indexBytes[0] = 0x42
+	claim0 := claims.NewClaimBasic(indexBytes, valueBytes)
+	_, err = Create(cfg, kOp, []claims.Claimer{claim0}, storage, keyStore)
+	require.Nil(t, err)
+	issuer, err := Load(storage, keyStore, nil, nil, nil)
+	require.Nil(t, err)
+
+	credExist, err := issuer.GenCredentialExistenceGenesis(claim0)
+	require.Nil(t, err)
+	assert.Equal(t, issuer.ID(), core.IdGenesisFromIdenState(credExist.IdenStateData.IdenState))
+	assert.Equal(t, claim0.Entry().Data, credExist.Claim.Data)
+
+	indexBytes[0] = 0x81
+	claim1 := claims.NewClaimBasic(indexBytes, valueBytes)
+	_, err = issuer.GenCredentialExistenceGenesis(claim1)
+	assert.Equal(t, ErrClaimNotFoundGenesis, err)
+}
+
+func TestIssuerGenCredentialsForState(t *testing.T) {
+	issuer, _, _ := newIssuer(t, false, idenPubOnChain, idenPubOffChain)
+	publish := func(indexes ...byte) *merkletree.Hash {
+		for _, index := range indexes {
+			indexBytes, valueBytes := [claims.IndexSlotLen]byte{}, [claims.ValueSlotLen]byte{}
+			indexBytes[0] = index
+			require.Nil(t, issuer.IssueClaim(claims.NewClaimBasic(indexBytes, valueBytes)))
+		}
+		require.Nil(t, issuer.PublishState())
+		idenPubOnChain.Sync()
+		blockN += 10
+		require.Nil(t, issuer.SyncIdenStatePublic())
+		return issuer.IdenStateOnChain()
+	}
+	genCredentials := func(idenState *merkletree.Hash) ([]*proof.CredentialExistence, error) {
+		var credentials []*proof.CredentialExistence
+		err := issuer.GenCredentialsForState(idenState, CredentialSinkFunc(
+			func(credExist *proof.CredentialExistence) error {
+				credentials = append(credentials, credExist)
+				return nil
+			}))
+		return credentials, err
+	}
+
+	state1 := publish(0x01, 0x02)
+	credentials, err := genCredentials(state1)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(credentials))
+	for _, credExist := range credentials {
+		assert.Equal(t, state1, credExist.IdenStateData.IdenState)
+	}
+	assert.Equal(t, byte(0x01), credentials[0].Claim.Data[0][12])
+
+	state2 := publish(0x03)
+	credentials, err = genCredentials(state2)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(credentials))
+	assert.Equal(t, byte(0x03), credentials[0].Claim.Data[0][12])
+
+	// Past identity states on chain can be exported again
+	credentials, err = genCredentials(state1)
+	require.Nil(t, err)
+	assert.Equal(t, 2, len(credentials))
+
+	// An identity state not on chain
+	var idenStateUnknown merkletree.Hash
+	idenStateUnknown[0] = 0x42
+	_, err = genCredentials(&idenStateUnknown)
+	assert.Equal(t, ErrIdenStateNotOnChain, err)
+}
+
+func TestIssuerClaimsIndex(t *testing.T) {
+	issuer, _, _ := newIssuer(t, false, idenPubOnChain, idenPubOffChain)
+
+	// The genesis claim of the operational key is indexed and included in
+	// the genesis state.
+	genesisState, _ := issuer.State()
+	claimsKOp, err := issuer.ClaimsByType(claims.ClaimTypeKeyBabyJub, 0, 0)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(claimsKOp))
+	assert.Equal(t, genesisState, claimsKOp[0].IdenState)
+
+	subject0 := core.NewID([2]byte{0, 0x42}, [27]byte{0x01})
+	subject1 := core.NewID([2]byte{0, 0x42}, [27]byte{0x02})
+	var root merkletree.Hash
+	for i := 0; i < 5; i++ {
+		var indexSlot [claims.EntryFullBytesLen]byte
+		indexSlot[0] = byte(i)
+		subject := &subject0
+		if i%2 == 1 {
+			subject = &subject1
+		}
+		err := issuer.IssueClaim(claims.NewClaimPayloadRoot(subject, claims.HashString("doc"), indexSlot, &root))
+		require.Nil(t, err)
+	}
+	indexBytes, valueBytes := [claims.IndexSlotLen]byte{}, [claims.ValueSlotLen]byte{}
+	claimBasic := claims.NewClaimBasic(indexBytes, valueBytes)
+	require.Nil(t, issuer.IssueClaim(claimBasic))
+
+	all, err := issuer.Claims(ClaimsQuery{})
+	require.Nil(t, err)
+	assert.Equal(t, 7, len(all))
+	for i, c := range all {
+		assert.Equal(t, uint32(i), c.Idx)
+	}
+
+	bySubject0, err := issuer.ClaimsBySubject(&subject0, 0, 0)
+	require.Nil(t, err)
+	assert.Equal(t, 3, len(bySubject0))
+	for _, c := range bySubject0 {
+		assert.Equal(t, &subject0, c.Subject)
+		assert.Nil(t, c.IdenState)
+	}
+
+	// Pagination
+	page, err := issuer.ClaimsByType(claims.ClaimTypePayloadRoot, 1, 2)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(page))
+	assert.Equal(t, uint32(2), page[0].Idx)
+	assert.Equal(t, uint32(3), page[1].Idx)
+	claimType := claims.ClaimTypePayloadRoot
+	page, err = issuer.Claims(ClaimsQuery{Type: &claimType, Subject: &subject1, Offset: 1, Limit: 5})
+	require.Nil(t, err)
+	require.Equal(t, 1, len(page))
+	assert.Equal(t, uint32(4), page[0].Idx)
+
+	// Lookup by revocation nonce
+	issuedClaim, err := issuer.ClaimByRevNonce(claimBasic.Metadata().RevNonce)
+	require.Nil(t, err)
+	assert.Equal(t, claimBasic.Entry().Data, issuedClaim.Claim.Data)
+	_, err = issuer.ClaimByRevNonce(0xffff)
+	assert.Equal(t, ErrClaimNotFoundRevNonce, err)
+
+	// Pages without filters
+	page, err = issuer.Claims(ClaimsQuery{Offset: 5, Limit: 5})
+	require.Nil(t, err)
+	require.Equal(t, 2, len(page))
+	assert.Equal(t, uint32(5), page[0].Idx)
+	assert.Equal(t, uint32(6), page[1].Idx)
+
+	// After publishing, the new claims are included in the new state once
+	// it's on chain
+	err = issuer.PublishState()
+	require.Nil(t, err)
+	newState, _ := issuer.State()
+	issuedClaim, err = issuer.ClaimByRevNonce(claimBasic.Metadata().RevNonce)
+	require.Nil(t, err)
+	assert.Nil(t, issuedClaim.IdenState)
+	idenPubOnChain.Sync()
+	blockN += 10
+	require.Nil(t, issuer.SyncIdenStatePublic())
+	issuedClaim, err = issuer.ClaimByRevNonce(claimBasic.Metadata().RevNonce)
+	require.Nil(t, err)
+	assert.Equal(t, newState, issuedClaim.IdenState)
+	claimsKOp, err = issuer.ClaimsByType(claims.ClaimTypeKeyBabyJub, 0, 0)
+	require.Nil(t, err)
+	assert.Equal(t, genesisState, claimsKOp[0].IdenState)
+}
+
+func TestIssuerIssueClaims(t *testing.T) {
+	issuer, _, _ := newIssuer(t, false, idenPubOnChain, idenPubOffChain)
+
+	newClaim := func(i byte) *claims.ClaimBasic {
+		indexBytes, valueBytes := [claims.IndexSlotLen]byte{}, [claims.ValueSlotLen]byte{}
+		indexBytes[0] = i
+		return claims.NewClaimBasic(indexBytes, valueBytes)
+	}
+	var rootOutOfField merkletree.Hash
+	for i := range rootOutOfField {
+		rootOutOfField[i] = 0xff
+	}
+	subject := core.NewID([2]byte{0, 0x42}, [27]byte{})
+	claimOutOfField := claims.NewClaimPayloadRoot(&subject, claims.HashString("doc"),
+		[claims.EntryFullBytesLen]byte{}, &rootOutOfField)
+
+	claimsTreeRoot := issuer.claimsTree.RootKey()
+
+	// A batch with a repeated index and a claim out of the field is not
+	// issued at all, and doesn't consume nonces.
+	batch := []claims.Claimer{newClaim(1), newClaim(2), newClaim(1), claimOutOfField}
+	err := issuer.IssueClaims(batch)
+	require.NotNil(t, err)
+	errClaims, ok := err.(*IssueClaimsError)
+	require.True(t, ok)
+	assert.Nil(t, errClaims.Errs[0])
+	assert.Nil(t, errClaims.Errs[1])
+	assert.Equal(t, merkletree.ErrEntryIndexAlreadyExists, errClaims.Errs[2])
+	assert.Equal(t, merkletree.ErrEntryNotInField, errClaims.Errs[3])
+	assert.Equal(t, claimsTreeRoot, issuer.claimsTree.RootKey())
+	for _, claim := range batch {
+		assert.Equal(t, uint32(0), claim.Metadata().RevNonce)
+	}
+	all, err := issuer.Claims(ClaimsQuery{})
+	require.Nil(t, err)
+	assert.Equal(t, 1, len(all))
+
+	// A valid batch is issued completely
+	batch = []claims.Claimer{newClaim(1), newClaim(2), newClaim(3)}
+	err = issuer.IssueClaims(batch)
+	require.Nil(t, err)
+	for i, claim := range batch {
+		assert.Equal(t, uint32(i+1), claim.Metadata().RevNonce)
+		issuedClaim, err := issuer.ClaimByRevNonce(claim.Metadata().RevNonce)
+		require.Nil(t, err)
+		assert.Equal(t, claim.Entry().Data, issuedClaim.Claim.Data)
+	}
+
+	// Issuing a single claim reports the error directly
+	err = issuer.IssueClaim(newClaim(2))
+	assert.Equal(t, merkletree.ErrEntryIndexAlreadyExists, err)
+	claim := newClaim(4)
+	require.Nil(t, issuer.IssueClaim(claim))
+	assert.Equal(t, uint32(4), claim.Metadata().RevNonce)
+}
+
+func TestIssuerRotateKeyOperational(t *testing.T) {
+	issuer, _, keyStore := newIssuer(t, false, idenPubOnChain, idenPubOffChain)
+	genesisState, _ := issuer.State()
+	kOpGenesis := issuer.KeyOperational()
+
+	kOpNew, err := keyStore.NewKey(pass)
+	require.Nil(t, err)
+	require.Nil(t, keyStore.UnlockKey(kOpNew, pass))
+
+	// The identity state update circuit doesn't support key rotation
+	assert.Equal(t, ErrKeyRotationUnsupported, issuer.RotateKeyOperational(kOpNew))
+	assert.Equal(t, kOpGenesis, issuer.KeyOperational())
+
+	// With a circuit that supports it
+	issuer.idenStateZkProofConf = &IdenStateZkProofConf{
+		Levels:      idenStateZkProofConf.Levels,
+		Files:       *newIdenStateZkFiles(),
+		KeyRotation: true,
+	}
+	assert.Equal(t, ErrKeyOperationalAlreadyInUse, issuer.RotateKeyOperational(kOpGenesis))
+	require.Nil(t, issuer.RotateKeyOperational(kOpNew))
+	assert.Equal(t, kOpNew, issuer.KeyOperational())
+
+	// The genesis key claim is revoked
+	claimsKOp, err := issuer.ClaimsByType(claims.ClaimTypeKeyBabyJub, 0, 0)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(claimsKOp))
+	revHi, err := claims.NewLeafRevocationsTree(claimsKOp[0].RevNonce, 0).Entry().HIndex()
+	require.Nil(t, err)
+	_, err = issuer.revocationsTree.GetDataByIndex(revHi)
+	assert.Nil(t, err)
+
+	_, err = issuer.GenIdOwnershipGenesisInputs(idenStateZkProofConf.Levels)
+	assert.Equal(t, ErrKeyOperationalRotated, err)
+
+	// The state update that includes the rotation is proved with the
+	// genesis key, authorized in the old (genesis) state.
+	tx, err := issuer.storage.NewTx()
+	require.Nil(t, err)
+	roots, err := issuer.getIdenStateTreeRoots(tx, genesisState)
+	require.Nil(t, err)
+	kOp, _, err := issuer.keyOperationalInState(tx, roots)
+	require.Nil(t, err)
+	assert.Equal(t, kOpGenesis, kOp)
+	tx.Close()
+	_, err = issuer.GenIdOwnershipInputs(genesisState, idenStateZkProofConf.Levels)
+	require.Nil(t, err)
+
+	// The rotation is included in a new identity state, with the inputs
+	// of its zk proof.
+	issuer.rw.Lock()
+	_, newState, inputs, err := issuer.preparePublishState()
+	issuer.rw.Unlock()
+	require.Nil(t, err)
+	assert.Equal(t, genesisState.BigInt(), inputs["oldIdState"])
+	assert.NotNil(t, inputs["authClaimNonRevMtp"])
+
+	// Later state updates are proved with the new key
+	tx, err = issuer.storage.NewTx()
+	require.Nil(t, err)
+	roots, err = issuer.getIdenStateTreeRoots(tx, newState)
+	require.Nil(t, err)
+	kOp, _, err = issuer.keyOperationalInState(tx, roots)
+	require.Nil(t, err)
+	assert.Equal(t, kOpNew, kOp)
+	tx.Close()
+	_, err = issuer.GenIdOwnershipInputs(newState, idenStateZkProofConf.Levels)
+	require.Nil(t, err)
+}
+
+func TestIssuerPendingStateRecovery(t *testing.T) {
+	issuer, storage, keyStore := newIssuer(t, false, idenPubOnChain, idenPubOffChain)
+	issuer.cfg.PendingTxStaleBlocks = 5
+
+	assert.Equal(t, ErrIdenStatePendingNoTx, issuer.ResubmitPendingState())
+	assert.Equal(t, ErrIdenStatePendingNoTx, issuer.AbandonPendingState())
+
+	indexBytes, valueBytes := [claims.IndexSlotLen]byte{}, [claims.ValueSlotLen]byte{}
+	require.Nil(t, issuer.IssueClaim(claims.NewClaimBasic(indexBytes, valueBytes)))
+	require.Nil(t, issuer.PublishState())
+	newState, _ := issuer.State()
+	stale, err := issuer.IdenStatePendingStale()
+	require.Nil(t, err)
+	assert.False(t, stale)
+
+	// The transaction is not mined for many blocks
+	blockN += 10
+	stale, err = issuer.IdenStatePendingStale()
+	require.Nil(t, err)
+	assert.True(t, stale)
+	assert.Equal(t, ErrIdenStatePendingStale, issuer.SyncIdenStatePublic())
+
+	// Resubmit with a bumped gas price
+	gasPrice := issuer.ethTxInitState().GasPrice()
+	require.Nil(t, issuer.ResubmitPendingState())
+	assert.Equal(t, 1, issuer.ethTxInitState().GasPrice().Cmp(gasPrice))
+	stale, err = issuer.IdenStatePendingStale()
+	require.Nil(t, err)
+	assert.False(t, stale)
+
+	// The pending transaction is persisted
+	issuerLoad, err := Load(storage, keyStore, idenPubOnChain, idenStateZkProofConf, idenPubOffChain)
+	require.Nil(t, err)
+	assert.Equal(t, issuer.ethTxInitState().Hash(), issuerLoad.ethTxInitState().Hash())
+	assert.Equal(t, issuer.idenStatePendingTxSent(), issuerLoad.idenStatePendingTxSent())
+
+	// An Issuer with a stale pending transaction can be loaded
+	blockN += ConfigDefault.PendingTxStaleBlocks
+	issuerLoad, err = Load(storage, keyStore, idenPubOnChain, idenStateZkProofConf, idenPubOffChain)
+	require.Nil(t, err)
+	stale, err = issuerLoad.IdenStatePendingStale()
+	require.Nil(t, err)
+	assert.True(t, stale)
+	idenStatePending, transacted := issuerLoad.IdenStatePending()
+	assert.Equal(t, newState, idenStatePending)
+	assert.True(t, transacted)
+
+	// The transaction can't be abandoned while its nonce isn't mined
+	assert.Equal(t, ErrIdenStatePendingTxUnmined, issuer.AbandonPendingState())
+
+	// The transaction is replaced by another one and abandoned
+	idenPubOnChain.CancelPending()
+	require.Nil(t, issuer.AbandonPendingState())
+	idenStatePending, transacted = issuer.IdenStatePending()
+	assert.Equal(t, newState, idenStatePending)
+	assert.False(t, transacted)
+
+	// The pending state is published again
+	require.Nil(t, issuer.PublishState())
+	idenPubOnChain.Sync()
+	blockN += 10
+	require.Nil(t, issuer.SyncIdenStatePublic())
+	assert.Equal(t, newState, issuer.IdenStateOnChain())
+}
+
+func TestIssuerReorg(t *testing.T) {
+	issuer, storage, keyStore := newIssuer(t, false, idenPubOnChain, idenPubOffChain)
+
+	indexBytes, valueBytes := [claims.IndexSlotLen]byte{}, [claims.ValueSlotLen]byte{}
+	require.Nil(t, issuer.IssueClaim(claims.NewClaimBasic(indexBytes, valueBytes)))
+	require.Nil(t, issuer.PublishState())
+	idenPubOnChain.Sync()
+	blockN += 10
+	require.Nil(t, issuer.SyncIdenStatePublic())
+	state1, _ := issuer.State()
+	assert.Equal(t, state1, issuer.IdenStateOnChain())
+
+	indexBytes[0] = 1
+	require.Nil(t, issuer.IssueClaim(claims.NewClaimBasic(indexBytes, valueBytes)))
+	require.Nil(t, issuer.PublishState())
+	idenPubOnChain.Sync()
+	blockN += 10
+	require.Nil(t, issuer.SyncIdenStatePublic())
+	state2, _ := issuer.State()
+	assert.Equal(t, state2, issuer.IdenStateOnChain())
+
+	// The block with the last identity state update is reorganized
+	idenPubOnChain.Reorg(issuer.ID(), 1)
+	require.Nil(t, issuer.SyncIdenStatePublic())
+	assert.Equal(t, state1, issuer.IdenStateOnChain())
+	idenStatePending, transacted := issuer.IdenStatePending()
+	assert.Equal(t, state2, idenStatePending)
+	assert.False(t, transacted)
+	_, err := issuer.storage.Get(dbKeyIdenStateData(state2))
+	assert.Equal(t, db.ErrNotFound, err)
+	_, err = issuer.storage.Get(dbKeyIdenStateData(state1))
+	assert.Nil(t, err)
+	auditLog, err := issuer.AuditLog(time.Unix(0, 0), time.Now().Add(time.Minute))
+	require.Nil(t, err)
+	assert.Equal(t, EventStateRolledBack, auditLog[len(auditLog)-1].Type)
+	assert.Equal(t, state1, auditLog[len(auditLog)-1].IdenState)
+
+	// The rollback is persisted
+	issuerLoad, err := Load(storage, keyStore, idenPubOnChain, idenStateZkProofConf, idenPubOffChain)
+	require.Nil(t, err)
+	assert.Equal(t, state1, issuerLoad.IdenStateOnChain())
+	assert.Equal(t, issuer.idenStateOnChainBlockHash(), issuerLoad.idenStateOnChainBlockHash())
+
+	// The requeued identity state is published again
+	require.Nil(t, issuer.PublishState())
+	idenPubOnChain.Sync()
+	blockN += 10
+	require.Nil(t, issuer.SyncIdenStatePublic())
+	assert.Equal(t, state2, issuer.IdenStateOnChain())
+}
+
+func TestIssuerEvents(t *testing.T) {
+	issuer, _, _ := newIssuer(t, false, idenPubOnChain, idenPubOffChain)
+	start := time.Now()
+	events, unsubscribe := issuer.Subscribe(16)
+
+	indexBytes, valueBytes := [claims.IndexSlotLen]byte{}, [claims.ValueSlotLen]byte{}
+	claim := claims.NewClaimBasic(indexBytes, valueBytes)
+	require.Nil(t, issuer.IssueClaim(claim))
+	event := <-events
+	assert.Equal(t, EventClaimIssued, event.Type)
+	assert.Equal(t, claim.Metadata().RevNonce, *event.RevNonce)
+	state, _ := issuer.State()
+	assert.Equal(t, state, event.IdenState)
+
+	require.Nil(t, issuer.RevokeClaim(claim))
+	event = <-events
+	assert.Equal(t, EventClaimRevoked, event.Type)
+	hi, err := claim.Entry().HIndex()
+	require.Nil(t, err)
+	assert.Equal(t, hi, event.HIndex)
+
+	require.Nil(t, issuer.PublishState())
+	assert.Equal(t, EventStateComputed, (<-events).Type)
+	assert.Equal(t, EventStatePublished, (<-events).Type)
+	idenPubOnChain.Sync()
+	blockN += 10
+	require.Nil(t, issuer.SyncIdenStatePublic())
+	event = <-events
+	assert.Equal(t, EventStateConfirmed, event.Type)
+	assert.Equal(t, issuer.IdenStateOnChain(), event.IdenState)
+
+	unsubscribe()
+	_, ok := <-events
+	assert.False(t, ok)
+
+	// The audit log contains the genesis claim and all the operations
+	auditLog, err := issuer.AuditLog(start.Add(-time.Minute), time.Now().Add(time.Minute))
+	require.Nil(t, err)
+	var types []EventType
+	for _, event := range auditLog {
+		types = append(types, event.Type)
+	}
+	assert.Equal(t, []EventType{EventClaimIssued, EventClaimIssued, EventClaimRevoked,
+		EventStateComputed, EventStatePublished, EventStateConfirmed}, types)
+	auditLog, err = issuer.AuditLog(time.Now().Add(time.Minute), time.Now().Add(2*time.Minute))
+	require.Nil(t, err)
+	assert.Equal(t, 0, len(auditLog))
+}
+
+func TestIssuerRevocationStatus(t *testing.T) {
+	issuer, _, _ := newIssuer(t, false, idenPubOnChain, idenPubOffChain)
+
+	indexBytes, valueBytes := [claims.IndexSlotLen]byte{}, [claims.ValueSlotLen]byte{}
+	claim := claims.NewClaimBasic(indexBytes, valueBytes)
+	require.Nil(t, issuer.IssueClaim(claim))
+	nonce := claim.Metadata().RevNonce
+	status, err := issuer.RevocationStatus(nonce)
+	require.Nil(t, err)
+	assert.Equal(t, &RevocationStatus{}, status)
+
+	require.Nil(t, issuer.RevokeByNonce(nonce))
+	assert.Equal(t, ErrClaimAlreadyRevoked, issuer.RevokeByNonce(nonce))
+	assert.Equal(t, ErrClaimNotFoundRevNonce, issuer.RevokeByNonce(nonce+100))
+	_, err = issuer.RevocationStatus(nonce + 100)
+	assert.Equal(t, ErrClaimNotFoundRevNonce, err)
+	status, err = issuer.RevocationStatus(nonce)
+	require.Nil(t, err)
+	assert.Equal(t, &RevocationStatus{Revoked: true}, status)
+
+	// The claim of the operational key in use can't be revoked
+	claimsKOp, err := issuer.ClaimsByType(claims.ClaimTypeKeyBabyJub, 0, 0)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(claimsKOp))
+	assert.Equal(t, ErrRevokeKeyOperationalInUse, issuer.RevokeByNonce(claimsKOp[0].RevNonce))
+
+	// The revocation is included in a new identity state, which is not
+	// published until it's seen on chain
+	require.Nil(t, issuer.PublishState())
+	newState, _ := issuer.State()
+	status, err = issuer.RevocationStatus(nonce)
+	require.Nil(t, err)
+	assert.Equal(t, &RevocationStatus{Revoked: true}, status)
+
+	// The identity state with the revocation is confirmed on chain
+	idenPubOnChain.Sync()
+	blockN += 10
+	require.Nil(t, issuer.SyncIdenStatePublic())
+	status, err = issuer.RevocationStatus(nonce)
+	require.Nil(t, err)
+	assert.Equal(t, &RevocationStatus{Revoked: true, IdenState: newState, OnChain: true}, status)
+}
+
+func TestIssuerPublishStateCtx(t *testing.T) {
+	issuer, _, _ := newIssuer(t, false, idenPubOnChain, idenPubOffChain)
+	zkProver := zkprover.New(zkprover.ConfigDefault)
+	defer zkProver.Stop()
+	issuer.SetProver(zkProver)
+	events, unsubscribe := issuer.Subscribe(16)
+	defer unsubscribe()
+	waitEvent := func(eventType EventType) {
+		for event := range events {
+			if event.Type == eventType {
+				return
+			}
+		}
+	}
+	// keepProverBusy blocks the prover until the returned function is
+	// called.
+	keepProverBusy := func() func() {
+		release := make(chan struct{})
+		busy := make(chan struct{})
+		go func() {
+			_, _ = zkProver.SubmitFunc(context.Background(), zkprover.PriorityHigh,
+				func() (*zkutils.ZkProofOut, error) {
+					close(busy)
+					<-release
+					return nil, nil
+				})
+		}()
+		<-busy
+		return func() { close(release) }
+	}
+
+	// The pending state changes while the proof is generated
+	release := keepProverBusy()
+	indexBytes, valueBytes := [claims.IndexSlotLen]byte{}, [claims.ValueSlotLen]byte{}
+	require.Nil(t, issuer.IssueClaim(claims.NewClaimBasic(indexBytes, valueBytes)))
+	done := make(chan error)
+	go func() { done <- issuer.PublishStateCtx(context.Background()) }()
+	waitEvent(EventStateComputed)
+	// The Issuer is not locked while the proof is generated
+	indexBytes[0] = 0x01
+	require.Nil(t, issuer.IssueClaim(claims.NewClaimBasic(indexBytes, valueBytes)))
+	issuer.rw.Lock()
+	tx, err := issuer.storage.NewTx()
+	require.Nil(t, err)
+	issuer.setIdenStatePending(tx, &merkletree.HashZero, false)
+	require.Nil(t, tx.Commit())
+	issuer.rw.Unlock()
+	release()
+	assert.Equal(t, ErrIdenStateDiverged, <-done)
+
+	// Cancelled publication
+	release = keepProverBusy()
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() { done <- issuer.PublishStateCtx(ctx) }()
+	waitEvent(EventStateComputed)
+	cancel()
+	// The publication doesn't return until the queued proof is dropped
+	select {
+	case err := <-done:
+		t.Fatalf("publication returned before the proof stopped: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	release()
+	assert.Equal(t, context.Canceled, <-done)
+	newState, _ := issuer.State()
+	idenStatePending, transacted := issuer.IdenStatePending()
+	assert.Equal(t, newState, idenStatePending)
+	assert.False(t, transacted)
+
+	// Finally the pending state is published
+	require.Nil(t, issuer.PublishStateCtx(context.Background()))
+	idenStatePending, transacted = issuer.IdenStatePending()
+	assert.Equal(t, newState, idenStatePending)
+	assert.True(t, transacted)
+}
+
+func TestIssuerPreviewState(t *testing.T) {
+	issuer, storage, _ := newIssuer(t, false, idenPubOnChain, idenPubOffChain)
+	preview, err := issuer.PreviewState()
+	require.Nil(t, err)
+	assert.False(t, preview.Changed)
+
+	indexBytes, valueBytes := [claims.IndexSlotLen]byte{}, [claims.ValueSlotLen]byte{}
+	claim0 := claims.NewClaimBasic(indexBytes, valueBytes)
+	indexBytes[0] = 0x01
+	claim1 := claims.NewClaimBasic(indexBytes, valueBytes)
+	require.Nil(t, issuer.IssueClaims([]claims.Claimer{claim0, claim1}))
+	require.Nil(t, issuer.RevokeClaim(claim0))
+	issuedClaims, err := issuer.Claims(ClaimsQuery{})
+	require.Nil(t, err)
+	require.Equal(t, 3, len(issuedClaims))
+
+	idenState, idenStateTreeRoots := issuer.State()
+	preview, err = issuer.PreviewState()
+	require.Nil(t, err)
+	assert.True(t, preview.Changed)
+	assert.False(t, preview.Pending)
+	assert.True(t, preview.ClaimsTreeRootAdded)
+	tx, err := storage.NewTx()
+	require.Nil(t, err)
+	defer tx.Close()
+	genesisState, _, err := issuer.getIdenStateByIdx(tx, 0)
+	require.Nil(t, err)
+	assert.Equal(t, genesisState, preview.IdenStateFrom)
+	assert.Equal(t, idenStateTreeRoots.ClaimsTreeRoot, preview.IdenStateTreeRoots.ClaimsTreeRoot)
+	assert.Equal(t, idenStateTreeRoots.RevocationsTreeRoot, preview.IdenStateTreeRoots.RevocationsTreeRoot)
+	assert.NotEqual(t, idenStateTreeRoots.RootsTreeRoot, preview.IdenStateTreeRoots.RootsTreeRoot)
+	assert.Equal(t, issuedClaims[1:], preview.Claims)
+	assert.Equal(t, []uint32{issuedClaims[1].RevNonce}, preview.RevokedNonces)
+	assert.True(t, preview.RevocationsTreeBlobSize > 0)
+	assert.True(t, preview.RootsTreeBlobSize > 0)
+
+	// The Issuer is not modified
+	idenStateAfter, idenStateTreeRootsAfter := issuer.State()
+	assert.Equal(t, idenState, idenStateAfter)
+	assert.Equal(t, idenStateTreeRoots, idenStateTreeRootsAfter)
+	idenStateListLen, err := issuer.idenStateList.Length(tx)
+	require.Nil(t, err)
+	assert.Equal(t, uint32(1), idenStateListLen)
+
+	// The previewed identity state is the one calculated by PublishState
+	issuer.rw.Lock()
+	_, idenStateNew, _, err := issuer.preparePublishState()
+	issuer.rw.Unlock()
+	require.Nil(t, err)
+	assert.Equal(t, preview.IdenState, idenStateNew)
+	idenStateNew, idenStateTreeRootsNew := issuer.State()
+	assert.Equal(t, preview.IdenState, idenStateNew)
+	assert.Equal(t, preview.IdenStateTreeRoots, idenStateTreeRootsNew)
+
+	// Once calculated, the pending identity state is previewed
+	previewPending, err := issuer.PreviewState()
+	require.Nil(t, err)
+	assert.True(t, previewPending.Pending)
+	previewPending.Pending = false
+	assert.Equal(t, preview, previewPending)
+
+	// Revocations after the calculation are not in the pending identity
+	// state
+	require.Nil(t, issuer.RevokeClaim(claim1))
+	previewPending, err = issuer.PreviewState()
+	require.Nil(t, err)
+	assert.Equal(t, preview.RevokedNonces, previewPending.RevokedNonces)
+	require.Nil(t, issuer.PublishState())
+	idenPubOnChain.Sync()
+	blockN += 10
+	require.Nil(t, issuer.SyncIdenStatePublic())
+	idenStateOnChain := issuer.IdenStateOnChain()
+
+	// The pending identity state is previewed as a transition from the
+	// identity state on chain
+	indexBytes[0] = 0x02
+	claim2 := claims.NewClaimBasic(indexBytes, valueBytes)
+	require.Nil(t, issuer.IssueClaim(claim2))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, context.Canceled, issuer.PublishStateCtx(ctx))
+	require.Nil(t, issuer.RevokeClaim(claim2))
+	issuedClaims, err = issuer.Claims(ClaimsQuery{})
+	require.Nil(t, err)
+	require.Equal(t, 4, len(issuedClaims))
+	previewPending, err = issuer.PreviewState()
+	require.Nil(t, err)
+	assert.True(t, previewPending.Pending)
+	assert.Equal(t, idenStateOnChain, previewPending.IdenStateFrom)
+	assert.Equal(t, issuedClaims[3:], previewPending.Claims)
+	assert.Equal(t, []uint32{issuedClaims[2].RevNonce}, previewPending.RevokedNonces)
+
+	// After a chain reorganization removing both identity states, the
+	// requeued one is a transition from the genesis identity state
+	require.Nil(t, issuer.PublishState())
+	idenPubOnChain.Sync()
+	blockN += 10
+	require.Nil(t, issuer.SyncIdenStatePublic())
+	idenPubOnChain.Reorg(issuer.ID(), 2)
+	require.Nil(t, issuer.SyncIdenStatePublic())
+	issuedClaims, err = issuer.Claims(ClaimsQuery{})
+	require.Nil(t, err)
+	previewPending, err = issuer.PreviewState()
+	require.Nil(t, err)
+	assert.True(t, previewPending.Pending)
+	assert.Equal(t, genesisState, previewPending.IdenStateFrom)
+	assert.Equal(t, issuedClaims[1:], previewPending.Claims)
+	assert.Equal(t, []uint32{issuedClaims[1].RevNonce, issuedClaims[2].RevNonce}, previewPending.RevokedNonces)
+}
+
+func TestIssuerRecover(t *testing.T) {
+	issuer, _, keyStore := newIssuer(t, false, idenPubOnChain, idenPubOffChain)
+	genesisState, _ := issuer.State()
+
+	// Published claims and revocation
+	indexBytes, valueBytes := [claims.IndexSlotLen]byte{}, [claims.ValueSlotLen]byte{}
+	claim0 := claims.NewClaimBasic(indexBytes, valueBytes)
+	indexBytes[0] = 0x01
+	claim1 := claims.NewClaimBasic(indexBytes, valueBytes)
+	require.Nil(t, issuer.IssueClaims([]claims.Claimer{claim0, claim1}))
+	require.Nil(t, issuer.RevokeClaim(claim0))
+	require.Nil(t, issuer.PublishState())
+	idenPubOnChain.Sync()
+	blockN += 10
+	require.Nil(t, issuer.SyncIdenStatePublic())
+
+	// Unpublished claim and revocation
+	indexBytes[0] = 0x02
+	require.Nil(t, issuer.IssueClaim(claims.NewClaimBasic(indexBytes, valueBytes)))
+	require.Nil(t, issuer.RevokeClaim(claim1))
+
+	claimsDump, err := NewAdmin(issuer).ClaimsDump(nil)
+	require.Nil(t, err)
+	revokedNonces := []uint32{claim0.Metadata().RevNonce, claim1.Metadata().RevNonce}
+	publicData, err := idenPubOffChain.GetPublicData(idenPubOffChain.Url(), issuer.ID(), issuer.IdenStateOnChain())
+	require.Nil(t, err)
+
+	storage := db.NewMemoryStorage()
+	id, err := Recover(issuer.cfg, storage, keyStore, claimsDump, revokedNonces, publicData, idenPubOnChain)
+	require.Nil(t, err)
+	assert.Equal(t, issuer.ID(), id)
+	issuerRecover, err := Load(storage, keyStore, idenPubOnChain, idenStateZkProofConf, idenPubOffChain)
+	require.Nil(t, err)
+	idenState, idenStateTreeRoots := issuer.State()
+	idenStateRecover, idenStateTreeRootsRecover := issuerRecover.State()
+	assert.Equal(t, idenState, idenStateRecover)
+	assert.Equal(t, idenStateTreeRoots, idenStateTreeRootsRecover)
+	assert.Equal(t, issuer.IdenStateOnChain(), issuerRecover.IdenStateOnChain())
+	assert.Equal(t, issuer.KeyOperational(), issuerRecover.KeyOperational())
+	cs, err := issuerRecover.ClaimsByType(claims.ClaimTypeBasic, 0, 0)
+	require.Nil(t, err)
+	assert.Equal(t, 3, len(cs))
+
+	// The revocation nonces are not reused
+	tx, err := storage.NewTx()
+	require.Nil(t, err)
+	nonce, err := issuerRecover.nonceGen.Next(tx)
+	require.Nil(t, err)
+	tx.Close()
+	assert.Equal(t, cs[2].RevNonce+1, nonce)
+
+	// The unpublished state can be published by the recovered issuer
+	preview, err := issuerRecover.PreviewState()
+	require.Nil(t, err)
+	assert.Equal(t, issuer.IdenStateOnChain(), preview.IdenStateFrom)
+	assert.Equal(t, []uint32{claim1.Metadata().RevNonce}, preview.RevokedNonces)
+
+	_, err = Recover(issuer.cfg, storage, keyStore, claimsDump, revokedNonces, publicData, idenPubOnChain)
+	assert.Equal(t, ErrRecoverStorageNotEmpty, err)
+	// A failed recovery doesn't write into the storage, so it can be
+	// retried
+	storageRetry := db.NewMemoryStorage()
+	_, err = Recover(issuer.cfg, storageRetry, keyStore, claimsDump, revokedNonces[1:], publicData, idenPubOnChain)
+	assert.Equal(t, ErrRecoverRevocationsMismatch, err)
+	require.Nil(t, storageRetry.Iterate(func(k, v []byte) (bool, error) {
+		t.Fatalf("unexpected key %x in the storage", k)
+		return false, nil
+	}))
+	ksStorageEmpty := keystore.MemStorage([]byte{})
+	keyStoreEmpty, err := keystore.NewKeyStore(&ksStorageEmpty, keystore.LightKeyStoreParams)
+	require.Nil(t, err)
+	_, err = Recover(issuer.cfg, storageRetry, keyStoreEmpty, claimsDump, revokedNonces, publicData, idenPubOnChain)
+	assert.Equal(t, ErrRecoverKeyOperationalNotFound, err)
+	_, err = Recover(issuer.cfg, storageRetry, keyStore, claimsDump, revokedNonces, publicData, idenPubOnChain)
+	require.Nil(t, err)
+	claimsDumpGenesis, err := NewAdmin(issuer).ClaimsDump(genesisState)
+	require.Nil(t, err)
+	_, err = Recover(issuer.cfg, db.NewMemoryStorage(), keyStore, claimsDumpGenesis, revokedNonces, publicData, idenPubOnChain)
+	assert.Equal(t, ErrRecoverClaimsMismatch, err)
+	_, err = Recover(issuer.cfg, db.NewMemoryStorage(), keyStore, claimsDump, revokedNonces, nil, idenPubOnChain)
+	assert.Equal(t, ErrRecoverPublicDataNil, err)
+
+	// An issuer without identity states on chain is recovered without
+	// public data
+	issuerGenesis, _, keyStoreGenesis := newIssuer(t, false, idenPubOnChain, idenPubOffChain)
+	require.Nil(t, issuerGenesis.IssueClaim(claim0))
+	require.Nil(t, issuerGenesis.RevokeClaim(claim0))
+	claimsDump, err = NewAdmin(issuerGenesis).ClaimsDump(nil)
+	require.Nil(t, err)
+	storageGenesis := db.NewMemoryStorage()
+	id, err = Recover(issuerGenesis.cfg, storageGenesis, keyStoreGenesis, claimsDump,
+		[]uint32{claim0.Metadata().RevNonce}, nil, idenPubOnChain)
+	require.Nil(t, err)
+	assert.Equal(t, issuerGenesis.ID(), id)
+	issuerRecover, err = Load(storageGenesis, keyStoreGenesis, idenPubOnChain, idenStateZkProofConf, idenPubOffChain)
+	require.Nil(t, err)
+	idenState, _ = issuerGenesis.State()
+	idenStateRecover, _ = issuerRecover.State()
+	assert.Equal(t, idenState, idenStateRecover)
+	assert.Equal(t, &merkletree.HashZero, issuerRecover.IdenStateOnChain())
+	preview, err = issuerRecover.PreviewState()
+	require.Nil(t, err)
+	assert.Equal(t, 1, len(preview.Claims))
+	assert.Equal(t, []uint32{claim0.Metadata().RevNonce}, preview.RevokedNonces)
+}
+
+func TestIssuerSign(t *testing.T) {
+	issuer, _, _ := newIssuer(t, true, nil, nil)
+
+	claimKOp, err := issuer.ClaimKeyOperational()
+	require.Nil(t, err)
+	kOpComp := (&babyjub.PublicKey{X: claimKOp.Ax, Y: claimKOp.Ay}).Compress()
+	assert.Equal(t, issuer.KeyOperational(), &kOpComp)
+
+	signedMsg, err := issuer.Sign("login:example.com", []byte("challenge"))
+	require.Nil(t, err)
+	ok, err := keystore.VerifySignatureElem(&kOpComp, signedMsg.Hash(), signedMsg.Signature)
+	require.Nil(t, err)
+	assert.True(t, ok)
+
+	// The same message in another domain has a different hash
+	signedMsgOther := proof.SignedMsg{Domain: "login:example.org", Msg: signedMsg.Msg}
+	assert.NotEqual(t, signedMsg.Hash(), signedMsgOther.Hash())
+	// A message with trailing zeros has a different hash
+	signedMsgOther = proof.SignedMsg{Domain: signedMsg.Domain, Msg: append(signedMsg.Msg, 0x00)}
+	assert.NotEqual(t, signedMsg.Hash(), signedMsgOther.Hash())
+}
+
 func TestIssuerGenZkProofIdenStateUpdate(t *testing.T) {
 	issuer, _, _ := newIssuer(t, false, idenPubOnChain, idenPubOffChain)
 	var oldIdState, newIdState merkletree.Hash
@@ -225,15 +1127,19 @@ func TestIssuerGenZkProofIdenStateUpdate(t *testing.T) {
 var vk *zktypes.Vk
 var blockN uint64
 
-func TestMain(m *testing.M) {
-	log.SetLevel(log.DebugLevel)
-	zkFiles := zkutils.NewZkFiles("http://161.35.72.58:9000/circuit-idstate/", "/tmp/iden3/idenstatezk-issuer",
+func newIdenStateZkFiles() *zkutils.ZkFiles {
+	return zkutils.NewZkFiles("http://161.35.72.58:9000/circuit-idstate/", "/tmp/iden3/idenstatezk-issuer",
 		zkutils.ProvingKeyFormatJSON,
 		zkutils.ZkFilesHashes{
 			ProvingKey:      "2c72fceb10323d8b274dbd7649a63c1b6a11fff3a1e4cd7f5ec12516f32ec452",
 			VerificationKey: "473952ff80aef85403005eb12d1e78a3f66b1cc11e7bd55d6bfe94e0b5577640",
 			WitnessCalcWASM: "8eafd9314c4d2664a23bf98a4f42cd0c29984960ae3544747ba5fbd60905c41f",
 		}, true)
+}
+
+func TestMain(m *testing.M) {
+	log.SetLevel(log.DebugLevel)
+	zkFiles := newIdenStateZkFiles()
 	if err := zkFiles.LoadAll(); err != nil {
 		panic(err)
 	}
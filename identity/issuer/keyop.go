@@ -0,0 +1,311 @@
+package issuer
+
+import (
+	"fmt"
+	"math/big"
+
+	"github.com/iden3/go-iden3-core/core"
+	"github.com/iden3/go-iden3-core/core/claims"
+	"github.com/iden3/go-iden3-core/db"
+	"github.com/iden3/go-iden3-core/merkletree"
+	"github.com/iden3/go-iden3-crypto/babyjub"
+)
+
+var (
+	ErrKeyOperationalRotated      = fmt.Errorf("the genesis operational key has been rotated")
+	ErrKeyOperationalNotFound     = fmt.Errorf("no valid operational key found in the identity state")
+	ErrKeyOperationalAlreadyInUse = fmt.Errorf("the new operational key is already the current one")
+	ErrKeyRotationUnsupported     = fmt.Errorf("the identity state update circuit doesn't support key rotation")
+)
+
+var (
+	dbPrefixKOpList = []byte("kops:")
+)
+
+// keyOperational is the information stored for every operational key of the
+// Issuer, indexed by the compressed public key.
+type keyOperational struct {
+	ClaimHIndex *merkletree.Hash
+	RevNonce    uint32
+}
+
+// RotateKeyOperational issues a ClaimKeyBabyJub authorizing the new
+// operational key newKOpComp and revokes the claim of the current one in a
+// single storage transaction.  The new key must be unlocked in the KeyStore.
+// The previous key must remain in the KeyStore until the next identity state
+// is published, because the zk proof of that state update proves the
+// ownership of the identity with the key authorized in the old state.  The
+// identity state update circuit must support it (see
+// IdenStateZkProofConf.KeyRotation).  The Identity State is not updated.
+func (is *Issuer) RotateKeyOperational(newKOpComp *babyjub.PublicKeyComp) error {
+	if is.cfg.GenesisOnly {
+		return ErrIdenGenesisOnly
+	}
+	if is.idenStateZkProofConf == nil || !is.idenStateZkProofConf.KeyRotation {
+		return ErrKeyRotationUnsupported
+	}
+	newKOp, err := newKOpComp.Decompress()
+	if err != nil {
+		return err
+	}
+	is.rw.Lock()
+	defer is.rw.Unlock()
+	if *newKOpComp == *is.kOpComp {
+		return ErrKeyOperationalAlreadyInUse
+	}
+	if _, err := is.keyStore.ExportKey(newKOpComp); err != nil {
+		return fmt.Errorf("new operational key not available in the keystore: %w", err)
+	}
+
+	tx, err := is.storage.NewTx()
+	if err != nil {
+		return err
+	}
+	defer tx.Close()
+	txClaimsTree, err := is.claimsTree.Storage().NewTx()
+	if err != nil {
+		return err
+	}
+	defer txClaimsTree.Close()
+	txRevocationsTree, err := is.revocationsTree.Storage().NewTx()
+	if err != nil {
+		return err
+	}
+	defer txRevocationsTree.Close()
+
+	var kOpOld keyOperational
+	if err := is.kOpList.Get(tx, is.kOpComp[:], &kOpOld); err != nil {
+		return err
+	}
+
+	claimKOp := claims.NewClaimKeyBabyJub(newKOp, claims.BabyJubKeyTypeAuthorizeKSign)
+	claimsTreeRoot, events, err := is.issueClaimsTx(tx, txClaimsTree, []claims.Claimer{claimKOp})
+	if errClaims, ok := err.(*IssueClaimsError); ok {
+		return errClaims.Errs[0]
+	} else if err != nil {
+		return err
+	}
+	claimKOpHi, err := claimKOp.Entry().HIndex()
+	if err != nil {
+		return err
+	}
+	revocationsTreeRoot, err := is.revocationsTree.AddEntryTx(txRevocationsTree, is.revocationsTree.RootKey(),
+		claims.NewLeafRevocationsTree(kOpOld.RevNonce, 0xffffffff).Entry())
+	if err != nil {
+		return err
+	}
+
+	idenState := core.IdenState(claimsTreeRoot, revocationsTreeRoot, is.rootsTree.RootKey())
+	events = append(events, newClaimEvent(EventClaimRevoked, kOpOld.ClaimHIndex, kOpOld.RevNonce, nil))
+	for _, event := range events {
+		event.IdenState = idenState
+	}
+	if err := is.audit(tx, events...); err != nil {
+		return err
+	}
+	tx.Put(dbKeyKOp, newKOpComp[:])
+	tx.Put(dbKeyClaimKOpHi, claimKOpHi[:])
+	if err := is.kOpList.Append(tx, newKOpComp[:], &keyOperational{
+		ClaimHIndex: claimKOpHi,
+		RevNonce:    claimKOp.Metadata().RevNonce,
+	}); err != nil {
+		return err
+	}
+
+	tx.Add(txClaimsTree)
+	tx.Add(txRevocationsTree)
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if err := is.claimsTree.SetRootKey(claimsTreeRoot); err != nil {
+		return err
+	}
+	if err := is.revocationsTree.SetRootKey(revocationsTreeRoot); err != nil {
+		return err
+	}
+	is.kOpComp = newKOpComp
+	is.emit(events...)
+	return nil
+}
+
+// ClaimKeyOperational returns the ClaimKeyBabyJub that authorizes the current
+// operational key.  A credential of this claim allows verifying the messages
+// signed with Sign.
+func (is *Issuer) ClaimKeyOperational() (*claims.ClaimKeyBabyJub, error) {
+	is.rw.RLock()
+	defer is.rw.RUnlock()
+	hiBytes, err := is.storage.Get(dbKeyClaimKOpHi)
+	if err != nil {
+		return nil, err
+	}
+	var hi merkletree.Hash
+	copy(hi[:], hiBytes)
+	data, err := is.claimsTree.GetDataByIndex(&hi)
+	if err != nil {
+		return nil, err
+	}
+	return claims.NewClaimKeyBabyJubFromEntry(&merkletree.Entry{Data: *data}), nil
+}
+
+// keyOperationalRotated returns true if the genesis operational key has ever
+// been rotated.
+func (is *Issuer) keyOperationalRotated(tx db.Tx) (bool, error) {
+	kOpListLen, err := is.kOpList.Length(tx)
+	if err != nil {
+		return false, err
+	}
+	return kOpListLen > 1, nil
+}
+
+// keyOperationalInState returns the most recent operational key that is
+// authorized in the identity state with roots idenStateTreeRoots: its claim
+// exists in the claims tree and its revocation nonce is not in the
+// revocations tree.
+func (is *Issuer) keyOperationalInState(tx db.Tx,
+	idenStateTreeRoots *IdenStateTreeRoots) (*babyjub.PublicKeyComp, *keyOperational, error) {
+	kOpListLen, err := is.kOpList.Length(tx)
+	if err != nil {
+		return nil, nil, err
+	}
+	for idx := int64(kOpListLen) - 1; idx >= 0; idx-- {
+		var kOp keyOperational
+		kOpCompBytes, err := is.kOpList.GetByIdx(tx, uint32(idx), &kOp)
+		if err != nil {
+			return nil, nil, err
+		}
+		mtpClaim, err := is.claimsTree.GenerateProof(kOp.ClaimHIndex, idenStateTreeRoots.ClaimsTreeRoot)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !mtpClaim.Existence {
+			continue
+		}
+		revHi, err := claims.NewLeafRevocationsTree(kOp.RevNonce, 0).Entry().HIndex()
+		if err != nil {
+			return nil, nil, err
+		}
+		mtpRev, err := is.revocationsTree.GenerateProof(revHi, idenStateTreeRoots.RevocationsTreeRoot)
+		if err != nil {
+			return nil, nil, err
+		}
+		if mtpRev.Existence {
+			continue
+		}
+		var kOpComp babyjub.PublicKeyComp
+		copy(kOpComp[:], kOpCompBytes)
+		return &kOpComp, &kOp, nil
+	}
+	return nil, nil, ErrKeyOperationalNotFound
+}
+
+// IdOwnershipInputs are the inputs to prove the ownership of an identity in a
+// zk proof with an operational key authorized in a non genesis identity
+// state.
+type IdOwnershipInputs struct {
+	Id                      *big.Int
+	PrivateKey              *big.Int
+	ClaimsTreeRoot          *big.Int
+	AuthClaimMtp            []*big.Int
+	RevTreeRoot             *big.Int
+	AuthClaimNonRevMtp      []*big.Int
+	AuthClaimNonRevMtpNoAux *big.Int
+	AuthClaimNonRevMtpAuxHi *big.Int
+	AuthClaimNonRevMtpAuxHv *big.Int
+	RootsTreeRoot           *big.Int
+}
+
+// GenIdOwnershipInputs generates the inputs to prove the ownership of the
+// identity with the operational key authorized in the identity state
+// idenState, with proofs of existence and non revocation of its claim.
+func (is *Issuer) GenIdOwnershipInputs(idenState *merkletree.Hash, levels int) (*IdOwnershipInputs, error) {
+	tx, err := is.storage.NewTx() // Read only Tx
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Close()
+	idenStateTreeRoots, err := is.getIdenStateTreeRoots(tx, idenState)
+	if err != nil {
+		return nil, err
+	}
+	kOpComp, kOp, err := is.keyOperationalInState(tx, idenStateTreeRoots)
+	if err != nil {
+		return nil, err
+	}
+	sk, err := is.keyStore.ExportKey(kOpComp)
+	if err != nil {
+		return nil, err
+	}
+
+	mtpClaim, err := is.claimsTree.GenerateProof(kOp.ClaimHIndex, idenStateTreeRoots.ClaimsTreeRoot)
+	if err != nil {
+		return nil, err
+	}
+	mtpClaimSiblings := mtpClaim.AllSiblingsCircom(levels)
+	if len(mtpClaimSiblings) != levels+1 {
+		return nil, fmt.Errorf("number of mtp siblings in ClaimTree (%v) "+
+			"is higher than requested levels (%v)", len(mtpClaimSiblings), levels+1)
+	}
+
+	revHi, err := claims.NewLeafRevocationsTree(kOp.RevNonce, 0).Entry().HIndex()
+	if err != nil {
+		return nil, err
+	}
+	mtpRev, err := is.revocationsTree.GenerateProof(revHi, idenStateTreeRoots.RevocationsTreeRoot)
+	if err != nil {
+		return nil, err
+	}
+	mtpRevSiblings := mtpRev.AllSiblingsCircom(levels)
+	if len(mtpRevSiblings) != levels+1 {
+		return nil, fmt.Errorf("number of mtp siblings in RevocationsTree (%v) "+
+			"is higher than requested levels (%v)", len(mtpRevSiblings), levels+1)
+	}
+	noAux, auxHi, auxHv := big.NewInt(1), big.NewInt(0), big.NewInt(0)
+	if mtpRev.NodeAux != nil {
+		noAux = big.NewInt(0)
+		auxHi = mtpRev.NodeAux.HIndex.BigInt()
+		auxHv = mtpRev.NodeAux.HValue.BigInt()
+	}
+
+	return &IdOwnershipInputs{
+		Id:                      is.id.BigInt(),
+		PrivateKey:              (*big.Int)(sk.Scalar()),
+		ClaimsTreeRoot:          idenStateTreeRoots.ClaimsTreeRoot.BigInt(),
+		AuthClaimMtp:            mtpClaimSiblings,
+		RevTreeRoot:             idenStateTreeRoots.RevocationsTreeRoot.BigInt(),
+		AuthClaimNonRevMtp:      mtpRevSiblings,
+		AuthClaimNonRevMtpNoAux: noAux,
+		AuthClaimNonRevMtpAuxHi: auxHi,
+		AuthClaimNonRevMtpAuxHv: auxHv,
+		RootsTreeRoot:           idenStateTreeRoots.RootsTreeRoot.BigInt(),
+	}, nil
+}
+
+// migrateKOpList initializes the list of operational keys with the current
+// one.
+func (is *Issuer) migrateKOpList(tx db.Tx) (bool, error) {
+	if _, err := is.kOpList.Length(tx); err == nil {
+		return false, nil
+	} else if err != db.ErrNotFound {
+		return false, err
+	}
+	hiBytes, err := tx.Get(dbKeyClaimKOpHi)
+	if err != nil {
+		return false, err
+	}
+	var hi merkletree.Hash
+	copy(hi[:], hiBytes)
+	data, err := is.claimsTree.GetDataByIndex(&hi)
+	if err != nil {
+		return false, err
+	}
+	var metadata claims.Metadata
+	metadata.Unmarshal(&merkletree.Entry{Data: *data})
+	is.kOpList.Init(tx)
+	if err := is.kOpList.Append(tx, is.kOpComp[:], &keyOperational{
+		ClaimHIndex: &hi,
+		RevNonce:    metadata.RevNonce,
+	}); err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,211 @@
+package issuer
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+
+	"github.com/iden3/go-iden3-core/components/idenpuboffchain"
+	"github.com/iden3/go-iden3-core/components/idenpubonchain"
+	"github.com/iden3/go-iden3-core/components/zkprover"
+	"github.com/iden3/go-iden3-core/core"
+	"github.com/iden3/go-iden3-core/core/claims"
+	"github.com/iden3/go-iden3-core/db"
+	"github.com/iden3/go-iden3-core/keystore"
+	"github.com/iden3/go-iden3-crypto/babyjub"
+)
+
+var (
+	ErrIdenNotFound      = fmt.Errorf("identity not found in the manager")
+	ErrIdenAlreadyExists = fmt.Errorf("identity already exists in the manager")
+)
+
+var (
+	dbPrefixManagerIdenList    = []byte("manageridens:")
+	dbPrefixManagerIdenStorage = []byte("manageriden:")
+)
+
+// managedIden is the information stored by the Manager for every identity.
+type managedIden struct {
+	// StorageIdx is the index used to build the storage prefix of the
+	// identity.
+	StorageIdx uint32
+}
+
+// Manager hosts many Issuers in a single storage.  Each Issuer uses its own
+// prefix in the storage, while the KeyStore, the IdenPubOnChainer, the
+// IdenPubOffChainWriter and the zkprover.Prover are shared among all of them.
+// Issuers are loaded lazily and cached.
+type Manager struct {
+	rw                    sync.RWMutex
+	storage               db.Storage
+	keyStore              *keystore.KeyStore
+	idenPubOnChain        idenpubonchain.IdenPubOnChainer
+	idenStateZkProofConf  *IdenStateZkProofConf
+	idenPubOffChainWriter idenpuboffchain.IdenPubOffChainWriter
+	prover                *zkprover.Prover
+	idenList              *db.StorageList
+	issuers               map[core.ID]*Issuer
+}
+
+// NewManager creates a new Manager that hosts Issuers in the storage,
+// initializing the storage if it's the first time it's used by a Manager.
+// idenPubOnChain, idenStateZkProofConf and idenPubOffChainWriter can be nil
+// if the Manager only hosts genesis only Issuers.  prover can be nil to
+// let each Issuer generate its zk proofs on its own.
+func NewManager(storage db.Storage, keyStore *keystore.KeyStore,
+	idenPubOnChain idenpubonchain.IdenPubOnChainer,
+	idenStateZkProofConf *IdenStateZkProofConf,
+	idenPubOffChainWriter idenpuboffchain.IdenPubOffChainWriter,
+	prover *zkprover.Prover) (*Manager, error) {
+	idenList := db.NewStorageList(dbPrefixManagerIdenList)
+	tx, err := storage.NewTx()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := idenList.Length(tx); err == db.ErrNotFound {
+		idenList.Init(tx)
+		if err := tx.Commit(); err != nil {
+			return nil, err
+		}
+	} else {
+		tx.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &Manager{
+		storage:               storage,
+		keyStore:              keyStore,
+		idenPubOnChain:        idenPubOnChain,
+		idenStateZkProofConf:  idenStateZkProofConf,
+		idenPubOffChainWriter: idenPubOffChainWriter,
+		prover:                prover,
+		idenList:              idenList,
+		issuers:               make(map[core.ID]*Issuer),
+	}, nil
+}
+
+// idenStorage returns the prefixed storage of the identity with storage
+// index idx.
+func (m *Manager) idenStorage(idx uint32) db.Storage {
+	var idxBytes [4]byte
+	binary.BigEndian.PutUint32(idxBytes[:], idx)
+	prefix := append(append(append([]byte{}, dbPrefixManagerIdenStorage...), idxBytes[:]...), ':')
+	return m.storage.WithPrefix(prefix)
+}
+
+// Create creates a new Issuer (see Create) in its own prefix of the Manager
+// storage and returns it loaded.  The Issuer is first created in memory, and
+// its storage is written together with the Manager list of identities in a
+// single transaction.
+func (m *Manager) Create(cfg Config, kOpComp *babyjub.PublicKeyComp,
+	extraGenesisClaims []claims.Claimer) (*Issuer, error) {
+	m.rw.Lock()
+	defer m.rw.Unlock()
+	storageMem := db.NewMemoryStorage()
+	id, err := Create(cfg, kOpComp, extraGenesisClaims, storageMem, m.keyStore)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := m.storage.NewTx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Close()
+	if err := m.idenList.Get(tx, id[:], &managedIden{}); err == nil {
+		return nil, ErrIdenAlreadyExists
+	} else if err != db.ErrNotFound {
+		return nil, err
+	}
+	idx, err := m.idenList.Length(tx)
+	if err != nil {
+		return nil, err
+	}
+	storage := m.idenStorage(idx)
+	txIden, err := storage.NewTx()
+	if err != nil {
+		return nil, err
+	}
+	defer txIden.Close()
+	if err := storageMem.Iterate(func(k, v []byte) (bool, error) {
+		txIden.Put(k, v)
+		return true, nil
+	}); err != nil {
+		return nil, err
+	}
+	if err := m.idenList.Append(tx, id[:], &managedIden{StorageIdx: idx}); err != nil {
+		return nil, err
+	}
+	tx.Add(txIden)
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return m.load(id, storage)
+}
+
+// load loads the Issuer with the given id from its storage and caches it.
+func (m *Manager) load(id *core.ID, storage db.Storage) (*Issuer, error) {
+	is, err := Load(storage, m.keyStore, m.idenPubOnChain, m.idenStateZkProofConf,
+		m.idenPubOffChainWriter)
+	if err != nil {
+		return nil, err
+	}
+	is.prover = m.prover
+	m.issuers[*id] = is
+	return is, nil
+}
+
+// Issuer returns the Issuer with the given id, loading it if it's not already
+// loaded.
+func (m *Manager) Issuer(id *core.ID) (*Issuer, error) {
+	m.rw.RLock()
+	is, ok := m.issuers[*id]
+	m.rw.RUnlock()
+	if ok {
+		return is, nil
+	}
+
+	m.rw.Lock()
+	defer m.rw.Unlock()
+	if is, ok := m.issuers[*id]; ok {
+		return is, nil
+	}
+	tx, err := m.storage.NewTx() // Read only Tx
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Close()
+	var iden managedIden
+	if err := m.idenList.Get(tx, id[:], &iden); err == db.ErrNotFound {
+		return nil, ErrIdenNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return m.load(id, m.idenStorage(iden.StorageIdx))
+}
+
+// IDs returns the IDs of the identities in the Manager, in creation order.
+func (m *Manager) IDs() ([]core.ID, error) {
+	m.rw.RLock()
+	defer m.rw.RUnlock()
+	tx, err := m.storage.NewTx() // Read only Tx
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Close()
+	idenListLen, err := m.idenList.Length(tx)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]core.ID, idenListLen)
+	for idx := uint32(0); idx < idenListLen; idx++ {
+		idBytes, err := m.idenList.GetByIdx(tx, idx, &managedIden{})
+		if err != nil {
+			return nil, err
+		}
+		copy(ids[idx][:], idBytes)
+	}
+	return ids, nil
+}
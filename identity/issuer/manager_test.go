@@ -0,0 +1,73 @@
+package issuer
+
+import (
+	"testing"
+
+	"github.com/iden3/go-iden3-core/core"
+	"github.com/iden3/go-iden3-core/core/claims"
+	"github.com/iden3/go-iden3-core/db"
+	"github.com/iden3/go-iden3-core/keystore"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestManager(t *testing.T) {
+	storage := db.NewMemoryStorage()
+	ksStorage := keystore.MemStorage([]byte{})
+	keyStore, err := keystore.NewKeyStore(&ksStorage, keystore.LightKeyStoreParams)
+	require.Nil(t, err)
+	manager, err := NewManager(storage, keyStore, nil, nil, nil, nil)
+	require.Nil(t, err)
+
+	cfg := ConfigDefault
+	cfg.GenesisOnly = true
+	var issuers []*Issuer
+	for i := 0; i < 3; i++ {
+		kOp, err := keyStore.NewKey(pass)
+		require.Nil(t, err)
+		require.Nil(t, keyStore.UnlockKey(kOp, pass))
+		issuer, err := manager.Create(cfg, kOp, []claims.Claimer{})
+		require.Nil(t, err)
+		issuers = append(issuers, issuer)
+	}
+	_, err = manager.Create(cfg, issuers[0].KeyOperational(), []claims.Claimer{})
+	assert.Equal(t, ErrIdenAlreadyExists, err)
+
+	// Nothing is written for an identity that already exists
+	written := 0
+	require.Nil(t, manager.idenStorage(3).Iterate(func(_, _ []byte) (bool, error) {
+		written++
+		return true, nil
+	}))
+	assert.Equal(t, 0, written)
+
+	ids, err := manager.IDs()
+	require.Nil(t, err)
+	require.Equal(t, 3, len(ids))
+	for i, issuer := range issuers {
+		assert.Equal(t, *issuer.ID(), ids[i])
+	}
+
+	// The storages of the issuers are independent
+	state0, _ := issuers[0].State()
+	state1, _ := issuers[1].State()
+	assert.NotEqual(t, state0, state1)
+
+	// A new manager loads the issuers from the same storage
+	manager, err = NewManager(storage, keyStore, nil, nil, nil, nil)
+	require.Nil(t, err)
+	ids, err = manager.IDs()
+	require.Nil(t, err)
+	require.Equal(t, 3, len(ids))
+	issuer1, err := manager.Issuer(&ids[1])
+	require.Nil(t, err)
+	issuer1State, _ := issuer1.State()
+	assert.Equal(t, state1, issuer1State)
+	issuer1Cached, err := manager.Issuer(&ids[1])
+	require.Nil(t, err)
+	assert.True(t, issuer1 == issuer1Cached)
+
+	idUnknown := core.NewID([2]byte{0, 0x42}, [27]byte{0x01})
+	_, err = manager.Issuer(&idUnknown)
+	assert.Equal(t, ErrIdenNotFound, err)
+}
@@ -0,0 +1,39 @@
+package issuer
+
+import (
+	"github.com/iden3/go-iden3-core/db"
+)
+
+// migration initializes in an open db transaction the storage keys added to
+// the Issuer after its first version, and returns true if it wrote any.
+type migration func(tx db.Tx) (bool, error)
+
+// migrate initializes the storage keys that were added to the Issuer after
+// it was created, so that the storage of an Issuer created by a previous
+// version can be loaded.
+func (is *Issuer) migrate() error {
+	tx, err := is.storage.NewTx()
+	if err != nil {
+		return err
+	}
+	defer tx.Close()
+	migrated := false
+	for _, m := range []migration{
+		is.migrateClaimsIndex,
+		is.migrateKOpList,
+		is.migrateAuditLog,
+		is.migrateIdenStatePendingTxSent,
+		is.migrateIdenStateOnChainBlockHash,
+		is.migrateIdenStateData,
+	} {
+		ok, err := m(tx)
+		if err != nil {
+			return err
+		}
+		migrated = migrated || ok
+	}
+	if !migrated {
+		return nil
+	}
+	return tx.Commit()
+}
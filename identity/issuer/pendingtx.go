@@ -0,0 +1,246 @@
+package issuer
+
+import (
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/iden3/go-iden3-core/components/idenpubonchain"
+	"github.com/iden3/go-iden3-core/db"
+	"github.com/iden3/go-iden3-core/merkletree"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	ErrIdenStatePendingStale      = fmt.Errorf("the transaction publishing the pending IdenState is stale")
+	ErrIdenStatePendingNoTx       = fmt.Errorf("there's no transaction publishing a pending IdenState")
+	ErrIdenStatePendingAlreadySet = fmt.Errorf("the pending IdenState is already set on chain")
+	ErrIdenStatePendingTxFailed   = fmt.Errorf("the transaction publishing the pending IdenState failed")
+	ErrIdenStatePendingTxUnmined  = fmt.Errorf("the nonce of the transaction publishing the pending IdenState is not mined")
+)
+
+// TxSent is the time and block number at which a transaction was sent.  A
+// BlockN of 0 means unknown.
+type TxSent struct {
+	Time   int64
+	BlockN uint64
+}
+
+// newTxSent returns a TxSent with the current time of the clock and block
+// number.
+func (is *Issuer) newTxSent(clock Clock) *TxSent {
+	txSent := TxSent{Time: clock.Now().Unix()}
+	blockN, err := is.idenPubOnChain.CurrentBlock()
+	if err != nil {
+		log.WithError(err).Warn("Unable to get the current block of a sent transaction")
+	} else {
+		txSent.BlockN = blockN
+	}
+	return &txSent
+}
+
+// ethTxPending returns the ethereum transaction that publishes the
+// idenStatePending.  If idenStateOnChain is zero, the pending state was
+// caused by InitState.  Otherwise it was a regular SetState.
+func (is *Issuer) ethTxPending() *types.Transaction {
+	if is.idenStateOnChain().Equals(&merkletree.HashZero) {
+		return is.ethTxInitState()
+	}
+	return is.ethTxSetState()
+}
+
+// ethTxPendingHash returns the hash of the ethereum transaction that
+// publishes the idenStatePending, or the zero hash if there's none.
+func (is *Issuer) ethTxPendingHash() common.Hash {
+	is.rw.RLock()
+	defer is.rw.RUnlock()
+	if _, transacted := is.idenStatePending(); !transacted {
+		return common.Hash{}
+	}
+	return is.ethTxPending().Hash()
+}
+
+// idenStatePendingStale returns true if the transaction publishing the
+// idenStatePending was sent longer than cfg.PendingTxStaleTimeout ago or
+// cfg.PendingTxStaleBlocks blocks ago, according to the clock.
+func (is *Issuer) idenStatePendingStale(clock Clock) (bool, error) {
+	if _, transacted := is.idenStatePending(); !transacted {
+		return false, nil
+	}
+	txSent := is.idenStatePendingTxSent()
+	if is.cfg.PendingTxStaleTimeout != 0 &&
+		clock.Now().Sub(time.Unix(txSent.Time, 0)) >= is.cfg.PendingTxStaleTimeout {
+		return true, nil
+	}
+	if is.cfg.PendingTxStaleBlocks != 0 && txSent.BlockN != 0 {
+		blockN, err := is.idenPubOnChain.CurrentBlock()
+		if err != nil {
+			return false, err
+		}
+		if blockN >= txSent.BlockN+is.cfg.PendingTxStaleBlocks {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// checkIdenStatePendingStale returns ErrIdenStatePendingStale if the
+// transaction publishing the idenStatePending is stale.
+func (is *Issuer) checkIdenStatePendingStale(clock Clock) error {
+	stale, err := is.idenStatePendingStale(clock)
+	if err != nil {
+		return err
+	}
+	if stale {
+		log.WithField("tx", is.ethTxPending().Hash().Hex()).Warn("Stale identity state update transaction")
+		return ErrIdenStatePendingStale
+	}
+	return nil
+}
+
+// IdenStatePendingStale returns true if there's a transaction publishing a
+// pending identity state that is stale (see Config.PendingTxStaleTimeout and
+// Config.PendingTxStaleBlocks).
+func (is *Issuer) IdenStatePendingStale() (bool, error) {
+	if is.cfg.GenesisOnly {
+		return false, ErrIdenGenesisOnly
+	}
+	is.rw.RLock()
+	defer is.rw.RUnlock()
+	return is.idenStatePendingStale(ClockSystem)
+}
+
+// ResubmitPendingState resends the transaction publishing the pending
+// identity state with the same nonce and a gas price increased by
+// Config.GasPriceBumpPercent, so that it replaces the stale one.
+func (is *Issuer) ResubmitPendingState() error {
+	return is.resubmitPendingState(ClockSystem)
+}
+
+// resubmitPendingState is ResubmitPendingState using the clock to timestamp
+// the new transaction.
+func (is *Issuer) resubmitPendingState(clock Clock) error {
+	if is.cfg.GenesisOnly {
+		return ErrIdenGenesisOnly
+	}
+	is.rw.Lock()
+	defer is.rw.Unlock()
+	if _, transacted := is.idenStatePending(); !transacted {
+		return ErrIdenStatePendingNoTx
+	}
+	ethTx := is.ethTxPending()
+	gasPrice := ethTx.GasPrice()
+	minGasPrice := new(big.Int).Mul(gasPrice, new(big.Int).SetUint64(100+is.cfg.GasPriceBumpPercent))
+	minGasPrice.Div(minGasPrice, big.NewInt(100))
+	if minGasPrice.Cmp(gasPrice) == 0 {
+		minGasPrice.Add(minGasPrice, big.NewInt(1))
+	}
+	newEthTx, err := is.idenPubOnChain.ReplaceTx(ethTx, minGasPrice)
+	if err != nil {
+		return err
+	}
+	log.WithField("tx", newEthTx.Hash().Hex()).WithField("replacedTx", ethTx.Hash().Hex()).
+		Info("Resubmitted identity state update transaction")
+
+	tx, err := is.storage.NewTx()
+	if err != nil {
+		return err
+	}
+	if is.idenStateOnChain().Equals(&merkletree.HashZero) {
+		err = is.setEthTxInitState(tx, newEthTx)
+	} else {
+		err = is.setEthTxSetState(tx, newEthTx)
+	}
+	if err != nil {
+		return err
+	}
+	if err := is.setIdenStatePendingTxSent(tx, is.newTxSent(clock)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// AbandonPendingState forgets the transaction publishing the pending
+// identity state, so that the next call to PublishState generates a new
+// proof and sends a new transaction to publish it.  It fails if the nonce of
+// the transaction is not mined yet, because the transaction could still
+// publish the identity state (use ResubmitPendingState instead), or if the
+// pending identity state is already set on chain.
+func (is *Issuer) AbandonPendingState() error {
+	if is.cfg.GenesisOnly {
+		return ErrIdenGenesisOnly
+	}
+	is.rw.Lock()
+	defer is.rw.Unlock()
+	idenStatePending, transacted := is.idenStatePending()
+	if !transacted {
+		return ErrIdenStatePendingNoTx
+	}
+	ethTx := is.ethTxPending()
+	mined, err := is.idenPubOnChain.TxNonceMined(ethTx)
+	if err != nil {
+		return err
+	}
+	if !mined {
+		return ErrIdenStatePendingTxUnmined
+	}
+	idenStateData, err := is.idenPubOnChain.GetState(is.id)
+	if err == nil && idenStateData.IdenState.Equals(idenStatePending) {
+		return ErrIdenStatePendingAlreadySet
+	} else if err != nil && err != idenpubonchain.ErrIdenNotOnChain {
+		return fmt.Errorf("error calling idenstates smart contract getState: %w", err)
+	}
+	log.WithField("tx", ethTx.Hash().Hex()).Info("Abandoned identity state update transaction")
+	return is.clearEthTxPending()
+}
+
+// idenStatePendingTxFailed forgets the transaction publishing the pending
+// identity state after it has been reverted, so that the pending identity
+// state is published again with a new transaction, and returns
+// ErrIdenStatePendingTxFailed.
+func (is *Issuer) idenStatePendingTxFailed() error {
+	log.WithField("tx", is.ethTxPending().Hash().Hex()).Error("Failed identity state update transaction")
+	if err := is.clearEthTxPending(); err != nil {
+		return err
+	}
+	return ErrIdenStatePendingTxFailed
+}
+
+// clearEthTxPending forgets the transaction publishing the idenStatePending,
+// which is kept as pending to be transacted.
+func (is *Issuer) clearEthTxPending() error {
+	idenStatePending, _ := is.idenStatePending()
+	tx, err := is.storage.NewTx()
+	if err != nil {
+		return err
+	}
+	if is.idenStateOnChain().Equals(&merkletree.HashZero) {
+		err = is.setEthTxInitState(tx, nil)
+	} else {
+		err = is.setEthTxSetState(tx, nil)
+	}
+	if err != nil {
+		return err
+	}
+	is.setIdenStatePending(tx, idenStatePending, false)
+	if err := is.setIdenStatePendingTxSent(tx, &TxSent{}); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// migrateIdenStatePendingTxSent initializes an empty pending transaction.
+func (is *Issuer) migrateIdenStatePendingTxSent(tx db.Tx) (bool, error) {
+	if _, err := tx.Get(dbKeyIdenStatePendingTxSent); err == nil {
+		return false, nil
+	} else if err != db.ErrNotFound {
+		return false, err
+	}
+	if err := is.setIdenStatePendingTxSent(tx, &TxSent{}); err != nil {
+		return false, err
+	}
+	return true, nil
+}
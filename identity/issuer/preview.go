@@ -0,0 +1,240 @@
+package issuer
+
+import (
+	"bytes"
+	"sort"
+
+	"github.com/iden3/go-iden3-core/core"
+	"github.com/iden3/go-iden3-core/core/claims"
+	"github.com/iden3/go-iden3-core/db"
+	"github.com/iden3/go-iden3-core/merkletree"
+)
+
+// StatePreview is the result of a dry run of PublishState.
+type StatePreview struct {
+	// Changed is false if the identity state hasn't changed since the last
+	// calculated one, in which case PublishState does nothing.
+	Changed bool
+	// Pending is true if the new identity state was already calculated by
+	// a previous PublishState that didn't send it to the smart contract, so
+	// PublishState would only try to publish it again.
+	Pending bool
+	// IdenStateFrom is the identity state from which the transition to
+	// IdenState is proven: the identity state on chain, or the genesis one
+	// if there's none.
+	IdenStateFrom      *merkletree.Hash
+	IdenState          *merkletree.Hash
+	IdenStateTreeRoots IdenStateTreeRoots
+	// ClaimsTreeRootAdded is true if the claims tree root is added to the
+	// roots tree in the new identity state.
+	ClaimsTreeRootAdded bool
+	// Claims are the claims issued since the previous identity state, in
+	// issuance order.
+	Claims []*IssuedClaim
+	// RevokedNonces are the revocation nonces added since the previous
+	// identity state, in ascending order.
+	RevokedNonces []uint32
+	// RevocationsTreeBlobSize and RootsTreeBlobSize are the sizes in bytes
+	// of the trees dumps published off chain.
+	RevocationsTreeBlobSize int
+	RootsTreeBlobSize       int
+}
+
+// PreviewState returns what PublishState would do without modifying the
+// Issuer: the new identity state and roots, the claims and revocations
+// included since the previous identity state, and the size of the off chain
+// public data.
+func (is *Issuer) PreviewState() (*StatePreview, error) {
+	if is.cfg.GenesisOnly {
+		return nil, ErrIdenGenesisOnly
+	}
+	is.rw.RLock()
+	defer is.rw.RUnlock()
+	idenStatePending, transacted := is.idenStatePending()
+	if !idenStatePending.Equals(&merkletree.HashZero) && transacted {
+		return nil, ErrIdenStatePendingNotNil
+	}
+
+	tx, err := is.storage.NewTx() // Read only Tx
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Close()
+	idenStateFrom, err := is.idenStatePublishFrom(tx)
+	if err != nil {
+		return nil, err
+	}
+	idenStateTreeRootsFrom, err := is.getIdenStateTreeRoots(tx, idenStateFrom)
+	if err != nil {
+		return nil, err
+	}
+
+	preview := StatePreview{IdenStateFrom: idenStateFrom}
+	// claimsLogLen is the number of issued claims included in the new
+	// identity state.
+	var claimsLogLen uint32
+	if idenStatePending.Equals(&merkletree.HashZero) {
+		// The new identity state is calculated from the current trees,
+		// adding the claims tree root to the roots tree in a
+		// transaction that is never committed if it has changed.
+		idenStateLast, idenStateTreeRootsLast, err := is.getIdenStateByIdx(tx, -1)
+		if err != nil {
+			return nil, err
+		}
+		idenState, idenStateTreeRoots := is.state()
+		if idenState.Equals(idenStateLast) {
+			preview.IdenState = idenState
+			preview.IdenStateTreeRoots = idenStateTreeRoots
+			return &preview, nil
+		}
+		txRootsTree, err := is.rootsTree.Storage().NewTx() // Never committed
+		if err != nil {
+			return nil, err
+		}
+		defer txRootsTree.Close()
+		if !idenStateTreeRoots.ClaimsTreeRoot.Equals(idenStateTreeRootsLast.ClaimsTreeRoot) {
+			if idenStateTreeRoots.RootsTreeRoot, err = is.rootsTree.AddEntryTx(txRootsTree,
+				idenStateTreeRoots.RootsTreeRoot,
+				claims.NewLeafRootsTree(*idenStateTreeRoots.ClaimsTreeRoot).Entry()); err != nil {
+				return nil, err
+			}
+		}
+		var dump bytes.Buffer
+		if err := is.rootsTree.DumpTreeTx(txRootsTree, &dump, idenStateTreeRoots.RootsTreeRoot); err != nil {
+			return nil, err
+		}
+		preview.RootsTreeBlobSize = dump.Len()
+		if claimsLogLen, err = is.claimsLog.Length(tx); err != nil {
+			return nil, err
+		}
+		preview.IdenState = core.IdenState(idenStateTreeRoots.ClaimsTreeRoot,
+			idenStateTreeRoots.RevocationsTreeRoot, idenStateTreeRoots.RootsTreeRoot)
+		preview.IdenStateTreeRoots = idenStateTreeRoots
+	} else {
+		// The pending identity state was already calculated.
+		preview.Pending = true
+		idenStateTreeRoots, err := is.getIdenStateTreeRoots(tx, idenStatePending)
+		if err != nil {
+			return nil, err
+		}
+		if preview.RootsTreeBlobSize, err = dumpTreeSize(is.rootsTree, idenStateTreeRoots.RootsTreeRoot); err != nil {
+			return nil, err
+		}
+		if claimsLogLen, err = db.NewStorageValue(dbKeyIdenStateClaimsLogLen(idenStatePending)).Get(tx); err != nil {
+			return nil, err
+		}
+		preview.IdenState = idenStatePending
+		preview.IdenStateTreeRoots = *idenStateTreeRoots
+	}
+	// The claims and revocations are the ones since the identity state
+	// from which the transition is proven.
+	preview.Changed = true
+	preview.ClaimsTreeRootAdded = !preview.IdenStateTreeRoots.RootsTreeRoot.Equals(idenStateTreeRootsFrom.RootsTreeRoot)
+
+	if preview.RevocationsTreeBlobSize, err = dumpTreeSize(is.revocationsTree,
+		preview.IdenStateTreeRoots.RevocationsTreeRoot); err != nil {
+		return nil, err
+	}
+	if preview.RevokedNonces, err = is.revokedNoncesSince(tx, idenStateFrom, idenStateTreeRootsFrom,
+		idenStatePending, &preview.IdenStateTreeRoots); err != nil {
+		return nil, err
+	}
+
+	claimsLogLenFrom, err := db.NewStorageValue(dbKeyIdenStateClaimsLogLen(idenStateFrom)).Get(tx)
+	if err != nil {
+		return nil, err
+	}
+	preview.Claims = []*IssuedClaim{}
+	for idx := claimsLogLenFrom; idx < claimsLogLen; idx++ {
+		hi, err := is.claimsLog.GetByIdx(tx, idx, &ClaimRecord{})
+		if err != nil {
+			return nil, err
+		}
+		issuedClaim, err := is.issuedClaim(tx, hi)
+		if err != nil {
+			return nil, err
+		}
+		preview.Claims = append(preview.Claims, issuedClaim)
+	}
+	return &preview, nil
+}
+
+// revokedNoncesSince returns the revocation nonces added to the revocations
+// tree after the identity state idenStateFrom, up to the pending identity
+// state idenStatePending (or up to now if it's zero), in ascending order.
+// They are found in the audit log, walking back to the computation of
+// idenStateFrom.  If it's not in the audit log (it's the genesis identity
+// state, or the audit log was started after it), the revocations trees are
+// compared instead.
+func (is *Issuer) revokedNoncesSince(tx db.Tx, idenStateFrom *merkletree.Hash,
+	idenStateTreeRootsFrom *IdenStateTreeRoots, idenStatePending *merkletree.Hash,
+	idenStateTreeRoots *IdenStateTreeRoots) ([]uint32, error) {
+	nonces := []uint32{}
+	if idenStateTreeRoots.RevocationsTreeRoot.Equals(idenStateTreeRootsFrom.RevocationsTreeRoot) {
+		return nonces, nil
+	}
+	auditLogLen, err := is.auditLog.Length(tx)
+	if err != nil {
+		return nil, err
+	}
+	// Events after the computation of the pending identity state are not
+	// included in it.
+	included := idenStatePending.Equals(&merkletree.HashZero)
+	for idx := int64(auditLogLen) - 1; idx >= 0; idx-- {
+		var event Event
+		if _, err := is.auditLog.GetByIdx(tx, uint32(idx), &event); err != nil {
+			return nil, err
+		}
+		if event.Type == EventStateComputed && event.IdenState.Equals(idenStatePending) {
+			included = true
+		} else if event.Type == EventStateComputed && event.IdenState.Equals(idenStateFrom) {
+			sort.Slice(nonces, func(i, j int) bool { return nonces[i] < nonces[j] })
+			return nonces, nil
+		} else if event.Type == EventClaimRevoked && included {
+			nonces = append(nonces, *event.RevNonce)
+		}
+	}
+	return is.revokedNoncesSinceTree(idenStateTreeRootsFrom.RevocationsTreeRoot,
+		idenStateTreeRoots.RevocationsTreeRoot)
+}
+
+// revokedNoncesSinceTree returns the revocation nonces in the revocations
+// tree with root revocationsTreeRoot that are not in the one with root
+// revocationsTreeRootPrev, in ascending order.
+func (is *Issuer) revokedNoncesSinceTree(revocationsTreeRootPrev,
+	revocationsTreeRoot *merkletree.Hash) ([]uint32, error) {
+	nonces := []uint32{}
+	if revocationsTreeRoot.Equals(revocationsTreeRootPrev) {
+		return nonces, nil
+	}
+	var leafs []*merkletree.Entry
+	if err := is.revocationsTree.Walk(revocationsTreeRoot, func(n *merkletree.Node) {
+		if n.Type == merkletree.NodeTypeLeaf {
+			leafs = append(leafs, n.Entry)
+		}
+	}); err != nil {
+		return nil, err
+	}
+	for _, leaf := range leafs {
+		nonce := claims.NewLeafRevocationsTreeFromEntry(leaf).Nonce
+		revoked, err := is.nonceRevoked(nonce, revocationsTreeRootPrev)
+		if err != nil {
+			return nil, err
+		}
+		if !revoked {
+			nonces = append(nonces, nonce)
+		}
+	}
+	sort.Slice(nonces, func(i, j int) bool { return nonces[i] < nonces[j] })
+	return nonces, nil
+}
+
+// dumpTreeSize returns the size in bytes of the dump of the merkle tree mt
+// with root rootKey, as published off chain.
+func dumpTreeSize(mt *merkletree.MerkleTree, rootKey *merkletree.Hash) (int, error) {
+	var dump bytes.Buffer
+	if err := mt.DumpTree(&dump, rootKey); err != nil {
+		return 0, err
+	}
+	return dump.Len(), nil
+}
@@ -0,0 +1,256 @@
+package issuer
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/iden3/go-iden3-core/core/proof"
+	"github.com/iden3/go-iden3-core/db"
+	"github.com/iden3/go-iden3-core/merkletree"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Clock is the source of time used by the Publisher.  It allows testing the
+// Publisher with a fake clock.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type clockSystem struct{}
+
+func (clockSystem) Now() time.Time                         { return time.Now() }
+func (clockSystem) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// ClockSystem is the Clock that uses the system time.
+var ClockSystem Clock = clockSystem{}
+
+// PublisherConfig allows configuring the Publisher.
+type PublisherConfig struct {
+	// Interval is the time between publishing cycles.
+	Interval time.Duration
+	// MinChanges is the minimum number of claims issued or revoked since
+	// the last calculated identity state required to publish a new one.
+	MinChanges uint32
+	// MaxDelay is the maximum time to wait before publishing a new
+	// identity state with changes, even if there are less than MinChanges
+	// changes.  0 means no limit.
+	MaxDelay time.Duration
+	// RetryBackoffMin is the time to wait before retrying after the
+	// first failed cycle.  It's doubled after every consecutive failure
+	// up to RetryBackoffMax.
+	RetryBackoffMin time.Duration
+	RetryBackoffMax time.Duration
+}
+
+// PublisherConfigDefault is a default configuration for the Publisher.
+var PublisherConfigDefault = PublisherConfig{
+	Interval:        1 * time.Minute,
+	MinChanges:      1,
+	MaxDelay:        1 * time.Hour,
+	RetryBackoffMin: 10 * time.Second,
+	RetryBackoffMax: 10 * time.Minute,
+}
+
+// PublisherHooks are functions called by the Publisher on events.  Nil hooks
+// are ignored.
+type PublisherHooks struct {
+	// StateConfirmed is called when a published identity state is
+	// confirmed on chain.
+	StateConfirmed func(idenStateData *proof.IdenStateData)
+	// TxFailed is called when the transaction publishing an identity
+	// state is reverted, or when it's stale and can't be resubmitted.  A
+	// reverted identity state is published again with a new transaction.
+	TxFailed func(txHash common.Hash, err error)
+	// CycleFailed is called when a publishing cycle fails, either syncing,
+	// publishing or resubmitting the identity state.  The cycle will be
+	// retried after a backoff.
+	CycleFailed func(err error)
+	// ZkProofGenerated is called with the time spent generating the zk
+	// proof of every identity state update.
+	ZkProofGenerated func(elapsed time.Duration)
+}
+
+// Publisher is a long-running service that periodically syncs the Issuer
+// identity state with the Smart Contract and publishes new identity states
+// when enough claims have been issued or revoked.  Stale transactions are resubmitted
+// with a higher gas price.
+type Publisher struct {
+	is          *Issuer
+	cfg         PublisherConfig
+	hooks       PublisherHooks
+	clock       Clock
+	lastPublish time.Time
+	backoff     time.Duration
+}
+
+// NewPublisher creates a new Publisher for the Issuer.
+func NewPublisher(is *Issuer, cfg PublisherConfig, hooks PublisherHooks, clock Clock) *Publisher {
+	return &Publisher{
+		is:          is,
+		cfg:         cfg,
+		hooks:       hooks,
+		clock:       clock,
+		lastPublish: clock.Now(),
+	}
+}
+
+// Run runs publishing cycles until the ctx is cancelled, returning the ctx
+// error.
+func (p *Publisher) Run(ctx context.Context) error {
+	if p.is.cfg.GenesisOnly {
+		return ErrIdenGenesisOnly
+	}
+	for {
+		wait := p.cfg.Interval
+		if p.backoff != 0 {
+			wait = p.backoff
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-p.clock.After(wait):
+		}
+		if err := p.step(ctx); err != nil {
+			p.backoff = p.nextBackoff()
+			log.WithError(err).WithField("backoff", p.backoff).Warn("Publisher cycle failed")
+			if p.hooks.CycleFailed != nil {
+				p.hooks.CycleFailed(err)
+			}
+			continue
+		}
+		p.backoff = 0
+	}
+}
+
+// nextBackoff returns the time to wait after a failed cycle.
+func (p *Publisher) nextBackoff() time.Duration {
+	if p.backoff == 0 {
+		return p.cfg.RetryBackoffMin
+	}
+	backoff := 2 * p.backoff
+	if backoff > p.cfg.RetryBackoffMax {
+		backoff = p.cfg.RetryBackoffMax
+	}
+	return backoff
+}
+
+// step runs a single publishing cycle.
+func (p *Publisher) step(ctx context.Context) error {
+	idenStateOnChain := p.is.IdenStateOnChain()
+	txHash := p.is.ethTxPendingHash()
+	if err := p.is.syncIdenStatePublic(p.clock); errors.Is(err, ErrIdenStatePendingStale) {
+		if err := p.is.resubmitPendingState(p.clock); err != nil {
+			p.txFailed(txHash, err)
+			return err
+		}
+		return nil
+	} else if errors.Is(err, ErrIdenStatePendingTxFailed) {
+		p.txFailed(txHash, err)
+		return err
+	} else if err != nil {
+		return err
+	}
+	idenStateDataOnChain := p.is.StateDataOnChain()
+	if !idenStateDataOnChain.IdenState.Equals(idenStateOnChain) && p.hooks.StateConfirmed != nil {
+		p.hooks.StateConfirmed(idenStateDataOnChain)
+	}
+
+	idenStatePending, transacted := p.is.IdenStatePending()
+	if !idenStatePending.Equals(&merkletree.HashZero) {
+		if transacted {
+			// Wait for the pending state to be confirmed.
+			return nil
+		}
+		// A previous publish was interrupted before sending the
+		// transaction.
+		return p.publish(ctx)
+	}
+
+	changes, changed, err := p.is.unpublishedChanges()
+	if err != nil {
+		return err
+	}
+	if !changed {
+		return nil
+	}
+	if changes >= p.cfg.MinChanges ||
+		(p.cfg.MaxDelay != 0 && p.clock.Now().Sub(p.lastPublish) >= p.cfg.MaxDelay) {
+		return p.publish(ctx)
+	}
+	return nil
+}
+
+func (p *Publisher) txFailed(txHash common.Hash, err error) {
+	if p.hooks.TxFailed != nil {
+		p.hooks.TxFailed(txHash, err)
+	}
+}
+
+func (p *Publisher) publish(ctx context.Context) error {
+	if err := p.is.publishState(ctx, p.clock, p.hooks.ZkProofGenerated); errors.Is(err, ErrIdenStatePendingNotNil) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	p.lastPublish = p.clock.Now()
+	return nil
+}
+
+// unpublishedChanges returns the number of claims issued or revoked after the
+// last calculated identity state, and whether the current identity state is
+// different than the last calculated one.
+func (is *Issuer) unpublishedChanges() (uint32, bool, error) {
+	is.rw.RLock()
+	defer is.rw.RUnlock()
+	tx, err := is.storage.NewTx() // Read only Tx
+	if err != nil {
+		return 0, false, err
+	}
+	defer tx.Close()
+	idenStateLast, _, err := is.getIdenStateByIdx(tx, -1)
+	if err != nil {
+		return 0, false, err
+	}
+	claimsLogLenLast, err := db.NewStorageValue(dbKeyIdenStateClaimsLogLen(idenStateLast)).Get(tx)
+	if err != nil {
+		return 0, false, err
+	}
+	claimsLogLen, err := is.claimsLog.Length(tx)
+	if err != nil {
+		return 0, false, err
+	}
+	revocations, err := is.unpublishedRevocations(tx)
+	if err != nil {
+		return 0, false, err
+	}
+	idenState, _ := is.state()
+	return claimsLogLen - claimsLogLenLast + revocations, !idenState.Equals(idenStateLast), nil
+}
+
+// unpublishedRevocations returns the number of claims revoked after the last
+// calculated identity state, counting the revocation events in the audit log
+// back to the last computed identity state.
+func (is *Issuer) unpublishedRevocations(tx db.Tx) (uint32, error) {
+	auditLogLen, err := is.auditLog.Length(tx)
+	if err != nil {
+		return 0, err
+	}
+	revocations := uint32(0)
+	for idx := int64(auditLogLen) - 1; idx >= 0; idx-- {
+		var event Event
+		if _, err := is.auditLog.GetByIdx(tx, uint32(idx), &event); err != nil {
+			return 0, err
+		}
+		if event.Type == EventStateComputed {
+			break
+		}
+		if event.Type == EventClaimRevoked {
+			revocations++
+		}
+	}
+	return revocations, nil
+}
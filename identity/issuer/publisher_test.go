@@ -0,0 +1,188 @@
+package issuer
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/iden3/go-iden3-core/core/claims"
+	"github.com/iden3/go-iden3-core/core/proof"
+	"github.com/iden3/go-iden3-core/merkletree"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type clockFake struct {
+	rw      sync.RWMutex
+	now     time.Time
+	waiters []clockFakeWaiter
+}
+
+type clockFakeWaiter struct {
+	deadline time.Time
+	c        chan time.Time
+}
+
+func newClockFake() *clockFake {
+	return &clockFake{now: time.Unix(1600000000, 0)}
+}
+
+func (c *clockFake) Now() time.Time {
+	c.rw.RLock()
+	defer c.rw.RUnlock()
+	return c.now
+}
+
+func (c *clockFake) After(d time.Duration) <-chan time.Time {
+	c.rw.Lock()
+	defer c.rw.Unlock()
+	ch := make(chan time.Time, 1)
+	c.waiters = append(c.waiters, clockFakeWaiter{deadline: c.now.Add(d), c: ch})
+	return ch
+}
+
+func (c *clockFake) Advance(d time.Duration) {
+	c.rw.Lock()
+	defer c.rw.Unlock()
+	c.now = c.now.Add(d)
+	waiters := c.waiters[:0]
+	for _, w := range c.waiters {
+		if !c.now.Before(w.deadline) {
+			w.c <- c.now
+		} else {
+			waiters = append(waiters, w)
+		}
+	}
+	c.waiters = waiters
+}
+
+func TestPublisher(t *testing.T) {
+	issuer, _, _ := newIssuer(t, false, idenPubOnChain, idenPubOffChain)
+	clock := newClockFake()
+	cfg := PublisherConfigDefault
+	cfg.MinChanges = 2
+	var confirmed []*proof.IdenStateData
+	var zkProofsGenerated int
+	p := NewPublisher(issuer, cfg, PublisherHooks{
+		StateConfirmed:   func(d *proof.IdenStateData) { confirmed = append(confirmed, d) },
+		ZkProofGenerated: func(time.Duration) { zkProofsGenerated++ },
+	}, clock)
+
+	// Nothing to publish
+	require.Nil(t, p.step(context.Background()))
+	idenStatePending, _ := issuer.IdenStatePending()
+	assert.Equal(t, &merkletree.HashZero, idenStatePending)
+
+	// Less than MinChanges new claims
+	indexBytes, valueBytes := [claims.IndexSlotLen]byte{}, [claims.ValueSlotLen]byte{}
+	require.Nil(t, issuer.IssueClaim(claims.NewClaimBasic(indexBytes, valueBytes)))
+	require.Nil(t, p.step(context.Background()))
+	idenStatePending, _ = issuer.IdenStatePending()
+	assert.Equal(t, &merkletree.HashZero, idenStatePending)
+
+	// After MaxDelay the state is published anyway
+	clock.Advance(cfg.MaxDelay)
+	require.Nil(t, p.step(context.Background()))
+	newState, _ := issuer.State()
+	idenStatePending, transacted := issuer.IdenStatePending()
+	assert.Equal(t, newState, idenStatePending)
+	assert.True(t, transacted)
+	assert.Equal(t, 1, zkProofsGenerated)
+	assert.Equal(t, clock.Now().Unix(), issuer.idenStatePendingTxSent().Time)
+
+	// Not yet on chain
+	require.Nil(t, p.step(context.Background()))
+	assert.Equal(t, 0, len(confirmed))
+
+	// Confirmed on chain
+	idenPubOnChain.Sync()
+	blockN += 10
+	require.Nil(t, p.step(context.Background()))
+	require.Equal(t, 1, len(confirmed))
+	assert.Equal(t, newState, confirmed[0].IdenState)
+
+	// Publish after MinChanges new claims
+	claimsNew := []claims.Claimer{}
+	for i := 1; i <= 2; i++ {
+		indexBytes[0] = byte(i)
+		claim := claims.NewClaimBasic(indexBytes, valueBytes)
+		require.Nil(t, issuer.IssueClaim(claim))
+		claimsNew = append(claimsNew, claim)
+	}
+	require.Nil(t, p.step(context.Background()))
+	newState, _ = issuer.State()
+	idenStatePending, _ = issuer.IdenStatePending()
+	assert.Equal(t, newState, idenStatePending)
+	assert.Equal(t, 2, zkProofsGenerated)
+	idenPubOnChain.Sync()
+	blockN += 10
+	require.Nil(t, p.step(context.Background()))
+
+	// Revocations count as changes
+	for _, claim := range claimsNew {
+		require.Nil(t, issuer.RevokeClaim(claim))
+	}
+	require.Nil(t, p.step(context.Background()))
+	newState, _ = issuer.State()
+	idenStatePending, _ = issuer.IdenStatePending()
+	assert.Equal(t, newState, idenStatePending)
+	assert.Equal(t, 3, zkProofsGenerated)
+}
+
+func TestPublisherTxFailed(t *testing.T) {
+	issuer, _, _ := newIssuer(t, false, idenPubOnChain, idenPubOffChain)
+	var txsFailed []common.Hash
+	p := NewPublisher(issuer, PublisherConfigDefault, PublisherHooks{
+		TxFailed: func(txHash common.Hash, err error) { txsFailed = append(txsFailed, txHash) },
+	}, newClockFake())
+
+	indexBytes, valueBytes := [claims.IndexSlotLen]byte{}, [claims.ValueSlotLen]byte{}
+	require.Nil(t, issuer.IssueClaim(claims.NewClaimBasic(indexBytes, valueBytes)))
+	require.Nil(t, p.step(context.Background()))
+	newState, _ := issuer.State()
+	txHash := issuer.ethTxPendingHash()
+
+	// The transaction is reverted
+	idenPubOnChain.RevertPending()
+	assert.Equal(t, ErrIdenStatePendingTxFailed, p.step(context.Background()))
+	assert.Equal(t, []common.Hash{txHash}, txsFailed)
+	idenStatePending, transacted := issuer.IdenStatePending()
+	assert.Equal(t, newState, idenStatePending)
+	assert.False(t, transacted)
+
+	// The pending state is published again with a new transaction
+	require.Nil(t, p.step(context.Background()))
+	_, transacted = issuer.IdenStatePending()
+	assert.True(t, transacted)
+	assert.NotEqual(t, txHash, issuer.ethTxPendingHash())
+	idenPubOnChain.Sync()
+	blockN += 10
+	require.Nil(t, p.step(context.Background()))
+	assert.Equal(t, newState, issuer.IdenStateOnChain())
+	assert.Equal(t, 1, len(txsFailed))
+}
+
+func TestPublisherRun(t *testing.T) {
+	issuer, _, _ := newIssuer(t, false, idenPubOnChain, idenPubOffChain)
+	clock := newClockFake()
+	p := NewPublisher(issuer, PublisherConfigDefault, PublisherHooks{}, clock)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- p.Run(ctx) }()
+	cancel()
+	assert.Equal(t, context.Canceled, <-done)
+}
+
+func TestPublisherBackoff(t *testing.T) {
+	cfg := PublisherConfig{RetryBackoffMin: 10 * time.Second, RetryBackoffMax: 30 * time.Second}
+	p := NewPublisher(nil, cfg, PublisherHooks{}, newClockFake())
+	p.backoff = p.nextBackoff()
+	assert.Equal(t, 10*time.Second, p.backoff)
+	p.backoff = p.nextBackoff()
+	assert.Equal(t, 20*time.Second, p.backoff)
+	p.backoff = p.nextBackoff()
+	assert.Equal(t, 30*time.Second, p.backoff)
+}
@@ -0,0 +1,471 @@
+package issuer
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/iden3/go-iden3-core/components/idenpuboffchain"
+	"github.com/iden3/go-iden3-core/components/idenpubonchain"
+	"github.com/iden3/go-iden3-core/core"
+	"github.com/iden3/go-iden3-core/core/claims"
+	"github.com/iden3/go-iden3-core/core/proof"
+	"github.com/iden3/go-iden3-core/db"
+	"github.com/iden3/go-iden3-core/keystore"
+	"github.com/iden3/go-iden3-core/merkletree"
+	"github.com/iden3/go-iden3-crypto/babyjub"
+)
+
+var (
+	ErrRecoverStorageNotEmpty        = fmt.Errorf("the storage to recover the issuer into is not empty")
+	ErrRecoverPublicDataNil          = fmt.Errorf("the public data is required to recover an issuer with an identity state on chain")
+	ErrRecoverNoClaims               = fmt.Errorf("the claims dump is empty")
+	ErrRecoverDuplicatedNonce        = fmt.Errorf("duplicated revocation nonce in the claims dump")
+	ErrRecoverClaimKOpNotFound       = fmt.Errorf("the first claim of the dump is not the genesis operational key claim")
+	ErrRecoverGenesisNotFound        = fmt.Errorf("the genesis claims tree root is not in the public roots tree")
+	ErrRecoverClaimsMismatch         = fmt.Errorf("the claims dump doesn't contain the claims of the public identity state")
+	ErrRecoverRevocationsMismatch    = fmt.Errorf("the revoked nonces don't contain the revocations of the public identity state")
+	ErrRecoverRootsMismatch          = fmt.Errorf("the public roots tree doesn't match its root")
+	ErrRecoverIdenStateMismatch      = fmt.Errorf("the public identity state doesn't match the one on chain")
+	ErrRecoverKeyOperationalNotFound = fmt.Errorf("no valid operational key of the claims dump is in the keystore")
+)
+
+// entrier wraps a merkletree.Entry to use it as a merkletree.Entrier.
+type entrier merkletree.Entry
+
+func (e *entrier) Entry() *merkletree.Entry { return (*merkletree.Entry)(e) }
+
+// recoveredClaim is a claim from a claims dump with its decoded metadata.
+type recoveredClaim struct {
+	entry    *merkletree.Entry
+	hi       *merkletree.Hash
+	metadata claims.Metadata
+}
+
+// Recover rebuilds an Issuer whose storage has been lost into the empty
+// storage, from a claims dump of its claims tree (see Admin.ClaimsDump),
+// the revocation nonces of its revoked claims, and the public data published
+// off chain for its identity state on chain, and returns its ID.  The
+// operational key must be in the keyStore.  The Issuer can then be loaded
+// with Load.
+//
+// Claims are issued with increasing revocation nonces, so the genesis
+// claims are the first ones of the dump in nonce order whose claims tree
+// root is in the public roots tree.  The rebuilt trees are checked against
+// the public data and the identity state on chain, obtained with
+// idenPubOnChain.  Claims and revocations of the dump not included in the
+// public identity state are left unpublished.  The idenStateList only
+// contains the genesis and the on chain identity states, the issue time of
+// the claims is unknown and set to 0, and the revocation nonces generator
+// continues after the highest known nonce so that no nonce is reused.
+//
+// If the identity is not on chain (only the genesis identity state has been
+// published), publicData can be nil, and then the genesis claims are only the
+// genesis operational key claim.  Otherwise it must be the public data of
+// the genesis identity state.
+//
+// For genesis only Issuers all the claims of the dump are genesis claims,
+// and publicData and idenPubOnChain are not used.
+func Recover(cfg Config, storage db.Storage, keyStore *keystore.KeyStore,
+	claimsDump []string, revokedNonces []uint32, publicData *idenpuboffchain.PublicData,
+	idenPubOnChain idenpubonchain.IdenPubOnChainer) (*core.ID, error) {
+	empty := true
+	if err := storage.Iterate(func(k, v []byte) (bool, error) {
+		empty = false
+		return false, nil
+	}); err != nil {
+		return nil, err
+	}
+	if !empty {
+		return nil, ErrRecoverStorageNotEmpty
+	}
+	if !cfg.GenesisOnly && idenPubOnChain == nil {
+		return nil, ErrIdenPubOnChainNil
+	}
+
+	// Sort the claims in issuance order
+	entries, err := decodeClaimsDumpEntries(claimsDump)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, ErrRecoverNoClaims
+	}
+	rcs := make([]recoveredClaim, len(entries))
+	for i, e := range entries {
+		hi, err := e.HIndex()
+		if err != nil {
+			return nil, err
+		}
+		rcs[i].entry, rcs[i].hi = e, hi
+		rcs[i].metadata.Unmarshal(e)
+	}
+	sort.Slice(rcs, func(i, j int) bool { return rcs[i].metadata.RevNonce < rcs[j].metadata.RevNonce })
+	nonceMax := rcs[len(rcs)-1].metadata.RevNonce
+	for i := 1; i < len(rcs); i++ {
+		if rcs[i].metadata.RevNonce == rcs[i-1].metadata.RevNonce {
+			return nil, ErrRecoverDuplicatedNonce
+		}
+	}
+	if _, ok := claimKeyOperational(&rcs[0]); !ok || rcs[0].metadata.RevNonce != 0 {
+		return nil, ErrRecoverClaimKOpNotFound
+	}
+	revokedNoncesSet := make(map[uint32]bool)
+	for _, nonce := range revokedNonces {
+		revokedNoncesSet[nonce] = true
+		if nonce > nonceMax {
+			nonceMax = nonce
+		}
+	}
+	publicDataNil := publicData == nil
+	if !cfg.GenesisOnly && publicDataNil {
+		if publicData, err = genesisPublicData(&cfg, &rcs[0]); err != nil {
+			return nil, err
+		}
+	}
+
+	// The trees are built in memory and copied into the storage in the
+	// final transaction, so that a failed recovery leaves the storage
+	// empty.
+	storageTrees := db.NewMemoryStorage()
+	clt, ret, rot, err := loadMTs(&cfg, storageTrees)
+	if err != nil {
+		return nil, err
+	}
+
+	// Claims tree, finding the genesis and the on chain claims among the
+	// claims in issuance order
+	genesisLen, onChainLen := 0, 0
+	var genesisClaimsTreeRoot *merkletree.Hash
+	for i := range rcs {
+		if err := clt.AddEntry(rcs[i].entry); err != nil {
+			return nil, err
+		}
+		if cfg.GenesisOnly {
+			continue
+		}
+		if genesisLen == 0 {
+			if ok, err := rootInRootsTree(publicData, clt.RootKey()); err != nil {
+				return nil, err
+			} else if ok {
+				genesisLen, genesisClaimsTreeRoot = i+1, clt.RootKey()
+			}
+		}
+		if clt.RootKey().Equals(publicData.ClaimsTreeRoot) {
+			onChainLen = i + 1
+		}
+	}
+	if cfg.GenesisOnly {
+		genesisLen, genesisClaimsTreeRoot = len(rcs), clt.RootKey()
+	} else if genesisLen == 0 {
+		return nil, ErrRecoverGenesisNotFound
+	} else if onChainLen < genesisLen {
+		return nil, ErrRecoverClaimsMismatch
+	}
+
+	// Genesis identity state
+	genesisRootsTree, err := merkletree.NewMerkleTree(db.NewMemoryStorage(), cfg.MaxLevelsRootsTree)
+	if err != nil {
+		return nil, err
+	}
+	if err := claims.AddLeafRootsTree(genesisRootsTree, genesisClaimsTreeRoot); err != nil {
+		return nil, err
+	}
+	genesisTreeRoots := IdenStateTreeRoots{
+		ClaimsTreeRoot:      genesisClaimsTreeRoot,
+		RevocationsTreeRoot: &merkletree.HashZero,
+		RootsTreeRoot:       genesisRootsTree.RootKey(),
+	}
+	genesisState := core.IdenState(genesisTreeRoots.ClaimsTreeRoot,
+		genesisTreeRoots.RevocationsTreeRoot, genesisTreeRoots.RootsTreeRoot)
+	id := core.IdGenesisFromIdenState(genesisState)
+
+	// Roots and revocations trees.  The published revocations are added
+	// first, then the unpublished ones.
+	revokedNoncesPublished := make(map[uint32]bool)
+	if cfg.GenesisOnly {
+		if err := claims.AddLeafRootsTree(rot, genesisClaimsTreeRoot); err != nil {
+			return nil, err
+		}
+	} else {
+		rootsLeafs, err := treeLeafs(publicData.RootsTree, publicData.RootsTreeRoot)
+		if err != nil {
+			return nil, err
+		}
+		for _, leaf := range rootsLeafs {
+			if err := rot.AddEntry(leaf); err != nil {
+				return nil, err
+			}
+		}
+		if !rot.RootKey().Equals(publicData.RootsTreeRoot) {
+			return nil, ErrRecoverRootsMismatch
+		}
+
+		revocationsLeafs, err := treeLeafs(publicData.RevocationsTree, publicData.RevocationsTreeRoot)
+		if err != nil {
+			return nil, err
+		}
+		for _, leaf := range revocationsLeafs {
+			nonce := claims.NewLeafRevocationsTreeFromEntry(leaf).Nonce
+			if !revokedNoncesSet[nonce] {
+				return nil, ErrRecoverRevocationsMismatch
+			}
+			revokedNoncesPublished[nonce] = true
+			if err := claims.AddLeafRevocationsTree(ret, nonce, 0xffffffff); err != nil {
+				return nil, err
+			}
+		}
+		if !ret.RootKey().Equals(publicData.RevocationsTreeRoot) {
+			return nil, ErrRecoverRevocationsMismatch
+		}
+
+		idenState := core.IdenState(publicData.ClaimsTreeRoot, publicData.RevocationsTreeRoot,
+			publicData.RootsTreeRoot)
+		if !idenState.Equals(publicData.IdenState) {
+			return nil, ErrRecoverIdenStateMismatch
+		}
+	}
+	for _, nonce := range revokedNonces {
+		if revokedNoncesPublished[nonce] {
+			continue
+		}
+		revokedNoncesPublished[nonce] = true
+		if err := claims.AddLeafRevocationsTree(ret, nonce, 0xffffffff); err != nil {
+			return nil, err
+		}
+	}
+
+	// Identity state on chain
+	idenStateData := &proof.IdenStateData{IdenState: &merkletree.HashZero}
+	var blockHash common.Hash
+	if !cfg.GenesisOnly {
+		idenStateDataOnChain, err := idenPubOnChain.GetState(id)
+		if err == idenpubonchain.ErrIdenNotOnChain {
+			// Only the genesis identity state is on chain
+			if !publicData.IdenState.Equals(genesisState) {
+				return nil, ErrRecoverIdenStateMismatch
+			}
+		} else if err != nil {
+			return nil, fmt.Errorf("error calling idenstates smart contract getState: %w", err)
+		} else if publicDataNil {
+			return nil, ErrRecoverPublicDataNil
+		} else if !idenStateDataOnChain.IdenState.Equals(publicData.IdenState) {
+			return nil, ErrRecoverIdenStateMismatch
+		} else {
+			idenStateData = idenStateDataOnChain
+			if blockHash, err = idenPubOnChain.BlockHash(idenStateData.BlockN); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// The current operational key is the last one not revoked
+	var kOpComp *babyjub.PublicKeyComp
+	var claimKOpHi *merkletree.Hash
+	for i := range rcs {
+		if claimKOpI, ok := claimKeyOperational(&rcs[i]); ok && !revokedNoncesSet[rcs[i].metadata.RevNonce] {
+			kOpCompI := (&babyjub.PublicKey{X: claimKOpI.Ax, Y: claimKOpI.Ay}).Compress()
+			kOpComp, claimKOpHi = &kOpCompI, rcs[i].hi
+		}
+	}
+	if kOpComp == nil || !keyStoreHasKey(keyStore, kOpComp) {
+		return nil, ErrRecoverKeyOperationalNotFound
+	}
+	claimKOpMtp, err := clt.GenerateProof(rcs[0].hi, genesisClaimsTreeRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := storage.NewTx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Close()
+	if err := storageTrees.Iterate(func(k, v []byte) (bool, error) {
+		tx.Put(k, v)
+		return true, nil
+	}); err != nil {
+		return nil, err
+	}
+
+	// Continue the revocation nonces after the highest known one
+	nonceGen := NewUniqueNonceGen(db.NewStorageValue(dbKeyNonceIdx))
+	nonceGen.index.Set(tx, nonceMax+1)
+
+	tx.Put(dbKeyId, id[:])
+	tx.Put(dbKeyKOp, kOpComp[:])
+	tx.Put(dbKeyClaimKOpHi, claimKOpHi[:])
+	if err := db.StoreJSON(tx, dbKeyGenesisClaimKOpMtp, claimKOpMtp); err != nil {
+		return nil, err
+	}
+	if err := db.StoreJSON(tx, dbKeyGenesisClaimTreeRoot, genesisClaimsTreeRoot); err != nil {
+		return nil, err
+	}
+
+	cfgJSON, err := json.Marshal(cfg)
+	if err != nil {
+		return nil, err
+	}
+	tx.Put(dbKeyConfig, cfgJSON)
+
+	idenStateList := db.NewStorageList(dbPrefixIdenStateList)
+	claimsLog := db.NewStorageList(dbPrefixClaimsLog)
+	kOpList := db.NewStorageList(dbPrefixKOpList)
+	auditLog := db.NewStorageList(dbPrefixAuditLog)
+
+	is := Issuer{
+		rw:              &sync.RWMutex{},
+		publishMutex:    &sync.Mutex{},
+		id:              id,
+		claimsTree:      clt,
+		revocationsTree: ret,
+		rootsTree:       rot,
+		keyStore:        keyStore,
+		kOpComp:         kOpComp,
+		storage:         storage,
+		nonceGen:        nonceGen,
+		idenStateList:   idenStateList,
+		claimsLog:       claimsLog,
+		kOpList:         kOpList,
+		auditLog:        auditLog,
+		subs:            &subscriptions{},
+		cfg:             cfg,
+	}
+
+	// Rebuild the list of operational keys, the claims index and the
+	// history of idenStates with the genesis and the on chain ones
+	kOpList.Init(tx)
+	claimsLog.Init(tx)
+	idenStateList.Init(tx)
+	for i := range rcs {
+		if claimKOpI, ok := claimKeyOperational(&rcs[i]); ok {
+			kOpCompI := (&babyjub.PublicKey{X: claimKOpI.Ax, Y: claimKOpI.Ay}).Compress()
+			if err := kOpList.Append(tx, kOpCompI[:], &keyOperational{
+				ClaimHIndex: rcs[i].hi,
+				RevNonce:    rcs[i].metadata.RevNonce,
+			}); err != nil {
+				return nil, err
+			}
+		}
+		if err := is.indexClaim(tx, (*entrier)(rcs[i].entry), 0); err != nil {
+			return nil, err
+		}
+		if i+1 == genesisLen {
+			if err := idenStateList.Append(tx, genesisState[:], &genesisTreeRoots); err != nil {
+				return nil, err
+			}
+			if err := is.indexIdenState(tx, genesisState); err != nil {
+				return nil, err
+			}
+		}
+		if i+1 == onChainLen && !publicData.IdenState.Equals(genesisState) {
+			if err := idenStateList.Append(tx, publicData.IdenState[:], &IdenStateTreeRoots{
+				ClaimsTreeRoot:      publicData.ClaimsTreeRoot,
+				RevocationsTreeRoot: publicData.RevocationsTreeRoot,
+				RootsTreeRoot:       publicData.RootsTreeRoot,
+			}); err != nil {
+				return nil, err
+			}
+			if err := is.indexIdenState(tx, publicData.IdenState); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// The audit log history is lost
+	auditLog.Init(tx)
+
+	if err := is.setIdenStateDataOnChain(tx, idenStateData); err != nil {
+		return nil, err
+	}
+	is.setIdenStateOnChainBlockHash(tx, blockHash)
+	is.setIdenStatePending(tx, &merkletree.HashZero, false)
+	if err := is.setEthTxInitState(tx, nil); err != nil {
+		return nil, err
+	}
+	if err := is.setEthTxSetState(tx, nil); err != nil {
+		return nil, err
+	}
+	if err := is.setIdenStatePendingTxSent(tx, &TxSent{}); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return is.id, nil
+}
+
+// genesisPublicData returns the public data of the genesis identity state
+// whose only claim is the genesis operational key claim rc.
+func genesisPublicData(cfg *Config, rc *recoveredClaim) (*idenpuboffchain.PublicData, error) {
+	clt, ret, rot, err := loadMTs(cfg, db.NewMemoryStorage())
+	if err != nil {
+		return nil, err
+	}
+	if err := clt.AddEntry(rc.entry); err != nil {
+		return nil, err
+	}
+	if err := claims.AddLeafRootsTree(rot, clt.RootKey()); err != nil {
+		return nil, err
+	}
+	return &idenpuboffchain.PublicData{
+		IdenState:           core.IdenState(clt.RootKey(), ret.RootKey(), rot.RootKey()),
+		ClaimsTreeRoot:      clt.RootKey(),
+		RevocationsTreeRoot: ret.RootKey(),
+		RevocationsTree:     ret,
+		RootsTreeRoot:       rot.RootKey(),
+		RootsTree:           rot,
+	}, nil
+}
+
+// claimKeyOperational returns the ClaimKeyBabyJub of the claim if it
+// authorizes an operational key.
+func claimKeyOperational(rc *recoveredClaim) (*claims.ClaimKeyBabyJub, bool) {
+	if rc.metadata.Type() != claims.ClaimTypeKeyBabyJub {
+		return nil, false
+	}
+	claimKOp := claims.NewClaimKeyBabyJubFromEntry(rc.entry)
+	return claimKOp, claimKOp.KeyType == claims.BabyJubKeyTypeAuthorizeKSign
+}
+
+// keyStoreHasKey returns true if the public key pk is in the keyStore.
+func keyStoreHasKey(keyStore *keystore.KeyStore, pk *babyjub.PublicKeyComp) bool {
+	for _, key := range keyStore.Keys() {
+		if key == *pk {
+			return true
+		}
+	}
+	return false
+}
+
+// rootInRootsTree returns true if the claims tree root is a leaf of the
+// published roots tree.
+func rootInRootsTree(publicData *idenpuboffchain.PublicData, claimsTreeRoot *merkletree.Hash) (bool, error) {
+	hi, err := claims.NewLeafRootsTree(*claimsTreeRoot).Entry().HIndex()
+	if err != nil {
+		return false, err
+	}
+	mtp, err := publicData.RootsTree.GenerateProof(hi, publicData.RootsTreeRoot)
+	if err != nil {
+		return false, err
+	}
+	return mtp.Existence, nil
+}
+
+// treeLeafs returns the entries of the leafs of the merkle tree mt with root
+// rootKey.
+func treeLeafs(mt *merkletree.MerkleTree, rootKey *merkletree.Hash) ([]*merkletree.Entry, error) {
+	var leafs []*merkletree.Entry
+	if err := mt.Walk(rootKey, func(n *merkletree.Node) {
+		if n.Type == merkletree.NodeTypeLeaf {
+			leafs = append(leafs, n.Entry)
+		}
+	}); err != nil {
+		return nil, err
+	}
+	return leafs, nil
+}
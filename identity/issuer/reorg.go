@@ -0,0 +1,148 @@
+package issuer
+
+import (
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/iden3/go-iden3-core/core/proof"
+	"github.com/iden3/go-iden3-core/db"
+	"github.com/iden3/go-iden3-core/merkletree"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// updateIdenStateOnChainBlock updates the block of the idenStateDataOnChain
+// if the identity state update was included in a different block after a
+// chain reorganization.
+func (is *Issuer) updateIdenStateOnChainBlock(idenStateData *proof.IdenStateData) error {
+	if idenStateData.IdenState.Equals(&merkletree.HashZero) {
+		return nil
+	}
+	blockHash, err := is.idenPubOnChain.BlockHash(idenStateData.BlockN)
+	if err != nil {
+		return err
+	}
+	if idenStateData.BlockN == is.idenStateDataOnChain().BlockN &&
+		blockHash == is.idenStateOnChainBlockHash() {
+		return nil
+	}
+	tx, err := is.storage.NewTx()
+	if err != nil {
+		return err
+	}
+	if err := is.setIdenStateDataOnChain(tx, idenStateData); err != nil {
+		return err
+	}
+	is.setIdenStateOnChainBlockHash(tx, blockHash)
+	return tx.Commit()
+}
+
+// idenStateOnChainReorged returns true if the block in which the
+// idenStateOnChain was set is no longer in the canonical chain.
+func (is *Issuer) idenStateOnChainReorged() (bool, error) {
+	if is.idenStateOnChainBlockHash() == (common.Hash{}) {
+		return false, nil
+	}
+	blockHash, err := is.idenPubOnChain.BlockHash(is.idenStateDataOnChain().BlockN)
+	if err != nil {
+		return false, err
+	}
+	return blockHash != is.idenStateOnChainBlockHash(), nil
+}
+
+// rollbackIdenStateOnChain sets the idenStateOnChain back to the identity
+// state found in the Smart Contract after a chain reorganization, forgets the
+// IdenStateData of the identity states removed from the chain, and requeues
+// the last calculated identity state so that the next call to PublishState
+// publishes it again.  The identity state in the Smart Contract must be one
+// of the identity states calculated by the Issuer.
+func (is *Issuer) rollbackIdenStateOnChain(idenStateData *proof.IdenStateData) error {
+	tx, err := is.storage.NewTx()
+	if err != nil {
+		return err
+	}
+	var blockHash common.Hash
+	if !idenStateData.IdenState.Equals(&merkletree.HashZero) {
+		if _, err := is.getIdenStateTreeRoots(tx, idenStateData.IdenState); err != nil {
+			tx.Close()
+			return fmt.Errorf("Fatal error: Identity State in the Smart Contract (%v)"+
+				" after a chain reorganization is unknown: %w", idenStateData.IdenState, err)
+		}
+		if blockHash, err = is.idenPubOnChain.BlockHash(idenStateData.BlockN); err != nil {
+			tx.Close()
+			return err
+		}
+	}
+	idenStateLast, _, err := is.getIdenStateByIdx(tx, -1)
+	if err != nil {
+		tx.Close()
+		return err
+	}
+	log.WithField("idenStateOnChain", is.idenStateOnChain()).
+		WithField("idenState", idenStateData.IdenState).
+		Warn("Chain reorganization: rolling back the identity state on chain")
+
+	if err := is.setEthTxInitState(tx, nil); err != nil {
+		return err
+	}
+	if err := is.setEthTxSetState(tx, nil); err != nil {
+		return err
+	}
+	if err := is.setIdenStatePendingTxSent(tx, &TxSent{}); err != nil {
+		return err
+	}
+	if err := is.setIdenStateDataOnChain(tx, idenStateData); err != nil {
+		return err
+	}
+	is.setIdenStateOnChainBlockHash(tx, blockHash)
+	if err := is.deleteIdenStateDataAfter(tx, idenStateData.IdenState); err != nil {
+		return err
+	}
+	if idenStateLast.Equals(idenStateData.IdenState) {
+		is.setIdenStatePending(tx, &merkletree.HashZero, false)
+	} else {
+		is.setIdenStatePending(tx, idenStateLast, false)
+	}
+	eventRolledBack := newEvent(EventStateRolledBack, idenStateData.IdenState)
+	if err := is.audit(tx, eventRolledBack); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	is.emit(eventRolledBack)
+	return nil
+}
+
+// deleteIdenStateDataAfter deletes the IdenStateData of the identity states
+// calculated after idenState, which are no longer on chain.
+func (is *Issuer) deleteIdenStateDataAfter(tx db.Tx, idenState *merkletree.Hash) error {
+	idenStateListLen, err := is.idenStateList.Length(tx)
+	if err != nil {
+		return err
+	}
+	for idx := int64(idenStateListLen) - 1; idx >= 0; idx-- {
+		idenStateIdx, _, err := is.getIdenStateByIdx(tx, idx)
+		if err != nil {
+			return err
+		}
+		if idenStateIdx.Equals(idenState) {
+			break
+		}
+		tx.Delete(dbKeyIdenStateData(idenStateIdx))
+	}
+	return nil
+}
+
+// migrateIdenStateOnChainBlockHash initializes the block hash of the
+// identity state on chain.  It's unknown, so chain reorganizations are not
+// detected until the next identity state is confirmed.
+func (is *Issuer) migrateIdenStateOnChainBlockHash(tx db.Tx) (bool, error) {
+	if _, err := tx.Get(dbKeyIdenStateOnChainBlockHash); err == nil {
+		return false, nil
+	} else if err != db.ErrNotFound {
+		return false, err
+	}
+	is.setIdenStateOnChainBlockHash(tx, common.Hash{})
+	return true, nil
+}
@@ -0,0 +1,179 @@
+package issuer
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/iden3/go-iden3-core/core"
+	"github.com/iden3/go-iden3-core/core/claims"
+	"github.com/iden3/go-iden3-core/db"
+	"github.com/iden3/go-iden3-core/merkletree"
+)
+
+var (
+	ErrClaimAlreadyRevoked       = fmt.Errorf("the claim is already revoked")
+	ErrRevokeKeyOperationalInUse = fmt.Errorf("the claim of the operational key in use can't be revoked, rotate the key instead")
+)
+
+// RevocationStatus is the revocation status of an issued claim.
+type RevocationStatus struct {
+	Revoked bool
+	// IdenState is the first published identity state that includes the
+	// revocation, like IssuedClaim.IdenState.  It is nil if the claim is
+	// not revoked or if no identity state including the revocation has
+	// been seen on chain yet.
+	IdenState *merkletree.Hash
+	// OnChain is true if the revocation is included in an identity state
+	// seen on chain, which is IdenState.
+	OnChain bool
+}
+
+// revokeNonce adds the revocation nonce of the claim with HIndex hi to the
+// revocations tree and records the revocation in the audit log in a single
+// storage transaction.  The claim of the operational key in use can't be
+// revoked.
+func (is *Issuer) revokeNonce(hi *merkletree.Hash, nonce uint32) error {
+	tx0, err := is.storage.NewTx() // Read only Tx
+	if err != nil {
+		return err
+	}
+	var kOp keyOperational
+	err = is.kOpList.Get(tx0, is.kOpComp[:], &kOp)
+	tx0.Close()
+	if err != nil {
+		return err
+	}
+	if kOp.RevNonce == nonce {
+		return ErrRevokeKeyOperationalInUse
+	}
+	revoked, err := is.nonceRevoked(nonce, is.revocationsTree.RootKey())
+	if err != nil {
+		return err
+	}
+	if revoked {
+		return ErrClaimAlreadyRevoked
+	}
+
+	tx, err := is.storage.NewTx()
+	if err != nil {
+		return err
+	}
+	defer tx.Close()
+	txRevocationsTree, err := is.revocationsTree.Storage().NewTx()
+	if err != nil {
+		return err
+	}
+	defer txRevocationsTree.Close()
+	revocationsTreeRoot, err := is.revocationsTree.AddEntryTx(txRevocationsTree, is.revocationsTree.RootKey(),
+		claims.NewLeafRevocationsTree(nonce, 0xffffffff).Entry())
+	if err != nil {
+		return err
+	}
+
+	idenState := core.IdenState(is.claimsTree.RootKey(), revocationsTreeRoot, is.rootsTree.RootKey())
+	event := newClaimEvent(EventClaimRevoked, hi, nonce, idenState)
+	if err := is.audit(tx, event); err != nil {
+		return err
+	}
+	tx.Add(txRevocationsTree)
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if err := is.revocationsTree.SetRootKey(revocationsTreeRoot); err != nil {
+		return err
+	}
+	is.emit(event)
+	return nil
+}
+
+// nonceRevoked returns true if the revocation nonce is in the revocations
+// tree with root revocationsTreeRoot.
+func (is *Issuer) nonceRevoked(nonce uint32, revocationsTreeRoot *merkletree.Hash) (bool, error) {
+	revHi, err := claims.NewLeafRevocationsTree(nonce, 0).Entry().HIndex()
+	if err != nil {
+		return false, err
+	}
+	mtp, err := is.revocationsTree.GenerateProof(revHi, revocationsTreeRoot)
+	if err != nil {
+		return false, err
+	}
+	return mtp.Existence, nil
+}
+
+// RevokeByNonce revokes the issued claim with the revocation nonce.  The
+// Identity State is not updated.
+func (is *Issuer) RevokeByNonce(nonce uint32) error {
+	if is.cfg.GenesisOnly {
+		return ErrIdenGenesisOnly
+	}
+	is.rw.Lock()
+	defer is.rw.Unlock()
+	tx, err := is.storage.NewTx() // Read only Tx
+	if err != nil {
+		return err
+	}
+	hiBytes, err := tx.Get(dbKeyClaimsIdxRevNonce(nonce))
+	tx.Close()
+	if err == db.ErrNotFound {
+		return ErrClaimNotFoundRevNonce
+	} else if err != nil {
+		return err
+	}
+	var hi merkletree.Hash
+	copy(hi[:], hiBytes)
+	return is.revokeNonce(&hi, nonce)
+}
+
+// RevocationStatus returns the revocation status of the issued claim with the
+// revocation nonce.
+func (is *Issuer) RevocationStatus(nonce uint32) (*RevocationStatus, error) {
+	is.rw.RLock()
+	defer is.rw.RUnlock()
+	tx, err := is.storage.NewTx() // Read only Tx
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Close()
+	if _, err := tx.Get(dbKeyClaimsIdxRevNonce(nonce)); err == db.ErrNotFound {
+		return nil, ErrClaimNotFoundRevNonce
+	} else if err != nil {
+		return nil, err
+	}
+
+	var status RevocationStatus
+	if status.Revoked, err = is.nonceRevoked(nonce, is.revocationsTree.RootKey()); err != nil {
+		return nil, err
+	}
+	if !status.Revoked {
+		return &status, nil
+	}
+
+	// Once revoked, all the following identity states include the
+	// revocation, so the first one can be found with a binary search.
+	idenStateListLen, err := is.idenStateList.Length(tx)
+	if err != nil {
+		return nil, err
+	}
+	var errSearch error
+	i := sort.Search(int(idenStateListLen), func(i int) bool {
+		_, idenStateTreeRoots, err := is.getIdenStateByIdx(tx, int64(i))
+		if err != nil {
+			errSearch = err
+			return true
+		}
+		revoked, err := is.nonceRevoked(nonce, idenStateTreeRoots.RevocationsTreeRoot)
+		if err != nil {
+			errSearch = err
+			return true
+		}
+		return revoked
+	})
+	if errSearch != nil {
+		return nil, errSearch
+	}
+	if status.IdenState, err = is.firstPublishedIdenState(tx, i); err != nil {
+		return nil, err
+	}
+	status.OnChain = status.IdenState != nil
+	return &status, nil
+}
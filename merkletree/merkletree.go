@@ -124,6 +124,11 @@ var (
 	ErrNotWritable = errors.New("Merkle Tree not writable")
 	// ErrEntryDataNotMatch is used when the entry data doesn't match the expected one.
 	ErrEntryDataNotMatch = errors.New("Entry data doesn't match the expected one")
+	// ErrEntryNotInField is used when the entry elements don't fit inside
+	// the finite field.
+	ErrEntryNotInField = errors.New("Elements not inside the Finite Field over R")
+	// ErrDumpRootNotFound is used when a tree dump doesn't contain the root.
+	ErrDumpRootNotFound = errors.New("root not found in the tree dump")
 
 	// HashZero is a hash value of zeros, and is the key of an empty node.
 	HashZero = Hash{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
@@ -391,7 +396,7 @@ func (mt *MerkleTree) addLeaf(tx db.Tx, newLeaf *Node, key *Hash,
 	if lvl > mt.maxLevels-1 {
 		return nil, ErrReachedMaxLevel
 	}
-	n, err := mt.GetNode(key)
+	n, err := mt.getNodeTx(tx, key)
 	if err != nil {
 		return nil, err
 	}
@@ -456,7 +461,7 @@ func (mt *MerkleTree) AddEntry(e *Entry) error {
 	}
 	// verfy that the ElemBytes are valid and fit inside the mimc7 field.
 	if !CheckEntryInField(*e) {
-		return errors.New("Elements not inside the Finite Field over R")
+		return ErrEntryNotInField
 	}
 	tx, err := mt.storage.NewTx()
 	if err != nil {
@@ -485,9 +490,52 @@ func (mt *MerkleTree) AddEntry(e *Entry) error {
 	return nil
 }
 
-// walk is a helper recursive function to iterate over all tree branches
-func (mt *MerkleTree) walk(key *Hash, f func(*Node)) error {
-	n, err := mt.GetNode(key)
+// AddEntryTx adds the Entry to the MerkleTree with root rootKey in an open db
+// transaction of the MerkleTree storage, and returns the new root.  The
+// transaction can contain previous uncommitted additions.  The root of the
+// MerkleTree is not updated: once the transaction is committed, the new root
+// must be set with SetRootKey.
+func (mt *MerkleTree) AddEntryTx(tx db.Tx, rootKey *Hash, e *Entry) (*Hash, error) {
+	// verify that the MerkleTree is writable
+	if !mt.writable {
+		return nil, ErrNotWritable
+	}
+	// verfy that the ElemBytes are valid and fit inside the mimc7 field.
+	if !CheckEntryInField(*e) {
+		return nil, ErrEntryNotInField
+	}
+
+	newNodeLeaf := NewNodeLeaf(e)
+	hIndex, err := e.HIndex()
+	if err != nil {
+		return nil, err
+	}
+	path := getPath(mt.maxLevels, hIndex)
+
+	newRootKey, err := mt.addLeaf(tx, newNodeLeaf, rootKey, 0, path)
+	if err != nil {
+		return nil, err
+	}
+	mt.dbInsert(tx, rootNodeValue, DBEntryTypeRoot, newRootKey[:])
+	return newRootKey, nil
+}
+
+// SetRootKey sets the root of the MerkleTree after committing a transaction
+// with additions done with AddEntryTx.
+func (mt *MerkleTree) SetRootKey(rootKey *Hash) error {
+	if !mt.writable {
+		return ErrNotWritable
+	}
+	mt.Lock()
+	defer mt.Unlock()
+	mt.rootKey = rootKey
+	return nil
+}
+
+// walk is a helper recursive function to iterate over all tree branches,
+// getting the nodes with getNode.
+func (mt *MerkleTree) walk(getNode func(*Hash) (*Node, error), key *Hash, f func(*Node)) error {
+	n, err := getNode(key)
 	if err != nil {
 		return err
 	}
@@ -498,10 +546,10 @@ func (mt *MerkleTree) walk(key *Hash, f func(*Node)) error {
 		f(n)
 	case NodeTypeMiddle:
 		f(n)
-		if err := mt.walk(n.ChildL, f); err != nil {
+		if err := mt.walk(getNode, n.ChildL, f); err != nil {
 			return err
 		}
-		if err := mt.walk(n.ChildR, f); err != nil {
+		if err := mt.walk(getNode, n.ChildR, f); err != nil {
 			return err
 		}
 	default:
@@ -519,10 +567,16 @@ func (mt *MerkleTree) Walk(rootKey *Hash, f func(*Node)) error {
 	if rootKey == nil {
 		rootKey = mt.RootKey()
 	}
-	err := mt.walk(rootKey, f)
+	err := mt.walk(mt.GetNode, rootKey, f)
 	return err
 }
 
+// WalkTx is Walk reading the nodes in an open db transaction, so that the
+// uncommitted additions done with AddEntryTx are found.
+func (mt *MerkleTree) WalkTx(tx db.Tx, rootKey *Hash, f func(*Node)) error {
+	return mt.walk(func(key *Hash) (*Node, error) { return mt.getNodeTx(tx, key) }, rootKey, f)
+}
+
 // GraphViz uses Walk function to generate a string GraphViz representation of the
 // tree and writes it to w
 func (mt *MerkleTree) GraphViz(w io.Writer, rootKey *Hash) error {
@@ -587,8 +641,21 @@ func (mt *MerkleTree) PrintGraphViz(rootKey *Hash) error {
 // to compute the Tree, while with DumpClaims will require to compute the Tree
 // (with the computational cost of each hash)
 func (mt *MerkleTree) DumpTree(w io.Writer, rootKey *Hash) error {
+	if rootKey == nil {
+		rootKey = mt.RootKey()
+	}
+	return mt.dumpTree(func(f func(*Node)) error { return mt.Walk(rootKey, f) }, w, rootKey)
+}
+
+// DumpTreeTx is DumpTree reading the nodes in an open db transaction, so that
+// the uncommitted additions done with AddEntryTx are found.
+func (mt *MerkleTree) DumpTreeTx(tx db.Tx, w io.Writer, rootKey *Hash) error {
+	return mt.dumpTree(func(f func(*Node)) error { return mt.WalkTx(tx, rootKey, f) }, w, rootKey)
+}
+
+func (mt *MerkleTree) dumpTree(walk func(func(*Node)) error, w io.Writer, rootKey *Hash) error {
 	var errS error
-	err := mt.Walk(rootKey, func(n *Node) {
+	err := walk(func(n *Node) {
 		if n.Type != NodeTypeEmpty {
 			k, err := n.Key()
 			if err != nil {
@@ -607,9 +674,6 @@ func (mt *MerkleTree) DumpTree(w io.Writer, rootKey *Hash) error {
 		return errS
 	}
 
-	if rootKey == nil {
-		rootKey = mt.RootKey()
-	}
 	err = serializeKV(w, rootNodeValue, rootKey.Bytes())
 
 	return err
@@ -702,6 +766,44 @@ func (mt *MerkleTree) ImportTree(i io.Reader) error {
 	return nil
 }
 
+// ImportTreeTx imports the nodes from the output of the DumpTree function in
+// an open db transaction of the MerkleTree storage, checking that every node
+// is stored under its key, and returns the root of the dumped tree.  The root
+// of the MerkleTree is not updated.
+func (mt *MerkleTree) ImportTreeTx(tx db.Tx, i io.Reader) (*Hash, error) {
+	var rootKey *Hash
+	r := bufio.NewReader(i)
+	for {
+		k, v, err := deserializeKV(r)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if bytes.Equal(k, rootNodeValue) {
+			rootKey = &Hash{}
+			copy(rootKey[:], v)
+			continue
+		}
+		n, err := NewNodeFromBytes(v)
+		if err != nil {
+			return nil, err
+		}
+		key, err := n.Key()
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(k, key[:]) {
+			return nil, ErrInvalidNodeFound
+		}
+		tx.Put(k, v)
+	}
+	if rootKey == nil {
+		return nil, ErrDumpRootNotFound
+	}
+	return rootKey, nil
+}
+
 // DumpClaimsIoWriter uses Walk function to get all the Claims of the tree and write
 // them to w.  The output is JSON encoded with claims in hex.
 func (mt *MerkleTree) DumpClaimsIoWriter(w io.Writer, rootKey *Hash) error {
@@ -1047,6 +1149,19 @@ func (mt *MerkleTree) GetNode(key *Hash) (*Node, error) {
 	return NewNodeFromBytes(nBytes)
 }
 
+// getNodeTx gets a node by key from the MT in an open db transaction, so that
+// uncommitted nodes are found.
+func (mt *MerkleTree) getNodeTx(tx db.Tx, key *Hash) (*Node, error) {
+	if bytes.Equal(key[:], HashZero[:]) {
+		return NewNodeEmpty(), nil
+	}
+	nBytes, err := tx.Get(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return NewNodeFromBytes(nBytes)
+}
+
 // addNode adds a node into the MT.  Empty nodes are not stored in the tree;
 // they are all the same and assumed to always exist.
 func (mt *MerkleTree) addNode(tx db.Tx, n *Node) (*Hash, error) {
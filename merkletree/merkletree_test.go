@@ -161,6 +161,43 @@ func TestAddEntryRepeatIndex(t *testing.T) {
 	assert.Equal(t, err, ErrEntryIndexAlreadyExists)
 }
 
+func TestAddEntryTx(t *testing.T) {
+	mt1 := newTestingMerkle(t, 140)
+	defer mt1.Storage().Close()
+	for i := 0; i < 16; i++ {
+		e := NewEntryFromInts(int64(i), 0, 0, 0, int64(i), 0, 0, 0)
+		require.Nil(t, mt1.AddEntry(&e))
+	}
+
+	mt2 := newTestingMerkle(t, 140)
+	defer mt2.Storage().Close()
+	rootKey := mt2.RootKey()
+	tx, err := mt2.Storage().NewTx()
+	require.Nil(t, err)
+	for i := 0; i < 16; i++ {
+		e := NewEntryFromInts(int64(i), 0, 0, 0, int64(i), 0, 0, 0)
+		rootKey, err = mt2.AddEntryTx(tx, rootKey, &e)
+		require.Nil(t, err)
+	}
+	// Repeated index in the same transaction
+	e := NewEntryFromInts(3, 0, 0, 0, 3, 0, 0, 0)
+	_, err = mt2.AddEntryTx(tx, rootKey, &e)
+	assert.Equal(t, ErrEntryIndexAlreadyExists, err)
+
+	// The root is not updated until the transaction is committed
+	assert.Equal(t, &HashZero, mt2.RootKey())
+
+	// The uncommitted nodes are dumped from the transaction
+	var dump1, dump2 bytes.Buffer
+	require.Nil(t, mt1.DumpTree(&dump1, nil))
+	require.Nil(t, mt2.DumpTreeTx(tx, &dump2, rootKey))
+	assert.Equal(t, dump1.Bytes(), dump2.Bytes())
+
+	require.Nil(t, tx.Commit())
+	require.Nil(t, mt2.SetRootKey(rootKey))
+	assert.Equal(t, mt1.RootKey().Hex(), mt2.RootKey().Hex())
+}
+
 func TestEntriesIndex(t *testing.T) {
 	// Two entries with different Index generate different hash index
 	in := interfaceToInt64Array(testgen.GetTestValue("EntryInts4"))
@@ -779,6 +816,55 @@ func TestDumpTreeImportTree(t *testing.T) {
 	assert.Equal(t, dumpedTree, dumpedTree2)
 }
 
+func TestDumpTreeImportTreeTx(t *testing.T) {
+	mt := newTestingMerkle(t, 140)
+	defer mt.Storage().Close()
+
+	var rootKeys []*Hash
+	for i := 0; i < 8; i++ {
+		var indexSlot [800 / 8]byte
+		var dataSlot [960 / 8]byte
+		indexSlot[0] = byte(i)
+		require.Nil(t, mt.AddEntry(newClaimBasicEntry(indexSlot, dataSlot)))
+		rootKeys = append(rootKeys, mt.RootKey())
+	}
+
+	// Import a historical state of the tree
+	w := bytes.NewBufferString("")
+	require.Nil(t, mt.DumpTree(w, rootKeys[3]))
+	dumpedTree := w.Bytes()
+
+	imt := newTestingMerkle(t, 140)
+	defer imt.Storage().Close()
+	tx, err := imt.Storage().NewTx()
+	require.Nil(t, err)
+	rootKey, err := imt.ImportTreeTx(tx, bytes.NewReader(dumpedTree))
+	require.Nil(t, err)
+	require.Nil(t, tx.Commit())
+	assert.Equal(t, rootKeys[3], rootKey)
+	// The root of the tree is not updated
+	assert.Equal(t, &HashZero, imt.RootKey())
+
+	w = bytes.NewBufferString("")
+	require.Nil(t, imt.DumpTree(w, rootKey))
+	assert.Equal(t, dumpedTree, w.Bytes())
+
+	// A node not stored under its key is rejected
+	dumpedTree[len(dumpedTree)-40] ^= 0x01
+	tx, err = imt.Storage().NewTx()
+	require.Nil(t, err)
+	_, err = imt.ImportTreeTx(tx, bytes.NewReader(dumpedTree))
+	assert.Equal(t, ErrInvalidNodeFound, err)
+	tx.Close()
+
+	// A dump without root is rejected
+	tx, err = imt.Storage().NewTx()
+	require.Nil(t, err)
+	_, err = imt.ImportTreeTx(tx, bytes.NewReader([]byte{}))
+	assert.Equal(t, ErrDumpRootNotFound, err)
+	tx.Close()
+}
+
 func TestDumpClaimsIoWriter(t *testing.T) {
 	mt := newTestingMerkle(t, 140)
 	defer mt.Storage().Close()
@@ -566,6 +566,18 @@ func (z *ZkFiles) VerificationKey() (*zktypes.Vk, error) {
 	return z.verificationKey, nil
 }
 
+// CacheProvingKey returns true if the ProvingKey is kept in memory after
+// requesting it.
+func (z *ZkFiles) CacheProvingKey() bool {
+	return z.cacheProvingKey
+}
+
+// VerificationKeyHash returns the sha256 hash in hex of the VerificationKey,
+// which is checked when the VerificationKey is loaded.
+func (z *ZkFiles) VerificationKeyHash() string {
+	return z.hashes.VerificationKey
+}
+
 // WitnessCalcWASM returns the WitnessCalcWASM byte slice, downloading and loading it if necessary.
 func (z *ZkFiles) WitnessCalcWASM() ([]byte, error) {
 	z.m.Lock()
@@ -601,6 +613,28 @@ func InputsToMapStrings(inputs interface{}) (map[string]interface{}, error) {
 	return inputsStrings, nil
 }
 
+// CredentialExpiration describes how a credential circuit proves that its
+// claim is not expired without disclosing the expiration: the circuit has a
+// public input TimeNowInput with a unix time in seconds, found at
+// TimeNowSignalIdx in the public signals, and checks that the claim
+// expiration, if the claim has one, is after it.
+type CredentialExpiration struct {
+	TimeNowInput     string
+	TimeNowSignalIdx int
+	// MaxDelay is the maximum age of the TimeNowInput accepted by the
+	// verifier, which bounds the time a claim may have been expired.
+	MaxDelay time.Duration
+}
+
+// CredentialNonce describes how a credential circuit binds a proof to the
+// nonce of a presentation request: the circuit has a public input
+// NonceInput with the nonce as a field element, found at NonceSignalIdx in
+// the public signals.
+type CredentialNonce struct {
+	NonceInput     string
+	NonceSignalIdx int
+}
+
 // ZkProofOut is the output of calculating a zkp.
 type ZkProofOut struct {
 	Proof      zktypes.Proof